@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"strings"
@@ -9,6 +10,12 @@ import (
 )
 
 func main() {
+	// check the command line before starting the server, which allows for
+	// bad arguments to fail with a message that says what to fix.
+	if _, err := server.ParseCommandLine(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
 	if err := server.Start(&server.Options{
 		Args: os.Args[1:], // pass the app args to the server
 	}); err != nil {
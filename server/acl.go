@@ -0,0 +1,159 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The ACL log records recent authentication failures, which allows for
+// brute-force attempts to be seen without MONITOR. There is only the
+// "default" user, so every entry has that username. Similar entries that
+// happen within aclLogGroupTime are grouped into one entry with a count, as
+// Redis does. The log has its own lock because AUTH is a fast command and
+// runs without the server lock.
+
+const (
+	aclLogGroupTime    = time.Minute // similar entries are grouped for this long
+	aclLogGroupEntries = 10          // number of recent entries checked for grouping
+)
+
+type aclLogEntry struct {
+	id         int64
+	count      int
+	reason     string // "auth"
+	context    string // "toplevel"
+	object     string // the command
+	username   string
+	clientInfo string
+	created    time.Time
+	updated    time.Time
+}
+
+type aclLog struct {
+	mu      sync.Mutex
+	entries []*aclLogEntry // newest first
+	nextID  int64
+}
+
+// add records an entry. The log is trimmed to maxLen entries.
+func (l *aclLog) add(c *client, reason, object string, maxLen int) {
+	now := time.Now()
+	info := "addr=" + c.addr + " db=" + strconv.Itoa(c.db.num) +
+		" cmd=" + strings.ToLower(c.args[0])
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, e := range l.entries {
+		if i == aclLogGroupEntries {
+			break
+		}
+		if e.reason == reason && e.object == object &&
+			now.Sub(e.created) <= aclLogGroupTime {
+			e.count++
+			e.clientInfo = info
+			e.updated = now
+			return
+		}
+	}
+	e := &aclLogEntry{
+		id:         l.nextID,
+		count:      1,
+		reason:     reason,
+		context:    "toplevel",
+		object:     object,
+		username:   "default",
+		clientInfo: info,
+		created:    now,
+		updated:    now,
+	}
+	l.nextID++
+	l.entries = append([]*aclLogEntry{e}, l.entries...)
+	l.trim(maxLen)
+}
+
+func (l *aclLog) trim(maxLen int) {
+	if len(l.entries) > maxLen {
+		l.entries = l.entries[:maxLen]
+	}
+}
+
+func (l *aclLog) reset() {
+	l.mu.Lock()
+	l.entries = nil
+	l.mu.Unlock()
+}
+
+// authFailed records a failed AUTH.
+func (c *client) authFailed() {
+	atomic.AddUint64(&c.s.authFailures, 1)
+	c.s.acllog.add(c, "auth", "AUTH", c.s.authConfig().aclLogMaxLen)
+}
+
+func aclCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	switch strings.ToLower(c.args[1]) {
+	default:
+		c.replyError("Unknown ACL subcommand or wrong number of arguments for '" + c.args[1] + "'")
+	case "log":
+		aclLogCommand(c)
+	}
+}
+
+// aclLogCommand is ACL LOG [count|RESET]
+func aclLogCommand(c *client) {
+	if len(c.args) > 3 {
+		c.replyAritryError()
+		return
+	}
+	count := 10
+	if len(c.args) == 3 {
+		if strings.ToLower(c.args[2]) == "reset" {
+			c.s.acllog.reset()
+			c.replyString("OK")
+			return
+		}
+		n, err := strconv.ParseInt(c.args[2], 10, 32)
+		if err != nil || n < 0 {
+			c.replyError("value is out of range, must be positive")
+			return
+		}
+		count = int(n)
+	}
+	l := &c.s.acllog
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.trim(c.s.authConfig().aclLogMaxLen)
+	if count > len(l.entries) {
+		count = len(l.entries)
+	}
+	now := time.Now()
+	c.replyMultiBulkLen(count)
+	for _, e := range l.entries[:count] {
+		c.replyMultiBulkLen(20)
+		c.replyBulk("count")
+		c.replyInt(e.count)
+		c.replyBulk("reason")
+		c.replyBulk(e.reason)
+		c.replyBulk("context")
+		c.replyBulk(e.context)
+		c.replyBulk("object")
+		c.replyBulk(e.object)
+		c.replyBulk("username")
+		c.replyBulk(e.username)
+		c.replyBulk("age-seconds")
+		c.replyBulk(strconv.FormatFloat(now.Sub(e.created).Seconds(), 'f', 3, 64))
+		c.replyBulk("client-info")
+		c.replyBulk(e.clientInfo)
+		c.replyBulk("entry-id")
+		c.replyInt(int(e.id))
+		c.replyBulk("timestamp-created")
+		c.replyInt(int(e.created.UnixNano() / int64(time.Millisecond)))
+		c.replyBulk("timestamp-last-updated")
+		c.replyInt(int(e.updated.UnixNano() / int64(time.Millisecond)))
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestACLLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"),
+		"--requirepass", "pass", "--acllog-max-len", "2")
+	stop := testServe(t, s, addr)
+	conn := testDial(t, addr)
+	defer func() {
+		conn.do("CONFIG", "SET", "requirepass", "")
+		conn.close()
+		stop()
+	}()
+	if err, ok := conn.do("ACL", "LOG").(error); !ok || !strings.HasPrefix(err.Error(), "NOAUTH") {
+		t.Fatalf("expected a NOAUTH error, got %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		conn.do("AUTH", "wrong")
+	}
+	conn.do("AUTH", "pass")
+
+	entries := conn.do("ACL", "LOG").([]interface{})
+	if len(entries) != 1 {
+		t.Fatalf("expected one grouped entry, got %d", len(entries))
+	}
+	entry := make(map[string]interface{})
+	fields := entries[0].([]interface{})
+	for i := 0; i < len(fields); i += 2 {
+		entry[fields[i].(string)] = fields[i+1]
+	}
+	if entry["count"] != 3 || entry["reason"] != "auth" ||
+		entry["object"] != "AUTH" || entry["username"] != "default" ||
+		!strings.Contains(entry["client-info"].(string), "addr=127.0.0.1:") {
+		t.Fatalf("unexpected entry %v", entry)
+	}
+	info := conn.do("INFO", "stats").(string)
+	if !strings.Contains(info, "acl_access_denied_auth:3\n") {
+		t.Fatalf("expected 3 auth failures, got\n%s", info)
+	}
+
+	// bounded by acllog-max-len
+	for i := 0; i < 3; i++ {
+		c := &client{s: s, addr: "test", args: []string{"AUTH"}, db: s.selectDB(0)}
+		s.acllog.add(c, "auth", "AUTH"+itoa(i), 2)
+	}
+	if entries := conn.do("ACL", "LOG").([]interface{}); len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if entries := conn.do("ACL", "LOG", "1").([]interface{}); len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	if reply := conn.do("ACL", "LOG", "RESET"); reply != "OK" {
+		t.Fatalf("expected OK, got %v", reply)
+	}
+	if entries := conn.do("ACL", "LOG").([]interface{}); len(entries) != 0 {
+		t.Fatalf("expected no entries, got %d", len(entries))
+	}
+}
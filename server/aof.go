@@ -2,6 +2,10 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -9,32 +13,94 @@ import (
 	"os"
 	"path"
 	"sort"
-	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 // openAOF opens the appendonly.aof file and loads it.
-// There is also a background goroutine that syncs every seconds.
+// There is also a background goroutine that syncs every seconds, or sooner
+// when a WAITAOF is waiting for a sync. With appendfsync no the goroutine only
+// writes the buffer and leaves the sync to the operating system.
+// Nothing is opened when the append only file is disabled.
 func (s *Server) openAOF() error {
-	f, err := os.OpenFile(s.aofPath, os.O_CREATE|os.O_RDWR, 0644)
+	if !s.cfg.appendOnly {
+		return nil
+	}
+	files, err := s.readAOFManifest()
+	if err != nil {
+		return err
+	}
+	s.aofSegments, s.aofActive = files[:len(files)-1], files[len(files)-1]
+	f, err := os.OpenFile(s.aofActive, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return err
 	}
 	s.aof = f
-	go func() {
+	s.aofSyncWait = make(chan struct{})
+	s.aofSyncNow = make(chan struct{}, 1)
+	s.workers.start(workerAOF, func(ctx context.Context) {
 		t := time.NewTicker(time.Second)
 		defer t.Stop()
-		for range t.C {
+		for {
+			var now bool
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			case <-s.aofSyncNow:
+				now = true
+			}
 			s.mu.Lock()
 			if s.aofclosed {
 				s.mu.Unlock()
 				return
 			}
-			s.aof.Sync()
+			if !now && s.cfg.appendFsync == "no" {
+				if err := s.flushAOF(); err != nil {
+					s.fatalError(err)
+				}
+			} else {
+				s.syncAOF()
+			}
 			s.mu.Unlock()
 		}
-	}()
-	return s.loadAOF()
+	})
+	if err := s.loadAOF(); err != nil {
+		return err
+	}
+	if s.aofTruncated > 0 {
+		// remove the incomplete command so that new commands are not
+		// appended to it.
+		s.lwarningf("!!! Warning: short read while loading the AOF file %s!!!", s.aofActive)
+		size, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if err := f.Truncate(size - int64(s.aofTruncated)); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+		s.lwarningf("AOF loaded anyway because the last %d bytes were truncated", s.aofTruncated)
+		s.aofTruncated = 0
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		var buf bytes.Buffer
+		s.writeAOFHeader(&buf)
+		n, err := f.Write(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		size = int64(n)
+	}
+	s.aofSize, s.aofBaseSize = size, size
+	return nil
 }
 
 func writeBulk(wr io.Writer, arg string) {
@@ -57,6 +123,13 @@ func writeMultiBulk(wr io.Writer, args ...interface{}) {
 	}
 }
 
+// buildCommand returns the args as a multibulk command.
+func buildCommand(args ...interface{}) []byte {
+	var buf bytes.Buffer
+	writeMultiBulk(&buf, args...)
+	return buf.Bytes()
+}
+
 type dbsByNumber []*database
 
 func (a dbsByNumber) Len() int {
@@ -102,18 +175,22 @@ func (s *Server) rewriteAOF() bool {
 	}
 	s.aofrewrite = true
 	s.lnoticef("Background append only file rewriting started")
-	go func() {
+	s.workers.start(workerJobs, func(ctx context.Context) {
 		// We use one err variable for the entire process. When we encounter an
 		// error we should assign this variable and return. Before calling
 		// return there we should be in lock mode (s.mu.Lock()).
 		var err error
 		s.mu.Lock()
+		// the changes until now are in the rewrite
+		dirty := s.dirty
 		defer func() {
 			if err == nil {
+				s.dirty -= dirty
 				s.lnoticef("Background AOF rewrite finished successfully")
 			} else {
-				s.lnoticef("Background AOF rewrite failed: %v", err)
+				s.lwarningf("Background AOF rewrite failed: %v", err)
 			}
+			s.aofRewriteErr = err
 			s.aofrewrite = false
 			s.mu.Unlock()
 		}()
@@ -121,7 +198,7 @@ func (s *Server) rewriteAOF() bool {
 		// Create a temporary aof file for writting the new commands to. If this
 		// process is successful then this file will become the active AOF.
 
-		tempName := path.Join(path.Dir(s.aofPath),
+		tempName := path.Join(path.Dir(s.aofActive),
 			fmt.Sprintf("temp-rewrite-%d.aof", os.Getpid()))
 		var f *os.File
 		f, err = os.Create(tempName)
@@ -139,6 +216,13 @@ func (s *Server) rewriteAOF() bool {
 		// Doing so keeps makes the process much quicker by avoiding too many
 		// writes to the file.
 		wr := bufio.NewWriter(f)
+		s.writeAOFHeader(wr)
+		if s.options.SeedPath != "" || len(s.aofSegments) > 0 {
+			// The rewrite has the seeded keys too, so it replaces them
+			// when the seed is loaded ahead of it, and the same for the
+			// segments of the aof until the manifest is updated.
+			writeMultiBulk(wr, "FLUSHALL")
+		}
 
 		// Get the size of the active AOF file, and get the last DB num that was
 		// used when the previous command was written. These both will be used
@@ -146,11 +230,15 @@ func (s *Server) rewriteAOF() bool {
 		// which reflect changes that have occured since the start of the
 		// rewrite.
 		var lastpos int64
+		if err = s.flushAOF(); err != nil {
+			return
+		}
 		lastpos, err = s.aof.Seek(0, 1)
 		if err != nil {
 			return
 		}
 		lastdbnum := s.aofdbnum
+		compatPexpireat := s.aofCompatible("pexpireat")
 		s.ldebugf("AOF starting pos: %v, dbnum: %v", lastpos, lastdbnum)
 		s.mu.Unlock()
 
@@ -183,7 +271,7 @@ func (s *Server) rewriteAOF() bool {
 		// a map there the order of the databases will be random.
 		for _, db := range dbs {
 			s.mu.RLock()
-			if len(db.items) == 0 {
+			if len(db.items) == 0 && len(db.tombstones) == 0 {
 				s.mu.RUnlock()
 				continue // skip empty databases
 			}
@@ -199,10 +287,10 @@ func (s *Server) rewriteAOF() bool {
 			keys := make([]string, len(db.items))
 			items := make([]dbItem, len(db.items))
 			expires := make(map[string]time.Time)
-			expireKeys := make([]string, len(expires))
+			expireKeys := make([]string, len(db.expires))
 			i := 0
 			for key, item := range db.items {
-				items[i] = item
+				items[i] = dbItem{expires: item.expires, value: item.value}
 				keys[i] = key
 				i++
 			}
@@ -233,8 +321,7 @@ func (s *Server) rewriteAOF() bool {
 				expired := false
 				if item.expires {
 					if t, ok := expires[key]; ok {
-						seconds := int((t.Sub(now) / time.Second) + 1)
-						if seconds <= 0 {
+						if t.Sub(now) <= 0 {
 							expired = true
 						}
 					}
@@ -259,7 +346,7 @@ func (s *Server) rewriteAOF() bool {
 						var strs []interface{}
 						v.ascend(func(v string) bool {
 							if len(strs) == 0 {
-								strs = append(strs, "RPUSH", v)
+								strs = append(strs, "RPUSH", key, v)
 							} else {
 								strs = append(strs, v)
 							}
@@ -277,7 +364,7 @@ func (s *Server) rewriteAOF() bool {
 						var strs []interface{}
 						v.ascend(func(v string) bool {
 							if len(strs) == 0 {
-								strs = append(strs, "SADD", v)
+								strs = append(strs, "SADD", key, v)
 							} else {
 								strs = append(strs, v)
 							}
@@ -291,6 +378,40 @@ func (s *Server) rewriteAOF() bool {
 							writeMultiBulk(wr, strs...)
 							strs = nil
 						}
+					case *hash:
+						var strs []interface{}
+						v.ascend(func(field, value string) bool {
+							if len(strs) == 0 {
+								strs = append(strs, "HSET", key)
+							}
+							strs = append(strs, field, value)
+							if len(strs) >= 20 {
+								writeMultiBulk(wr, strs...)
+								strs = nil
+							}
+							return true
+						})
+						if len(strs) != 0 {
+							writeMultiBulk(wr, strs...)
+							strs = nil
+						}
+					case *zset:
+						var strs []interface{}
+						v.ascend(func(member string, score float64) bool {
+							if len(strs) == 0 {
+								strs = append(strs, "ZADD", key)
+							}
+							strs = append(strs, formatDouble(score), member)
+							if len(strs) >= 20 {
+								writeMultiBulk(wr, strs...)
+								strs = nil
+							}
+							return true
+						})
+						if len(strs) != 0 {
+							writeMultiBulk(wr, strs...)
+							strs = nil
+						}
 					}
 				}
 			}
@@ -300,12 +421,21 @@ func (s *Server) rewriteAOF() bool {
 			}
 			// write expires
 			for _, key := range expireKeys {
+				// the times are absolute, so that the ttl doesn't start
+				// again when the aof is loaded
 				t := expires[key]
-				seconds := int((t.Sub(now) / time.Second) + 1)
-				if seconds > 0 {
-					writeMultiBulk(wr, "EXPIRE", key, seconds)
+				if t.After(now) {
+					ms := unixMillis(t.Add(time.Millisecond - 1))
+					if compatPexpireat {
+						writeMultiBulk(wr, "PEXPIREAT", key, ms)
+					} else {
+						// rounded up, so that the key is never
+						// expired early
+						writeMultiBulk(wr, "EXPIREAT", key, (ms+999)/1000)
+					}
 				}
 			}
+			s.writeTombstones(wr, db, now)
 			s.mu.RUnlock()
 		}
 		err = wr.Flush()
@@ -323,7 +453,7 @@ func (s *Server) rewriteAOF() bool {
 
 		// Then skip to the position in the live aof.
 		var cf *os.File
-		cf, err = os.Open(s.aofPath)
+		cf, err = os.Open(s.aofActive)
 		if err != nil {
 			return
 		}
@@ -336,7 +466,9 @@ func (s *Server) rewriteAOF() bool {
 
 		// Write out the new commands that were added since the rewrite began.
 		if ln != lastpos {
-			if lastdbnum != dbnum {
+			// a -1 is a rotated aof, which selects the db ahead of the
+			// first command
+			if lastdbnum != dbnum && lastdbnum != -1 {
 				writeMultiBulk(wr, "SELECT", lastdbnum)
 			}
 			err = wr.Flush()
@@ -359,101 +491,295 @@ func (s *Server) rewriteAOF() bool {
 		if err = cf.Close(); err != nil {
 			return
 		}
+		// The synced offset covers the commands in the rewritten aof, so
+		// it must be on disk before it replaces the live aof.
+		if err = f.Sync(); err != nil {
+			return
+		}
 		if err = f.Close(); err != nil {
 			return
 		}
 
 		// Finally switch out the aof files, failures here can by sucky
-		if err = os.Rename(tempName, s.aofPath); err != nil {
+		if err = os.Rename(tempName, s.aofActive); err != nil {
 			return
 		}
+		if len(s.aofSegments) > 0 {
+			// the rewrite has the commands of the segments
+			if err = s.writeAOFManifest([]string{s.aofActive}); err != nil {
+				return
+			}
+			s.aofSegments = nil
+		}
 
 		var nf *os.File
-		nf, err = os.OpenFile(s.aofPath, os.O_CREATE|os.O_RDWR, 0644)
+		nf, err = os.OpenFile(s.aofActive, os.O_CREATE|os.O_RDWR, 0644)
 		if err != nil {
 			s.fatalError(err)
 			return
 		}
-		if _, err = nf.Seek(0, 2); err != nil {
+		var size int64
+		if size, err = nf.Seek(0, 2); err != nil {
 			s.fatalError(err)
 			return
 		}
 		s.aof.Close()
 		s.aof = nf
+		s.aofSize, s.aofBaseSize = size, size
+		if ln == lastpos {
+			// the rewritten aof ends with the db of its last key
+			s.aofdbnum = dbnum
+		}
 
 		// We are really really done. Celebrate with a bag of Funyuns!
 
-	}()
+	})
 	return true
 }
 
-// flushAOF flushes the
+// appendAOF appends a command to the aof buffer. A SELECT is injected ahead
+// of the command when it targets a different database than the previous one,
+// which keeps the commands from multiple databases in their execution order.
+// Nothing is appended while the aof is loading, or when the aof is disabled.
+func (s *Server) appendAOF(dbnum int, raw []byte) {
+	if s.aof == nil || s.Loading() {
+		return
+	}
+	n := s.aofbuf.Len()
+	if dbnum != s.aofdbnum {
+		writeMultiBulk(&s.aofbuf, "SELECT", dbnum)
+		s.aofdbnum = dbnum
+	}
+	s.aofbuf.Write(raw)
+	s.aofOffset += int64(s.aofbuf.Len() - n)
+}
+
+// flushAOF writes the aof buffer to the aof file.
 func (s *Server) flushAOF() error {
-	if s.dbs[s.aofdbnum] != nil {
-		db := s.dbs[s.aofdbnum]
-		if db.aofbuf.Len() > 0 {
-			if _, err := s.aof.Write(db.aofbuf.Bytes()); err != nil {
-				return err
-			}
-			db.aofbuf.Reset()
+	if s.aofbuf.Len() > 0 {
+		n, err := s.aof.Write(s.aofbuf.Bytes())
+		s.aofSize += int64(n)
+		if err != nil {
+			return err
 		}
+		s.aofbuf.Reset()
 	}
-	for num, db := range s.dbs {
-		if db.aofbuf.Len() > 0 {
-			selstr := strconv.FormatInt(int64(num), 10)
-			lenstr := strconv.FormatInt(int64(len(selstr)), 10)
-			if _, err := s.aof.WriteString("*2\r\n$6\r\nSELECT\r\n$" + lenstr +
-				"\r\n" + selstr + "\r\n"); err != nil {
-				return err
-			}
-			if _, err := s.aof.Write(db.aofbuf.Bytes()); err != nil {
-				return err
-			}
-			db.aofbuf.Reset()
-			s.aofdbnum = num
-		}
+	return nil
+}
+
+// aofDelayedSync is how long a sync may take before it's counted as delayed.
+const aofDelayedSync = time.Second * 2
+
+// syncAOF flushes the aof buffer and syncs the aof file to disk. The waiting
+// WAITAOF commands are woken when the sync succeeds. Must be called while
+// holding the write lock.
+func (s *Server) syncAOF() error {
+	if err := s.flushAOF(); err != nil {
+		s.fatalError(err)
+		return err
+	}
+	start := time.Now()
+	if err := s.aof.Sync(); err != nil {
+		return err
 	}
+	if elapsed := time.Since(start); elapsed > aofDelayedSync {
+		s.aofDelayedSyncs++
+		s.lwarningf("AOF fsync is taking too long (disk is busy?), it took %s", elapsed)
+	}
+	s.aofSynced = s.aofOffset
+	close(s.aofSyncWait)
+	s.aofSyncWait = make(chan struct{})
 	return nil
 }
 
+// crashAOF writes the aof buffer and syncs the aof file after a panic, so
+// that the writes that were acknowledged before the crash are not lost. The
+// client that panicked may already hold the server lock. Errors are logged
+// because the server is about to exit.
+func (s *Server) crashAOF(c *client) {
+	if !c.locked {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	if s.aof == nil || s.aofclosed {
+		return
+	}
+	if err := s.flushAOF(); err != nil {
+		s.lwarningf("Can't write the AOF file before exiting: %v", err)
+		return
+	}
+	if err := s.aof.Sync(); err != nil {
+		s.lwarningf("Can't sync the AOF file before exiting: %v", err)
+		return
+	}
+	s.lnoticef("AOF synced before exiting")
+}
+
+// closeAOF syncs and closes the aof, and stops the routine that syncs it.
 func (s *Server) closeAOF() {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.flushAOF()
-	s.aof.Sync()
+	if s.aof == nil {
+		s.mu.Unlock()
+		return
+	}
+	s.syncAOF()
 	s.aof.Close()
 	s.aofclosed = true
+	s.mu.Unlock()
+	s.stopWorkers(workerAOF)
 }
 
+// loadAOF loads the segments and the active file of the aof.
 func (s *Server) loadAOF() error {
 	start := time.Now()
-	rd := &commandReader{rd: s.aof, rbuf: make([]byte, 64*1024)}
-	c := &client{wr: ioutil.Discard, s: s}
+	for _, name := range s.aofSegments {
+		if err := s.loadAOFSegment(name); err != nil {
+			return err
+		}
+	}
+	truncated, dbnum, err := s.loadFile(s.aof, "aof")
+	s.aofdbnum = dbnum
+	if err != nil {
+		return err
+	}
+	s.aofTruncated = truncated
+	s.lnoticef("DB loaded from disk: %.3f seconds",
+		float64(time.Now().Sub(start))/float64(time.Second))
+	return nil
+}
+
+// loadBatchCommands is the number of commands that are replayed while
+// holding the lock.
+const loadBatchCommands = 1000
+
+// loadFile replays the commands of an aof file. The phase is reported by
+// INFO while the file is loading. See aofcompat.go for the header and the
+// unknown commands. Returns the number of bytes of an
+// incomplete command at the end of the file, and the db num of the last
+// command.
+func (s *Server) loadFile(f *os.File, phase string) (truncated, dbnum int, err error) {
+	rd := &commandReader{rd: f, rbuf: make([]byte, 64*1024)}
+	if fi, err := f.Stat(); err == nil {
+		atomic.StoreInt64(&s.loadingTotal, fi.Size())
+	}
+	atomic.StoreInt64(&s.loadingLoaded, 0)
+	atomic.StoreInt64(&s.loadingStart, time.Now().UnixNano())
+	s.loadingPhase.Store(phase)
+	// The replayed commands are already in the aof, so the loading state
+	// keeps them from being appended, propagated, or loaded again.
+	c := &client{wr: ioutil.Discard, s: s, loading: true}
 	c.db = s.selectDB(0)
+	atomic.AddInt32(&s.loading, 1)
+	defer atomic.AddInt32(&s.loading, -1)
+	// The clients that connect during the load may run the commands that
+	// are allowed while loading, so the lock is released between batches.
+	s.mu.Lock()
+	c.locked = true
 	defer func() {
-		s.aofdbnum = c.db.num
+		if c.locked {
+			s.mu.Unlock()
+		}
 	}()
-	var read int
-	for {
+	var skipped int
+	defer func() {
+		if skipped > 0 {
+			s.aofLoadSkipped += skipped
+			s.lwarningf("Skipped %d unknown commands in the %s", skipped, phase)
+		}
+	}()
+	for n := 1; ; n++ {
+		if n%loadBatchCommands == 0 {
+			s.mu.Unlock()
+			c.locked = false
+			if err := s.getFatalError(); err != nil {
+				// a SHUTDOWN while loading
+				return 0, c.db.num, err
+			}
+			s.mu.Lock()
+			c.locked = true
+		}
 		raw, args, _, err := rd.readCommand()
 		if err != nil {
 			if err == io.EOF {
-				break
+				return len(rd.buf), c.db.num, nil
 			}
 			s.lwarningf("%v", err)
-			return err
+			return 0, c.db.num, err
 		}
 		c.args = args
 		c.raw = raw
+		c.err = nil
 		commandName := autocase(args[0])
 		if cmd, ok := s.cmds[commandName]; ok {
+			dirty := c.dirty
 			cmd.funct(c)
+			if aofRefused(c.err) {
+				return 0, c.db.num, fmt.Errorf("%s in the %s: %v",
+					args[0], phase, c.err)
+			}
+			if c.dirty > dirty && cmd.aof {
+				s.auditCommand(c, cmd, auditSourceAOF)
+			}
+		} else if strings.ToLower(args[0]) == "aofheader" {
+			if err := s.loadAOFHeader(args, phase); err != nil {
+				return 0, c.db.num, err
+			}
+		} else if strings.ToLower(args[0]) == "tombstone" {
+			if err := s.loadTombstone(c.db, args); err != nil {
+				return 0, c.db.num, fmt.Errorf("%v in the %s", err, phase)
+			}
+		} else if s.cfg.aofLoadMode == "tolerant" {
+			if skipped == 0 {
+				s.lwarningf("Skipping the unknown command '%s' in the %s",
+					args[0], phase)
+			}
+			skipped++
 		} else {
-			return errors.New("unknown command '" + args[0] + "'")
+			return 0, c.db.num, errors.New("unknown command '" + args[0] +
+				"' in the " + phase)
 		}
-		read++
+		atomic.AddInt64(&s.loadingLoaded, int64(len(raw)))
 	}
-	s.lnoticef("DB loaded from disk: %.3f seconds",
+}
+
+// loadSeed loads the seed file ahead of the aof, which makes the aof the
+// changes since the seed. The seed is a rewritten aof, such as a backup of
+// one. When the seed has a .digest file, which holds the hex SHA-256 of the
+// seed in the format of sha256sum, the seed must match it.
+func (s *Server) loadSeed() error {
+	if s.options.SeedPath == "" {
+		return nil
+	}
+	start := time.Now()
+	f, err := os.Open(s.options.SeedPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if data, err := ioutil.ReadFile(s.options.SeedPath + ".digest"); err == nil {
+		fields := strings.Fields(string(data))
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		if len(fields) == 0 || !strings.EqualFold(fields[0], hex.EncodeToString(h.Sum(nil))) {
+			return fmt.Errorf("the seed %s does not match its digest", s.options.SeedPath)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	truncated, _, err := s.loadFile(f, "seed")
+	if err != nil {
+		return err
+	}
+	if truncated > 0 {
+		return fmt.Errorf("the last %d bytes of the seed %s are an incomplete "+
+			"command", truncated, s.options.SeedPath)
+	}
+	s.lnoticef("Seed loaded from %s: %.3f seconds", s.options.SeedPath,
 		float64(time.Now().Sub(start))/float64(time.Second))
 	return nil
 }
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// An aof starts with a header that has the format of the file and the
+// version of the server that wrote it:
+//
+//	AOFHEADER <format> <version>
+//
+// An aof without a header is format 1. Format 2 added the header, and the
+// commands in aofCommandFormats. A new command that's appended to the aof
+// must be added to aofCommandFormats with a new format.
+//
+// The aof-load-mode config decides what's loaded. In strict mode, which is
+// the default, an aof with a newer format, or with an unknown command, is
+// refused. In tolerant mode both are loaded, and the unknown commands are
+// skipped and counted. A known command that fails, such as SET with an option
+// that's unknown to this version, is always refused, because its change
+// would be lost. Other errors, such as WRONGTYPE, are expected, because the
+// rewrite doesn't hold the lock for the whole snapshot, and the commands
+// appended during the rewrite may replay against keys that already have
+// their later values.
+//
+// Rolling back to an older version is done by setting aof-compat-level to
+// the format of the older version, and then running BGREWRITEAOF. The
+// rewrite only uses the commands of that format. The commands appended after
+// the rewrite are written as they are received, so the clients must stick to
+// the commands of the older version until the rollback.
+
+// aofFormat is the format of the aofs written by this version.
+const aofFormat = 3
+
+// aofCommandFormats are the aof commands that are newer than format 1.
+var aofCommandFormats = map[string]int{
+	"aofheader":        2,
+	"pexpire":          2,
+	"pexpireat":        2,
+	"persist":          2,
+	"incrbyfloat":      2,
+	"setrange":         2,
+	"tombstone":        3,
+	"hset":             3,
+	"hdel":             3,
+	"hsetnx":           3,
+	"hincrby":          3,
+	"hincrbyfloat":     3,
+	"linsert":          3,
+	"lmove":            3,
+	"zadd":             3,
+	"zrem":             3,
+	"zremrangebyrank":  3,
+	"zremrangebyscore": 3,
+	"zremrangebylex":   3,
+}
+
+// aofRefused returns true when a command of the aof failed because this
+// version doesn't understand it.
+func aofRefused(err error) bool {
+	return err != nil && (errors.Is(err, ErrSyntax) ||
+		strings.HasPrefix(err.Error(), "ERR wrong number of arguments"))
+}
+
+// aofCommandFormat returns the first format of an aof command.
+func aofCommandFormat(name string) int {
+	if format, ok := aofCommandFormats[name]; ok {
+		return format
+	}
+	return 1
+}
+
+// aofCompatible returns true when a command can be written to an aof that's
+// loaded by a server of the aof-compat-level.
+func (s *Server) aofCompatible(name string) bool {
+	return aofCommandFormat(name) <= s.cfg.aofCompatLevel
+}
+
+// writeAOFHeader writes the header of a new aof, unless the aof-compat-level
+// is older than the header.
+func (s *Server) writeAOFHeader(wr io.Writer) {
+	if s.aofCompatible("aofheader") {
+		writeMultiBulk(wr, "AOFHEADER", aofFormat, s.options.Version)
+	}
+}
+
+// loadAOFHeader checks the header of an aof that's loading.
+func (s *Server) loadAOFHeader(args []string, phase string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("invalid aof header in the %s", phase)
+	}
+	format, err := strconv.Atoi(args[1])
+	if err != nil || format < 2 {
+		return fmt.Errorf("invalid aof header in the %s", phase)
+	}
+	if format <= aofFormat {
+		return nil
+	}
+	if s.cfg.aofLoadMode == "strict" {
+		return fmt.Errorf("the %s was written by version %s in format %d, "+
+			"which is newer than format %d of this version. Set "+
+			"aof-load-mode to tolerant to load it anyway", phase, args[2],
+			format, aofFormat)
+	}
+	s.lwarningf("Loading the %s that was written by version %s in format %d, "+
+		"which is newer than format %d of this version", phase, args[2],
+		format, aofFormat)
+	return nil
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWriteAOF writes the commands to an aof.
+func testWriteAOF(t *testing.T, path string, cmds ...[]string) {
+	var buf bytes.Buffer
+	for _, args := range cmds {
+		buf.Write(encodeMultiBulk(args))
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAOFCompatLoad loads aofs that were written by other versions.
+func TestAOFCompatLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+
+	// an aof of an older version has no header
+	testWriteAOF(t, aofPath,
+		[]string{"SET", "a", "1"},
+		[]string{"RPUSH", "list", "x", "y"},
+		[]string{"EXPIRE", "a", "100"},
+	)
+	s, addr := testNewServer(t, aofPath)
+	stop := testServe(t, s, addr)
+	if v, err := s.Do("LLEN", "list"); err != nil || v != 2 {
+		t.Fatalf("expected '2', got '%v', %v", v, err)
+	}
+	if v, err := s.Do("TTL", "a"); err != nil || v != 100 {
+		t.Fatalf("expected '100', got '%v', %v", v, err)
+	}
+	stop()
+
+	// an aof of a newer version is refused, unless the load is tolerant
+	newer := [][]string{
+		{"AOFHEADER", "99", "9.9.9"},
+		{"SET", "a", "1"},
+		{"FUTURECOMMAND", "a", "b"},
+		{"SET", "b", "2"},
+		{"FUTURECOMMAND", "c"},
+	}
+	testWriteAOF(t, aofPath, newer...)
+	s, _ = testNewServer(t, aofPath)
+	if err := s.ListenAndServe(); err == nil || !strings.Contains(err.Error(), "format 99") {
+		t.Fatalf("expected a format error, got %v", err)
+	}
+	testWriteAOF(t, aofPath, newer[1:]...)
+	s, _ = testNewServer(t, aofPath)
+	if err := s.ListenAndServe(); err == nil || !strings.Contains(err.Error(), "unknown command 'FUTURECOMMAND'") {
+		t.Fatalf("expected an unknown command error, got %v", err)
+	}
+	testWriteAOF(t, aofPath, newer...)
+	s, addr = testNewServer(t, aofPath, "--aof-load-mode", "tolerant")
+	stop = testServe(t, s, addr)
+	if v, err := s.Do("MGET", "a", "b"); err != nil || len(v.([]interface{})) != 2 ||
+		v.([]interface{})[1] != "2" {
+		t.Fatalf("expected '[1 2]', got '%v', %v", v, err)
+	}
+	info, _ := s.Do("INFO", "persistence")
+	if !strings.Contains(info.(string), "aof_load_skipped_commands:2") {
+		t.Fatalf("expected 2 skipped commands, got\n%s", info)
+	}
+	stop()
+
+	// an unknown option of a known command is always refused
+	testWriteAOF(t, aofPath,
+		[]string{"AOFHEADER", "99", "9.9.9"},
+		[]string{"SET", "a", "1", "FUTUREOPTION"},
+	)
+	s, _ = testNewServer(t, aofPath, "--aof-load-mode", "tolerant")
+	if err := s.ListenAndServe(); err == nil || !strings.Contains(err.Error(), "syntax error") {
+		t.Fatalf("expected a syntax error, got %v", err)
+	}
+}
+
+// TestAOFCompatRewrite checks that a rewrite at an older aof-compat-level
+// only has the commands of that format, so that it can be loaded by an older
+// version.
+func TestAOFCompatRewrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	s, addr := testNewServer(t, aofPath)
+	stop := testServe(t, s, addr)
+	defer func() { stop() }()
+
+	readAOF := func() [][]string {
+		f, err := os.Open(aofPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var cmds [][]string
+		rd := newCommandReader(f)
+		for {
+			_, args, _, err := rd.readCommand()
+			if err == io.EOF {
+				return cmds
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the args are only valid until the next read
+			cmd := make([]string, len(args))
+			for i, arg := range args {
+				cmd[i] = strings.Clone(arg)
+			}
+			cmds = append(cmds, cmd)
+		}
+	}
+	if cmds := readAOF(); len(cmds) != 1 || cmds[0][0] != "AOFHEADER" {
+		t.Fatalf("expected a header, got %v", cmds)
+	}
+	s.Do("SET", "a", "1")
+	deadline := time.Now().Add(time.Millisecond * 100500)
+	s.Do("PEXPIRE", "a", "100500")
+	s.Do("SADD", "set", "x")
+	s.Do("INCRBYFLOAT", "f", "1.5")
+
+	s.Do("CONFIG", "SET", "aof-compat-level", "1")
+	if _, err := s.Do("SAVE"); err != nil {
+		t.Fatal(err)
+	}
+	cmds := readAOF()
+	for _, args := range cmds {
+		if format := aofCommandFormat(strings.ToLower(args[0])); format > 1 {
+			t.Fatalf("expected format 1 commands, got %v", args)
+		}
+	}
+	// the time is rounded up to seconds
+	last := cmds[len(cmds)-1]
+	if strings.ToUpper(last[0]) != "EXPIREAT" || last[1] != "a" {
+		t.Fatalf("expected an EXPIREAT, got %v", cmds)
+	}
+	if at, _ := strconv.ParseInt(last[2], 10, 64); at*1000 < unixMillis(deadline) ||
+		at*1000 > unixMillis(deadline)+1100 {
+		t.Fatalf("expected the time of %v in seconds, got %v", deadline, last)
+	}
+	stop()
+
+	// this version loads it too
+	s, addr = testNewServer(t, aofPath)
+	stop = testServe(t, s, addr)
+	if v, err := s.Do("GET", "f"); err != nil || v != "1.5" {
+		t.Fatalf("expected '1.5', got '%v', %v", v, err)
+	}
+	// up to a second more, from the rounding
+	if v, err := s.Do("TTL", "a"); err != nil || v.(int) < 100 || v.(int) > 102 {
+		t.Fatalf("expected about '101', got '%v', %v", v, err)
+	}
+
+	// the header is back at the default level
+	s.Do("CONFIG", "SET", "aof-compat-level", strconv.Itoa(aofFormat))
+	if _, err := s.Do("SAVE"); err != nil {
+		t.Fatal(err)
+	}
+	if cmds := readAOF(); cmds[0][0] != "AOFHEADER" || cmds[0][1] != strconv.Itoa(aofFormat) {
+		t.Fatalf("expected a header, got %v", cmds)
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// AOF ROTATE finishes the active aof file and continues appending to a new
+// file, without a rewrite, so that a backup can copy the finished file while
+// the server runs. The finished files are the segments of the aof, and the
+// manifest, which is the aof path with a .manifest suffix, lists the files in
+// the order that they're loaded, the active file last. Without a manifest,
+// which is until the first rotation, the aof is only the aof path.
+//
+// A rewrite replaces the active file with the whole dataset, so the manifest
+// then only lists the active file. The segments are left on disk, it's up to
+// the backup to remove them. The rewrite starts with a FLUSHALL when there
+// are segments, so loading the segments ahead of it is harmless when the
+// server stops before the manifest is updated.
+
+// aofManifestPath returns the path of the manifest.
+func (s *Server) aofManifestPath() string {
+	return s.aofPath + ".manifest"
+}
+
+// readAOFManifest returns the files of the aof in the order that they're
+// loaded. The paths in the manifest are relative to the directory of the aof.
+func (s *Server) readAOFManifest() ([]string, error) {
+	data, err := ioutil.ReadFile(s.aofManifestPath())
+	if os.IsNotExist(err) {
+		return []string{s.aofPath}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if !path.IsAbs(line) {
+			line = path.Join(path.Dir(s.aofPath), line)
+		}
+		files = append(files, line)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("the AOF manifest %s has no files",
+			s.aofManifestPath())
+	}
+	return files, nil
+}
+
+// writeAOFManifest replaces the manifest with the files, or removes it when
+// the only file is the aof path. The manifest is written to a temporary file
+// and synced before it replaces the old one.
+func (s *Server) writeAOFManifest(files []string) error {
+	if len(files) == 1 && files[0] == s.aofPath {
+		err := os.Remove(s.aofManifestPath())
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("# The files of the AOF, in the order that they're loaded\n")
+	dir := path.Dir(s.aofPath)
+	for _, file := range files {
+		if path.Dir(file) == dir {
+			file = path.Base(file)
+		}
+		buf.WriteString(file + "\n")
+	}
+	tempName := s.aofManifestPath() + ".tmp"
+	f, err := os.Create(tempName)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		os.Remove(tempName)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tempName)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	return os.Rename(tempName, s.aofManifestPath())
+}
+
+// loadAOFSegment loads a finished file of the aof. Unlike the active file,
+// a segment was synced when it was finished, so an incomplete command at its
+// end is an error.
+func (s *Server) loadAOFSegment(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	truncated, _, err := s.loadFile(f, "aof")
+	if err != nil {
+		return err
+	}
+	if truncated > 0 {
+		return fmt.Errorf("the last %d bytes of the AOF segment %s are an "+
+			"incomplete command", truncated, name)
+	}
+	return nil
+}
+
+// rotateAOF syncs and closes the active file, and continues appending to a
+// new file, which must not exist. Returns the size of the finished file. Must
+// be called while holding the write lock.
+func (s *Server) rotateAOF(name string) (size int64, err error) {
+	if s.aofrewrite {
+		return 0, errors.New("Background append only file rewriting in progress")
+	}
+	nf, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			nf.Close()
+			os.Remove(name)
+		}
+	}()
+	var buf bytes.Buffer
+	s.writeAOFHeader(&buf)
+	if _, err = nf.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	if err = nf.Sync(); err != nil {
+		return 0, err
+	}
+	// the commands of the finished file are on disk before the manifest
+	// lists the new file after it
+	if err = s.syncAOF(); err != nil {
+		return 0, err
+	}
+	files := append(append([]string{}, s.aofSegments...), s.aofActive, name)
+	if err = s.writeAOFManifest(files); err != nil {
+		return 0, err
+	}
+	size = s.aofSize
+	s.aof.Close()
+	s.aof = nf
+	s.aofSegments = files[:len(files)-1]
+	s.aofActive = name
+	// a new file is loaded from db 0
+	s.aofdbnum = -1
+	s.aofSize, s.aofBaseSize = int64(buf.Len()), int64(buf.Len())
+	s.lnoticef("AOF rotated, %s is finished and %s is the active file",
+		files[len(files)-2], name)
+	return size, nil
+}
+
+// fileDigest returns the hex SHA-256 of a file.
+func fileDigest(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, bufio.NewReader(f)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// aofCommand is AOF ROTATE path. A relative path is in the directory of the
+// aof. The reply has the path, the size, and the SHA-256 of the finished
+// file.
+func aofCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	if strings.ToLower(c.args[1]) != "rotate" || len(c.args) != 3 {
+		c.replyError("Unknown subcommand or wrong number of arguments for '" + c.args[1] + "'")
+		return
+	}
+	if c.s.aof == nil {
+		c.replyError("The append only file is disabled")
+		return
+	}
+	file := c.args[2]
+	if !path.IsAbs(file) {
+		file = path.Join(path.Dir(c.s.aofPath), file)
+	}
+	old := c.s.aofActive
+	size, err := c.s.rotateAOF(file)
+	if err != nil {
+		c.replyError(err.Error())
+		return
+	}
+	// the finished file doesn't change, so it's hashed without the lock
+	c.s.mu.Unlock()
+	digest, err := fileDigest(old)
+	c.s.mu.Lock()
+	if err != nil {
+		c.replyError(err.Error())
+		return
+	}
+	c.replyMapLen(3)
+	c.replyBulk("path")
+	c.replyBulk(old)
+	c.replyBulk("size")
+	c.replyInt(int(size))
+	c.replyBulk("sha256")
+	c.replyBulk(digest)
+}
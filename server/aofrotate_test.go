@@ -0,0 +1,141 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAOFRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	s, addr := testNewServer(t, aofPath)
+	stop := testServe(t, s, addr)
+	defer func() { stop() }()
+
+	// rotate while clients write to two databases
+	var wg sync.WaitGroup
+	done := make(chan bool)
+	for _, db := range []string{"0", "1"} {
+		wg.Add(1)
+		go func(db string) {
+			defer wg.Done()
+			conn := testDial(t, addr)
+			defer conn.close()
+			conn.do("SELECT", db)
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				conn.do("INCR", "counter")
+				conn.do("RPUSH", "list", itoa(i))
+				if i%3 == 0 {
+					conn.do("LPOP", "list")
+				}
+			}
+		}(db)
+	}
+	conn := testDial(t, addr)
+	defer conn.close()
+	var finished []string
+	for _, name := range []string{"seg-1.aof", "seg-2.aof", filepath.Join(dir, "seg-3.aof")} {
+		for n := 0; n < 50; n++ {
+			conn.do("INCR", "rotations:"+name)
+		}
+		v, ok := conn.do("AOF", "ROTATE", name).([]interface{})
+		if !ok || len(v) != 6 || v[0] != "path" || v[2] != "size" || v[4] != "sha256" {
+			t.Fatalf("unexpected reply %v", v)
+		}
+		// the finished file doesn't change
+		digest, err := fileDigest(v[1].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(v[1].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digest != v[5] || fi.Size() != int64(v[3].(int)) {
+			t.Fatalf("expected size %d and digest %s, got %v", fi.Size(), digest, v)
+		}
+		finished = append(finished, v[1].(string))
+	}
+	close(done)
+	wg.Wait()
+	if finished[0] != aofPath {
+		t.Fatalf("expected %s to be finished first, got %s", aofPath, finished[0])
+	}
+
+	// the new file must not exist
+	if err, ok := conn.do("AOF", "ROTATE", "seg-1.aof").(error); !ok ||
+		!strings.Contains(err.Error(), "exists") {
+		t.Fatalf("expected an error, got %v", err)
+	}
+	if _, ok := conn.do("AOF", "SPIN", "x").(error); !ok {
+		t.Fatal("expected an error")
+	}
+	conn.close()
+
+	// the segments are loaded in order
+	digest, _ := s.Do("DEBUG", "DIGEST")
+	data, err := ioutil.ReadFile(aofPath + ".manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(data), "appendonly.aof\nseg-1.aof\nseg-2.aof\nseg-3.aof\n") {
+		t.Fatalf("unexpected manifest %q", data)
+	}
+	stop()
+	s, addr = testNewServer(t, aofPath)
+	stop = testServe(t, s, addr)
+	if v, _ := s.Do("DEBUG", "DIGEST"); v != digest {
+		t.Fatalf("expected digest %v, got %v", digest, v)
+	}
+
+	// a rewrite replaces the segments, which are left on disk
+	if _, err := s.Do("SAVE"); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile(aofPath + ".manifest")
+	if err != nil || strings.Contains(string(data), "seg-1.aof") ||
+		!strings.HasSuffix(string(data), "\nseg-3.aof\n") {
+		t.Fatalf("unexpected manifest %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "seg-1.aof")); err != nil {
+		t.Fatal(err)
+	}
+	s.Do("SET", "after", "rewrite")
+	digest, _ = s.Do("DEBUG", "DIGEST")
+	stop()
+	s, addr = testNewServer(t, aofPath)
+	stop = testServe(t, s, addr)
+	if v, _ := s.Do("DEBUG", "DIGEST"); v != digest {
+		t.Fatalf("expected digest %v after the rewrite, got %v", digest, v)
+	}
+
+	// a segment that's missing its end is refused
+	stop()
+	stop = func() {}
+	if err := ioutil.WriteFile(aofPath+".manifest",
+		[]byte("seg-1.aof\nbroken.aof\nseg-3.aof\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.aof"),
+		[]byte("*3\r\n$3\r\nSET\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, _ = testNewServer(t, aofPath)
+	if err := s.ListenAndServe(); err == nil ||
+		!strings.Contains(err.Error(), "incomplete command") {
+		t.Fatalf("expected an incomplete command error, got %v", err)
+	}
+}
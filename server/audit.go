@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// The audit log is an optional JSON lines file that records who changed what.
+// Each write command is recorded with the time, the client, the command name,
+// and the names of the keys. Values are never recorded. Events are written by
+// a dedicated goroutine so that a slow disk does not stall the server. When
+// the queue is full the event is dropped and counted.
+
+const auditQueueSize = 4096 // number of events waiting to be written
+
+// audit event sources
+const (
+	auditSourceClient = "client" // a command from a connected client
+	auditSourceAOF    = "aof"    // a command replayed from the aof at startup
+)
+
+type auditEvent struct {
+	Time    string   `json:"time"`
+	Source  string   `json:"source"`
+	Addr    string   `json:"addr,omitempty"`
+	DB      int      `json:"db"`
+	Command string   `json:"command"`
+	Keys    []string `json:"keys,omitempty"`
+	Trace   string   `json:"trace,omitempty"`
+}
+
+type auditLog struct {
+	events  chan *auditEvent
+	closed  bool   // no more events are accepted
+	written uint64 // number of events written, atomic
+	dropped uint64 // number of events dropped, atomic
+}
+
+// startAuditLog runs the background routine which writes audit events. The
+// file is opened on the first event, which allows for the audit-log directive
+// to be changed at runtime.
+func (s *Server) startAuditLog() {
+	a := &auditLog{
+		events: make(chan *auditEvent, auditQueueSize),
+	}
+	s.audit = a
+	// the events are written until the channel is closed, even after the
+	// context is cancelled
+	s.workers.start(workerAudit, func(ctx context.Context) {
+		var f *os.File
+		var size int64
+		var failed bool
+		defer func() {
+			if f != nil {
+				f.Close()
+			}
+		}()
+		for e := range a.events {
+			if f == nil {
+				var err error
+				f, size, err = openAuditLogFile(s.cfg.auditLogFile)
+				if err != nil {
+					if !failed {
+						s.lwarningf("Can't open the audit log: %v", err)
+						failed = true
+					}
+					atomic.AddUint64(&a.dropped, 1)
+					continue
+				}
+				failed = false
+			}
+			data, _ := json.Marshal(e)
+			n, err := f.Write(append(data, '\n'))
+			size += int64(n)
+			if err != nil {
+				s.lwarningf("Can't write to the audit log: %v", err)
+				atomic.AddUint64(&a.dropped, 1)
+			} else {
+				atomic.AddUint64(&a.written, 1)
+			}
+			s.mu.RLock()
+			maxSize := int64(s.cfg.auditLogMaxSize)
+			s.mu.RUnlock()
+			if size >= maxSize {
+				// rotate
+				f.Close()
+				f = nil
+				if err := os.Rename(s.cfg.auditLogFile, s.cfg.auditLogFile+".1"); err != nil {
+					s.lwarningf("Can't rotate the audit log: %v", err)
+				}
+			}
+		}
+	})
+}
+
+func openAuditLogFile(path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// stopAuditLog writes the remaining events and stops the background routine.
+func (s *Server) stopAuditLog() {
+	s.mu.Lock()
+	s.audit.closed = true
+	close(s.audit.events)
+	s.mu.Unlock()
+	s.stopWorkers(workerAudit)
+}
+
+// auditCommand queues an audit event for a write command. This must be called
+// while holding the server lock, or before the server accepts connections.
+func (s *Server) auditCommand(c *client, cmd *command, source string) {
+	if !s.cfg.auditLog || s.audit == nil || s.audit.closed {
+		return
+	}
+	e := &auditEvent{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Source:  source,
+		Addr:    c.addr,
+		DB:      c.db.num,
+		Command: cmd.name,
+		Keys:    cmd.keys(c.args),
+		Trace:   c.trace,
+	}
+	select {
+	case s.audit.events <- e:
+	default:
+		atomic.AddUint64(&s.audit.dropped, 1)
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWaitForAudit waits until the audit log has written count events.
+func testWaitForAudit(t *testing.T, conn *testConn, count int) {
+	start := time.Now()
+	for {
+		info := conn.do("INFO", "persistence").(string)
+		if strings.Contains(info, "audit_log_events:"+itoa(count)+"\n") {
+			return
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatalf("timeout waiting for %d audit events\n%s", count, info)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func testReadAudit(t *testing.T, paths ...string) []auditEvent {
+	var events []auditEvent
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "secret") {
+			t.Fatalf("expected no values in the audit log, got %s", data)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line == "" {
+				continue
+			}
+			var e auditEvent
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	auditPath := filepath.Join(dir, "audit.log")
+	args := []string{"--audit-log", "yes", "--audit-log-file", auditPath}
+
+	addr, stop := testStartServer(t, aofPath, args...)
+	conn := testDial(t, addr)
+	conn.do("SET", "key1", "secret")
+	conn.do("GET", "key1")
+	conn.do("MSET", "key2", "secret", "key3", "secret")
+	conn.do("DEL", "key4") // no change
+	conn.do("SELECT", "1")
+	conn.do("RPUSH", "list", "secret")
+	testWaitForAudit(t, conn, 3)
+	events := testReadAudit(t, auditPath)
+	expect := []struct {
+		db      int
+		command string
+		keys    string
+	}{
+		{0, "set", "key1"},
+		{0, "mset", "key2 key3"},
+		{1, "rpush", "list"},
+	}
+	if len(events) != len(expect) {
+		t.Fatalf("expected %d events, got %d", len(expect), len(events))
+	}
+	for i, e := range events {
+		if e.Source != auditSourceClient || e.Addr == "" || e.DB != expect[i].db ||
+			e.Command != expect[i].command ||
+			strings.Join(e.Keys, " ") != expect[i].keys {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	}
+
+	// disabled at runtime
+	conn.do("CONFIG", "SET", "audit-log", "no")
+	conn.do("SET", "key5", "secret")
+	conn.do("CONFIG", "SET", "audit-log", "yes")
+	conn.do("SET", "key6", "secret")
+	testWaitForAudit(t, conn, 4)
+	events = testReadAudit(t, auditPath)
+	if len(events) != 4 || events[3].Keys[0] != "key6" {
+		t.Fatalf("expected key6 to be the last event, got %+v", events)
+	}
+	conn.close()
+	stop()
+
+	// replayed from the aof and rotated
+	os.Remove(auditPath)
+	addr, stop = testStartServer(t, aofPath,
+		append(args, "--audit-log-max-size", "1024")...)
+	defer stop()
+	conn = testDial(t, addr)
+	defer conn.close()
+	testWaitForAudit(t, conn, 5)
+	for _, e := range testReadAudit(t, auditPath) {
+		if e.Source != auditSourceAOF || e.Addr != "" {
+			t.Fatalf("expected an aof event, got %+v", e)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		conn.do("SET", "key"+itoa(i), "secret")
+	}
+	testWaitForAudit(t, conn, 25)
+	events = testReadAudit(t, auditPath+".1", auditPath)
+	if len(events) >= 25 {
+		t.Fatalf("expected the audit log to be rotated, got %d events", len(events))
+	}
+	if e := events[len(events)-1]; e.Source != auditSourceClient || e.Keys[0] != "key19" {
+		t.Fatalf("expected key19 to be the last event, got %+v", e)
+	}
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BIGKEYS finds the largest keys of each type, by their estimated memory and
+// by their number of elements, and makes a histogram of the value sizes. The
+// keys are scanned in the background like the key statistics, and the scan
+// is duty cycled, it sleeps for bigKeysIdleRatio times the time that it held
+// the lock, so that it doesn't compete with the clients. The results are
+// updated as the scan goes, and kept with the time that the scan finished
+// until the next BIGKEYS, so polling them is cheap.
+
+const (
+	bigKeysIdleRatio = 3   // the time slept per time scanned
+	bigKeysMaxCount  = 100 // the maximum number of keys per type
+	bigKeysMinBucket = 6   // the smallest histogram bucket is up to 64 bytes
+)
+
+// bigKey is a key in the results of BIGKEYS.
+type bigKey struct {
+	db     int
+	key    string
+	memory int // the estimated bytes of the key and its value
+	length int // the bytes of a string, or the elements of the others
+}
+
+// bigKeysType are the results of BIGKEYS for a type.
+type bigKeysType struct {
+	keys     int
+	memory   int
+	byMemory []bigKey // largest first
+	byLength []bigKey // largest first
+}
+
+// bigKeysState is the progress and the results of the BIGKEYS command. It's
+// changed by the scan and read by BIGKEYS RESULT while holding jobsMu, because
+// both only hold the read lock.
+type bigKeysState struct {
+	count     int
+	started   time.Time
+	finished  time.Time
+	total     int // the keys when the scan started
+	scanned   int
+	running   bool
+	cancelled bool
+	types     map[string]*bigKeysType
+	histogram []int // the values up to 1<<(bigKeysMinBucket+i) bytes
+}
+
+// valueLength returns the bytes of a string, or the elements of the other
+// types.
+func valueLength(value interface{}) int {
+	switch v := value.(type) {
+	case string:
+		return len(v)
+	case *list:
+		return v.len()
+	case *set:
+		return len(v.m)
+	case *hash:
+		return len(v.m)
+	case *zset:
+		return len(v.m)
+	}
+	return 0
+}
+
+// insertBigKey inserts the key in the keys that are ordered by less, and
+// keeps up to count keys.
+func insertBigKey(keys []bigKey, key bigKey, count int, less func(a, b bigKey) bool) []bigKey {
+	i := sort.Search(len(keys), func(i int) bool { return less(keys[i], key) })
+	if i == count {
+		return keys
+	}
+	if len(keys) < count {
+		keys = append(keys, bigKey{})
+	}
+	copy(keys[i+1:], keys[i:])
+	keys[i] = key
+	return keys
+}
+
+// add records a key in the results.
+func (state *bigKeysState) add(db int, key, typ string, value interface{}) {
+	t := state.types[typ]
+	if t == nil {
+		t = &bigKeysType{}
+		state.types[typ] = t
+	}
+	k := bigKey{db: db, key: key, memory: memoryUsage(key, value, 5),
+		length: valueLength(value)}
+	t.keys++
+	t.memory += k.memory
+	t.byMemory = insertBigKey(t.byMemory, k, state.count, func(a, b bigKey) bool {
+		return a.memory < b.memory
+	})
+	t.byLength = insertBigKey(t.byLength, k, state.count, func(a, b bigKey) bool {
+		return a.length < b.length
+	})
+	bucket := bits.Len(uint(k.memory-1)) - bigKeysMinBucket
+	if bucket < 0 {
+		bucket = 0
+	}
+	for len(state.histogram) <= bucket {
+		state.histogram = append(state.histogram, 0)
+	}
+	state.histogram[bucket]++
+}
+
+// bigKeys scans the keys of all databases until it's done, cancelled, or the
+// server shuts down.
+func (s *Server) bigKeys(ctx context.Context, state *bigKeysState) {
+	s.mu.RLock()
+	dbs := make([]*database, 0, len(s.dbs))
+	for _, db := range s.dbs {
+		dbs = append(dbs, db)
+	}
+	s.mu.RUnlock()
+	var busy time.Duration
+	for _, db := range dbs {
+		s.mu.RLock()
+		keys := make([]string, 0, db.len())
+		db.ascend(func(key string, value interface{}) bool {
+			keys = append(keys, key)
+			return true
+		})
+		s.mu.RUnlock()
+		for len(keys) > 0 {
+			n := exportBatchSize
+			if n > len(keys) {
+				n = len(keys)
+			}
+			start := time.Now()
+			if ctx.Err() != nil {
+				s.jobsMu.Lock()
+				if state.running {
+					state.running = false
+					state.cancelled = true
+					state.finished = time.Now()
+				}
+				s.jobsMu.Unlock()
+				return
+			}
+			s.mu.RLock()
+			s.jobsMu.Lock()
+			if state.cancelled {
+				s.jobsMu.Unlock()
+				s.mu.RUnlock()
+				return
+			}
+			for _, key := range keys[:n] {
+				value, ok := db.get(key)
+				if !ok {
+					continue
+				}
+				state.add(db.num, key, db.getType(key), value)
+			}
+			state.scanned += n
+			s.jobsMu.Unlock()
+			s.mu.RUnlock()
+			keys = keys[n:]
+			// the sleeps are batched, because a short sleep oversleeps
+			busy += time.Since(start)
+			if busy > time.Millisecond {
+				time.Sleep(busy * bigKeysIdleRatio)
+				busy = 0
+			}
+		}
+	}
+	s.jobsMu.Lock()
+	if !state.cancelled {
+		state.running = false
+		state.finished = time.Now()
+	}
+	s.jobsMu.Unlock()
+}
+
+// bigkeysCommand is BIGKEYS [COUNT count], which starts the scan in the
+// background, BIGKEYS RESULT, or BIGKEYS CANCEL.
+func bigkeysCommand(c *client) {
+	c.s.jobsMu.Lock()
+	defer c.s.jobsMu.Unlock()
+	if len(c.args) == 2 {
+		switch strings.ToLower(c.args[1]) {
+		case "result":
+			bigkeysResultCommand(c)
+			return
+		case "cancel":
+			state := c.s.bigKeysState
+			if state == nil || !state.running {
+				c.replyError("No big keys scan in progress")
+				return
+			}
+			state.running = false
+			state.cancelled = true
+			state.finished = time.Now()
+			c.replyString("OK")
+			return
+		}
+	}
+	count := 5
+	switch {
+	case len(c.args) == 1:
+	case len(c.args) == 3 && strings.ToLower(c.args[1]) == "count":
+		n, err := strconv.Atoi(c.args[2])
+		if err != nil || n < 1 || n > bigKeysMaxCount {
+			c.replyError("COUNT must be between 1 and " + strconv.Itoa(bigKeysMaxCount))
+			return
+		}
+		count = n
+	default:
+		c.replySyntaxError()
+		return
+	}
+	if c.s.bigKeysState != nil && c.s.bigKeysState.running {
+		c.replyError("Big keys scan already in progress")
+		return
+	}
+	state := &bigKeysState{count: count, started: time.Now(), running: true,
+		types: make(map[string]*bigKeysType)}
+	for _, db := range c.s.dbs {
+		state.total += db.len()
+	}
+	c.s.bigKeysState = state
+	c.s.workers.start(workerJobs, func(ctx context.Context) {
+		c.s.bigKeys(ctx, state)
+	})
+	c.replyString("Background big keys scan started")
+}
+
+// bigkeysResultCommand replies with the progress and the results of the last
+// BIGKEYS, which are partial while it's running. Called with jobsMu held.
+func bigkeysResultCommand(c *client) {
+	state := c.s.bigKeysState
+	if state == nil {
+		c.replyMultiBulkLen(2)
+		c.replyBulk("status")
+		c.replyBulk("none")
+		return
+	}
+	status, elapsed, finished := "running", time.Since(state.started), 0
+	if !state.running {
+		status, elapsed = "done", state.finished.Sub(state.started)
+		if state.cancelled {
+			status = "cancelled"
+		}
+		finished = int(state.finished.UnixNano() / int64(time.Millisecond))
+	}
+	c.replyMultiBulkLen(16)
+	c.replyBulk("status")
+	c.replyBulk(status)
+	c.replyBulk("count")
+	c.replyInt(state.count)
+	c.replyBulk("keys-total")
+	c.replyInt(state.total)
+	c.replyBulk("keys-scanned")
+	c.replyInt(state.scanned)
+	c.replyBulk("elapsed-ms")
+	c.replyInt(int(elapsed / time.Millisecond))
+	c.replyBulk("finished-at")
+	c.replyInt(finished)
+	c.replyBulk("types")
+	types := make([]string, 0, len(state.types))
+	for typ := range state.types {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	c.replyMultiBulkLen(len(types))
+	for _, typ := range types {
+		t := state.types[typ]
+		c.replyMultiBulkLen(10)
+		c.replyBulk("type")
+		c.replyBulk(typ)
+		c.replyBulk("keys")
+		c.replyInt(t.keys)
+		c.replyBulk("memory")
+		c.replyInt(t.memory)
+		c.replyBulk("by-memory")
+		replyBigKeys(c, t.byMemory)
+		c.replyBulk("by-length")
+		replyBigKeys(c, t.byLength)
+	}
+	c.replyBulk("histogram")
+	c.replyMultiBulkLen(len(state.histogram))
+	for i, n := range state.histogram {
+		c.replyMultiBulkLen(2)
+		c.replyInt(1 << uint(bigKeysMinBucket+i))
+		c.replyInt(n)
+	}
+}
+
+// replyBigKeys replies with the db, the key, the memory and the length of
+// each key.
+func replyBigKeys(c *client, keys []bigKey) {
+	c.replyMultiBulkLen(len(keys))
+	for _, k := range keys {
+		c.replyMultiBulkLen(8)
+		c.replyBulk("db")
+		c.replyInt(k.db)
+		c.replyBulk("key")
+		c.replyBulk(k.key)
+		c.replyBulk("memory")
+		c.replyInt(k.memory)
+		c.replyBulk("length")
+		c.replyInt(k.length)
+	}
+}
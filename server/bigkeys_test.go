@@ -0,0 +1,169 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInsertBigKey(t *testing.T) {
+	less := func(a, b bigKey) bool { return a.length < b.length }
+	var keys []bigKey
+	for _, n := range []int{3, 1, 4, 1, 5, 9, 2, 6} {
+		keys = insertBigKey(keys, bigKey{length: n}, 3, less)
+	}
+	if len(keys) != 3 || keys[0].length != 9 || keys[1].length != 6 || keys[2].length != 5 {
+		t.Fatalf("expected 9 6 5, got %v", keys)
+	}
+}
+
+func TestBigKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"))
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	if v := conn.do("BIGKEYS", "RESULT").([]interface{}); v[1] != "none" {
+		t.Fatalf("expected no results, got %v", v)
+	}
+	if _, ok := conn.do("BIGKEYS", "COUNT", "0").(error); !ok {
+		t.Fatal("expected an error for a zero count")
+	}
+	if _, ok := conn.do("BIGKEYS", "CANCEL").(error); !ok {
+		t.Fatal("expected an error without a scan")
+	}
+	for i := 0; i < 250; i++ {
+		conn.do("SET", "str:"+strconv.Itoa(i), strings.Repeat("x", i))
+	}
+	conn.do("RPUSH", "list:small", "a")
+	conn.do("RPUSH", "list:long", "a", "b", "c", "d")
+	conn.do("RPUSH", "list:wide", strings.Repeat("y", 1000))
+	conn.do("SELECT", "1")
+	conn.do("SADD", "set", "a", "b")
+	if v := conn.do("BIGKEYS", "COUNT", "2"); v != "Background big keys scan started" {
+		t.Fatalf("unexpected reply '%v'", v)
+	}
+	res := testBigKeysResult(t, conn)
+	if res[5] != 254 || res[7] != 254 || res[11].(int) == 0 {
+		t.Fatalf("expected 254 keys scanned and a finish time, got %v", res)
+	}
+	types := make(map[string][]interface{})
+	for _, typ := range res[13].([]interface{}) {
+		typ := typ.([]interface{})
+		types[typ[1].(string)] = typ
+	}
+	if len(types) != 3 || types["string"][3] != 250 || types["set"][3] != 1 {
+		t.Fatalf("unexpected types %v", types)
+	}
+	keyName := func(keys interface{}, i int) string {
+		return keys.([]interface{})[i].([]interface{})[3].(string)
+	}
+	list := types["list"]
+	if keyName(list[7], 0) != "list:wide" || keyName(list[9], 0) != "list:long" ||
+		len(list[9].([]interface{})) != 2 {
+		t.Fatalf("unexpected lists %v", list)
+	}
+	if keyName(types["string"][7], 0) != "str:249" || keyName(types["string"][7], 1) != "str:248" {
+		t.Fatalf("unexpected strings %v", types["string"])
+	}
+	if db := types["set"][7].([]interface{})[0].([]interface{})[1]; db != 1 {
+		t.Fatalf("expected db 1, got %v", db)
+	}
+	var counted int
+	for _, bucket := range res[15].([]interface{}) {
+		counted += bucket.([]interface{})[1].(int)
+	}
+	if counted != 254 {
+		t.Fatalf("expected 254 values in the histogram, got %d", counted)
+	}
+
+	// the cached result doesn't change until the next scan
+	if again := testBigKeysResult(t, conn); again[11] != res[11] {
+		t.Fatalf("expected the cached result, got %v", again)
+	}
+
+	// a cancelled scan
+	for i := 0; i < 20000; i++ {
+		conn.send("SET", "many:"+strconv.Itoa(i), "x")
+	}
+	for i := 0; i < 20000; i++ {
+		if _, err := conn.read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.do("BIGKEYS")
+	if _, ok := conn.do("BIGKEYS").(error); !ok {
+		t.Fatal("expected an error for a scan in progress")
+	}
+	if v := conn.do("BIGKEYS", "CANCEL"); v != "OK" {
+		t.Fatalf("expected OK, got %v", v)
+	}
+	if res := conn.do("BIGKEYS", "RESULT").([]interface{}); res[1] != "cancelled" ||
+		res[7].(int) >= res[5].(int) {
+		t.Fatalf("expected a cancelled scan, got %v", res[:12])
+	}
+}
+
+// testBigKeysResult waits for the scan to finish and returns its result.
+func testBigKeysResult(t *testing.T, conn *testConn) []interface{} {
+	t.Helper()
+	for start := time.Now(); ; time.Sleep(time.Millisecond * 10) {
+		res := conn.do("BIGKEYS", "RESULT").([]interface{})
+		if res[1] == "done" {
+			return res
+		}
+		if time.Since(start) > time.Second*10 {
+			t.Fatal("timeout waiting for the big keys")
+		}
+	}
+}
+
+// TestBackgroundJobsReadLock checks that EXPORT, KEYSTATS and BIGKEYS only
+// take the read lock, so that they run beside the other readers.
+func TestBackgroundJobsReadLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"))
+	stop := testServe(t, s, addr)
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+	conn.do("PING")
+
+	s.mu.RLock()
+	done := make(chan error, 1)
+	go func() {
+		for _, args := range [][]string{
+			{"EXPORT", "STATUS"}, {"KEYSTATS", "RESULT"}, {"BIGKEYS", "RESULT"},
+		} {
+			conn.send(args...)
+			if _, err := conn.read(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		s.mu.RUnlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		s.mu.RUnlock()
+		t.Fatal("expected the commands to run under the read lock")
+	}
+}
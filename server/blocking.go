@@ -0,0 +1,429 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A client that runs BLPOP, BRPOP, BLMOVE or BRPOPLPUSH on lists that are all
+// empty is blocked. It's queued on each of the keys, and waits without the
+// server lock in the goroutine of its connection. A command that pushes to a
+// key that has blocked clients marks the key as ready, and before the command
+// releases the lock, the elements of the ready keys are handed to the blocked
+// clients in the order that they blocked. The pops are appended to the aof
+// when they're made, after the command that pushed, as the command that
+// they're the same as, such as LPOP.
+//
+// While a client is blocked, its connection is read by another goroutine, so
+// that a disconnect cancels the wait, and the commands that the client
+// pipelined after the blocking command are buffered until it's served.
+
+// blockKey is a key of a database.
+type blockKey struct {
+	db  int
+	key string
+}
+
+// blockedClient is a client that waits on the keys of a blocking command.
+type blockedClient struct {
+	c      *client
+	db     int
+	keys   []string
+	name   string // the command that a serve is the same as, such as lpop
+	left   bool   // pops from the head, otherwise from the tail
+	move   bool   // pushes the element to dst, for BLMOVE and BRPOPLPUSH
+	dst    string
+	toLeft bool              // pushes to the head of dst
+	served chan blockedReply // buffered
+}
+
+// blockedReply is what a blocked client is served.
+type blockedReply struct {
+	key   string
+	value string
+	err   error
+}
+
+// blockedClients are the clients that are blocked on keys.
+type blockedClients struct {
+	queues map[blockKey][]*blockedClient // the clients in the order they blocked
+	ready  []blockKey                    // the keys that were pushed to by the command
+	count  int                           // the number of blocked clients
+}
+
+// listEnd returns the LEFT or RIGHT argument of LMOVE.
+func listEnd(left bool) string {
+	if left {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
+
+// command returns the command that popping key for the client is the same
+// as, which is what's appended to the aof.
+func (b *blockedClient) command(key string) []string {
+	switch b.name {
+	case "lmove":
+		return []string{"lmove", key, b.dst, listEnd(b.left), listEnd(b.toLeft)}
+	case "rpoplpush":
+		return []string{"rpoplpush", key, b.dst}
+	}
+	return []string{b.name, key}
+}
+
+// raw returns the command of the key as it's appended to the aof.
+func (b *blockedClient) raw(key string) []byte {
+	args := b.command(key)
+	iargs := make([]interface{}, len(args))
+	for i, arg := range args {
+		iargs[i] = arg
+	}
+	return buildCommand(iargs...)
+}
+
+// block queues the client on its keys.
+func (s *Server) block(c *client, b *blockedClient) {
+	b.c, b.db, b.served = c, c.db.num, make(chan blockedReply, 1)
+	if s.blocked.queues == nil {
+		s.blocked.queues = make(map[blockKey][]*blockedClient)
+	}
+	for _, key := range b.keys {
+		bk := blockKey{b.db, key}
+		s.blocked.queues[bk] = append(s.blocked.queues[bk], b)
+	}
+	s.blocked.count++
+}
+
+// unblock removes the client from the queues of its keys.
+func (s *Server) unblock(b *blockedClient) {
+	for _, key := range b.keys {
+		bk := blockKey{b.db, key}
+		queue := s.blocked.queues[bk]
+		for i := range queue {
+			if queue[i] == b {
+				queue = append(queue[:i], queue[i+1:]...)
+				break
+			}
+		}
+		if len(queue) == 0 {
+			delete(s.blocked.queues, bk)
+		} else {
+			s.blocked.queues[bk] = queue
+		}
+	}
+	s.blocked.count--
+}
+
+// signalList marks a list that was pushed to as ready, when clients are
+// blocked on it.
+func (s *Server) signalList(db *database, key string) {
+	bk := blockKey{db.num, key}
+	if _, ok := s.blocked.queues[bk]; !ok {
+		return
+	}
+	for _, ready := range s.blocked.ready {
+		if ready == bk {
+			return
+		}
+	}
+	s.blocked.ready = append(s.blocked.ready, bk)
+}
+
+// serveBlocked hands the elements of the ready keys to the clients that are
+// blocked on them, first come first served. A move pushes to its destination
+// right away, which may serve the clients that are blocked on it in turn.
+// Must be called while holding the write lock.
+func (s *Server) serveBlocked() {
+	for len(s.blocked.ready) > 0 {
+		bk := s.blocked.ready[0]
+		s.blocked.ready = s.blocked.ready[1:]
+		db := s.selectDB(bk.db)
+		for len(s.blocked.queues[bk]) > 0 {
+			l, ok := db.getList(bk.key, false)
+			if !ok || l == nil {
+				break
+			}
+			b := s.blocked.queues[bk][0]
+			s.unblock(b)
+			b.served <- s.popBlocked(db, bk.key, l, b)
+		}
+	}
+	s.blocked.ready = nil
+}
+
+// popBlocked pops an element of the list for the blocked client, and pushes
+// it to the destination of a move. The pop is appended to the aof, and to
+// the audit log and the write-behind queue, as the command it's the same as.
+// A move to a destination that's not a list is served the WRONGTYPE error.
+func (s *Server) popBlocked(db *database, key string, l *list, b *blockedClient) blockedReply {
+	var dst *list
+	if b.move {
+		var ok bool
+		if dst, ok = db.getList(b.dst, false); !ok {
+			return blockedReply{err: ErrWrongType}
+		}
+	}
+	var value string
+	if b.left {
+		value, _ = l.lpop()
+	} else {
+		value, _ = l.rpop()
+	}
+	if l.len() == 0 && l != dst {
+		db.del(key)
+	}
+	if b.move {
+		if dst == nil {
+			dst = newList()
+			db.set(b.dst, dst)
+		}
+		if b.toLeft {
+			dst.lpush(value)
+		} else {
+			dst.rpush(value)
+		}
+		s.signalList(db, b.dst)
+	}
+	cmd := s.cmds[b.name]
+	pc := &client{s: s, db: db, addr: b.c.addr, trace: b.c.trace,
+		args: b.command(key)}
+	s.appendAOF(db.num, b.raw(key))
+	s.dirty++
+	b.c.aofOffset = s.aofOffset
+	s.auditCommand(pc, cmd, auditSourceClient)
+	s.queueWriteBehind(pc, cmd)
+	return blockedReply{key: key, value: value}
+}
+
+// parseBlockTimeout parses the timeout of a blocking command, in seconds.
+func parseBlockTimeout(c *client, arg string) (float64, bool) {
+	timeout, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(timeout) || math.IsInf(timeout, 0) {
+		c.replyError("timeout is not a float or out of range")
+		return 0, false
+	}
+	if timeout < 0 {
+		c.replyError("timeout is negative")
+		return 0, false
+	}
+	if timeout*float64(time.Second) >= math.MaxInt64 {
+		c.replyError("timeout is out of range")
+		return 0, false
+	}
+	return timeout, true
+}
+
+// waitBlocked queues the client on its keys, and waits without the write
+// lock until it's served, or until the timeout in seconds, zero is forever.
+// Returns false when it's not served. The wait is abandoned when the context
+// of the client is cancelled, and then c.ctxErr is set.
+func (c *client) waitBlocked(b *blockedClient, timeout float64) (blockedReply, bool) {
+	c.s.block(c, b)
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(time.Duration(timeout * float64(time.Second)))
+		defer t.Stop()
+		expired = t.C
+	}
+	c.s.lockReleased()
+	c.s.mu.Unlock()
+	stop := c.watchConn()
+	var reply blockedReply
+	var ok bool
+	select {
+	case reply = <-b.served:
+		ok = true
+	case <-expired:
+	case <-c.context().Done():
+	}
+	stop()
+	c.s.mu.Lock()
+	if !ok {
+		// the element may have been handed over before the lock
+		select {
+		case reply = <-b.served:
+			ok = true
+		default:
+			c.s.unblock(b)
+		}
+	}
+	if !ok {
+		if err := c.context().Err(); err != nil && err != context.DeadlineExceeded {
+			c.ctxErr = err
+		}
+		return reply, false
+	}
+	// the pop is written to the aof before the reply
+	if err := c.s.flushAOF(); err != nil {
+		c.s.fatalError(err)
+	}
+	return reply, true
+}
+
+// blpopCommand is BLPOP key [key ...] timeout.
+func blpopCommand(c *client) {
+	blockingPopCommand(c, true)
+}
+
+// brpopCommand is BRPOP key [key ...] timeout.
+func brpopCommand(c *client) {
+	blockingPopCommand(c, false)
+}
+
+// blockingPopCommand pops from the first of the keys that's a list, or
+// blocks until an element is pushed to one of them. The reply is the key and
+// the element, or a null array at the timeout.
+func blockingPopCommand(c *client, left bool) {
+	if len(c.args) < 3 {
+		c.replyAritryError()
+		return
+	}
+	timeout, ok := parseBlockTimeout(c, c.args[len(c.args)-1])
+	if !ok {
+		return
+	}
+	b := &blockedClient{keys: c.args[1 : len(c.args)-1], name: "rpop", left: left}
+	if left {
+		b.name = "lpop"
+	}
+	for _, key := range b.keys {
+		l, ok := c.db.getList(key, false)
+		if !ok {
+			c.replyTypeError()
+			return
+		}
+		if l == nil {
+			continue
+		}
+		var value string
+		if left {
+			value, _ = l.lpop()
+		} else {
+			value, _ = l.rpop()
+		}
+		if l.len() == 0 {
+			c.db.del(key)
+		}
+		c.raw = b.raw(key)
+		c.replyMultiBulkLen(2)
+		c.replyBulk(key)
+		c.replyBulk(value)
+		c.dirty++
+		return
+	}
+	reply, ok := c.waitBlocked(b, timeout)
+	if !ok {
+		if c.ctxErr == nil {
+			c.replyNullArray()
+		}
+		return
+	}
+	c.replyMultiBulkLen(2)
+	c.replyBulk(reply.key)
+	c.replyBulk(reply.value)
+}
+
+// blmoveCommand is BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout.
+func blmoveCommand(c *client) {
+	if len(c.args) != 6 {
+		c.replyAritryError()
+		return
+	}
+	var ends [2]bool
+	for i, arg := range c.args[3:5] {
+		switch strings.ToLower(arg) {
+		default:
+			c.replySyntaxError()
+			return
+		case "left":
+			ends[i] = true
+		case "right":
+		}
+	}
+	blockingMoveCommand(c, "lmove", ends[0], ends[1])
+}
+
+// brpoplpushCommand is BRPOPLPUSH source destination timeout, which is the
+// same as BLMOVE source destination RIGHT LEFT timeout.
+func brpoplpushCommand(c *client) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	blockingMoveCommand(c, "rpoplpush", false, true)
+}
+
+// blockingMoveCommand moves an element like LMOVE, or blocks until an
+// element is pushed to the source. The move is made when the client is
+// served, and it's appended to the aof then, as the command that's named.
+// The reply is the element, or a null at the timeout.
+func blockingMoveCommand(c *client, name string, fromLeft, toLeft bool) {
+	timeout, ok := parseBlockTimeout(c, c.args[len(c.args)-1])
+	if !ok {
+		return
+	}
+	b := &blockedClient{keys: c.args[1:2], name: name, left: fromLeft,
+		move: true, dst: c.args[2], toLeft: toLeft}
+	src, ok := c.db.getList(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if src != nil {
+		c.raw = b.raw(c.args[1])
+		lmoveGeneric(c, fromLeft, toLeft)
+		return
+	}
+	reply, ok := c.waitBlocked(b, timeout)
+	if !ok {
+		if c.ctxErr == nil {
+			c.replyNull()
+		}
+		return
+	}
+	if reply.err != nil {
+		c.replyErr(reply.err)
+		return
+	}
+	c.replyBulk(reply.value)
+}
+
+// watchConn reads the connection of a blocked client in another goroutine,
+// which cancels the context of the client when the connection closes, and
+// buffers the commands that follow. Each fill updates the memory of the
+// client, so a client that keeps sending while it's blocked is evicted by
+// maxmemory-clients. The returned function stops the reading, and must be
+// called before the connection goroutine reads again. The client of Do has no
+// connection to watch.
+func (c *client) watchConn() (stop func()) {
+	if c.rd == nil || c.cw == nil {
+		return func() {}
+	}
+	conn := c.cw.conn
+	var stopping int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if err := c.rd.fill(); err != nil {
+				if err, ok := err.(net.Error); ok && err.Timeout() &&
+					atomic.LoadInt32(&stopping) == 1 {
+					return
+				}
+				c.cancel()
+				return
+			}
+		}
+	}()
+	return func() {
+		atomic.StoreInt32(&stopping, 1)
+		conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		conn.SetReadDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlockingPop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	s, addr := testNewServer(t, aofPath)
+	stop := testServe(t, s, addr)
+	defer func() { stop() }()
+
+	// the blocked clients are served in the order they blocked
+	var conns []*testConn
+	for i := 0; i < 3; i++ {
+		conn := testDial(t, addr)
+		defer conn.close()
+		conn.send("BLPOP", "queue", "0")
+		testWaitBlocked(t, s, i+1)
+		conns = append(conns, conn)
+	}
+	if v, _ := s.Do("RPUSH", "queue", "a", "b", "c", "d"); v != 4 {
+		t.Fatalf("expected 4, got %v", v)
+	}
+	for i, conn := range conns {
+		v, err := conn.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fmt.Sprint(v), fmt.Sprintf("[queue %c]", 'a'+i); got != want {
+			t.Fatalf("expected %s, got %s", want, got)
+		}
+	}
+	if v, _ := s.Do("LRANGE", "queue", "0", "-1"); fmt.Sprint(v) != "[d]" {
+		t.Fatalf("expected [d], got %v", v)
+	}
+
+	// an element is popped right away, from the first key that has one
+	conn := conns[0]
+	if v := conn.do("BRPOP", "missing", "queue", "0"); fmt.Sprint(v) != "[queue d]" {
+		t.Fatalf("expected [queue d], got %v", v)
+	}
+	s.Do("SET", "str", "x")
+	if _, ok := conn.do("BLPOP", "missing", "str", "0").(error); !ok {
+		t.Fatal("expected a WRONGTYPE error")
+	}
+	for _, timeout := range []string{"-1", "x", "inf", "1e300"} {
+		if _, ok := conn.do("BLPOP", "queue", timeout).(error); !ok {
+			t.Fatalf("expected an error for the timeout %s", timeout)
+		}
+	}
+
+	// any of the keys, and the commands pipelined after the blocked one
+	conn.send("BRPOP", "k1", "k2", "0")
+	conn.send("PING")
+	testWaitBlocked(t, s, 1)
+	s.Do("LMOVE", "src", "k2", "LEFT", "LEFT")
+	s.Do("RPUSH", "k2", "x", "y")
+	if v, _ := conn.read(); fmt.Sprint(v) != "[k2 y]" {
+		t.Fatalf("expected [k2 y], got %v", v)
+	}
+	if v, _ := conn.read(); v != "PONG" {
+		t.Fatalf("expected PONG, got %v", v)
+	}
+
+	// the timeout
+	start := time.Now()
+	if v := conn.do("BLPOP", "empty", "0.1"); v != nil {
+		t.Fatalf("expected nil, got %v", v)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("expected the timeout after 100ms, got %v", elapsed)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if v, err := s.DoContext(ctx, "BLPOP", "empty", "0"); v != nil || err != nil {
+		t.Fatalf("expected nil at the deadline, got %v, %v", v, err)
+	}
+
+	// a client that disconnects is no longer served
+	gone := testDial(t, addr)
+	gone.send("BLPOP", "jobs", "0")
+	testWaitBlocked(t, s, 1)
+	gone.close()
+	testWaitBlocked(t, s, 0)
+	s.Do("RPUSH", "jobs", "1")
+	if v, _ := s.Do("LLEN", "jobs"); v != 1 {
+		t.Fatalf("expected 1, got %v", v)
+	}
+
+	// the pops are in the aof
+	conn.send("BLPOP", "jobs2", "0")
+	testWaitBlocked(t, s, 1)
+	s.Do("RPUSH", "jobs2", "1", "2")
+	if v, _ := conn.read(); fmt.Sprint(v) != "[jobs2 1]" {
+		t.Fatalf("expected [jobs2 1], got %v", v)
+	}
+	digest, _ := s.Do("DEBUG", "DIGEST")
+	stop()
+	s, addr = testNewServer(t, aofPath)
+	stop = testServe(t, s, addr)
+	if v, _ := s.Do("DEBUG", "DIGEST"); v != digest {
+		t.Fatalf("expected digest %v, got %v", digest, v)
+	}
+	if v, _ := s.Do("LRANGE", "jobs2", "0", "-1"); fmt.Sprint(v) != "[2]" {
+		t.Fatalf("expected [2], got %v", v)
+	}
+}
+
+// testWaitBlocked waits until n clients are blocked.
+func testWaitBlocked(t *testing.T, s *Server, n int) {
+	t.Helper()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		s.mu.RLock()
+		count := s.blocked.count
+		s.mu.RUnlock()
+		if count == n {
+			return
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("expected %d blocked clients, got %d", n, count)
+		}
+	}
+}
+
+func TestBlockingMove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	s, addr := testNewServer(t, aofPath)
+	stop := testServe(t, s, addr)
+	defer func() { stop() }()
+
+	// the move is made before the next blocked client is served, and the
+	// element that's moved serves the clients blocked on the destination
+	worker, popper, watcher := testDial(t, addr), testDial(t, addr), testDial(t, addr)
+	defer worker.close()
+	defer popper.close()
+	defer watcher.close()
+	watcher.send("BLPOP", "done", "0")
+	testWaitBlocked(t, s, 1)
+	worker.send("BLMOVE", "jobs", "processing", "LEFT", "RIGHT", "0")
+	testWaitBlocked(t, s, 2)
+	popper.send("BRPOPLPUSH", "jobs", "done", "0")
+	testWaitBlocked(t, s, 3)
+	s.Do("RPUSH", "jobs", "a", "b")
+	if v, _ := worker.read(); v != "a" {
+		t.Fatalf("expected a, got %v", v)
+	}
+	if v, _ := popper.read(); v != "b" {
+		t.Fatalf("expected b, got %v", v)
+	}
+	if v, _ := watcher.read(); fmt.Sprint(v) != "[done b]" {
+		t.Fatalf("expected [done b], got %v", v)
+	}
+	if v, _ := s.Do("LRANGE", "processing", "0", "-1"); fmt.Sprint(v) != "[a]" {
+		t.Fatalf("expected [a], got %v", v)
+	}
+	if v, _ := s.Do("EXISTS", "jobs", "done"); v != 0 {
+		t.Fatalf("expected the lists to be empty, got %v", v)
+	}
+
+	// a destination that's no longer a list
+	worker.send("BLMOVE", "jobs", "str", "LEFT", "LEFT", "0")
+	testWaitBlocked(t, s, 1)
+	s.Do("SET", "str", "x")
+	s.Do("RPUSH", "jobs", "c")
+	if v, _ := worker.read(); v == nil || !strings.HasPrefix(fmt.Sprint(v), "WRONGTYPE") {
+		t.Fatalf("expected a WRONGTYPE error, got %v", v)
+	}
+	if v, _ := s.Do("LRANGE", "jobs", "0", "-1"); fmt.Sprint(v) != "[c]" {
+		t.Fatalf("expected [c], got %v", v)
+	}
+
+	// without blocking, and the timeout
+	if v := worker.do("BRPOPLPUSH", "jobs", "processing", "0"); v != "c" {
+		t.Fatalf("expected c, got %v", v)
+	}
+	if v := worker.do("BLMOVE", "jobs", "processing", "LEFT", "LEFT", "0.05"); v != nil {
+		t.Fatalf("expected nil, got %v", v)
+	}
+	if _, ok := worker.do("BLMOVE", "jobs", "processing", "UP", "LEFT", "0").(error); !ok {
+		t.Fatal("expected a syntax error")
+	}
+
+	// the moves are in the aof as they were made
+	worker.send("BLMOVE", "jobs", "processing", "RIGHT", "LEFT", "0")
+	testWaitBlocked(t, s, 1)
+	s.Do("RPUSH", "jobs", "d", "e")
+	if v, _ := worker.read(); v != "e" {
+		t.Fatalf("expected e, got %v", v)
+	}
+	data, err := ioutil.ReadFile(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "lmove\r\n$4\r\njobs\r\n$10\r\nprocessing\r\n$5\r\nRIGHT\r\n$4\r\nLEFT\r\n") {
+		t.Fatalf("expected the LMOVE in the aof, got %q", data)
+	}
+	digest, _ := s.Do("DEBUG", "DIGEST")
+	stop()
+	s, addr = testNewServer(t, aofPath)
+	stop = testServe(t, s, addr)
+	if v, _ := s.Do("DEBUG", "DIGEST"); v != digest {
+		t.Fatalf("expected digest %v, got %v", digest, v)
+	}
+	if v, _ := s.Do("LRANGE", "processing", "0", "-1"); fmt.Sprint(v) != "[e c a]" {
+		t.Fatalf("expected [e c a], got %v", v)
+	}
+}
@@ -1,23 +1,119 @@
 package server
 
 import (
+	"bufio"
+	"context"
 	"io"
+	"math"
+	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type client struct {
-	wr      io.Writer // client writer
-	s       *Server   // shared server
-	db      *database // the active database
-	args    []string  // command arguments
-	raw     []byte    // the raw command bytes
-	addr    string    // the address of the client
-	dirty   int       // the number of changes made by the client
-	monitor bool      // the client is in monitor mode
-	errd    bool      // flag that indicates that the last command was an error
-	authd   int       // 0 = no auth checked, 1 = protected checked, 2 = pass checked
+	wr      io.Writer   // client writer
+	s       *Server     // shared server
+	db      *database   // the active database
+	args    []string    // command arguments
+	raw     []byte      // the raw command bytes
+	addr    string      // the address of the client
+	dirty   int         // the number of changes made by the client
+	monitor bool        // the client is in monitor mode
+	errd    bool        // flag that indicates that the last command was an error
+	authd   int         // 0 = no auth checked, 1 = protected checked, 2 = pass checked
+	loadKey string      // a key that the command needs loaded by the KeyLoader
+	loaded  bool        // the command is being run again after a load
+	loading bool        // the client is replaying the aof
+	denied  bool        // the client was denied by protected mode
+	unix    bool        // the client is connected to the unix socket
+	resp    int         // the protocol version, 3 for RESP3, otherwise RESP2
+	cw      *connWriter // the connection writer, nil for the aof client
+	id      int         // unique id of the connection
+	created time.Time   // when the client connected
+	notouch bool        // CLIENT NO-TOUCH, the commands don't touch keys
+	name    string      // the name set by HELLO SETNAME
 
+	trace     string // the TRACEID of the command that's running
+	nextTrace string // the TRACEID for the next command
+
+	aofOffset int64 // the aof offset of the last write by the client
+	err       error // the first error reply of the command
+	replyType byte  // the first byte of the reply of the command
+	locked    bool  // the command holds the server lock
+
+	rd      *commandReader // the connection reader, nil for the aof client and Do
+	bw      *bufio.Writer  // the connection writer, nil for the aof client and Do
+	mem     int64          // memory of the connection buffers, atomic
+	evicted int32          // the client was evicted by maxmemory-clients, atomic
+
+	ctx    context.Context    // cancelled when the connection closes, or by the caller of DoContext
+	cancel context.CancelFunc // cancels ctx, nil for DoContext
+	ctxErr error              // ctx was done before the command ran, or it abandoned a wait
+
+	history commandHistory // the last commands
+
+}
+
+// connWriter writes the replies to a connection. Each write must finish within
+// the send-timeout, otherwise the client is considered a slow consumer and is
+// disconnected. A write is never retried. The first error closes the
+// connection, and the bufio.Writer that wraps the connWriter keeps returning
+// that error, which makes sure that nothing is written after a partial reply.
+type connWriter struct {
+	s       *Server
+	conn    net.Conn
+	err     error // the first write error
+	pending int64 // bytes of the write in progress, atomic
+	noEvict int32 // CLIENT NO-EVICT, the send-timeout and maxmemory-clients don't apply, atomic
+}
+
+func (w *connWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	var deadline time.Time
+	if timeout := atomic.LoadInt64(&w.s.sendTimeout); timeout > 0 && atomic.LoadInt32(&w.noEvict) == 0 {
+		deadline = time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	}
+	w.conn.SetWriteDeadline(deadline)
+	atomic.StoreInt64(&w.pending, int64(len(p)))
+	n, err := w.conn.Write(p)
+	atomic.StoreInt64(&w.pending, 0)
+	if err != nil {
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			atomic.AddUint64(&w.s.sendTimeouts, 1)
+			w.s.lverbosf("Client %s disconnected, send-timeout reached", w.conn.RemoteAddr())
+		}
+		w.err = err
+		w.conn.Close()
+	}
+	return n, err
+}
+
+// writeFailed returns true when the replies can no longer be written to the
+// connection.
+func (c *client) writeFailed() bool {
+	return c.cw != nil && c.cw.err != nil
+}
+
+// context returns the context of the client. The aof client has none, which
+// is the same as a context that's never cancelled.
+func (c *client) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// touchKeys updates the lru clock of the keys of the command.
+func (c *client) touchKeys(cmd *command) {
+	for _, key := range cmd.keys(c.args) {
+		if item, ok := c.db.lookup(key); ok {
+			item.touch()
+		}
+	}
 }
 
 // flushAOF checks if the the client has any dirty markers and
@@ -35,25 +131,51 @@ func (c *client) flushAOF() error {
 	return nil
 }
 
+// storeResult stores the result of a store command in the destination key and
+// replies with the length of the result. The result must be computed in full
+// before it's stored, because the destination may also be a source. An empty
+// result deletes the destination.
+func (c *client) storeResult(key string, value interface{}, n int) {
+	if n == 0 {
+		if _, ok := c.db.del(key); ok {
+			c.dirty++
+		}
+		c.replyInt(0)
+		return
+	}
+	c.db.set(key, value)
+	c.dirty++
+	c.replyInt(n)
+}
+
+// propagate replaces the command that is appended to the aof when the command
+// needs to be written in a different form than it was received.
+func (c *client) propagate(args ...interface{}) {
+	c.raw = buildCommand(args...)
+}
+
 func (c *client) authenticate(cmd *command) bool {
 	if c.authd == 2 {
 		return true
 	}
-	c.s.mu.RLock()
-	defer c.s.mu.RUnlock()
+	auth := c.s.authConfig()
 	if c.authd == 0 {
-		if c.s.protected() {
-			if !strings.HasPrefix(c.addr, "127.0.0.1:") && !strings.HasPrefix(c.addr, "[::1]:") {
+		if auth.protected {
+			if !c.unix && !strings.HasPrefix(c.addr, "127.0.0.1:") && !strings.HasPrefix(c.addr, "[::1]:") {
+				if !c.denied {
+					c.denied = true
+					atomic.AddUint64(&c.s.rejectedConns, 1)
+				}
 				c.replyProtectedError()
 				return false
 			}
 		}
 		c.authd = 1
 	}
-	if c.s.cfg.requirepass == "" {
+	if auth.requirepass == "" {
 		return true
 	}
-	if cmd.name != "auth" {
+	if cmd.name != "auth" && cmd.name != "hello" {
 		c.replyNoAuthError()
 		return false
 	}
@@ -61,45 +183,148 @@ func (c *client) authenticate(cmd *command) bool {
 	return false
 }
 
+// loadingRefused replies with an error and returns true when the command
+// can't run while the aof is loading.
+func (c *client) loadingRefused(cmd *command) bool {
+	if cmd.loading || !c.s.Loading() {
+		return false
+	}
+	c.replyUniqueError("LOADING " + c.s.options.AppName + " is loading the dataset in memory")
+	return true
+}
+
+// replied records the type of the first reply of a command, for the history.
+func (c *client) replied(kind byte) {
+	if c.replyType == 0 {
+		c.replyType = kind
+	}
+}
+
 func (c *client) replyString(s string) {
+	c.replied('+')
 	io.WriteString(c.wr, "+"+s+"\r\n")
 }
+
+// replyUniqueError replies with an error that has its own code, which is the
+// first word of s.
 func (c *client) replyUniqueError(s string) {
-	io.WriteString(c.wr, "-"+s+"\r\n")
-	c.errd = true
+	code, msg := s, ""
+	if i := strings.IndexByte(s, ' '); i != -1 {
+		code, msg = s[:i], s[i+1:]
+	}
+	c.replyErr(&Error{code, msg})
 }
+
+// replyBulk writes the parts of the reply one by one, which doesn't allocate
+// or copy the value, so large replies such as KEYS can be streamed.
 func (c *client) replyBulk(s string) {
-	io.WriteString(c.wr, "$"+strconv.FormatInt(int64(len(s)), 10)+"\r\n"+s+"\r\n")
+	c.replied('$')
+	io.WriteString(c.wr, "$")
+	io.WriteString(c.wr, strconv.FormatInt(int64(len(s)), 10))
+	io.WriteString(c.wr, "\r\n")
+	io.WriteString(c.wr, s)
+	io.WriteString(c.wr, "\r\n")
 }
 func (c *client) replyNull() {
+	c.replied('_')
 	io.WriteString(c.wr, "$-1\r\n")
 }
+
+// replyNullArray replies with the null of the commands that reply with an
+// array.
+func (c *client) replyNullArray() {
+	c.replied('_')
+	io.WriteString(c.wr, "*-1\r\n")
+}
 func (c *client) replyInt(n int) {
+	c.replied(':')
 	io.WriteString(c.wr, ":"+strconv.FormatInt(int64(n), 10)+"\r\n")
 }
+
+// replyBoolOrInt replies with a boolean for RESP3, or with 1 or 0 for RESP2.
+func (c *client) replyBoolOrInt(b bool) {
+	switch {
+	case c.resp == 3 && b:
+		c.replied('#')
+		io.WriteString(c.wr, "#t\r\n")
+	case c.resp == 3:
+		c.replied('#')
+		io.WriteString(c.wr, "#f\r\n")
+	case b:
+		c.replyInt(1)
+	default:
+		c.replyInt(0)
+	}
+}
+
+// formatDouble formats a number like Redis, with the shortest digits that
+// parse back to the number, and with an exponent only when it's below -4 or
+// above 16, as with %.17g.
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if i := strings.IndexByte(s, 'e'); i != -1 {
+		if exp, _ := strconv.Atoi(s[i+1:]); exp >= -4 && exp < 17 {
+			s = strconv.FormatFloat(f, 'f', -1, 64)
+		}
+	}
+	return s
+}
+
+// replyDoubleOrBulk replies with a double for RESP3, or with a bulk string
+// for RESP2. Both are formatted by formatDouble.
+func (c *client) replyDoubleOrBulk(f float64) {
+	s := formatDouble(f)
+	if c.resp == 3 {
+		c.replied(',')
+		io.WriteString(c.wr, ","+s+"\r\n")
+	} else {
+		c.replyBulk(s)
+	}
+}
 func (c *client) replyMultiBulkLen(n int) {
+	c.replied('*')
 	io.WriteString(c.wr, "*"+strconv.FormatInt(int64(n), 10)+"\r\n")
 }
+
+// replyMapLen starts a map of n pairs for RESP3, or an array of the keys and
+// values for RESP2.
+func (c *client) replyMapLen(n int) {
+	if c.resp == 3 {
+		c.replied('%')
+		io.WriteString(c.wr, "%"+strconv.FormatInt(int64(n), 10)+"\r\n")
+	} else {
+		c.replyMultiBulkLen(n * 2)
+	}
+}
 func (c *client) replyError(s string) {
-	c.replyUniqueError("ERR " + s)
+	c.replyErr(&Error{"ERR", s})
 }
 func (c *client) replyAritryError() {
-	c.replyError("wrong number of arguments for '" + c.args[0] + "'")
+	c.replyError("wrong number of arguments for '" + strings.ToLower(c.args[0]) + "' command")
 }
 func (c *client) replyTypeError() {
-	c.replyUniqueError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	c.replyErr(ErrWrongType)
 }
 func (c *client) replyNoAuthError() {
-	c.replyUniqueError("NOAUTH Authentication required.")
+	c.replyErr(ErrNoAuth)
 }
 func (c *client) replySyntaxError() {
-	c.replyError("syntax error")
+	c.replyErr(ErrSyntax)
 }
 func (c *client) replyInvalidIntError() {
-	c.replyError("value is not an integer or out of range")
+	c.replyErr(ErrOutOfRange)
 }
 func (c *client) replyNoSuchKeyError() {
-	c.replyError("no such key")
+	c.replyErr(ErrNoSuchKey)
+}
+func (c *client) replyInvalidExpireError() {
+	c.replyError("invalid expire time in '" + strings.ToLower(c.args[0]) + "' command")
 }
 
 func (c *client) replyProtectedError() {
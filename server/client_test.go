@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProtocolReplies(t *testing.T) {
+	s := &Server{cmds: make(map[string]*command), dbs: make(map[int]*database),
+		cfg: &config{aofCompatLevel: aofFormat}}
+	s.commandTable()
+
+	// Each command runs against a database with "str" set to "value", "set"
+	// holding "a" and "hash" holding "f", and replies with the RESP2 or the
+	// RESP3 reply.
+	tests := []struct {
+		args  []string
+		resp2 string
+		resp3 string
+	}{
+		{[]string{"SISMEMBER", "set", "a"}, ":1\r\n", "#t\r\n"},
+		{[]string{"SISMEMBER", "set", "b"}, ":0\r\n", "#f\r\n"},
+		{[]string{"SISMEMBER", "missing", "a"}, ":0\r\n", "#f\r\n"},
+		{[]string{"SMOVE", "set", "dst", "a"}, ":1\r\n", "#t\r\n"},
+		{[]string{"SMOVE", "set", "dst", "b"}, ":0\r\n", "#f\r\n"},
+		{[]string{"SETNX", "new", "value"}, ":1\r\n", "#t\r\n"},
+		{[]string{"SETNX", "str", "value"}, ":0\r\n", "#f\r\n"},
+		{[]string{"EXPIRE", "str", "100"}, ":1\r\n", "#t\r\n"},
+		{[]string{"EXPIRE", "missing", "100"}, ":0\r\n", "#f\r\n"},
+		{[]string{"EXPIREAT", "str", "4000000000"}, ":1\r\n", "#t\r\n"},
+		{[]string{"EXPIREAT", "missing", "4000000000"}, ":0\r\n", "#f\r\n"},
+		{[]string{"HEXISTS", "hash", "f"}, ":1\r\n", "#t\r\n"},
+		{[]string{"HEXISTS", "hash", "g"}, ":0\r\n", "#f\r\n"},
+		{[]string{"HEXISTS", "missing", "f"}, ":0\r\n", "#f\r\n"},
+		// INCRBYFLOAT replies with the string value, like in Redis
+		{[]string{"INCRBYFLOAT", "new", "1.5"}, "$3\r\n1.5\r\n", "$3\r\n1.5\r\n"},
+	}
+	for _, resp := range []int{2, 3} {
+		for _, tt := range tests {
+			var buf bytes.Buffer
+			db := newDB(0)
+			db.set("str", "value")
+			st := newSet()
+			st.add("a")
+			db.set("set", st)
+			h := newHash()
+			h.set("f", "v")
+			db.set("hash", h)
+			c := &client{wr: &buf, s: s, db: db, args: tt.args, resp: resp}
+			s.cmds[tt.args[0]].funct(c)
+			expect := tt.resp2
+			if resp == 3 {
+				expect = tt.resp3
+			}
+			if buf.String() != expect {
+				t.Fatalf("RESP%d %v: expected %q, got %q", resp, tt.args,
+					expect, buf.String())
+			}
+		}
+	}
+
+	doubles := []struct {
+		f     float64
+		resp2 string
+		resp3 string
+	}{
+		{1.5, "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{3, "$1\r\n3\r\n", ",3\r\n"},
+		{-0.1, "$4\r\n-0.1\r\n", ",-0.1\r\n"},
+		{1e20, "$5\r\n1e+20\r\n", ",1e+20\r\n"},
+		{math.Inf(1), "$3\r\ninf\r\n", ",inf\r\n"},
+		{math.Inf(-1), "$4\r\n-inf\r\n", ",-inf\r\n"},
+	}
+	for _, resp := range []int{2, 3} {
+		for _, tt := range doubles {
+			var buf bytes.Buffer
+			c := &client{wr: &buf, resp: resp}
+			c.replyDoubleOrBulk(tt.f)
+			expect := tt.resp2
+			if resp == 3 {
+				expect = tt.resp3
+			}
+			if buf.String() != expect {
+				t.Fatalf("RESP%d %v: expected %q, got %q", resp, tt.f,
+					expect, buf.String())
+			}
+		}
+	}
+}
+
+func TestClientNoTouchNoEvict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"),
+		"--send-timeout", "100")
+	stop := testServe(t, s, addr)
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+	flags := func() string {
+		info := conn.do("CLIENT", "INFO").(string)
+		i := strings.Index(info, " flags=")
+		return strings.Fields(info[i+7:])[0]
+	}
+	if f := flags(); f != "N" {
+		t.Fatalf("expected 'N', got '%s'", f)
+	}
+
+	// the key was last accessed 100 seconds ago
+	conn.do("SET", "key", "value")
+	idle := func() {
+		s.mu.Lock()
+		s.dbs[0].items["key"].lru = lruClock() - 100
+		s.mu.Unlock()
+	}
+	idle()
+	conn.do("CLIENT", "NO-TOUCH", "ON")
+	conn.do("GET", "key")
+	conn.do("EXISTS", "key")
+	if v, ok := conn.do("OBJECT", "IDLETIME", "key").(int); !ok || v < 100 {
+		t.Fatalf("expected GET to not touch the key, got '%v'", v)
+	}
+	conn.do("TOUCH", "key")
+	if v, ok := conn.do("OBJECT", "IDLETIME", "key").(int); !ok || v > 1 {
+		t.Fatalf("expected TOUCH to touch the key, got '%v'", v)
+	}
+	idle()
+	conn.do("CLIENT", "NO-TOUCH", "OFF")
+	conn.do("GET", "key")
+	if v, ok := conn.do("OBJECT", "IDLETIME", "key").(int); !ok || v > 1 {
+		t.Fatalf("expected GET to touch the key, got '%v'", v)
+	}
+
+	conn.do("CLIENT", "NO-EVICT", "ON")
+	conn.do("CLIENT", "NO-TOUCH", "ON")
+	if f := flags(); f != "eT" {
+		t.Fatalf("expected 'eT', got '%s'", f)
+	}
+	conn.do("SELECT", "1")
+	if v := conn.do("RESET"); v != "RESET" {
+		t.Fatalf("expected 'RESET', got '%v'", v)
+	}
+	if info := conn.do("CLIENT", "INFO").(string); !strings.Contains(info, " flags=N ") ||
+		!strings.Contains(info, " db=0 ") {
+		t.Fatalf("expected the default state, got '%s'", info)
+	}
+
+	// a client that doesn't read its replies is not disconnected by the
+	// send-timeout when it's in NO-EVICT mode
+	value := strings.Repeat("x", 1000)
+	args := []string{"RPUSH", "list"}
+	for i := 0; i < 1000; i++ {
+		args = append(args, value)
+	}
+	conn.do(args...)
+	stalled := testDial(t, addr)
+	defer stalled.close()
+	stalled.do("CLIENT", "NO-EVICT", "ON")
+	for i := 0; i < 100; i++ {
+		stalled.send("LRANGE", "list", "0", "-1")
+	}
+	time.Sleep(time.Millisecond * 500)
+	for i := 0; i < 100; i++ {
+		if reply, err := stalled.read(); err != nil {
+			t.Fatal(err)
+		} else if arr, ok := reply.([]interface{}); !ok || len(arr) != 1000 {
+			t.Fatalf("expected a full reply, got %T", reply)
+		}
+	}
+	if info := conn.do("INFO", "stats").(string); !strings.Contains(info, "send_timeout_disconnections:0\n") {
+		t.Fatalf("expected no disconnections, got\n%s", info)
+	}
+}
+
+func TestClientHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"))
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+	admin := testDial(t, addr)
+	defer admin.close()
+
+	id := strconv.Itoa(conn.do("CLIENT", "ID").(int))
+	conn.do("SET", "key", "value")
+	conn.do("GET", "key")
+	conn.do("INCR", "key")
+	conn.do("MGET", "a", "b", "c", "d", "e", strings.Repeat("k", 100))
+	history := func() []interface{} {
+		return admin.do("DEBUG", "CLIENT", id).([]interface{})
+	}
+	entries := history()
+	if len(entries) != 5 {
+		t.Fatalf("expected 5 entries, got %v", entries)
+	}
+	for i, expect := range []struct {
+		name  string
+		reply string
+	}{
+		{"client", "integer"}, {"set", "status"}, {"get", "bulk"},
+		{"incr", "error"}, {"mget", "array"},
+	} {
+		e := entries[i].([]interface{})
+		if e[0] != expect.name || e[4] != expect.reply {
+			t.Fatalf("entry %d: expected %s %s, got %v", i, expect.name, expect.reply, e)
+		}
+	}
+	if keys := entries[1].([]interface{})[1].([]interface{}); len(keys) != 1 || keys[0] != "key" {
+		t.Fatalf("expected the key, got %v", keys)
+	}
+	if keys := entries[4].([]interface{})[1].([]interface{}); len(keys) != historyMaxKeys {
+		t.Fatalf("expected %d keys, got %v", historyMaxKeys, keys)
+	}
+
+	// the ring keeps the last commands
+	admin.do("CONFIG", "SET", "client-history-len", "2")
+	for i := 0; i < 5; i++ {
+		conn.do("PING")
+	}
+	conn.do("ECHO", "x")
+	if entries := history(); len(entries) != 2 || entries[1].([]interface{})[0] != "echo" {
+		t.Fatalf("expected 2 entries, got %v", entries)
+	}
+	admin.do("CONFIG", "SET", "client-history-len", "0")
+	conn.do("PING")
+	if entries := history(); len(entries) != 0 {
+		t.Fatalf("expected no entries, got %v", entries)
+	}
+	if _, ok := admin.do("DEBUG", "CLIENT", "999999").(error); !ok {
+		t.Fatal("expected an error for a missing client")
+	}
+}
@@ -0,0 +1,153 @@
+//go:build clientlibs
+
+package server
+
+// The handshakes of the client libraries, which are tested against the
+// actual libraries, so this file has its own build tag to keep the default
+// tests free of dependencies:
+//
+//	go test -tags clientlibs -run ClientLibs ./server
+//
+// Each library connects, pings, sets and gets a key and disconnects, with
+// RESP2 and RESP3, and with and without a password. A handshake that fails
+// against sider is a bug of sider, unless the library can't do it against
+// Redis either, like RESP3 with redigo.
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/redis/rueidis"
+)
+
+// testClientLib runs the connect, ping, set, get and disconnect cycle of a
+// library.
+type testClientLib func(t *testing.T, addr, password string, resp int)
+
+func TestClientLibs(t *testing.T) {
+	libs := []struct {
+		name string
+		run  testClientLib
+	}{
+		{"go-redis", testGoRedis},
+		{"redigo", testRedigo},
+		{"rueidis", testRueidis},
+	}
+	for _, lib := range libs {
+		for _, resp := range []int{2, 3} {
+			for _, password := range []string{"", "secret"} {
+				name := lib.name + "/resp" + strconv.Itoa(resp)
+				if password != "" {
+					name += "/password"
+				}
+				run := lib.run
+				t.Run(name, func(t *testing.T) {
+					dir, err := ioutil.TempDir("", "sider-test")
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer os.RemoveAll(dir)
+					var args []string
+					if password != "" {
+						args = append(args, "--requirepass", password)
+					}
+					s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"), args...)
+					stop := testServe(t, s, addr)
+					defer func() {
+						// the SHUTDOWN of stop doesn't authenticate
+						s.Do("CONFIG", "SET", "requirepass", "")
+						stop()
+					}()
+					run(t, addr, password, resp)
+				})
+			}
+		}
+	}
+}
+
+func testGoRedis(t *testing.T, addr, password string, resp int) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	client := goredis.NewClient(&goredis.Options{
+		Addr:     addr,
+		Password: password,
+		Protocol: resp,
+		DB:       1,
+	})
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Set(ctx, "key", "value", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := client.Get(ctx, "key").Result(); err != nil || v != "value" {
+		t.Fatalf("expected 'value', got %q, %v", v, err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testRedigo(t *testing.T, addr, password string, resp int) {
+	opts := []redigo.DialOption{
+		redigo.DialPassword(password),
+		redigo.DialDatabase(1),
+		redigo.DialConnectTimeout(time.Second * 5),
+		redigo.DialReadTimeout(time.Second * 5),
+	}
+	if resp == 3 {
+		// the reader of redigo doesn't know the RESP3 types, starting with
+		// the map reply of HELLO 3
+		t.Skip("redigo speaks RESP2 only")
+	}
+	conn, err := redigo.Dial("tcp", addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if v, err := redigo.String(conn.Do("PING")); err != nil || v != "PONG" {
+		t.Fatalf("expected PONG, got %q, %v", v, err)
+	}
+	if _, err := conn.Do("SET", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := redigo.String(conn.Do("GET", "key")); err != nil || v != "value" {
+		t.Fatalf("expected 'value', got %q, %v", v, err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testRueidis(t *testing.T, addr, password string, resp int) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	client, err := rueidis.NewClient(rueidis.ClientOption{
+		InitAddress:  []string{addr},
+		Password:     password,
+		SelectDB:     1,
+		AlwaysRESP2:  resp == 2,
+		DisableCache: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Do(ctx, client.B().Ping().Build()).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Do(ctx, client.B().Set().Key("key").Value("value").Build()).Error(); err != nil {
+		t.Fatal(err)
+	}
+	v, err := client.Do(ctx, client.B().Get().Key("key").Build()).ToString()
+	if err != nil || v != "value" {
+		t.Fatalf("expected 'value', got %q, %v", v, err)
+	}
+}
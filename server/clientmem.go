@@ -0,0 +1,109 @@
+package server
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// Each connection has a read buffer, the query buffer with the commands that
+// are not complete yet, and a write buffer. Their memory is the tot-mem of
+// CLIENT INFO, and the sum of it over the connections is kept up to date by
+// the connections themselves. When the sum is over maxmemory-clients, the
+// connections that use the most memory are closed, except for the ones with
+// CLIENT NO-EVICT. A reply that's larger than the write buffer is written
+// from the value itself, so it's not counted.
+
+// clientMemory is the memory of the connection buffers of a client.
+type clientMemory struct {
+	qbuf int // bytes of the commands that are not complete
+	rbs  int // size of the read buffer
+	omem int // bytes of the replies that are not written
+	obs  int // size of the write buffer
+}
+
+func (m clientMemory) total() int {
+	return m.qbuf + m.rbs + m.obs + m.omem
+}
+
+// memory returns the memory of the client. Only called by the goroutine of
+// the connection, or by the one that reads for it while it's blocked.
+func (c *client) memory() clientMemory {
+	var m clientMemory
+	if c.rd != nil {
+		m.qbuf = cap(c.rd.buf)
+		m.rbs = len(c.rd.rbuf)
+	}
+	if c.bw != nil {
+		m.obs = c.bw.Size()
+		m.omem = c.bw.Buffered()
+	}
+	if c.cw != nil {
+		m.omem += int(atomic.LoadInt64(&c.cw.pending))
+	}
+	return m
+}
+
+// updateMemory records the memory of the client after its buffers changed,
+// and evicts clients when maxmemory-clients is reached. Must be called
+// without the server lock.
+func (c *client) updateMemory() {
+	var mem int64
+	if atomic.LoadInt32(&c.evicted) == 0 {
+		mem = int64(c.memory().total())
+	}
+	old := atomic.SwapInt64(&c.mem, mem)
+	if old == mem {
+		return
+	}
+	total := atomic.AddInt64(&c.s.clientsMem, mem-old)
+	if limit := atomic.LoadInt64(&c.s.maxMemoryClients); limit > 0 && total > limit {
+		c.s.evictClients(limit)
+	}
+}
+
+// releaseMemory removes the memory of a client that disconnected.
+func (c *client) releaseMemory() {
+	atomic.AddInt64(&c.s.clientsMem, -atomic.SwapInt64(&c.mem, 0))
+}
+
+// evictClients closes the clients that use the most memory until the memory
+// of the clients is below the limit. Must be called without the server lock.
+func (s *Server) evictClients(limit int64) {
+	if !s.clientsEvicting.TryLock() {
+		// another connection is already evicting
+		return
+	}
+	defer s.clientsEvicting.Unlock()
+	s.mu.RLock()
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		if atomic.LoadInt32(&c.evicted) == 0 && atomic.LoadInt32(&c.cw.noEvict) == 0 {
+			clients = append(clients, c)
+		}
+	}
+	s.mu.RUnlock()
+	mems := make(map[*client]int64, len(clients))
+	for _, c := range clients {
+		mems[c] = atomic.LoadInt64(&c.mem)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return mems[clients[i]] > mems[clients[j]]
+	})
+	for _, c := range clients {
+		if atomic.LoadInt64(&s.clientsMem) <= limit {
+			break
+		}
+		if !atomic.CompareAndSwapInt32(&c.evicted, 0, 1) {
+			continue
+		}
+		// the memory is released now, rather than when the connection
+		// goroutine notices the close.
+		mem := atomic.SwapInt64(&c.mem, 0)
+		atomic.AddInt64(&s.clientsMem, -mem)
+		atomic.AddUint64(&s.evictedClients, 1)
+		s.lverbosf("Client id=%d addr=%s evicted, tot-mem=%d exceeds maxmemory-clients",
+			c.id, c.addr, mem)
+		c.cancel()
+		c.cw.conn.Close()
+	}
+}
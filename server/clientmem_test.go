@@ -0,0 +1,84 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"), "--maxmemory-clients", "1mb")
+	stop := testServe(t, s, addr)
+	defer stop()
+
+	// sendPartial sends most of a large SET, which stays in the query
+	// buffer until the rest arrives.
+	sendPartial := func(conn *testConn) {
+		head := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1000000\r\n"
+		if _, err := conn.conn.Write([]byte(head + strings.Repeat("x", 600*1024))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitMem := func(min int) {
+		start := time.Now()
+		for {
+			info, _ := s.Do("INFO", "memory")
+			i := strings.Index(info.(string), "mem_clients_normal:")
+			line := info.(string)[i+len("mem_clients_normal:"):]
+			mem, _ := strconv.Atoi(strings.TrimSpace(line[:strings.IndexByte(line, '\n')]))
+			if mem >= min {
+				return
+			}
+			if time.Since(start) > time.Second*5 {
+				t.Fatalf("expected at least %d bytes of client memory, got %d", min, mem)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	// the no-evict client stays below the limit on its own
+	safe := testDial(t, addr)
+	defer safe.close()
+	if v := safe.do("CLIENT", "NO-EVICT", "ON"); v != "OK" {
+		t.Fatalf("expected 'OK', got '%v'", v)
+	}
+	if info := safe.do("CLIENT", "INFO").(string); !strings.Contains(info, " tot-mem=") {
+		t.Fatalf("expected the client memory, got %q", info)
+	}
+	sendPartial(safe)
+	waitMem(600 * 1024)
+
+	// the second one goes over the limit, and it's the largest client that
+	// can be evicted
+	big := testDial(t, addr)
+	defer big.close()
+	sendPartial(big)
+	big.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := big.read(); err == nil {
+		t.Fatal("expected the client to be evicted")
+	}
+	info, _ := s.Do("INFO", "stats")
+	if !strings.Contains(info.(string), "evicted_clients:1\n") {
+		t.Fatalf("expected one evicted client, got\n%s", info)
+	}
+
+	// the no-evict client finishes its command
+	if _, err := safe.conn.Write([]byte(strings.Repeat("x", 1000000-600*1024) + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := safe.read(); err != nil || v != "OK" {
+		t.Fatalf("expected 'OK', got '%v', %v", v, err)
+	}
+	if v, err := s.Do("GET", "k"); err != nil || len(v.(string)) != 1000000 {
+		t.Fatalf("expected the value, got %v", err)
+	}
+}
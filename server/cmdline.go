@@ -0,0 +1,114 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CommandLine is the parsed command line of the server.
+type CommandLine struct {
+	ConfigFile  string            // the config file, the first argument that's not an option
+	Directives  map[string]string // config directives, options override the config file
+	SanityCheck bool              // --sanity-check
+	Help        bool              // -h or --help
+	Version     bool              // -v or --version
+}
+
+// ParseCommandLine parses the command line arguments of the server. Any
+// config directive can be passed as an option, such as "--port 7777", and
+// options always override the directives in the config file no matter the
+// order of the arguments. The directives are validated, which allows for a
+// command line to be checked before starting a server. The error describes
+// all of the problems that were found.
+func ParseCommandLine(args []string) (*CommandLine, error) {
+	cl := &CommandLine{Directives: make(map[string]string)}
+	var names []string
+	values := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "-h", "--help":
+			cl.Help = true
+			return cl, nil
+		case "-v", "--version":
+			cl.Version = true
+			return cl, nil
+		case "--sanity-check":
+			cl.SanityCheck = true
+			continue
+		}
+		if !strings.HasPrefix(arg, "--") {
+			if cl.ConfigFile != "" {
+				return nil, fmt.Errorf("unexpected argument '%s', the config file "+
+					"is '%s' and options must start with '--'", arg, cl.ConfigFile)
+			}
+			cl.ConfigFile = arg
+			continue
+		}
+		name := strings.ToLower(arg[2:])
+		if findConfigProperty(name) == nil {
+			return nil, fmt.Errorf("unknown option '%s', see --help", arg)
+		}
+		if i+1 == len(args) || strings.HasPrefix(args[i+1], "--") {
+			return nil, fmt.Errorf("option '%s' requires a value", arg)
+		}
+		i++
+		if _, ok := values[name]; !ok {
+			names = append(names, name)
+		}
+		values[name] = args[i]
+	}
+	if cl.ConfigFile != "" {
+		if err := readConfigFile(cl.ConfigFile, cl.Directives); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range names {
+		cl.Directives[name] = values[name]
+	}
+	if err := cl.validate(); err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+// validate checks the directives and the combinations of directives.
+func (cl *CommandLine) validate() error {
+	cfg := &config{}
+	var errs []string
+	valid := true
+	for _, prop := range configProperties {
+		value, ok := cl.Directives[prop.name]
+		if !ok {
+			value = prop.def
+		}
+		if _, err := prop.set(cfg, value); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid value '%s' for '%s': %v",
+				value, prop.name, err))
+			valid = false
+		}
+	}
+	if cfg.dir != "" {
+		fi, err := os.Stat(cfg.dir)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("can't use dir '%s': %v", cfg.dir, err))
+		} else if !fi.IsDir() {
+			errs = append(errs, fmt.Sprintf("can't use dir '%s': not a directory", cfg.dir))
+		}
+	}
+	if cl.SanityCheck && !cfg.appendOnly {
+		errs = append(errs, "--sanity-check checks the append only file, "+
+			"which is disabled by 'appendonly no'")
+	}
+	if valid {
+		// the rules can't be checked against a value that was refused
+		rerrs, _ := checkConfig(cfg, nil)
+		errs = append(errs, rerrs...)
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
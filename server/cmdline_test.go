@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCommandLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, "sider.conf")
+	err = ioutil.WriteFile(conf, []byte("port 7000\nrequirepass filepass\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badconf := filepath.Join(dir, "bad.conf")
+	if err := ioutil.WriteFile(badconf, []byte("port\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args   []string
+		expect map[string]string // expected directives
+		err    string            // expected error prefix
+	}{
+		{[]string{}, map[string]string{}, ""},
+		{[]string{conf}, map[string]string{"port": "7000", "requirepass": "filepass"}, ""},
+		{[]string{conf, "--port", "7001"}, map[string]string{"port": "7001", "requirepass": "filepass"}, ""},
+		{[]string{"--port", "7001", conf}, map[string]string{"port": "7001", "requirepass": "filepass"}, ""},
+		{[]string{"--port", "7001", "--port", "7002"}, map[string]string{"port": "7002"}, ""},
+		{[]string{"--PORT", "7001", "--dir", dir}, map[string]string{"port": "7001", "dir": dir}, ""},
+		{[]string{"--appendonly", "no", "--unixsocket", "/tmp/s.sock"}, map[string]string{"appendonly": "no", "unixsocket": "/tmp/s.sock"}, ""},
+		{[]string{"--port"}, nil, "option '--port' requires a value"},
+		{[]string{"--port", "--bind", "127.0.0.1"}, nil, "option '--port' requires a value"},
+		{[]string{"--port", "abc"}, nil, "invalid value 'abc' for 'port'"},
+		{[]string{"--appendonly", "maybe"}, nil, "invalid value 'maybe' for 'appendonly'"},
+		{[]string{"--tls-cert-file", "cert.pem"}, nil, "unknown option '--tls-cert-file'"},
+		{[]string{conf, "other.conf"}, nil, "unexpected argument 'other.conf'"},
+		{[]string{filepath.Join(dir, "missing.conf")}, nil, "can't open config file"},
+		{[]string{badconf}, nil, "bad directive or wrong number of arguments at line 1"},
+		{[]string{"--dir", filepath.Join(dir, "missing")}, nil, "can't use dir"},
+		{[]string{"--dir", conf}, nil, "can't use dir"},
+		{[]string{"--sanity-check", "--appendonly", "no"}, nil, "--sanity-check checks the append only file"},
+	}
+	for _, tt := range tests {
+		cl, err := ParseCommandLine(tt.args)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Fatalf("%v: expected error '%s', got %v", tt.args, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", tt.args, err)
+		}
+		if len(cl.Directives) != len(tt.expect) {
+			t.Fatalf("%v: expected %v, got %v", tt.args, tt.expect, cl.Directives)
+		}
+		for name, value := range tt.expect {
+			if cl.Directives[name] != value {
+				t.Fatalf("%v: expected %v, got %v", tt.args, tt.expect, cl.Directives)
+			}
+		}
+	}
+
+	cl, err := ParseCommandLine([]string{conf, "--sanity-check"})
+	if err != nil || !cl.SanityCheck || cl.ConfigFile != conf {
+		t.Fatalf("unexpected %+v, %v", cl, err)
+	}
+	for _, arg := range []string{"-h", "--help"} {
+		if cl, err := ParseCommandLine([]string{arg, "--bad"}); err != nil || !cl.Help {
+			t.Fatalf("%s: unexpected %+v, %v", arg, cl, err)
+		}
+	}
+	for _, arg := range []string{"-v", "--version"} {
+		if cl, err := ParseCommandLine([]string{arg}); err != nil || !cl.Version {
+			t.Fatalf("%s: unexpected %+v, %v", arg, cl, err)
+		}
+	}
+}
+
+func TestDirAppendOnlyUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "sider.sock")
+
+	// the aof is in dir
+	addr, stop := testStartServer(t, "appendonly.aof", "--dir", dir,
+		"--unixsocket", sock)
+	conn := testDial(t, addr)
+	conn.do("SET", "key", "value")
+	conn.close()
+	uconn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = &testConn{t: t, conn: uconn, rd: bufio.NewReader(uconn)}
+	if v := conn.do("GET", "key"); v != "value" {
+		t.Fatalf("expected value, got %v", v)
+	}
+	conn.close()
+	stop()
+	if _, err := os.Stat(filepath.Join(dir, "appendonly.aof")); err != nil {
+		t.Fatal(err)
+	}
+
+	// no aof
+	aofPath := filepath.Join(dir, "disabled.aof")
+	addr, stop = testStartServer(t, aofPath, "--appendonly", "no")
+	conn = testDial(t, addr)
+	conn.do("SET", "key", "value")
+	if err, ok := conn.do("BGREWRITEAOF").(error); !ok ||
+		err.Error() != "ERR The append only file is disabled" {
+		t.Fatalf("expected an error, got %v", err)
+	}
+	if !strings.Contains(conn.do("INFO", "persistence").(string), "aof_enabled:0\n") {
+		t.Fatal("expected aof_enabled:0")
+	}
+	conn.close()
+	stop()
+	if _, err := os.Stat(aofPath); !os.IsNotExist(err) {
+		t.Fatalf("expected no aof, got %v", err)
+	}
+}
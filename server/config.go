@@ -2,11 +2,14 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
+	"runtime"
 	"strconv"
 	"strings"
 )
@@ -17,6 +20,58 @@ type config struct {
 	bindIsLocal   bool
 	protectedMode bool
 	requirepass   string
+	logfile       string
+	dir           string
+	appendOnly    bool
+	appendFsync   string // always, everysec, or no
+	stopWrites    bool   // stop-writes-on-bgsave-error
+	unixSocket    string
+
+	aofLoadMode    string // strict or tolerant
+	aofCompatLevel int    // the aof format of the rewrites
+
+	activeDefrag         bool
+	activeDefragCycleMax int
+
+	auditLog        bool
+	auditLogFile    string
+	auditLogMaxSize int
+
+	maxKeys int
+
+	maxMemory        int    // bytes, 0 for no limit
+	maxMemoryPolicy  string // see evictionPolicies
+	maxMemorySamples int
+
+	evictionExemptPatterns []*pattern // keys that are never evicted
+	evictionExemptDBs      []int      // databases that are never evicted
+
+	aclLogMaxLen int
+
+	sendTimeout int // milliseconds, 0 for no timeout
+
+	handshakeTimeout int // milliseconds until the first command, 0 for no timeout
+	maxClientsPerIP  int // connections per source ip, 0 for no limit
+
+	clientHistoryLen int // commands kept per client, 0 to disable
+
+	watchdogPeriod int // milliseconds a command may hold the write lock, 0 to disable
+
+	maxMemoryClients int // bytes of the connection buffers of all clients, 0 for no limit
+
+	tombstoneRetention int // seconds that DEL tombstones are kept, 0 to disable
+
+	keysMaxResults int // keys that KEYS may reply with, 0 for no limit
+
+	hotkeysWindow    int // seconds of the HOTKEYS window
+	hotkeysWarnShare int // percent of the commands that warns about a key, 0 to disable
+
+	compatRedisVersion string // the Redis version that's advertised to clients
+
+	enableDebugCommand string // yes, no, or local
+
+	readThroughPatterns []*pattern
+	writeBehindPatterns []*pattern
 
 	kvm  map[string]string
 	file string
@@ -32,17 +87,287 @@ func (err *cfgerr) Error() string {
 	return fmt.Sprintf("Fatal config file error: '%s \"%s\"': %s", err.property, err.value, err.message)
 }
 
-func fillBoolConfigOption(configMap map[string]string, configKey string, defaultValue bool) {
-	switch strings.ToLower(configMap[configKey]) {
-	default:
-		if defaultValue {
-			configMap[configKey] = "yes"
+// configProperty describes a single config directive. The set function
+// validates the value and assigns it to the config. It returns the normalized
+// value that is stored in the config kvm.
+type configProperty struct {
+	name    string
+	def     string // the default value
+	mutable bool   // the value can be changed at runtime by CONFIG SET
+	set     func(cfg *config, value string) (string, error)
+}
+
+// configProperties is the table of all supported config directives.
+var configProperties = []*configProperty{
+	{name: "port", def: "6379", set: func(cfg *config, value string) (string, error) {
+		n, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return "", errors.New("Invalid port")
+		}
+		cfg.port = int(n)
+		return value, nil
+	}},
+	{name: "bind", set: func(cfg *config, value string) (string, error) {
+		cfg.bind = strings.ToLower(value)
+		cfg.bindIsLocal = cfg.bind == "" || cfg.bind == "127.0.0.1" || cfg.bind == "::1" || cfg.bind == "localhost"
+		return value, nil
+	}},
+	boolConfigProperty("protected-mode", "yes", true, func(cfg *config) *bool { return &cfg.protectedMode }),
+	{name: "requirepass", mutable: true, set: func(cfg *config, value string) (string, error) {
+		cfg.requirepass = value
+		return value, nil
+	}},
+	{name: "logfile", set: func(cfg *config, value string) (string, error) {
+		cfg.logfile = value
+		return value, nil
+	}},
+	{name: "dir", set: func(cfg *config, value string) (string, error) {
+		cfg.dir = value
+		return value, nil
+	}},
+	boolConfigProperty("appendonly", "yes", false, func(cfg *config) *bool { return &cfg.appendOnly }),
+	enumConfigProperty("appendfsync", "everysec", true, []string{"always", "everysec", "no"}, func(cfg *config) *string { return &cfg.appendFsync }),
+	enumConfigProperty("aof-load-mode", "strict", false, []string{"strict", "tolerant"}, func(cfg *config) *string { return &cfg.aofLoadMode }),
+	intConfigProperty("aof-compat-level", strconv.Itoa(aofFormat), true, 1, aofFormat, func(cfg *config) *int { return &cfg.aofCompatLevel }),
+	boolConfigProperty("stop-writes-on-bgsave-error", "yes", true, func(cfg *config) *bool { return &cfg.stopWrites }),
+	{name: "unixsocket", set: func(cfg *config, value string) (string, error) {
+		cfg.unixSocket = value
+		return value, nil
+	}},
+	boolConfigProperty("activedefrag", "no", true, func(cfg *config) *bool { return &cfg.activeDefrag }),
+	intConfigProperty("active-defrag-cycle-max", "25", true, 1, 99, func(cfg *config) *int { return &cfg.activeDefragCycleMax }),
+	boolConfigProperty("audit-log", "no", true, func(cfg *config) *bool { return &cfg.auditLog }),
+	{name: "audit-log-file", def: "audit.log", set: func(cfg *config, value string) (string, error) {
+		cfg.auditLogFile = value
+		return value, nil
+	}},
+	intConfigProperty("audit-log-max-size", "67108864", true, 1024, math.MaxInt32, func(cfg *config) *int { return &cfg.auditLogMaxSize }),
+	intConfigProperty("maxkeys", "0", true, 0, math.MaxInt32, func(cfg *config) *int { return &cfg.maxKeys }),
+	intConfigProperty("keys-max-results", "0", true, 0, math.MaxInt32, func(cfg *config) *int { return &cfg.keysMaxResults }),
+	intConfigProperty("hotkeys-window", "60", true, 1, 86400, func(cfg *config) *int { return &cfg.hotkeysWindow }),
+	intConfigProperty("hotkeys-warn-share", "0", true, 0, 100, func(cfg *config) *int { return &cfg.hotkeysWarnShare }),
+	memoryConfigProperty("maxmemory", "0", true, func(cfg *config) *int { return &cfg.maxMemory }),
+	memoryConfigProperty("maxmemory-clients", "0", true, func(cfg *config) *int { return &cfg.maxMemoryClients }),
+	{name: "maxmemory-policy", def: "noeviction", mutable: true, set: func(cfg *config, value string) (string, error) {
+		value = strings.ToLower(value)
+		for _, policy := range evictionPolicies {
+			if policy == value {
+				cfg.maxMemoryPolicy = value
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("argument must be one of %s", strings.Join(evictionPolicies, ", "))
+	}},
+	intConfigProperty("maxmemory-samples", "5", true, 1, 64, func(cfg *config) *int { return &cfg.maxMemorySamples }),
+	intConfigProperty("tombstone-retention", "0", true, 0, math.MaxInt32, func(cfg *config) *int { return &cfg.tombstoneRetention }),
+	patternsConfigProperty("eviction-exempt-patterns", func(cfg *config) *[]*pattern { return &cfg.evictionExemptPatterns }),
+	{name: "eviction-exempt-dbs", mutable: true, set: func(cfg *config, value string) (string, error) {
+		fields := strings.Fields(value)
+		dbs := make([]int, len(fields))
+		for i, field := range fields {
+			n, err := strconv.ParseUint(field, 10, 31)
+			if err != nil {
+				return "", errors.New("argument must be a list of database numbers")
+			}
+			dbs[i] = int(n)
+		}
+		cfg.evictionExemptDBs = dbs
+		return strings.Join(fields, " "), nil
+	}},
+	intConfigProperty("send-timeout", "60000", true, 0, math.MaxInt32, func(cfg *config) *int { return &cfg.sendTimeout }),
+	intConfigProperty("handshake-timeout", "30000", true, 0, math.MaxInt32, func(cfg *config) *int { return &cfg.handshakeTimeout }),
+	intConfigProperty("maxclients-per-ip", "0", true, 0, math.MaxInt32, func(cfg *config) *int { return &cfg.maxClientsPerIP }),
+	intConfigProperty("acllog-max-len", "128", true, 0, math.MaxInt32, func(cfg *config) *int { return &cfg.aclLogMaxLen }),
+	intConfigProperty("client-history-len", "16", true, 0, historyMaxLen, func(cfg *config) *int { return &cfg.clientHistoryLen }),
+	intConfigProperty("watchdog-period", "0", true, 0, math.MaxInt32, func(cfg *config) *int { return &cfg.watchdogPeriod }),
+	{name: "compat-redis-version", def: defaultCompatRedisVersion, mutable: true, set: func(cfg *config, value string) (string, error) {
+		value, err := parseCompatRedisVersion(value)
+		if err != nil {
+			return "", err
+		}
+		cfg.compatRedisVersion = value
+		return value, nil
+	}},
+	enumConfigProperty("enable-debug-command", "no", false, []string{"yes", "no", "local"}, func(cfg *config) *string { return &cfg.enableDebugCommand }),
+	patternsConfigProperty("read-through-patterns", func(cfg *config) *[]*pattern { return &cfg.readThroughPatterns }),
+	patternsConfigProperty("write-behind-patterns", func(cfg *config) *[]*pattern { return &cfg.writeBehindPatterns }),
+}
+
+func boolConfigProperty(name, def string, mutable bool, field func(cfg *config) *bool) *configProperty {
+	return &configProperty{name: name, def: def, mutable: mutable,
+		set: func(cfg *config, value string) (string, error) {
+			switch strings.ToLower(value) {
+			default:
+				return "", errors.New("argument must be 'yes' or 'no'")
+			case "yes":
+				*field(cfg) = true
+				return "yes", nil
+			case "no":
+				*field(cfg) = false
+				return "no", nil
+			}
+		},
+	}
+}
+
+func intConfigProperty(name, def string, mutable bool, min, max int, field func(cfg *config) *int) *configProperty {
+	return &configProperty{name: name, def: def, mutable: mutable,
+		set: func(cfg *config, value string) (string, error) {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < int64(min) || n > int64(max) {
+				return "", fmt.Errorf("argument must be between %d and %d", min, max)
+			}
+			*field(cfg) = int(n)
+			return value, nil
+		},
+	}
+}
+
+// enumConfigProperty is one of a fixed set of lowercase values.
+func enumConfigProperty(name, def string, mutable bool, values []string, field func(cfg *config) *string) *configProperty {
+	return &configProperty{name: name, def: def, mutable: mutable,
+		set: func(cfg *config, value string) (string, error) {
+			value = strings.ToLower(value)
+			for _, v := range values {
+				if v == value {
+					*field(cfg) = value
+					return value, nil
+				}
+			}
+			return "", fmt.Errorf("argument must be one of %s", strings.Join(values, ", "))
+		},
+	}
+}
+
+// memoryConfigProperty is a number of bytes, which may have a unit such as
+// "100mb". The value is normalized to bytes.
+func memoryConfigProperty(name, def string, mutable bool, field func(cfg *config) *int) *configProperty {
+	return &configProperty{name: name, def: def, mutable: mutable,
+		set: func(cfg *config, value string) (string, error) {
+			num := strings.ToLower(value)
+			mul := int64(1)
+			for _, unit := range []struct {
+				suffix string
+				mul    int64
+			}{
+				{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+				{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+				{"b", 1},
+			} {
+				if strings.HasSuffix(num, unit.suffix) {
+					num, mul = num[:len(num)-len(unit.suffix)], unit.mul
+					break
+				}
+			}
+			n, err := strconv.ParseInt(num, 10, 64)
+			if err != nil || n < 0 || n > math.MaxInt64/mul {
+				return "", errors.New("argument must be a memory value")
+			}
+			*field(cfg) = int(n * mul)
+			return strconv.FormatInt(n*mul, 10), nil
+		},
+	}
+}
+
+// patternsConfigProperty is a mutable list of space separated glob patterns.
+func patternsConfigProperty(name string, field func(cfg *config) *[]*pattern) *configProperty {
+	return &configProperty{name: name, mutable: true,
+		set: func(cfg *config, value string) (string, error) {
+			values := strings.Fields(value)
+			patterns := make([]*pattern, len(values))
+			for i, value := range values {
+				patterns[i] = parsePattern(value)
+			}
+			*field(cfg) = patterns
+			return strings.Join(values, " "), nil
+		},
+	}
+}
+
+// configRule is a constraint between config directives. The check returns
+// what to change when the config breaks the rule, or an empty string. A config
+// that breaks an error rule is refused, and a warning is only logged.
+type configRule struct {
+	names []string // the directives of the rule
+	warn  bool
+	check func(cfg *config) string
+}
+
+// configRules are the constraints between the directives. They are checked
+// over the whole config, at startup and by CONFIG SET.
+var configRules = []*configRule{
+	{[]string{"appendfsync", "appendonly"}, false, func(cfg *config) string {
+		if cfg.appendFsync == "always" && !cfg.appendOnly {
+			return "'appendfsync always' requires 'appendonly yes', " +
+				"set 'appendfsync everysec' or enable the append only file"
+		}
+		return ""
+	}},
+	{[]string{"maxmemory-clients", "maxmemory"}, false, func(cfg *config) string {
+		if cfg.maxMemory > 0 && cfg.maxMemoryClients >= cfg.maxMemory {
+			return fmt.Sprintf("'maxmemory-clients' (%d) must be lower than "+
+				"'maxmemory' (%d), or the clients may use all of the memory",
+				cfg.maxMemoryClients, cfg.maxMemory)
+		}
+		return ""
+	}},
+	{[]string{"tombstone-retention", "aof-compat-level"}, true, func(cfg *config) string {
+		if cfg.tombstoneRetention > 0 && cfg.aofCompatLevel < aofCommandFormat("tombstone") {
+			return fmt.Sprintf("the tombstones of 'tombstone-retention' are "+
+				"not written to the aof at 'aof-compat-level %d', so they are "+
+				"lost on a restart", cfg.aofCompatLevel)
+		}
+		return ""
+	}},
+	{[]string{"maxmemory-policy", "maxmemory"}, true, func(cfg *config) string {
+		if cfg.maxMemoryPolicy != "noeviction" && cfg.maxMemory == 0 {
+			return fmt.Sprintf("'maxmemory-policy %s' has no effect until "+
+				"'maxmemory' is set", cfg.maxMemoryPolicy)
+		}
+		return ""
+	}},
+	{[]string{"eviction-exempt-patterns", "eviction-exempt-dbs", "maxmemory-policy"}, true, func(cfg *config) string {
+		if (len(cfg.evictionExemptPatterns) > 0 || len(cfg.evictionExemptDBs) > 0) &&
+			cfg.maxMemoryPolicy == "noeviction" {
+			return "'eviction-exempt-patterns' and 'eviction-exempt-dbs' " +
+				"have no effect with 'maxmemory-policy noeviction'"
+		}
+		return ""
+	}},
+}
+
+// checkConfig checks the rules of the directives in names, or all of the
+// rules when names is nil.
+func checkConfig(cfg *config, names map[string]bool) (errs, warns []string) {
+	for _, rule := range configRules {
+		if names != nil {
+			var ok bool
+			for _, name := range rule.names {
+				ok = ok || names[name]
+			}
+			if !ok {
+				continue
+			}
+		}
+		if msg := rule.check(cfg); msg == "" {
+			continue
+		} else if rule.warn {
+			warns = append(warns, msg)
 		} else {
-			configMap[configKey] = "no"
+			errs = append(errs, msg)
+		}
+	}
+	return errs, warns
+}
+
+func findConfigProperty(name string) *configProperty {
+	name = strings.ToLower(name)
+	for _, prop := range configProperties {
+		if prop.name == name {
+			return prop
 		}
-	case "yes", "no":
-		configMap[configKey] = strings.ToLower(configMap[configKey])
 	}
+	return nil
 }
 
 // fillOptions takes makes sure that the options are sane and
@@ -66,7 +391,10 @@ func fillOptions(options *Options) (
 		options.AppName = "Sider"
 	}
 	if options.Version == "" {
-		options.Version = "999.999.9999"
+		options.Version, _, _ = buildInfo()
+		if options.Version == "" {
+			options.Version = "999.999.9999"
+		}
 	}
 	if len(options.Args) > 0 {
 		configMap, configFile, ok = loadConfigArgs(options)
@@ -77,20 +405,12 @@ func fillOptions(options *Options) (
 	if configMap == nil {
 		configMap = map[string]string{}
 	}
-	// force valid strings into each config property
-	s := func(s string) string {
-		return s
-	}
-	configMap["bind"] = s(configMap["bind"])
-	configMap["port"] = s(configMap["port"])
-	configMap["protected-mode"] = s(configMap["protected-mode"])
-	configMap["requirepass"] = s(configMap["requirepass"])
-
 	// defaults
-	if configMap["port"] == "" {
-		configMap["port"] = "6379"
+	for _, prop := range configProperties {
+		if configMap[prop.name] == "" {
+			configMap[prop.name] = prop.def
+		}
 	}
-	fillBoolConfigOption(configMap, "protected-mode", true)
 	return options, configMap, configFile, true
 }
 
@@ -98,88 +418,133 @@ func fillConfig(configMap map[string]string, configFile string) (*config, error)
 	cfg := &config{}
 	cfg.file = configFile
 	cfg.kvm = configMap
-	n, err := strconv.ParseUint(configMap["port"], 10, 16)
-	if err != nil {
-		return nil, &cfgerr{"Invalid port", "port", configMap["port"]}
-	}
-	cfg.port = int(n)
-	cfg.bind = strings.ToLower(configMap["bind"])
-	cfg.bindIsLocal = cfg.bind == "" || cfg.bind == "127.0.0.1" || cfg.bind == "::1" || cfg.bind == "localhost"
-	switch strings.ToLower(configMap["protected-mode"]) {
-	default:
-		return nil, &cfgerr{"argument must be 'yes' or 'no'", "protected-mode", configMap["protected-mode"]}
-	case "yes":
-		cfg.protectedMode = true
-	case "no":
-		cfg.protectedMode = false
-	}
-	cfg.requirepass = configMap["requirepass"]
+	for _, prop := range configProperties {
+		value, err := prop.set(cfg, configMap[prop.name])
+		if err != nil {
+			return nil, &cfgerr{err.Error(), prop.name, configMap[prop.name]}
+		}
+		configMap[prop.name] = value
+	}
+	if errs, _ := checkConfig(cfg, nil); len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
 	return cfg, nil
 }
 
-func loadConfigArgs(options *Options) (config map[string]string, file string, ok bool) {
-	config = make(map[string]string)
-	ln := 2
-	for i := 0; i < len(options.Args); i++ {
-		arg := options.Args[i]
-		switch arg {
-		default:
-			if file == "" && !strings.HasPrefix(arg, "--") {
-				file = arg
-				var ok bool
-				ln, ok = readConfigFile(file, config, options)
-				if !ok {
-					return nil, "", false
-				}
-				continue
-			}
-			i++
-			var vals []string
-			for ; i < len(options.Args); i++ {
-				if strings.HasPrefix(options.Args[i], "--") {
-					break
-				}
-				vals = append(vals, options.Args[i])
-			}
-			i += len(vals)
-			if strings.HasPrefix(arg, "--") {
-				arg = arg[2:]
-			}
-			switch arg {
-			default:
-				printBadConfig(arg, vals, ln, options)
-				return nil, "", false
-			case "port":
-				if len(vals) != 1 {
-					printBadConfig(arg, vals, ln, options)
-					return nil, "", false
-				}
-				config["port"] = vals[0]
-			case "bind":
-				if len(vals) != 1 {
-					printBadConfig(arg, vals, ln, options)
-					return nil, "", false
-				}
-				config["port"] = vals[0]
+// setConfig validates and assigns config directives at runtime, as name and
+// value pairs. This is the path used by CONFIG SET and by ReloadConfig. The
+// pairs are assigned together, and none of them are assigned when a value is
+// invalid or when the new config breaks a configRule. The error has all of
+// the problems that were found.
+func (s *Server) setConfig(pairs ...string) error {
+	ncfg := *s.cfg
+	names := make(map[string]bool)
+	values := make(map[string]string)
+	var errs []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		name, value := pairs[i], pairs[i+1]
+		prop := findConfigProperty(name)
+		if prop == nil || !prop.mutable {
+			errs = append(errs, "Unsupported CONFIG parameter: "+name)
+			continue
+		}
+		if names[prop.name] {
+			errs = append(errs, "Duplicate parameter: "+name)
+			continue
+		}
+		names[prop.name] = true
+		nvalue, err := prop.set(&ncfg, value)
+		if err != nil {
+			errs = append(errs, "Invalid argument '"+value+"' for CONFIG SET '"+name+"'")
+			continue
+		}
+		values[prop.name] = nvalue
+	}
+	var warns []string
+	if len(errs) == 0 {
+		errs, warns = checkConfig(&ncfg, names)
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	for _, warn := range warns {
+		s.lwarningf("Config warning: %s", warn)
+	}
+	*s.cfg = ncfg
+	for name, value := range values {
+		s.cfg.kvm[name] = value
+	}
+	s.configChanged()
+	return nil
+}
+
+// ReloadConfig reopens the log file and re-reads the config file. Directives
+// that can be changed at runtime are applied using the same validation as
+// CONFIG SET. Changes to any other directive are logged and ignored.
+func (s *Server) ReloadConfig() error {
+	if s.logfile != nil {
+		if err := s.logfile.reopen(); err != nil {
+			s.lwarningf("Can't reopen the log file: %v", err)
+			return err
+		}
+	}
+	if s.cfg.file == "" {
+		return nil
+	}
+	configMap := make(map[string]string)
+	if err := readConfigFile(s.cfg.file, configMap); err != nil {
+		s.lwarningf("Can't reload the config, %v", err)
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ferr error
+	for _, prop := range configProperties {
+		value, ok := configMap[prop.name]
+		if !ok || value == s.cfg.kvm[prop.name] {
+			continue
+		}
+		if !prop.mutable {
+			s.lwarningf("Ignoring '%s' in config file, a restart is required to change it", prop.name)
+			continue
+		}
+		if err := s.setConfig(prop.name, value); err != nil {
+			s.lwarningf("%v", err)
+			if ferr == nil {
+				ferr = err
 			}
-			ln++
-		case "--help", "-h":
-			printHelp(options)
-			return nil, "", false
-		case "--version", "-v":
-			printVersion(options)
-			return nil, "", false
 		}
 	}
-	return config, file, true
+	s.lnoticef("Config file reloaded")
+	return ferr
 }
 
-func readConfigFile(file string, config map[string]string, options *Options) (int, bool) {
+func loadConfigArgs(options *Options) (config map[string]string, file string, ok bool) {
+	cl, err := ParseCommandLine(options.Args)
+	if err != nil {
+		log(options.LogWriter, '#', "Fatal config error, %v", err)
+		return nil, "", false
+	}
+	switch {
+	case cl.Help:
+		printHelp(options)
+		return nil, "", false
+	case cl.Version:
+		printVersion(options)
+		return nil, "", false
+	}
+	if cl.SanityCheck {
+		options.SanityCheck = true
+	}
+	return cl.Directives, cl.ConfigFile, true
+}
+
+// readConfigFile reads the directives in a config file into config.
+func readConfigFile(file string, config map[string]string) error {
 	ln := 0
 	f, err := os.Open(file)
 	if err != nil {
-		log(options.LogWriter, '#', "Fatal error, can't open config file '"+file+"'")
-		return 0, false
+		return fmt.Errorf("can't open config file '%s'", file)
 	}
 	defer f.Close()
 	rd := bufio.NewReader(f)
@@ -187,8 +552,7 @@ func readConfigFile(file string, config map[string]string, options *Options) (in
 		ln++
 		lineb, err := rd.ReadBytes('\n')
 		if err != nil && err != io.EOF {
-			log(options.LogWriter, '#', "Fatal error, can't open config file '"+file+"'")
-			return 0, false
+			return fmt.Errorf("can't read config file '%s'", file)
 		}
 		if len(lineb) == 0 {
 			break
@@ -208,23 +572,18 @@ func readConfigFile(file string, config map[string]string, options *Options) (in
 			arg = line[:sp]
 			val = strings.TrimSpace(line[sp:])
 		}
+		arg = strings.ToLower(arg)
 		config[arg] = val
-		switch arg {
-		default:
-			printBadConfig(line, nil, ln, options)
-			return 0, false
-		case "port", "protected-mode", "bind", "requirepass":
-			if val == "" {
-				printBadConfig(line, nil, ln, options)
-				return 0, false
-			}
+		if findConfigProperty(arg) == nil || val == "" {
+			return fmt.Errorf("bad directive or wrong number of arguments "+
+				"at line %d of '%s': '%s'", ln, file, line)
 		}
 		if err == io.EOF {
 			break
 		}
 
 	}
-	return ln + 1, true
+	return nil
 }
 
 func mergeConfigFile(file string, config map[string]string) error {
@@ -267,22 +626,15 @@ func printHelp(options *Options) {
 	       ./`+base+` /etc/`+strings.ToLower(options.AppName)+`/9851.conf
 	       ./`+base+` --port 7777
 	       ./`+base+` /etc/my`+strings.ToLower(options.AppName)+`.conf --loglevel verbose
+	       ./`+base+` /etc/my`+strings.ToLower(options.AppName)+`.conf --sanity-check
+	       ./`+base+` --dir /var/lib/`+strings.ToLower(options.AppName)+` --unixsocket /tmp/`+strings.ToLower(options.AppName)+`.sock
+
+	Options override the directives in the config file.
 	`)+"\n")
 }
 
 func printVersion(options *Options) {
-	fmt.Fprintf(options.LogWriter, "%s server v=%s", options.AppName, options.Version)
-}
-
-func printBadConfig(prop string, vals []string, ln int, options *Options) {
-	msg := prop
-	for _, val := range vals {
-		msg += " \"" + val + "\""
-	}
-	fmt.Fprintf(options.LogWriter, `
-*** FATAL CONFIG FILE ERROR ***
-Reading the configuration file, at line %d
->>> '%s'
-Bad directive or wrong number of arguments
-`, ln, msg)
+	_, sha, date := buildInfo()
+	fmt.Fprintf(options.LogWriter, "%s server v=%s sha=%s go=%s build=%s\n",
+		options.AppName, options.Version, sha, runtime.Version(), date)
 }
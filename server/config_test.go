@@ -0,0 +1,210 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	confPath := filepath.Join(dir, "sider.conf")
+	logPath := filepath.Join(dir, "sider.log")
+	writeConf := func(lines ...string) {
+		lines = append(lines, "logfile "+logPath)
+		err := ioutil.WriteFile(confPath, []byte(strings.Join(lines, "\n")), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	readLog := func(path string) string {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	auth := func(addr, pass string) interface{} {
+		conn := testDial(t, addr)
+		defer conn.close()
+		return conn.do("AUTH", pass)
+	}
+
+	writeConf("requirepass foo", "activedefrag no")
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"), confPath)
+	stop := testServe(t, s, addr)
+	if v := auth(addr, "foo"); v != "OK" {
+		t.Fatalf("expected 'OK', got '%v'", v)
+	}
+
+	// rotate the log and change the config file
+	if err := os.Rename(logPath, logPath+".1"); err != nil {
+		t.Fatal(err)
+	}
+	writeConf("requirepass bar", "activedefrag yes", "port 1",
+		"active-defrag-cycle-max 100")
+	if err := s.ReloadConfig(); err == nil {
+		t.Fatal("expected an error for active-defrag-cycle-max")
+	}
+	if v := auth(addr, "bar"); v != "OK" {
+		t.Fatalf("expected 'OK', got '%v'", v)
+	}
+	if _, ok := auth(addr, "foo").(error); !ok {
+		t.Fatal("expected an error for the old password")
+	}
+	conn := testDial(t, addr)
+	conn.do("AUTH", "bar")
+	if v := conn.do("CONFIG", "GET", "activedefrag").([]interface{}); v[1] != "yes" {
+		t.Fatalf("expected 'yes', got '%v'", v[1])
+	}
+	if v := conn.do("CONFIG", "GET", "active-defrag-cycle-max").([]interface{}); v[1] != "25" {
+		t.Fatalf("expected '25', got '%v'", v[1])
+	}
+	if v := conn.do("CONFIG", "GET", "port").([]interface{}); v[1] == "1" {
+		t.Fatal("expected the port to be unchanged")
+	}
+	if log := readLog(logPath + ".1"); !strings.Contains(log, "Server started") {
+		t.Fatalf("expected the rotated log to contain the startup, got %q", log)
+	}
+	if log := readLog(logPath); !strings.Contains(log, "Ignoring 'port'") {
+		t.Fatalf("expected the new log to contain the port warning, got %q", log)
+	}
+
+	// the same reload from a signal
+	if err := os.Rename(logPath, logPath+".2"); err != nil {
+		t.Fatal(err)
+	}
+	writeConf("requirepass baz")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for {
+		if _, err := os.Stat(logPath); err == nil {
+			if _, ok := auth(addr, "baz").(error); !ok {
+				break
+			}
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("timeout waiting for the config to reload")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// the stop function requires a server without a password
+	conn.do("CONFIG", "SET", "requirepass", "")
+	conn.close()
+	stop()
+}
+
+func TestConfigRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the error rules refuse a command line, with all of the problems
+	for _, tt := range []struct {
+		args []string
+		errs []string
+	}{
+		{[]string{"--appendonly", "no", "--appendfsync", "always"},
+			[]string{"'appendfsync always' requires 'appendonly yes'"}},
+		{[]string{"--maxmemory", "1mb", "--maxmemory-clients", "2mb"},
+			[]string{"'maxmemory-clients' (2097152) must be lower than 'maxmemory' (1048576)"}},
+		{[]string{"--appendonly", "no", "--appendfsync", "always",
+			"--maxmemory", "1mb", "--maxmemory-clients", "1mb"},
+			[]string{"'appendfsync always'", "'maxmemory-clients' (1048576)"}},
+		{[]string{"--port", "x", "--maxmemory", "y"},
+			[]string{"invalid value 'x' for 'port'", "invalid value 'y' for 'maxmemory'"}},
+	} {
+		_, err := ParseCommandLine(tt.args)
+		if err == nil {
+			t.Fatalf("%v: expected an error", tt.args)
+		}
+		parts := strings.Split(err.Error(), "; ")
+		if len(parts) != len(tt.errs) {
+			t.Fatalf("%v: expected %d problems, got %q", tt.args, len(tt.errs), err)
+		}
+		for i, expect := range tt.errs {
+			if !strings.HasPrefix(parts[i], expect) {
+				t.Fatalf("%v: expected %q, got %q", tt.args, expect, parts[i])
+			}
+		}
+	}
+	if _, err := ParseCommandLine([]string{"--maxmemory", "2mb",
+		"--maxmemory-clients", "1mb", "--appendfsync", "always"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the warning rules are logged at startup
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"),
+		"--maxmemory-policy", "allkeys-lru", "--tombstone-retention", "60",
+		"--aof-compat-level", "2")
+	var log testLog
+	s.options.LogWriter = &log
+	_, warns := checkConfig(s.cfg, nil)
+	if len(warns) != 2 || !strings.Contains(warns[0], "'aof-compat-level 2'") ||
+		!strings.Contains(warns[1], "'maxmemory-policy allkeys-lru' has no effect") {
+		t.Fatalf("unexpected warnings %q", warns)
+	}
+	stop := testServe(t, s, addr)
+	defer stop()
+
+	// CONFIG SET refuses a config that breaks an error rule, and it sets all
+	// of the pairs or none
+	for _, args := range [][]string{
+		{"maxmemory-clients", "2mb", "maxmemory", "2mb"},
+		{"maxmemory", "1mb", "maxmemory-clients", "1mb"},
+		{"maxmemory", "1mb", "hotkeys-window", "0"},
+		{"maxmemory", "1mb", "port", "1"},
+		{"maxmemory", "1mb", "MAXMEMORY", "2mb"},
+	} {
+		if _, err := s.Do(append([]string{"CONFIG", "SET"}, args...)...); err == nil {
+			t.Fatalf("%v: expected an error", args)
+		}
+		for _, name := range []string{"maxmemory", "maxmemory-clients", "hotkeys-window"} {
+			v, _ := s.Do("CONFIG", "GET", name)
+			if expect := map[string]string{"maxmemory": "0", "maxmemory-clients": "0",
+				"hotkeys-window": "60"}[name]; v.([]interface{})[1] != expect {
+				t.Fatalf("%v: expected %s %s, got %v", args, name, expect, v)
+			}
+		}
+	}
+	_, err = s.Do("CONFIG", "SET", "maxmemory-clients", "2mb", "maxmemory", "2mb",
+		"hotkeys-window", "x")
+	if err == nil || !strings.Contains(err.Error(), "Invalid argument 'x'") {
+		t.Fatalf("expected the invalid argument, got %v", err)
+	}
+	if _, err := s.Do("CONFIG", "SET", "maxmemory", "4mb", "maxmemory-clients", "1mb"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Do("CONFIG", "GET", "maxmemory-clients"); v.([]interface{})[1] != "1048576" {
+		t.Fatalf("expected 1048576, got %v", v)
+	}
+	if _, err := s.Do("CONFIG", "SET", "maxmemory", "1mb"); err == nil {
+		t.Fatal("expected an error for a maxmemory below maxmemory-clients")
+	}
+	if _, err := s.Do("CONFIG", "SET", "appendfsync", "always"); err != nil {
+		t.Fatal(err)
+	}
+	s.Do("CONFIG", "SET", "appendfsync", "everysec")
+
+	// a warning rule is logged by CONFIG SET, only for the parameters it sets
+	s.Do("CONFIG", "SET", "eviction-exempt-dbs", "1", "maxmemory-policy", "noeviction")
+	if !strings.Contains(log.String(), "have no effect with 'maxmemory-policy noeviction'") {
+		t.Fatalf("expected the eviction-exempt warning, got %q", log.String())
+	}
+	if strings.Contains(log.String(), "tombstone") {
+		t.Fatalf("expected no tombstone warning, got %q", log.String())
+	}
+}
@@ -1,6 +1,11 @@
 package server
 
-import "strconv"
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
 
 func echoCommand(c *client) {
 	if len(c.args) != 2 {
@@ -34,3 +39,116 @@ func selectCommand(c *client) {
 	c.db = c.s.selectDB(int(num))
 	c.replyString("OK")
 }
+
+// clientCommand is CLIENT subcommand [args]. The subcommands only use the
+// state of the connection, so CLIENT is a fast command.
+func clientCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	switch strings.ToLower(c.args[1]) {
+	default:
+		c.replyError("Unknown subcommand or wrong number of arguments for '" + c.args[1] + "'. Try CLIENT HELP.")
+	case "help":
+		msgs := []string{
+			"CLIENT <subcommand> arg arg ... arg. Subcommands:",
+			"ID -- Return the ID of the current connection.",
+			"INFO -- Return information about the current client connection.",
+			"NO-EVICT (ON|OFF) -- Protect the current client connection from eviction.",
+			"NO-TOUCH (ON|OFF) -- Will not touch LRU/LFU stats when this mode is on.",
+		}
+		c.replyMultiBulkLen(len(msgs))
+		for _, msg := range msgs {
+			c.replyBulk(msg)
+		}
+	case "id":
+		c.replyInt(c.id)
+	case "info":
+		c.replyBulk(c.info())
+	case "no-evict", "no-touch":
+		if len(c.args) != 3 {
+			c.replyAritryError()
+			return
+		}
+		var on bool
+		switch strings.ToLower(c.args[2]) {
+		default:
+			c.replySyntaxError()
+			return
+		case "on":
+			on = true
+		case "off":
+		}
+		if strings.ToLower(c.args[1]) == "no-evict" {
+			atomic.StoreInt32(&c.cw.noEvict, int32(btoi(on)))
+		} else {
+			c.notouch = on
+		}
+		c.replyString("OK")
+	}
+}
+
+// info returns the CLIENT INFO line of the client.
+func (c *client) info() string {
+	var flags string
+	if c.monitor {
+		flags += "O"
+	}
+	if atomic.LoadInt32(&c.cw.noEvict) != 0 {
+		flags += "e"
+	}
+	if c.notouch {
+		flags += "T"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	resp := 2
+	if c.resp == 3 {
+		resp = 3
+	}
+	mem := c.memory()
+	return "id=" + strconv.Itoa(c.id) +
+		" addr=" + c.addr +
+		" laddr=" + c.cw.conn.LocalAddr().String() +
+		" name=" + c.name +
+		" age=" + strconv.Itoa(int(time.Since(c.created)/time.Second)) +
+		" idle=0" +
+		" flags=" + flags +
+		" db=" + strconv.Itoa(c.db.num) +
+		" qbuf=" + strconv.Itoa(mem.qbuf) +
+		" rbs=" + strconv.Itoa(mem.rbs) +
+		" omem=" + strconv.Itoa(mem.omem) +
+		" tot-mem=" + strconv.Itoa(mem.total()) +
+		" cmd=" + strings.ToLower(c.args[0]) + "|" + strings.ToLower(c.args[1]) +
+		" user=default" +
+		" resp=" + strconv.Itoa(resp) + "\n"
+}
+
+// resetCommand restores the default state of the connection. The client must
+// authenticate again when a password is required.
+func resetCommand(c *client) {
+	if len(c.args) != 1 {
+		c.replyAritryError()
+		return
+	}
+	// RESET is a fast command, and only takes the lock to leave MONITOR or
+	// another database
+	if c.monitor || c.db.num != 0 {
+		c.s.mu.Lock()
+		if c.monitor {
+			c.monitor = false
+			delete(c.s.monitors, c)
+			atomic.AddInt32(&c.s.nmonitors, -1)
+		}
+		c.db = c.s.selectDB(0)
+		c.s.mu.Unlock()
+	}
+	c.resp = 2
+	c.notouch = false
+	c.name = ""
+	atomic.StoreInt32(&c.cw.noEvict, 0)
+	c.authd = 0
+	c.replyString("RESET")
+}
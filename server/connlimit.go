@@ -0,0 +1,37 @@
+package server
+
+import "sync"
+
+// ipConns counts the open connections of each source ip for the
+// maxclients-per-ip limit. It has its own lock so that connections are
+// refused without waiting on the server lock.
+type ipConns struct {
+	mu sync.Mutex
+	m  map[string]int
+}
+
+// acquire adds a connection for the ip. Returns false when the ip already has
+// max connections, in which case nothing is added. A max of zero is no limit.
+func (ic *ipConns) acquire(ip string, max int) bool {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if max > 0 && ic.m[ip] >= max {
+		return false
+	}
+	if ic.m == nil {
+		ic.m = make(map[string]int)
+	}
+	ic.m[ip]++
+	return true
+}
+
+// release removes a connection that was added by acquire.
+func (ic *ipConns) release(ip string) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if ic.m[ip] <= 1 {
+		delete(ic.m, ip)
+	} else {
+		ic.m[ip]--
+	}
+}
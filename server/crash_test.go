@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestCrashHelperProcess is not a real test. It runs the server for
+// TestDebugPanic in a subprocess, so that the crash does not take the test
+// binary with it.
+func TestCrashHelperProcess(t *testing.T) {
+	if os.Getenv("SIDER_CRASH_HELPER") != "1" {
+		return
+	}
+	s, err := NewServer(&Options{
+		AppendOnlyPath: os.Getenv("SIDER_CRASH_AOF"),
+		Args:           strings.Fields(os.Getenv("SIDER_CRASH_ARGS")),
+		LogWriter:      os.Stderr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ListenAndServe(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDebugPanicNotAllowed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"))
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+	for _, sub := range []string{"PANIC", "SEGFAULT"} {
+		v, ok := conn.do("DEBUG", sub).(error)
+		if !ok || !strings.HasPrefix(v.Error(), "ERR DEBUG "+sub+" not allowed") {
+			t.Fatalf("expected not allowed error, got %v", v)
+		}
+	}
+	if v := conn.do("PING"); v != "PONG" {
+		t.Fatalf("expected PONG, got %v", v)
+	}
+}
+
+func TestDebugPanic(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the server in a subprocess")
+	}
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	port := addr[strings.LastIndex(addr, ":")+1:]
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCrashHelperProcess$")
+	cmd.Env = append(os.Environ(),
+		"SIDER_CRASH_HELPER=1",
+		"SIDER_CRASH_AOF="+aofPath,
+		"SIDER_CRASH_ARGS=--port "+port+
+			" --appendfsync always --enable-debug-command local",
+	)
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	start := time.Now()
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("server did not start")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// each writer counts its acknowledged writes until the crash closes
+	// the connection.
+	const writers = 4
+	acked := make([]int, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		conn := testDial(t, addr)
+		defer conn.close()
+		wg.Add(1)
+		go func(i int, conn *testConn) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				key := "w" + strconv.Itoa(i) + ":" + strconv.Itoa(j)
+				if _, err := conn.conn.Write(encodeMultiBulk([]string{"SET", key, strconv.Itoa(j)})); err != nil {
+					return
+				}
+				if v, err := conn.read(); err != nil || v != "OK" {
+					return
+				}
+				acked[i] = j + 1
+			}
+		}(i, conn)
+	}
+	time.Sleep(time.Millisecond * 200)
+	conn := testDial(t, addr)
+	defer conn.close()
+	conn.send("DEBUG", "PANIC")
+	if v, err := conn.read(); err == nil {
+		t.Fatalf("expected the connection to close, got %v", v)
+	}
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Fatalf("expected exit code 1, got %v", err)
+	}
+	wg.Wait()
+	for _, msg := range []string{"BUG REPORT START", "DEBUG PANIC called by client",
+		"history:", "AOF synced before exiting"} {
+		if !strings.Contains(stderr.String(), msg) {
+			t.Fatalf("expected %q in the log, got:\n%s", msg, stderr.String())
+		}
+	}
+
+	// restart and check that no acknowledged write was lost
+	addr, stop := testStartServer(t, aofPath)
+	defer stop()
+	conn2 := testDial(t, addr)
+	defer conn2.close()
+	var total int
+	for i, n := range acked {
+		if n == 0 {
+			t.Fatalf("writer %d had no acknowledged writes", i)
+		}
+		total += n
+		for j := 0; j < n; j++ {
+			key := "w" + strconv.Itoa(i) + ":" + strconv.Itoa(j)
+			if v := conn2.do("GET", key); v != strconv.Itoa(j) {
+				t.Fatalf("expected %d for %s, got %v", j, key, v)
+			}
+		}
+	}
+	if v := conn2.do("DBSIZE").(int); v < total {
+		t.Fatalf("expected at least %d keys, got %d", total, v)
+	}
+}
@@ -1,28 +1,76 @@
 package server
 
 import (
-	"bytes"
-	"strconv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type dbItem struct {
 	expires bool
 	value   interface{}
+	lru     uint32 // the lru clock of the last access, atomic
+	index   int    // the position of the key in database.keys
+}
+
+// The lru clock is a coarse clock in seconds, like in Redis. It's updated by
+// a background tick and read atomically, which makes touching a key on every
+// read cheap. It wraps around in 2106.
+var (
+	lruclock     = uint32(time.Now().Unix()) // atomic
+	lruclockOnce sync.Once
+)
+
+// startLRUClock starts the process wide tick that updates the lru clock.
+func startLRUClock() {
+	lruclockOnce.Do(func() {
+		go func() {
+			for now := range time.Tick(time.Second) {
+				atomic.StoreUint32(&lruclock, uint32(now.Unix()))
+			}
+		}()
+	})
+}
+
+// lruClock returns the current lru clock.
+func lruClock() uint32 {
+	return atomic.LoadUint32(&lruclock)
+}
+
+// touch records an access of the item. This is safe to call while holding the
+// read lock. Writes touch the keys they store, and the keys of every other
+// command are touched after the command runs, see client.touchKeys.
+func (item *dbItem) touch() {
+	atomic.StoreUint32(&item.lru, lruClock())
+}
+
+// idle returns the number of seconds since the last access of the item.
+func (item *dbItem) idle(now uint32) uint32 {
+	return now - atomic.LoadUint32(&item.lru)
 }
 
 type database struct {
-	num     int
-	items   map[string]dbItem
-	expires map[string]time.Time
-	aofbuf  bytes.Buffer
+	num        int
+	items      map[string]*dbItem
+	expires    map[string]time.Time
+	ttls       map[int64]int    // the keys of expires by their slot, see ttlstats.go
+	keys       []string         // the keys of items in no order, for picking a random key
+	tombstones map[string]int64 // deleted keys, unix milliseconds, see tombstone.go
+	peak       int              // the largest number of items since the last rebuild
+	defrag     *defragState     // non-nil while the database is being rebuilt
+
+	// onExpire is called once for every key that is deleted because it
+	// expired, no matter which path noticed it. May be nil.
+	onExpire func(db *database, key string)
 }
 
 func newDB(num int) *database {
 	return &database{
 		num:     num,
-		items:   make(map[string]dbItem),
+		items:   make(map[string]*dbItem),
 		expires: make(map[string]time.Time),
+		ttls:    make(map[int64]int),
 	}
 }
 
@@ -31,13 +79,88 @@ func (db *database) len() int {
 }
 
 func (db *database) flush() {
-	db.items = make(map[string]dbItem)
+	db.items = make(map[string]*dbItem)
 	db.expires = make(map[string]time.Time)
+	db.ttls = make(map[int64]int)
+	db.keys = nil
+	db.tombstones = nil
+	db.peak = 0
+	db.defrag = nil
+}
+
+// ttlPolicy describes what a write does to the expiration time of a key that
+// it overwrites or modifies. Each write command declares its policy in the
+// command table, and the matching database helper applies it.
+type ttlPolicy int
+
+const (
+	ttlNone  ttlPolicy = iota // the command does not write values
+	ttlKeep                   // the value is modified and the ttl is kept, see update
+	ttlClear                  // the value is replaced and the ttl is removed, see set
+	ttlMove                   // the value and the ttl move to another key, see move
+)
+
+// set replaces the value of a key and removes its expiration time. Returns
+// true when the key was created.
+func (db *database) set(key string, value interface{}) (created bool) {
+	return db.store(key, value, ttlClear)
+}
+
+// update changes the value of a key and keeps its expiration time. Returns
+// true when the key was created.
+func (db *database) update(key string, value interface{}) (created bool) {
+	return db.store(key, value, ttlKeep)
+}
+
+// store sets the value of a key. The expiration time of an existing key is
+// kept when the policy is ttlKeep, otherwise it's removed. An expired key is
+// always replaced by a new key without an expiration time. Returns true when
+// the key was created, which includes replacing an expired key.
+func (db *database) store(key string, value interface{}, policy ttlPolicy) (created bool) {
+	item, ok := db.items[key]
+	if ok && item.expires {
+		if db.expire(key, time.Now()) {
+			ok = false
+		} else if policy != ttlKeep {
+			db.clearTTL(key)
+			ok = false
+		}
+	}
+	if ok {
+		item.value = value
+	} else {
+		if old, exists := db.items[key]; exists {
+			// the ttl was removed, the new item takes the place of the old
+			item = &dbItem{value: value, index: old.index}
+		} else {
+			item = &dbItem{value: value, index: len(db.keys)}
+			db.keys = append(db.keys, key)
+			created = true
+		}
+		db.items[key] = item
+	}
+	item.touch()
+	if created && len(db.items) > db.peak {
+		db.peak = len(db.items)
+	}
+	db.markDefragDirty(key)
+	return created
 }
 
-func (db *database) set(key string, value interface{}) {
-	delete(db.expires, key)
-	db.items[key] = dbItem{value: value}
+// move moves a key and its expiration time to dstKey in dst, which may be the
+// same database. An existing dstKey is replaced. Returns false if the key does
+// not exist.
+func (db *database) move(key string, dst *database, dstKey string) bool {
+	value, when, ok := db.getExpires(key)
+	if !ok {
+		return false
+	}
+	db.del(key)
+	dst.set(dstKey, value)
+	if !when.IsZero() {
+		dst.setExpire(dstKey, when)
+	}
+	return true
 }
 
 func (db *database) get(key string) (interface{}, bool) {
@@ -45,16 +168,22 @@ func (db *database) get(key string) (interface{}, bool) {
 	if !ok {
 		return nil, false
 	}
-	if item.expires {
-		if t, ok := db.expires[key]; ok {
-			if time.Now().After(t) {
-				return nil, false
-			}
-		}
+	if item.expires && db.checkExpired(key, time.Now()) {
+		return nil, false
 	}
 	return item.value, true
 }
 
+// lookup returns the item of a key without touching it. Returns false if the
+// key does not exist.
+func (db *database) lookup(key string) (*dbItem, bool) {
+	item, ok := db.items[key]
+	if !ok || (item.expires && db.checkExpired(key, time.Now())) {
+		return nil, false
+	}
+	return item, true
+}
+
 func (db *database) getType(key string) string {
 	v, ok := db.get(key)
 	if !ok {
@@ -72,34 +201,106 @@ func (db *database) getType(key string) string {
 		return "list"
 	case *set:
 		return "set"
+	case *hash:
+		return "hash"
+	case *zset:
+		return "zset"
 	}
 }
 
 func (db *database) del(key string) (interface{}, bool) {
 	item, ok := db.items[key]
-	if !ok {
+	if !ok || (item.expires && db.expire(key, time.Now())) {
 		return nil, false
 	}
+	db.remove(key, item)
+	db.clearTTL(key)
+	db.markDefragDirty(key)
+	return item.value, true
+}
+
+// remove deletes an item. The last key of keys takes the place of the key,
+// which keeps keys without gaps.
+func (db *database) remove(key string, item *dbItem) {
+	last := db.keys[len(db.keys)-1]
+	db.keys[item.index] = last
+	db.items[last].index = item.index
+	db.keys[len(db.keys)-1] = ""
+	db.keys = db.keys[:len(db.keys)-1]
 	delete(db.items, key)
-	if item.expires {
-		delete(db.expires, key)
-		if t, ok := db.expires[key]; ok {
-			if time.Now().After(t) {
-				return nil, false
-			}
+}
+
+// randomKey returns a random key. Picking a key of keys is O(1), and an
+// expired key that's picked is retried up to tries times, because it can't
+// be deleted while holding the read lock. Returns false when the database is
+// empty, or when every pick was an expired key. This is safe to call while
+// holding the read lock.
+func (db *database) randomKey(tries int) (string, bool) {
+	now := time.Now()
+	for i := 0; i < tries && len(db.keys) > 0; i++ {
+		key := db.keys[rand.Intn(len(db.keys))]
+		if !db.items[key].expires || !db.checkExpired(key, now) {
+			return key, true
 		}
 	}
-	return item.value, true
+	return "", false
 }
 
-func (db *database) expire(key string, when time.Time) bool {
-	item, ok := db.items[key]
-	if !ok {
+// checkExpired returns true when the key has an expiration time that is not
+// in the future. An expired key may stay in the database until the expire loop
+// deletes it, but it must be treated as if it does not exist. This is safe to
+// call while holding the read lock.
+func (db *database) checkExpired(key string, now time.Time) bool {
+	t, ok := db.expires[key]
+	return ok && !now.Before(t)
+}
+
+// expire deletes the key if it has expired and returns true when it did. This
+// is the only place where expired keys are deleted, which makes sure that
+// onExpire is called exactly once for each key, even when the expire loop and
+// a write notice the same key. Must be called while holding the write lock.
+func (db *database) expire(key string, now time.Time) bool {
+	if !db.checkExpired(key, now) {
 		return false
 	}
+	db.remove(key, db.items[key])
+	db.clearTTL(key)
+	db.markDefragDirty(key)
+	if db.onExpire != nil {
+		db.onExpire(db, key)
+	}
+	return true
+}
+
+// setExpire sets the expiration time of a key. A time that is not in the
+// future deletes the key immediately, in which case deleted is true. Returns
+// false if the key does not exist.
+func (db *database) setExpire(key string, when time.Time) (ok, deleted bool) {
+	now := time.Now()
+	item, ok := db.items[key]
+	if !ok || (item.expires && db.expire(key, now)) {
+		return false, false
+	}
+	if !now.Before(when) {
+		db.del(key)
+		return true, true
+	}
 	item.expires = true
-	db.items[key] = item
-	db.expires[key] = when
+	db.setTTL(key, when)
+	db.markDefragDirty(key)
+	return true, false
+}
+
+// persist removes the expiration time of a key. Returns false if the key
+// does not exist or does not have an expiration time.
+func (db *database) persist(key string) bool {
+	item, ok := db.items[key]
+	if !ok || !item.expires || db.expire(key, time.Now()) {
+		return false
+	}
+	item.expires = false
+	db.clearTTL(key)
+	db.markDefragDirty(key)
 	return true
 }
 
@@ -108,16 +309,13 @@ func (db *database) getExpires(key string) (interface{}, time.Time, bool) {
 	if !ok {
 		return nil, time.Time{}, false
 	}
-	var expires time.Time
-	if item.expires {
-		if t, ok := db.expires[key]; ok {
-			expires = t
-			if time.Now().After(t) {
-				return nil, time.Time{}, false
-			}
-		}
+	if !item.expires {
+		return item.value, time.Time{}, true
+	}
+	if db.checkExpired(key, time.Now()) {
+		return nil, time.Time{}, false
 	}
-	return item.value, expires, true
+	return item.value, db.expires[key], true
 }
 
 func (db *database) getList(key string, create bool) (*list, bool) {
@@ -156,15 +354,52 @@ func (db *database) getSet(key string, create bool) (*set, bool) {
 	return nil, true
 }
 
+func (db *database) getZSet(key string, create bool) (*zset, bool) {
+	value, ok := db.get(key)
+	if ok {
+		switch v := value.(type) {
+		default:
+			return nil, false
+		case *zset:
+			return v, true
+		}
+	}
+	if create {
+		z := newZSet()
+		db.set(key, z)
+		return z, true
+	}
+	return nil, true
+}
+
+func (db *database) getHash(key string, create bool) (*hash, bool) {
+	value, ok := db.get(key)
+	if ok {
+		switch v := value.(type) {
+		default:
+			return nil, false
+		case *hash:
+			return v, true
+		}
+	}
+	if create {
+		h := newHash()
+		db.set(key, h)
+		return h, true
+	}
+	return nil, true
+}
+
 func (db *database) ascend(iterator func(key string, value interface{}) bool) {
-	now := time.Now()
+	db.ascendAt(time.Now(), iterator)
+}
+
+// ascendAt iterates the keys that have not expired at now. Iterating twice
+// with the same now visits the same keys, unless the database changes.
+func (db *database) ascendAt(now time.Time, iterator func(key string, value interface{}) bool) {
 	for key, item := range db.items {
-		if item.expires {
-			if t, ok := db.expires[key]; ok {
-				if now.After(t) {
-					continue
-				}
-			}
+		if item.expires && db.checkExpired(key, now) {
+			continue
 		}
 		if !iterator(key, item.value) {
 			return
@@ -172,34 +407,33 @@ func (db *database) ascend(iterator func(key string, value interface{}) bool) {
 	}
 }
 
-func (db *database) update(key string, value interface{}) {
-	item, ok := db.items[key]
-	if ok {
-		item.value = value
-	} else {
-		item = dbItem{value: value}
+// expireSample checks up to count keys that have an expiration time and
+// deletes the ones that have expired. Map iteration starts at a random
+// position, which makes the checked keys a sample.
+func (db *database) expireSample(count int, now time.Time) (sampled, expired int) {
+	for key := range db.expires {
+		if sampled == count {
+			break
+		}
+		sampled++
+		if db.expire(key, now) {
+			expired++
+		}
 	}
-	db.items[key] = item
+	return sampled, expired
 }
 
-func (db *database) deleteExpires() bool {
+// deleteExpires deletes all expired keys and returns them.
+func (db *database) deleteExpires() []string {
 	if len(db.expires) == 0 {
-		return false
+		return nil
 	}
-	deleted := false
+	var deleted []string
 	now := time.Now()
-	for key, t := range db.expires {
-		if now.Before(t) {
-			continue
+	for key := range db.expires {
+		if db.expire(key, now) {
+			deleted = append(deleted, key)
 		}
-		delete(db.items, key)
-		db.aofbuf.WriteString("*2\r\n$3\r\nDEL\r\n$")
-		db.aofbuf.WriteString(strconv.FormatInt(int64(len(key)), 10))
-		db.aofbuf.WriteString("\r\n")
-		db.aofbuf.WriteString(key)
-		db.aofbuf.WriteString("\r\n")
-		delete(db.expires, key)
-		deleted = true
 	}
 	return deleted
 }
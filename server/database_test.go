@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreCreated(t *testing.T) {
+	db := newDB(0)
+	if !db.set("key", "a") {
+		t.Fatal("expected the key to be created")
+	}
+	if db.set("key", "b") || db.update("key", "c") {
+		t.Fatal("expected the key to be replaced")
+	}
+	db.setExpire("key", time.Now().Add(time.Hour))
+	if db.set("key", "d") {
+		t.Fatal("expected the key to be replaced when its ttl is removed")
+	}
+	db.setExpire("key", time.Now().Add(time.Millisecond))
+	time.Sleep(time.Millisecond * 2)
+	if !db.update("key", "e") {
+		t.Fatal("expected an expired key to be created again")
+	}
+}
+
+// TestKeyCounters runs a random workload, and checks that the counts that
+// the databases keep match a recount of their keys after every command. The
+// workload pauses now and then, so that the active expire cycle deletes the
+// keys that expired.
+func TestKeyCounters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"))
+	stop := testServe(t, s, addr)
+	defer stop()
+
+	rng := rand.New(rand.NewSource(1))
+	workload := []func(key string) []string{
+		func(key string) []string { return []string{"SET", key, "v"} },
+		func(key string) []string { return []string{"SET", key, "v", "EX", "100"} },
+		func(key string) []string { return []string{"SET", key, "v", "PX", "1"} },
+		func(key string) []string { return []string{"INCR", key} },
+		func(key string) []string { return []string{"DEL", key} },
+		func(key string) []string { return []string{"EXPIRE", key, "100"} },
+		func(key string) []string { return []string{"EXPIRE", key, strconv.Itoa(rng.Intn(100000))} },
+		func(key string) []string { return []string{"PEXPIRE", key, strconv.Itoa(rng.Intn(50))} },
+		func(key string) []string { return []string{"PERSIST", key} },
+		func(key string) []string { return []string{"RPUSH", key, "a", "b"} },
+		func(key string) []string { return []string{"LPOP", key} },
+		func(key string) []string { return []string{"SADD", key, "a"} },
+		func(key string) []string { return []string{"SREM", key, "a"} },
+		func(key string) []string { return []string{"HSET", key, "f", "v"} },
+		func(key string) []string { return []string{"HDEL", key, "f"} },
+		func(key string) []string { return []string{"RENAME", key, "key:" + strconv.Itoa(rng.Intn(20))} },
+		func(key string) []string { return []string{"MOVE", key, "1"} },
+		func(key string) []string { return []string{"LMOVE", key, "key:0", "LEFT", "LEFT"} },
+	}
+	for i := 0; i < 5000; i++ {
+		args := workload[rng.Intn(len(workload))]("key:" + strconv.Itoa(rng.Intn(20)))
+		if i%1000 == 999 {
+			args = []string{"FLUSHALL"}
+		}
+		if i%500 == 250 {
+			time.Sleep(activeExpireInterval * 2)
+		}
+		s.Do(args...)
+		if err := testRecountKeys(s); err != nil {
+			t.Fatalf("after %v: %v", args, err)
+		}
+	}
+
+	// the changes since the last save
+	changes := func() string {
+		v, _ := s.Do("INFO", "persistence")
+		for _, line := range strings.Split(v.(string), "\n") {
+			if strings.HasPrefix(line, "rdb_changes_since_last_save:") {
+				return line[len("rdb_changes_since_last_save:"):]
+			}
+		}
+		return ""
+	}
+	if v := changes(); v == "0" || v == "" {
+		t.Fatalf("expected changes, got %q", v)
+	}
+	if _, err := s.Do("SAVE"); err != nil {
+		t.Fatal(err)
+	}
+	if v := changes(); v != "0" {
+		t.Fatalf("expected no changes after the save, got %q", v)
+	}
+	s.Do("SET", "a", "1")
+	s.Do("SET", "b", "1", "NX")
+	s.Do("SET", "b", "1", "NX")
+	s.Do("GET", "a")
+	if v := changes(); v != "2" {
+		t.Fatalf("expected 2 changes, got %q", v)
+	}
+}
+
+// testRecountKeys counts the keys, the expires and the expiration slots of
+// every database, and compares them to the counts of the databases and of
+// INFO keyspace, all under one read lock.
+func testRecountKeys(s *Server) error {
+	s.mu.RLock()
+	var want []string
+	for num := 0; num < 2; num++ {
+		db, ok := s.dbs[num]
+		if !ok {
+			continue
+		}
+		var keys, expires int
+		ttls := make(map[int64]int)
+		for _, when := range db.expires {
+			ttls[ttlSlot(when)]++
+		}
+		if fmt.Sprint(ttls) != fmt.Sprint(db.ttls) {
+			s.mu.RUnlock()
+			return fmt.Errorf("db%d: counted the slots %v, the database has %v", num, ttls, db.ttls)
+		}
+		for key, item := range db.items {
+			keys++
+			if item.expires {
+				expires++
+				if _, ok := db.expires[key]; !ok {
+					s.mu.RUnlock()
+					return fmt.Errorf("db%d: %s has no expiration time", num, key)
+				}
+			}
+			if db.keys[item.index] != key {
+				s.mu.RUnlock()
+				return fmt.Errorf("db%d: %s is not at its index", num, key)
+			}
+		}
+		if keys != db.len() || keys != len(db.keys) || expires != len(db.expires) {
+			s.mu.RUnlock()
+			return fmt.Errorf("db%d: counted %d keys and %d expires, the database has "+
+				"%d, %d and %d", num, keys, expires, db.len(), len(db.keys), len(db.expires))
+		}
+		if keys > 0 {
+			want = append(want, fmt.Sprintf("db%d:keys=%d,expires=%d,avg_ttl=0",
+				num, keys, expires))
+		}
+	}
+	// INFO keyspace is read under the same lock, before the active expire
+	// cycle can delete keys
+	var info bytes.Buffer
+	writeInfoKeyspace(&client{s: s}, &info)
+	s.mu.RUnlock()
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(info.String()), "\n") {
+		if line != "" {
+			// the histogram is checked by TestTTLStats
+			got = append(got, line[:strings.Index(line, ",ttl_")])
+		}
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		return fmt.Errorf("expected INFO keyspace %v, got %v", want, got)
+	}
+	return nil
+}
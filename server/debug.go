@@ -1,17 +1,44 @@
 package server
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"os"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 func replyArgsError(c *client) {
 	c.replyError("Unknown DEBUG subcommand or wrong number of arguments for '" + c.args[1] + "'")
 }
 
+// debugCrashAllowed returns true when the enable-debug-command option allows
+// the client to run the subcommands that crash the server.
+func debugCrashAllowed(c *client) bool {
+	switch c.s.cfg.enableDebugCommand {
+	case "yes":
+		return true
+	case "local":
+		if c.unix {
+			return true
+		}
+		host, _, err := net.SplitHostPort(c.addr)
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsLoopback()
+	}
+	return false
+}
+
 func debugCommand(c *client) {
 	if len(c.args) == 1 {
 		c.replyError("You must specify a subcommand for DEBUG. Try DEBUG HELP for info.")
@@ -25,21 +52,115 @@ func debugCommand(c *client) {
 		msgs := []string{
 			"DEBUG <subcommand> arg arg ... arg. Subcommands:",
 			"segfault -- Crash the server with sigsegv.",
+			"panic -- Crash the server with a panic in the command handler.",
 			"object <key> -- Show low level info about key and associated value.",
 			"gc -- Force a garbage collection.",
+			"digest -- Output a hex signature representing the current dataset.",
+			"sleep <seconds> -- Stop the server for <seconds>. Decimals allowed.",
+			"client <id> -- Show the last commands of the client with <id>.",
 		}
 		c.replyMultiBulkLen(len(msgs))
 		for _, msg := range msgs {
 			c.replyBulk(msg)
 		}
-	case "segfault":
+	case "segfault", "panic":
+		if !debugCrashAllowed(c) {
+			c.replyError("DEBUG " + strings.ToUpper(c.args[1]) + " not allowed. " +
+				"If the enable-debug-command option is set to \"local\", you " +
+				"can run it from a local connection, otherwise you need to set " +
+				"this option in the configuration file, and then restart the server.")
+			return
+		}
+		if strings.ToLower(c.args[1]) == "panic" {
+			panic("DEBUG PANIC called by client")
+		}
 		syscall.Kill(os.Getpid(), syscall.SIGSEGV)
 	case "object":
 		debugObjectCommand(c)
+	case "client":
+		debugClientCommand(c)
 	case "gc":
 		runtime.GC()
 		c.replyString("OK")
+	case "digest":
+		if len(c.args) != 2 {
+			replyArgsError(c)
+			return
+		}
+		c.replyString(c.s.digest())
+	case "sleep":
+		if len(c.args) != 3 {
+			replyArgsError(c)
+			return
+		}
+		secs, err := strconv.ParseFloat(c.args[2], 64)
+		if err != nil || secs < 0 {
+			c.replyError("value is not a valid float")
+			return
+		}
+		// the write lock is held for the duration
+		time.Sleep(time.Duration(secs * float64(time.Second)))
+		c.replyString("OK")
+	}
+}
+
+// digest returns a hex signature of the dataset. The digest of each key is
+// xored together so that the order of the keys does not matter. An empty
+// dataset has a digest of all zeros. Expiration times are not part of the
+// digest, only whether the key has one, because an expire loaded from the aof
+// is relative to the load time.
+func (s *Server) digest() string {
+	var digest [sha1.Size]byte
+	for _, db := range s.dbs {
+		db.ascend(func(key string, value interface{}) bool {
+			h := sha1.New()
+			writeBulk(h, strconv.FormatInt(int64(db.num), 10))
+			writeBulk(h, key)
+			switch v := value.(type) {
+			case string:
+				writeBulk(h, "string")
+				writeBulk(h, v)
+			case *list:
+				writeBulk(h, "list")
+				for _, value := range v.strArr() {
+					writeBulk(h, value)
+				}
+			case *set:
+				writeBulk(h, "set")
+				var members []string
+				v.ascend(func(member string) bool {
+					members = append(members, member)
+					return true
+				})
+				sort.Strings(members)
+				for _, member := range members {
+					writeBulk(h, member)
+				}
+			case *hash:
+				writeBulk(h, "hash")
+				for _, field := range v.sortedFields() {
+					writeBulk(h, field)
+					writeBulk(h, v.m[field])
+				}
+			case *zset:
+				writeBulk(h, "zset")
+				v.ascend(func(member string, score float64) bool {
+					writeBulk(h, member)
+					writeBulk(h, formatDouble(score))
+					return true
+				})
+			}
+			if _, when, _ := db.getExpires(key); !when.IsZero() {
+				writeBulk(h, "expires")
+			}
+			sum := h.Sum(nil)
+			for i := range digest {
+				digest[i] ^= sum[i]
+			}
+			return true
+		})
 	}
+	return hex.EncodeToString(digest[:])
 }
 
 func debugObjectCommand(c *client) {
@@ -47,12 +168,13 @@ func debugObjectCommand(c *client) {
 		replyArgsError(c)
 		return
 	}
-	typ := c.db.getType(c.args[2])
-	_, ok := c.db.get(c.args[2])
+	item, ok := c.db.lookup(c.args[2])
 	if !ok {
-		c.replyError("no such key")
+		c.replyNoSuchKeyError()
 		return
 	}
-	res := fmt.Sprintf("Value at:0x0 refcount:1 encoding:%s", typ)
+	now := lruClock()
+	res := fmt.Sprintf("Value at:0x0 refcount:1 encoding:%s lru:%d lru_seconds_idle:%d",
+		objectEncoding(item.value), atomic.LoadUint32(&item.lru), item.idle(now))
 	c.replyString(res)
 }
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Go maps never release their buckets when keys are deleted. After a churn
+// heavy workload, such as loading 10M keys and deleting 9M, a database keeps
+// the memory for its largest size until the maps are rebuilt. The active
+// defrag loop rebuilds these maps incrementally by copying the live keys into
+// fresh maps in small batches, and then swapping the old maps out.
+
+const (
+	defragInterval  = time.Millisecond * 100 // how often the defrag loop runs
+	defragBatchSize = 1000                   // keys copied per lock hold
+	defragMinKeys   = 1024                   // ignore databases smaller than this
+)
+
+// defragState is the progress of a database that is being rebuilt.
+type defragState struct {
+	keys    []string             // snapshot of the keys to copy
+	pos     int                  // position of the next key in keys
+	items   map[string]*dbItem   // the new items map
+	expires map[string]time.Time // the new expires map
+	dirty   map[string]bool      // keys modified since the snapshot
+}
+
+// needsDefrag returns true when at least half of the database's map capacity
+// is unused.
+func (db *database) needsDefrag() bool {
+	return db.peak >= defragMinKeys && len(db.items) <= db.peak/2
+}
+
+// markDefragDirty is called by every function that mutates the database.
+// Keys that are modified after being copied are copied again at the end.
+func (db *database) markDefragDirty(key string) {
+	if db.defrag != nil {
+		db.defrag.dirty[key] = true
+	}
+}
+
+// startDefrag takes a snapshot of the keys that need to be copied.
+func (db *database) startDefrag() {
+	keys := make([]string, 0, len(db.items))
+	for key := range db.items {
+		keys = append(keys, key)
+	}
+	db.defrag = &defragState{
+		keys:    keys,
+		items:   make(map[string]*dbItem, len(keys)),
+		expires: make(map[string]time.Time, len(db.expires)),
+		dirty:   make(map[string]bool),
+	}
+}
+
+// copyDefragKey copies a single key, along with its expiration, from the
+// live maps into the new maps. String values are reallocated so that long
+// lived strings are moved out of otherwise empty memory spans.
+func (db *database) copyDefragKey(key string) {
+	item, ok := db.items[key]
+	if !ok {
+		delete(db.defrag.items, key)
+		delete(db.defrag.expires, key)
+		return
+	}
+	if s, ok := item.value.(string); ok {
+		item.value = strings.Clone(s)
+	}
+	db.defrag.items[key] = item
+	if t, ok := db.expires[key]; ok {
+		db.defrag.expires[key] = t
+	} else {
+		delete(db.defrag.expires, key)
+	}
+}
+
+// stepDefrag copies up to count keys into the new maps. When all keys have
+// been copied the modified keys are copied again and the maps are swapped.
+// Returns the number of keys copied and true when the rebuild is complete.
+func (db *database) stepDefrag(count int) (copied int, done bool) {
+	d := db.defrag
+	for ; copied < count && d.pos < len(d.keys); copied++ {
+		key := d.keys[d.pos]
+		d.keys[d.pos] = ""
+		d.pos++
+		if !d.dirty[key] {
+			db.copyDefragKey(key)
+		}
+	}
+	if d.pos < len(d.keys) {
+		return copied, false
+	}
+	for key := range d.dirty {
+		db.copyDefragKey(key)
+		copied++
+	}
+	db.items = d.items
+	db.expires = d.expires
+	db.keys = append(make([]string, 0, len(db.keys)), db.keys...)
+	ttls := make(map[int64]int, len(db.ttls))
+	for slot, n := range db.ttls {
+		ttls[slot] = n
+	}
+	db.ttls = ttls
+	db.peak = len(db.items)
+	db.defrag = nil
+	return copied, true
+}
+
+// startDefragLoop runs a background routine which rebuilds fragmented
+// databases when activedefrag is enabled. The time spent holding the lock is
+// limited to active-defrag-cycle-max percent of each interval.
+func (s *Server) startDefragLoop() {
+	s.workers.start(workerDefrag, func(ctx context.Context) {
+		t := time.NewTicker(defragInterval)
+		defer t.Stop()
+		var heapStart uint64
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			s.mu.Lock()
+			if s.defragdone {
+				s.mu.Unlock()
+				return
+			}
+			if !s.cfg.activeDefrag {
+				s.cancelDefrag()
+				s.mu.Unlock()
+				continue
+			}
+			db := s.findDefragDB()
+			if db == nil {
+				s.mu.Unlock()
+				continue
+			}
+			if db.defrag == nil {
+				s.defragRunning = true
+				heapStart = heapInuse()
+				db.startDefrag()
+			}
+			budget := defragInterval * time.Duration(s.cfg.activeDefragCycleMax) / 100
+			start := time.Now()
+			for {
+				copied, done := db.stepDefrag(defragBatchSize)
+				s.defragHits += copied
+				if done {
+					s.defragRunning = false
+					s.mu.Unlock()
+					runtime.GC()
+					if heapEnd := heapInuse(); heapEnd < heapStart {
+						s.mu.Lock()
+						s.defragReclaimed += heapStart - heapEnd
+						s.mu.Unlock()
+					}
+					s.lverbosf("Active defrag of DB %d finished", db.num)
+					break
+				}
+				if time.Since(start) >= budget {
+					s.mu.Unlock()
+					break
+				}
+				// let the lock breath for a moment
+				s.mu.Unlock()
+				s.mu.Lock()
+				if s.defragdone || db.defrag == nil {
+					s.mu.Unlock()
+					break
+				}
+			}
+		}
+	})
+}
+
+// findDefragDB returns the database currently being rebuilt, or the next
+// database that needs to be rebuilt.
+func (s *Server) findDefragDB() *database {
+	var next *database
+	for _, db := range s.dbs {
+		if db.defrag != nil {
+			return db
+		}
+		if next == nil && db.needsDefrag() {
+			next = db
+		}
+	}
+	return next
+}
+
+// cancelDefrag discards any rebuild that is in progress.
+func (s *Server) cancelDefrag() {
+	for _, db := range s.dbs {
+		db.defrag = nil
+	}
+	s.defragRunning = false
+}
+
+// stopDefragLoop stops the background routine.
+func (s *Server) stopDefragLoop() {
+	s.mu.Lock()
+	s.defragdone = true
+	s.mu.Unlock()
+	s.stopWorkers(workerDefrag)
+}
+
+func heapInuse() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapInuse
+}
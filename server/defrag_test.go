@@ -0,0 +1,73 @@
+package server
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDefrag(t *testing.T) {
+	db := newDB(0)
+	model := make(map[string]string)
+	for i := 0; i < 100000; i++ {
+		key := "key:" + strconv.Itoa(i)
+		db.set(key, strconv.Itoa(i))
+		model[key] = strconv.Itoa(i)
+	}
+	for i := 0; i < 100000; i++ {
+		if i%10 != 0 {
+			key := "key:" + strconv.Itoa(i)
+			db.del(key)
+			delete(model, key)
+		}
+	}
+	if !db.needsDefrag() {
+		t.Fatal("expected the database to need a rebuild")
+	}
+	runtime.GC()
+	heapBefore := heapInuse()
+
+	// modify the database between each batch, including keys that have
+	// already been copied and keys that have not been copied yet.
+	db.startDefrag()
+	for i := 0; ; i++ {
+		if _, done := db.stepDefrag(100); done {
+			break
+		}
+		key := "new:" + strconv.Itoa(i)
+		db.set(key, "new")
+		model[key] = "new"
+		key = "key:" + strconv.Itoa(i*10)
+		db.del(key)
+		delete(model, key)
+		key = "key:" + strconv.Itoa(99990-i*10)
+		db.update(key, "updated")
+		model[key] = "updated"
+		db.setExpire("key:"+strconv.Itoa(50000+i*10), time.Now().Add(time.Hour))
+	}
+	if db.defrag != nil || db.needsDefrag() {
+		t.Fatal("expected the rebuild to be complete")
+	}
+	if db.peak != db.len() {
+		t.Fatalf("expected peak %d, got %d", db.len(), db.peak)
+	}
+	if db.len() != len(model) {
+		t.Fatalf("expected %d keys, got %d", len(model), db.len())
+	}
+	for key, value := range model {
+		if v, ok := db.get(key); !ok || v != value {
+			t.Fatalf("expected '%v' for %s, got '%v'", value, key, v)
+		}
+	}
+	if _, when, _ := db.getExpires("key:50000"); when.IsZero() {
+		t.Fatal("expected key:50000 to have an expiration")
+	}
+
+	runtime.GC()
+	heapAfter := heapInuse()
+	if heapAfter >= heapBefore {
+		t.Fatalf("expected heap to shrink, before %d, after %d",
+			heapBefore, heapAfter)
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// doRefused are the commands that change the state of a connection, which
+// means nothing to Do.
+var doRefused = map[string]bool{
+	"auth": true, "client": true, "monitor": true, "quit": true,
+	"reset": true, "select": true,
+}
+
+// Do runs a command on database 0 and returns its reply. Status and bulk
+// replies are a string, integer replies are an int, a null is nil and arrays
+// are an []interface{}. An error reply is returned as an error that wraps an
+// *Error, which is one of the Err values for the common errors, so it can be
+// checked with errors.Is. The command is appended to the aof like a command
+// from a client.
+func (s *Server) Do(args ...string) (interface{}, error) {
+	return s.DoContext(context.Background(), args...)
+}
+
+// DoContext is like Do, but the command is not run when the context is done
+// before it starts, including while it waits on the lock, in which case the
+// error of the context is returned. A command that's running is not
+// interrupted, except for a command that blocks, such as WAITAOF, which gives
+// up waiting when the context is cancelled. The deadline of the context is
+// the same as the timeout of a command that blocks.
+func (s *Server) DoContext(ctx context.Context, args ...string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("missing command")
+	}
+	name := strings.ToLower(args[0])
+	cmd, ok := s.cmds[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name,
+			&Error{"ERR", "unknown command '" + args[0] + "'"})
+	}
+	if doRefused[name] {
+		return nil, fmt.Errorf("%s: %w", name,
+			&Error{"ERR", "'" + args[0] + "' can't be used with Do"})
+	}
+	iargs := make([]interface{}, len(args))
+	for i, arg := range args {
+		iargs[i] = arg
+	}
+	var buf bytes.Buffer
+	c := &client{wr: &buf, s: s, args: args, raw: buildCommand(iargs...),
+		addr: "do:0", authd: 2, created: time.Now(), ctx: ctx}
+	s.mu.Lock()
+	c.db = s.selectDB(0)
+	s.mu.Unlock()
+	s.exec(c, cmd)
+	if err := c.flushAOF(); err != nil {
+		return nil, err
+	}
+	if c.ctxErr != nil {
+		return nil, c.ctxErr
+	}
+	if c.err != nil {
+		return nil, fmt.Errorf("%s: %w", name, c.err)
+	}
+	return readReply(bufio.NewReader(&buf))
+}
+
+// readReply reads a RESP2 reply. The error replies in an array are an *Error.
+func readReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("invalid reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		code, msg := line, ""
+		if i := strings.IndexByte(line, ' '); i != -1 {
+			code, msg = line[:i], line[i+1:]
+		}
+		return &Error{code, msg}, nil
+	}
+	n, err := strconv.Atoi(line)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reply %q", line)
+	}
+	switch kind {
+	case ':':
+		return n, nil
+	case '$':
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			if arr[i], err = readReply(rd); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("invalid reply %q", string(kind)+line)
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"))
+	stop := testServe(t, s, addr)
+	defer stop()
+
+	if v, err := s.Do("SET", "key", "10"); err != nil || v != "OK" {
+		t.Fatalf("expected 'OK', got '%v', %v", v, err)
+	}
+	if v, err := s.Do("INCR", "key"); err != nil || v != 11 {
+		t.Fatalf("expected '11', got '%v', %v", v, err)
+	}
+	if v, err := s.Do("GET", "missing"); err != nil || v != nil {
+		t.Fatalf("expected nil, got '%v', %v", v, err)
+	}
+	s.Do("RPUSH", "list", "a", "b")
+	v, err := s.Do("LRANGE", "list", "0", "-1")
+	if arr, ok := v.([]interface{}); err != nil || !ok || len(arr) != 2 || arr[1] != "b" {
+		t.Fatalf("expected '[a b]', got '%v', %v", v, err)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		err  error
+	}{
+		{[]string{"GET", "list"}, ErrWrongType},
+		{[]string{"SET", "key", "value", "NX", "XX"}, ErrSyntax},
+		{[]string{"INCR", "list"}, ErrWrongType},
+		{[]string{"INCRBY", "key", "ten"}, ErrOutOfRange},
+		{[]string{"RENAME", "missing", "other"}, ErrNoSuchKey},
+	} {
+		_, err := s.Do(tc.args...)
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("%v: expected '%v', got '%v'", tc.args, tc.err, err)
+		}
+	}
+	s.Do("CONFIG", "SET", "maxmemory", "1")
+	if _, err := s.Do("SET", "other", "value"); !errors.Is(err, ErrOOM) {
+		t.Fatalf("expected '%v', got '%v'", ErrOOM, err)
+	}
+	s.Do("CONFIG", "SET", "maxmemory", "0")
+	if _, err := s.Do("SELECT", "1"); err == nil {
+		t.Fatal("expected SELECT to be refused")
+	}
+}
+
+// TestDoErrorSweep runs every command with bad arguments and checks that the
+// error replies are an *Error with a known code.
+func TestDoErrorSweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"))
+	stop := testServe(t, s, addr)
+	defer stop()
+
+	codes := map[string]bool{
+		"ERR": true, "WRONGTYPE": true, "NOAUTH": true, "OOM": true,
+		"LOADING": true, "MISCONF": true,
+	}
+	var names []string
+	for name := range s.cmds {
+		if name != strings.ToLower(name) {
+			// the commands are registered in both cases
+			continue
+		}
+		switch name {
+		case "shutdown", "debug", "export":
+			// these act on the process or the file system
+		default:
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var errs int
+		for n := 0; n < 6; n++ {
+			for _, key := range []string{"list", "missing"} {
+				s.Do("FLUSHALL")
+				s.Do("RPUSH", "list", "a", "b")
+				args := []string{strings.ToUpper(name)}
+				for i := 0; i < n; i++ {
+					if i == 0 {
+						args = append(args, key)
+					} else {
+						args = append(args, "nan")
+					}
+				}
+				_, err := s.Do(args...)
+				if err == nil {
+					continue
+				}
+				errs++
+				var e *Error
+				if !errors.As(err, &e) {
+					t.Fatalf("%v: expected an *Error, got %T '%v'", args, err, err)
+				}
+				if !codes[e.Code] {
+					t.Fatalf("%v: unexpected error code in '%v'", args, err)
+				}
+			}
+		}
+		if errs == 0 {
+			t.Fatalf("%s: expected an error for some of the arguments", name)
+		}
+	}
+}
+
+func TestDoContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"))
+	stop := testServe(t, s, addr)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.DoContext(ctx, "SET", "key", "value"); err != context.Canceled {
+		t.Fatalf("expected '%v', got '%v'", context.Canceled, err)
+	}
+	if v, err := s.Do("EXISTS", "key"); err != nil || v != 0 {
+		t.Fatalf("expected '0', got '%v', %v", v, err)
+	}
+
+	// cancelled while waiting on the lock
+	ctx, cancel = context.WithCancel(context.Background())
+	errc := make(chan error)
+	s.mu.Lock()
+	go func() {
+		_, err := s.DoContext(ctx, "SET", "key", "value")
+		errc <- err
+	}()
+	time.Sleep(time.Millisecond * 50)
+	cancel()
+	s.mu.Unlock()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("expected '%v', got '%v'", context.Canceled, err)
+	}
+	if v, err := s.Do("EXISTS", "key"); err != nil || v != 0 {
+		t.Fatalf("expected '0', got '%v', %v", v, err)
+	}
+
+	// a wait that's forever without a replica is abandoned on cancel
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		_, err := s.DoContext(ctx, "WAITAOF", "0", "1", "0")
+		errc <- err
+	}()
+	time.Sleep(time.Millisecond * 50)
+	start := time.Now()
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Fatalf("expected '%v', got '%v'", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected WAITAOF to give up on cancel")
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*100 {
+		t.Fatalf("expected WAITAOF to give up promptly, took %v", elapsed)
+	}
+	// the lock is released by the abandoned wait
+	if v, err := s.Do("SET", "key", "value"); err != nil || v != "OK" {
+		t.Fatalf("expected 'OK', got '%v', %v", v, err)
+	}
+
+	// the deadline is the timeout
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	v, err := s.DoContext(ctx, "WAITAOF", "0", "1", "0")
+	if arr, ok := v.([]interface{}); err != nil || !ok || len(arr) != 2 || arr[1] != 0 {
+		t.Fatalf("expected '[1 0]', got '%v', %v", v, err)
+	}
+}
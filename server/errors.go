@@ -0,0 +1,53 @@
+package server
+
+import (
+	"errors"
+	"io"
+)
+
+// Error is an error reply. The Code is the first word of the reply, such as
+// ERR or WRONGTYPE, which clients use to tell the kinds of errors apart.
+type Error struct {
+	Code    string
+	Message string
+}
+
+// The error replies that are shared by many commands. Use errors.Is to check
+// for them, an error returned by Server.Do wraps the reply error.
+var (
+	ErrWrongType  = &Error{"WRONGTYPE", "Operation against a key holding the wrong kind of value"}
+	ErrNoSuchKey  = &Error{"ERR", "no such key"}
+	ErrSyntax     = &Error{"ERR", "syntax error"}
+	ErrOutOfRange = &Error{"ERR", "value is not an integer or out of range"}
+	ErrOOM        = &Error{"OOM", "command not allowed when used memory > 'maxmemory'."}
+	ErrNoAuth     = &Error{"NOAUTH", "Authentication required."}
+	ErrTombstone  = &Error{"TOMBSTONE", "the key was deleted after the time of the write"}
+)
+
+// Error returns the error as it's written to the client, without the leading
+// '-'.
+func (err *Error) Error() string {
+	return err.Code + " " + err.Message
+}
+
+// Is reports whether the target is an *Error with the same code and message.
+func (err *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == err.Code && t.Message == err.Message
+}
+
+// replyErr writes an error reply. An *Error is written as its code and
+// message, any other error is an ERR. The first error of a command is kept
+// for Server.Do.
+func (c *client) replyErr(err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = &Error{"ERR", err.Error()}
+	}
+	c.replied('-')
+	io.WriteString(c.wr, "-"+e.Error()+"\r\n")
+	c.errd = true
+	if c.err == nil {
+		c.err = e
+	}
+}
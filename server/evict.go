@@ -0,0 +1,276 @@
+package server
+
+import (
+	"runtime"
+	"runtime/metrics"
+	"sync/atomic"
+)
+
+// Keys are evicted when the used memory is over maxmemory. The lru policies
+// use an approximated LRU like Redis. Each eviction samples maxmemory-samples
+// keys from every database and adds them to an eviction pool, which keeps the
+// evictionPoolSize most idle keys seen so far. The most idle key in the pool
+// is evicted. Because the pool is kept between evictions, repeated sampling
+// converges toward the keys that are truly idle, instead of evicting the
+// oldest of a handful of random keys.
+//
+// The used memory is the Go heap, which includes garbage until the next GC.
+// The estimated size of the evicted keys is subtracted from the heap until
+// then, otherwise a single write over the limit would evict much more than it
+// needs to. See usedMemory for how the other garbage is handled.
+
+const evictionPoolSize = 16
+
+var evictionPolicies = []string{
+	"noeviction", "allkeys-lru", "volatile-lru", "allkeys-random", "volatile-random",
+}
+
+type evictionCandidate struct {
+	idle uint32
+	db   int
+	key  string
+}
+
+// evictionPool is ordered by idle time, the most idle key is the last entry.
+type evictionPool struct {
+	entries []evictionCandidate
+}
+
+// insert adds a candidate to the pool. When the pool is full the candidate
+// replaces the least idle entry, unless it's less idle than all entries.
+func (p *evictionPool) insert(cand evictionCandidate) {
+	for i, e := range p.entries {
+		if e.db == cand.db && e.key == cand.key {
+			// already in the pool, it's added again with the new idle time
+			p.entries = append(p.entries[:i], p.entries[i+1:]...)
+			break
+		}
+	}
+	i := 0
+	for i < len(p.entries) && p.entries[i].idle < cand.idle {
+		i++
+	}
+	if len(p.entries) == evictionPoolSize {
+		if i == 0 {
+			return
+		}
+		// drop the least idle entry to make room
+		copy(p.entries, p.entries[1:i])
+		p.entries[i-1] = cand
+		return
+	}
+	p.entries = append(p.entries, evictionCandidate{})
+	copy(p.entries[i+1:], p.entries[i:])
+	p.entries[i] = cand
+}
+
+// pop removes and returns the most idle key.
+func (p *evictionPool) pop() (evictionCandidate, bool) {
+	if len(p.entries) == 0 {
+		return evictionCandidate{}, false
+	}
+	cand := p.entries[len(p.entries)-1]
+	p.entries = p.entries[:len(p.entries)-1]
+	return cand, true
+}
+
+// populate samples keys from the database and adds them to the pool. The
+// volatile policies only sample keys that have an expiration time. The keys
+// that are exempt from eviction are skipped and not counted as samples, and at
+// most limit keys are visited. A nil exempt skips no keys and a zero limit
+// visits every key.
+func (p *evictionPool) populate(db *database, samples int, volatile bool, now uint32,
+	exempt func(key string) bool, limit int,
+) {
+	var visited int
+	add := func(key string) bool {
+		visited++
+		if exempt == nil || !exempt(key) {
+			if item, ok := db.items[key]; ok {
+				p.insert(evictionCandidate{idle: item.idle(now), db: db.num, key: key})
+			}
+			samples--
+		}
+		return samples > 0 && (limit == 0 || visited < limit)
+	}
+	// map iteration starts at a random position
+	if volatile {
+		for key := range db.expires {
+			if !add(key) {
+				return
+			}
+		}
+	} else {
+		for key := range db.items {
+			if !add(key) {
+				return
+			}
+		}
+	}
+}
+
+// usedMemory returns the bytes of the heap minus the estimated size of the
+// keys evicted since the last GC. When the heap is over maxmemory and enough
+// has been allocated since the last GC, a GC is forced to remove the garbage
+// from the measurement. This bounds the cost of the GC to once for every
+// tenth of maxmemory that's allocated.
+func (s *Server) usedMemory() int {
+	used, allocs := s.readHeap()
+	if used > s.cfg.maxMemory && allocs-s.evictAllocs > uint64(s.cfg.maxMemory/10) {
+		runtime.GC()
+		used, _ = s.readHeap()
+	}
+	return used
+}
+
+// readHeap returns the used memory and the total bytes allocated. Reading
+// runtime/metrics does not stop the world, unlike runtime.ReadMemStats.
+func (s *Server) readHeap() (used int, allocs uint64) {
+	sample := []metrics.Sample{
+		{Name: "/memory/classes/heap/objects:bytes"},
+		{Name: "/gc/cycles/total:gc-cycles"},
+		{Name: "/gc/heap/allocs:bytes"},
+	}
+	metrics.Read(sample)
+	allocs = sample[2].Value.Uint64()
+	if gcs := sample[1].Value.Uint64(); gcs != s.evictGCs {
+		s.evictGCs = gcs
+		s.evictFreed = 0
+		s.evictAllocs = allocs
+	}
+	used = int(sample[0].Value.Uint64()) - s.evictFreed
+	if used < 0 {
+		used = 0
+	}
+	return used, allocs
+}
+
+// freeMemory evicts keys until the used memory is not over maxmemory. Returns
+// false if the used memory is still over maxmemory, in which case commands
+// that may create keys are refused. Must be called while holding the write
+// lock.
+func (s *Server) freeMemory() bool {
+	if s.cfg.maxMemory == 0 || s.follower || s.Loading() {
+		return true
+	}
+	used := s.usedMemory()
+	for used > s.cfg.maxMemory {
+		db, key, ok := s.evictionCandidate()
+		if !ok {
+			return false
+		}
+		value, ok := db.del(key)
+		if !ok {
+			// the key had expired, which is not an eviction
+			continue
+		}
+		size := memoryUsage(key, value, s.cfg.maxMemorySamples)
+		s.evictFreed += size
+		used -= size
+		atomic.AddUint64(&s.evictedKeys, 1)
+		s.appendAOF(db.num, buildCommand("DEL", key))
+	}
+	return true
+}
+
+// evictionExemptScan is how many keys are visited for each sample when
+// eviction-exempt-patterns is set, before every key is visited instead.
+const evictionExemptScan = 16
+
+// evictionExempt returns true when the key is excluded from eviction by
+// eviction-exempt-dbs or eviction-exempt-patterns.
+func (s *Server) evictionExempt(db int, key string) bool {
+	return s.dbEvictionExempt(db) || matchAny(s.cfg.evictionExemptPatterns, key)
+}
+
+// dbEvictionExempt returns true when all keys of the database are excluded
+// from eviction.
+func (s *Server) dbEvictionExempt(db int) bool {
+	for _, num := range s.cfg.evictionExemptDBs {
+		if num == db {
+			return true
+		}
+	}
+	return false
+}
+
+// populateEvictionPool samples the databases that are not exempt from
+// eviction. See populate for the limit.
+func (s *Server) populateEvictionPool(volatile bool, limit int) {
+	var exempt func(key string) bool
+	if patterns := s.cfg.evictionExemptPatterns; len(patterns) > 0 {
+		exempt = func(key string) bool { return matchAny(patterns, key) }
+	}
+	now := lruClock()
+	for _, db := range s.dbs {
+		if !s.dbEvictionExempt(db.num) {
+			s.evictPool.populate(db, s.cfg.maxMemorySamples, volatile, now, exempt, limit)
+		}
+	}
+}
+
+// evictionCandidate returns the next key to evict by the maxmemory-policy.
+// Returns false if there are no keys that can be evicted.
+func (s *Server) evictionCandidate() (*database, string, bool) {
+	policy := s.cfg.maxMemoryPolicy
+	volatile := policy == "volatile-lru" || policy == "volatile-random"
+	switch policy {
+	case "allkeys-lru", "volatile-lru":
+		for {
+			s.populateEvictionPool(volatile, s.cfg.maxMemorySamples*evictionExemptScan)
+			if len(s.evictPool.entries) == 0 {
+				// the visited keys may all be exempt, the other keys are
+				// visited before giving up
+				s.populateEvictionPool(volatile, 0)
+				if len(s.evictPool.entries) == 0 {
+					return nil, "", false
+				}
+			}
+			// the pooled keys may have been deleted since they were added
+			for {
+				cand, ok := s.evictPool.pop()
+				if !ok {
+					break
+				}
+				db := s.dbs[cand.db]
+				if db == nil {
+					continue
+				}
+				if _, ok := db.items[cand.key]; !ok {
+					continue
+				}
+				if volatile {
+					if _, ok := db.expires[cand.key]; !ok {
+						continue
+					}
+				}
+				if s.evictionExempt(cand.db, cand.key) {
+					// exempted after it was added to the pool
+					continue
+				}
+				return db, cand.key, true
+			}
+		}
+	case "allkeys-random", "volatile-random":
+		patterns := s.cfg.evictionExemptPatterns
+		for _, db := range s.dbs {
+			if s.dbEvictionExempt(db.num) {
+				continue
+			}
+			if volatile {
+				for key := range db.expires {
+					if !matchAny(patterns, key) {
+						return db, key, true
+					}
+				}
+			} else {
+				for key := range db.items {
+					if !matchAny(patterns, key) {
+						return db, key, true
+					}
+				}
+			}
+		}
+	}
+	return nil, "", false
+}
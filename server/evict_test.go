@@ -0,0 +1,212 @@
+package server
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestEvictionFidelity checks that the lru eviction evicts idle keys. The
+// keys have a known access pattern, 10% are hot and 90% are cold, and half of
+// the dataset is evicted.
+func TestEvictionFidelity(t *testing.T) {
+	const numKeys = 10000
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, _ := testNewServer(t, filepath.Join(dir, "appendonly.aof"),
+		"--maxmemory-policy", "allkeys-lru")
+	db := s.selectDB(0)
+	rng := rand.New(rand.NewSource(1))
+	now := lruClock()
+	hot := make(map[string]bool)
+	idle := make([]int, 0, numKeys)
+	for i := 0; i < numKeys; i++ {
+		key := "key:" + strconv.Itoa(i)
+		db.set(key, "value")
+		// hot keys were accessed within the last two seconds, cold keys
+		// within the last hour
+		n := 2 + rng.Intn(3600)
+		if i%10 == 0 {
+			hot[key] = true
+			n = rng.Intn(2)
+		}
+		db.items[key].lru = now - uint32(n)
+		idle = append(idle, n)
+	}
+	sort.Ints(idle)
+	median := uint32(idle[numKeys/2])
+
+	var cold, idlest int
+	for i := 0; i < numKeys/2; i++ {
+		db, key, ok := s.evictionCandidate()
+		if !ok {
+			t.Fatal("expected a candidate")
+		}
+		if !hot[key] {
+			cold++
+		}
+		if db.items[key].idle(now) >= median {
+			idlest++
+		}
+		db.del(key)
+	}
+	if cold < numKeys/2*95/100 {
+		t.Fatalf("expected at least 95%% cold keys, got %d of %d", cold, numKeys/2)
+	}
+	// the pool converges toward the most idle half of the dataset
+	if idlest < numKeys/2*80/100 {
+		t.Fatalf("expected at least 80%% from the most idle half, got %d of %d",
+			idlest, numKeys/2)
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	addr, stop := testStartServer(t, aofPath)
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	conn.do("CONFIG", "SET", "maxmemory", "1mb")
+	if v := conn.do("CONFIG", "GET", "maxmemory").([]interface{}); v[1] != "1048576" {
+		t.Fatalf("expected '1048576', got '%v'", v[1])
+	}
+	if _, ok := conn.do("CONFIG", "SET", "maxmemory-policy", "allkeys-lfu").(error); !ok {
+		t.Fatal("expected an error for an unknown policy")
+	}
+
+	// the limit is a few megabytes over the current heap
+	info := conn.do("INFO", "memory").(string)
+	var used int
+	for _, line := range strings.Split(info, "\n") {
+		if strings.HasPrefix(line, "used_memory:") {
+			used, _ = strconv.Atoi(line[len("used_memory:"):])
+		}
+	}
+	conn.do("CONFIG", "SET", "maxmemory", strconv.Itoa(used+4*1024*1024))
+	value := strings.Repeat("x", 100*1024)
+	var oom bool
+	for i := 0; i < 200 && !oom; i++ {
+		err, ok := conn.do("SET", "key:"+strconv.Itoa(i), value).(error)
+		oom = ok && strings.HasPrefix(err.Error(), "OOM ")
+	}
+	if !oom {
+		t.Fatal("expected an OOM error with noeviction")
+	}
+	if v := conn.do("DEL", "key:0"); v != 1 {
+		t.Fatalf("expected deletes to be allowed, got '%v'", v)
+	}
+
+	conn.do("CONFIG", "SET", "maxmemory-policy", "allkeys-lru")
+	for i := 0; i < 200; i++ {
+		if v := conn.do("SET", "key:"+strconv.Itoa(i), value); v != "OK" {
+			t.Fatalf("expected 'OK', got '%v'", v)
+		}
+	}
+	info = conn.do("INFO", "stats").(string)
+	if strings.Contains(info, "evicted_keys:0\n") {
+		t.Fatalf("expected evicted keys, got\n%s", info)
+	}
+	data, err := ioutil.ReadFile(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\r\nDEL\r\n"); n < 2 {
+		t.Fatalf("expected the evictions in the aof, got %d DELs", n)
+	}
+	conn.do("CONFIG", "SET", "maxmemory", "0")
+}
+
+// TestEvictionExempt checks that exempt keys are never evicted, and that
+// writes fail with OOM when the exempt keys alone reach maxmemory.
+func TestEvictionExempt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"))
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	conn.do("CONFIG", "SET", "eviction-exempt-patterns", "config:* settings")
+	conn.do("CONFIG", "SET", "eviction-exempt-dbs", "1")
+	if v := conn.do("CONFIG", "GET", "eviction-exempt-dbs").([]interface{}); v[1] != "1" {
+		t.Fatalf("expected '1', got '%v'", v[1])
+	}
+	if _, ok := conn.do("CONFIG", "SET", "eviction-exempt-dbs", "one").(error); !ok {
+		t.Fatal("expected an error for an invalid database")
+	}
+
+	info := conn.do("INFO", "memory").(string)
+	var used int
+	for _, line := range strings.Split(info, "\n") {
+		if strings.HasPrefix(line, "used_memory:") {
+			used, _ = strconv.Atoi(line[len("used_memory:"):])
+		}
+	}
+	conn.do("CONFIG", "SET", "maxmemory-policy", "allkeys-lru")
+	conn.do("CONFIG", "SET", "maxmemory", strconv.Itoa(used+4*1024*1024))
+	defer conn.do("CONFIG", "SET", "maxmemory", "0")
+
+	// a mix of exempt and evictable keys, several times maxmemory
+	value := strings.Repeat("x", 100*1024)
+	for i := 0; i < 5; i++ {
+		conn.do("SET", "config:"+strconv.Itoa(i), value)
+		conn.do("SELECT", "1")
+		conn.do("SET", "db1:"+strconv.Itoa(i), value)
+		conn.do("SELECT", "0")
+	}
+	for i := 0; i < 200; i++ {
+		if v := conn.do("SET", "cache:"+strconv.Itoa(i), value); v != "OK" {
+			t.Fatalf("expected 'OK', got '%v'", v)
+		}
+	}
+	info = conn.do("INFO", "stats").(string)
+	if strings.Contains(info, "evicted_keys:0\n") {
+		t.Fatalf("expected evicted keys, got\n%s", info)
+	}
+	for i := 0; i < 5; i++ {
+		if v := conn.do("EXISTS", "config:"+strconv.Itoa(i)); v != 1 {
+			t.Fatalf("expected config:%d to exist", i)
+		}
+	}
+	conn.do("SELECT", "1")
+	if v := conn.do("DBSIZE"); v != 5 {
+		t.Fatalf("expected 5 keys in db 1, got %v", v)
+	}
+	conn.do("SELECT", "0")
+
+	// the evictable keys run out
+	var oom bool
+	for i := 5; i < 200 && !oom; i++ {
+		err, ok := conn.do("SET", "config:"+strconv.Itoa(i), value).(error)
+		oom = ok && strings.HasPrefix(err.Error(), "OOM ")
+	}
+	if !oom {
+		t.Fatal("expected an OOM error when the exempt keys reach maxmemory")
+	}
+	if v := conn.do("KEYS", "cache:*").([]interface{}); len(v) != 0 {
+		t.Fatalf("expected the evictable keys to be evicted, got %d", len(v))
+	}
+	// over half of a smaller maxmemory is exempt
+	conn.do("CONFIG", "SET", "maxmemory", "1mb")
+	report := conn.do("MEMORY", "DOCTOR").(string)
+	if !strings.Contains(report, "Eviction exempt keys") {
+		t.Fatalf("expected an exempt keys report, got\n%s", report)
+	}
+}
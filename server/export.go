@@ -0,0 +1,306 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// An export writes the keyspace to a file in the background. The keys of each
+// database are collected under the read lock, and then the values are read in
+// small batches, which lets writers run between the batches. The export is
+// not a point-in-time snapshot: a key that is changed during the export is
+// written as it is when its batch is read, and a key that is deleted before
+// then is skipped.
+
+const exportBatchSize = 100 // keys read per lock hold
+
+// ExportOptions are the options of an Export.
+type ExportOptions struct {
+	Format string // "json" for JSON lines, or "csv", the default is "json"
+	Match  string // only the keys that match this glob pattern
+	Type   string // only the keys of this type, such as "string" or "list"
+}
+
+// exportRecord is a single key of an export. The ttl is in milliseconds, -1
+// for a key without an expiration.
+type exportRecord struct {
+	DB    int         `json:"db"`
+	Key   string      `json:"key"`
+	Type  string      `json:"type"`
+	TTL   int64       `json:"ttl"`
+	Value interface{} `json:"value"`
+}
+
+// exportState is the progress of the EXPORT command.
+type exportState struct {
+	path    string
+	started time.Time
+	elapsed time.Duration
+	total   int   // the number of keys when the export started
+	written int64 // atomic
+	running bool
+	err     error
+}
+
+// Export writes the keys of all databases to w and returns the number of keys
+// written. JSON lines have the db, key, type, ttl and value fields. CSV
+// records have the same columns, with a header, and lists and sets are
+// written as a JSON array in the value column, and hashes and sorted sets as
+// a JSON object. This must not be called while
+// holding the server lock.
+func (s *Server) Export(w io.Writer, opts ExportOptions) (int, error) {
+	var written int64
+	err := s.export(w, opts, &written)
+	return int(written), err
+}
+
+func (s *Server) export(w io.Writer, opts ExportOptions, written *int64) error {
+	format := strings.ToLower(opts.Format)
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		return fmt.Errorf("unknown export format '%s'", opts.Format)
+	}
+	var match *pattern
+	if opts.Match != "" {
+		match = parsePattern(opts.Match)
+	}
+	typ := strings.ToLower(opts.Type)
+
+	wr := bufio.NewWriter(w)
+	var cw *csv.Writer
+	if format == "csv" {
+		cw = csv.NewWriter(wr)
+		cw.Write([]string{"db", "key", "type", "ttl", "value"})
+	}
+	write := func(rec exportRecord) error {
+		if cw == nil {
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			wr.Write(data)
+			return wr.WriteByte('\n')
+		}
+		value, ok := rec.Value.(string)
+		if !ok {
+			data, err := json.Marshal(rec.Value)
+			if err != nil {
+				return err
+			}
+			value = string(data)
+		}
+		return cw.Write([]string{strconv.Itoa(rec.DB), rec.Key, rec.Type,
+			strconv.FormatInt(rec.TTL, 10), value})
+	}
+
+	s.mu.RLock()
+	dbs := make([]*database, 0, len(s.dbs))
+	for _, db := range s.dbs {
+		dbs = append(dbs, db)
+	}
+	s.mu.RUnlock()
+	sort.Sort(dbsByNumber(dbs))
+
+	var recs []exportRecord
+	for _, db := range dbs {
+		s.mu.RLock()
+		var keys []string
+		db.ascend(func(key string, value interface{}) bool {
+			if match == nil || match.match(key) {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		s.mu.RUnlock()
+		sort.Strings(keys)
+		for len(keys) > 0 {
+			n := exportBatchSize
+			if n > len(keys) {
+				n = len(keys)
+			}
+			recs = recs[:0]
+			now := time.Now()
+			s.mu.RLock()
+			for _, key := range keys[:n] {
+				if rec, ok := exportKey(db, key, now); ok && (typ == "" || rec.Type == typ) {
+					recs = append(recs, rec)
+				}
+			}
+			s.mu.RUnlock()
+			keys = keys[n:]
+			for _, rec := range recs {
+				if err := write(rec); err != nil {
+					return err
+				}
+				atomic.AddInt64(written, 1)
+			}
+		}
+	}
+	if cw != nil {
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+	}
+	return wr.Flush()
+}
+
+// exportKey returns the record of a key. The values are copied because they
+// are written after the lock is released.
+func exportKey(db *database, key string, now time.Time) (exportRecord, bool) {
+	value, when, ok := db.getExpires(key)
+	if !ok {
+		return exportRecord{}, false
+	}
+	rec := exportRecord{DB: db.num, Key: key, Type: db.getType(key), TTL: -1}
+	if !when.IsZero() {
+		rec.TTL = int64(when.Sub(now) / time.Millisecond)
+	}
+	switch v := value.(type) {
+	case int:
+		rec.Value = strconv.Itoa(v)
+	case string:
+		rec.Value = v
+	case *list:
+		rec.Value = v.strArr()
+	case *set:
+		members := v.strArr()
+		sort.Strings(members)
+		rec.Value = members
+	case *hash:
+		rec.Value = v.copy().m
+	case *zset:
+		rec.Value = v.scores()
+	}
+	return rec, true
+}
+
+// exportCommand is EXPORT path [FORMAT json|csv] [MATCH pattern] [TYPE type]
+// or EXPORT STATUS. A relative path is in the same directory as the aof.
+func exportCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	if strings.ToLower(c.args[1]) == "status" && len(c.args) == 2 {
+		exportStatusCommand(c)
+		return
+	}
+	if len(c.args)%2 != 0 {
+		c.replySyntaxError()
+		return
+	}
+	var opts ExportOptions
+	for i := 2; i < len(c.args); i += 2 {
+		switch strings.ToLower(c.args[i]) {
+		default:
+			c.replySyntaxError()
+			return
+		case "format":
+			opts.Format = strings.ToLower(c.args[i+1])
+			if opts.Format != "json" && opts.Format != "csv" {
+				c.replyError("FORMAT must be 'json' or 'csv'")
+				return
+			}
+		case "match":
+			opts.Match = c.args[i+1]
+		case "type":
+			opts.Type = c.args[i+1]
+		}
+	}
+	c.s.jobsMu.Lock()
+	defer c.s.jobsMu.Unlock()
+	if c.s.exportState != nil && c.s.exportState.running {
+		c.replyError("Background export already in progress")
+		return
+	}
+	file := c.args[1]
+	if !path.IsAbs(file) {
+		file = path.Join(path.Dir(c.s.aofPath), file)
+	}
+	var total int
+	for _, db := range c.s.dbs {
+		total += db.len()
+	}
+	state := &exportState{path: file, started: time.Now(), total: total, running: true}
+	c.s.exportState = state
+	c.s.workers.start(workerJobs, func(ctx context.Context) {
+		err := c.s.exportFile(file, opts, &state.written)
+		c.s.jobsMu.Lock()
+		state.running = false
+		state.err = err
+		state.elapsed = time.Since(state.started)
+		c.s.jobsMu.Unlock()
+		if err != nil {
+			c.s.lwarningf("Background export to %s failed: %v", file, err)
+		} else {
+			c.s.lnoticef("Background export to %s finished, %d keys",
+				file, atomic.LoadInt64(&state.written))
+		}
+	})
+	c.replyString("Background export started")
+}
+
+// exportFile writes the export to a temporary file, which replaces the file
+// when the export is complete.
+func (s *Server) exportFile(file string, opts ExportOptions, written *int64) error {
+	tempName := file + ".tmp"
+	f, err := os.Create(tempName)
+	if err != nil {
+		return err
+	}
+	if err := s.export(f, opts, written); err != nil {
+		f.Close()
+		os.Remove(tempName)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	return os.Rename(tempName, file)
+}
+
+func exportStatusCommand(c *client) {
+	c.s.jobsMu.Lock()
+	defer c.s.jobsMu.Unlock()
+	state := c.s.exportState
+	if state == nil {
+		c.replyMultiBulkLen(2)
+		c.replyBulk("status")
+		c.replyBulk("none")
+		return
+	}
+	status, elapsed, errmsg := "done", state.elapsed, ""
+	if state.running {
+		status, elapsed = "running", time.Since(state.started)
+	} else if state.err != nil {
+		status, errmsg = "failed", state.err.Error()
+	}
+	c.replyMultiBulkLen(12)
+	c.replyBulk("status")
+	c.replyBulk(status)
+	c.replyBulk("path")
+	c.replyBulk(state.path)
+	c.replyBulk("keys-total")
+	c.replyInt(state.total)
+	c.replyBulk("keys-written")
+	c.replyInt(int(atomic.LoadInt64(&state.written)))
+	c.replyBulk("elapsed-ms")
+	c.replyInt(int(elapsed / time.Millisecond))
+	c.replyBulk("error")
+	c.replyBulk(errmsg)
+}
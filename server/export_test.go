@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"))
+	stop := testServe(t, s, addr)
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+	conn.do("SET", "user:1", "alice")
+	conn.do("SET", "user:2", "bob", "EX", "100")
+	conn.do("RPUSH", "user:list", "a", "b")
+	conn.do("SADD", "user:set", "y", "x")
+	conn.do("SET", "other", "value")
+	conn.do("SELECT", "1")
+	conn.do("SET", "user:3", "carol")
+	conn.do("SELECT", "0")
+
+	// the Go api
+	var buf bytes.Buffer
+	n, err := s.Export(&buf, ExportOptions{Match: "user:*"})
+	if err != nil || n != 5 {
+		t.Fatalf("expected 5 keys, got %d, %v", n, err)
+	}
+	var recs []exportRecord
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var rec exportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) != 5 || recs[0].Key != "user:1" || recs[0].TTL != -1 ||
+		recs[1].TTL <= 0 || recs[1].TTL > 100000 || recs[4].DB != 1 {
+		t.Fatalf("unexpected records %+v", recs)
+	}
+	if v, ok := recs[3].Value.([]interface{}); !ok || len(v) != 2 || v[0] != "x" {
+		t.Fatalf("expected the sorted members, got %v", recs[3].Value)
+	}
+
+	// the command, in the background
+	if v := conn.do("EXPORT", "STATUS").([]interface{}); v[1] != "none" {
+		t.Fatalf("expected no export, got %v", v)
+	}
+	if v := conn.do("EXPORT", "dump.csv", "FORMAT", "csv", "TYPE", "string"); v != "Background export started" {
+		t.Fatalf("unexpected reply %v", v)
+	}
+	var status map[string]interface{}
+	start := time.Now()
+	for {
+		v := conn.do("EXPORT", "STATUS").([]interface{})
+		status = make(map[string]interface{})
+		for i := 0; i < len(v); i += 2 {
+			status[v[i].(string)] = v[i+1]
+		}
+		if status["status"] != "running" {
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("timeout waiting for the export")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if status["status"] != "done" || status["keys-written"] != 4 ||
+		status["path"] != filepath.Join(dir, "dump.csv") {
+		t.Fatalf("unexpected status %v", status)
+	}
+	f, err := os.Open(filepath.Join(dir, "dump.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, row := range rows {
+		if row[3] != "-1" && row[3] != "ttl" {
+			if ttl, _ := strconv.Atoi(row[3]); ttl <= 0 {
+				t.Fatalf("unexpected ttl %v", row)
+			}
+			row[3] = "ttl"
+		}
+		lines = append(lines, strings.Join(row, ","))
+	}
+	expect := "db,key,type,ttl,value\n0,other,string,-1,value\n" +
+		"0,user:1,string,-1,alice\n0,user:2,string,ttl,bob\n1,user:3,string,-1,carol"
+	if got := strings.Join(lines, "\n"); got != expect {
+		t.Fatalf("expected\n%s\ngot\n%s", expect, got)
+	}
+
+	if _, ok := conn.do("EXPORT", "dump.txt", "FORMAT", "xml").(error); !ok {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
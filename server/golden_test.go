@@ -0,0 +1,24 @@
+package server_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/tidwall/sider/server/testsupport"
+)
+
+// TestGolden runs the scripts in testdata. Set SIDER_COMPARE_ADDR to the
+// address of a Redis server to run the same scripts against Redis.
+func TestGolden(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		path := path
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			addr := testsupport.StartTestServer(t)
+			testsupport.RunScript(t, addr, path)
+		})
+	}
+}
@@ -0,0 +1,471 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type hash struct {
+	m map[string]string
+}
+
+func newHash() *hash {
+	return &hash{make(map[string]string)}
+}
+
+// set sets a field and returns true when the field is new.
+func (h *hash) set(field, value string) bool {
+	_, ok := h.m[field]
+	h.m[field] = value
+	return !ok
+}
+
+func (h *hash) get(field string) (string, bool) {
+	value, ok := h.m[field]
+	return value, ok
+}
+
+func (h *hash) del(field string) bool {
+	if _, ok := h.m[field]; ok {
+		delete(h.m, field)
+		return true
+	}
+	return false
+}
+
+func (h *hash) len() int {
+	return len(h.m)
+}
+
+func (h *hash) ascend(iterator func(field, value string) bool) {
+	for field, value := range h.m {
+		if !iterator(field, value) {
+			return
+		}
+	}
+}
+
+// copy returns a new hash with the same fields.
+func (h *hash) copy() *hash {
+	h2 := &hash{make(map[string]string, len(h.m))}
+	for field, value := range h.m {
+		h2.m[field] = value
+	}
+	return h2
+}
+
+func (h *hash) fields() []string {
+	fields := make([]string, 0, len(h.m))
+	for field := range h.m {
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// sortedFields returns the fields in order, for a digest that must be stable.
+func (h *hash) sortedFields() []string {
+	fields := h.fields()
+	sort.Strings(fields)
+	return fields
+}
+
+// hsetCommand is HSET key field value [field value ...]. Replies with the
+// number of new fields.
+func hsetCommand(c *client) {
+	if len(c.args) < 4 || len(c.args)%2 != 0 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], true)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	count := 0
+	for i := 2; i < len(c.args); i += 2 {
+		if h.set(c.args[i], c.args[i+1]) {
+			count++
+		}
+	}
+	c.dirty++
+	c.replyInt(count)
+}
+
+func hgetCommand(c *client) {
+	if len(c.args) != 3 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if h == nil {
+		c.replyNull()
+		return
+	}
+	value, ok := h.get(c.args[2])
+	if !ok {
+		c.replyNull()
+		return
+	}
+	c.replyBulk(value)
+}
+
+// hdelCommand is HDEL key field [field ...]. The key is deleted with its last
+// field.
+func hdelCommand(c *client) {
+	if len(c.args) < 3 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if h == nil {
+		c.replyInt(0)
+		return
+	}
+	count := 0
+	for i := 2; i < len(c.args); i++ {
+		if h.del(c.args[i]) {
+			count++
+			c.dirty++
+		}
+	}
+	if h.len() == 0 {
+		c.db.del(c.args[1])
+	}
+	c.replyInt(count)
+}
+
+// hgetallCommand is HGETALL key. The reply is a map for RESP3, otherwise a
+// flat array of fields and values.
+func hgetallCommand(c *client) {
+	if len(c.args) != 2 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if h == nil {
+		c.replyMapLen(0)
+		return
+	}
+	c.replyMapLen(h.len())
+	h.ascend(func(field, value string) bool {
+		c.replyBulk(field)
+		c.replyBulk(value)
+		return true
+	})
+}
+
+func hlenCommand(c *client) {
+	if len(c.args) != 2 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if h == nil {
+		c.replyInt(0)
+		return
+	}
+	c.replyInt(h.len())
+}
+
+func hexistsCommand(c *client) {
+	if len(c.args) != 3 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if h == nil {
+		c.replyBoolOrInt(false)
+		return
+	}
+	_, ok = h.get(c.args[2])
+	c.replyBoolOrInt(ok)
+}
+
+// hsetnxCommand is HSETNX key field value. The field is only set when it
+// doesn't exist.
+func hsetnxCommand(c *client) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if h != nil {
+		if _, ok := h.get(c.args[2]); ok {
+			c.replyInt(0)
+			return
+		}
+	} else {
+		h, _ = c.db.getHash(c.args[1], true)
+	}
+	h.set(c.args[2], c.args[3])
+	c.dirty++
+	c.replyInt(1)
+}
+
+// hmgetCommand is HMGET key field [field ...]. A missing field, or a missing
+// key, is a nil.
+func hmgetCommand(c *client) {
+	if len(c.args) < 3 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	c.replyMultiBulkLen(len(c.args) - 2)
+	for _, field := range c.args[2:] {
+		if h == nil {
+			c.replyNull()
+		} else if value, ok := h.get(field); ok {
+			c.replyBulk(value)
+		} else {
+			c.replyNull()
+		}
+	}
+}
+
+func hkeysCommand(c *client) {
+	hascendCommand(c, func(field, value string) { c.replyBulk(field) })
+}
+
+func hvalsCommand(c *client) {
+	hascendCommand(c, func(field, value string) { c.replyBulk(value) })
+}
+
+// hascendCommand replies with an array that has one element per field of the
+// hash, such as for HKEYS and HVALS. A missing key is an empty array.
+func hascendCommand(c *client, reply func(field, value string)) {
+	if len(c.args) != 2 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if h == nil {
+		c.replyMultiBulkLen(0)
+		return
+	}
+	c.replyMultiBulkLen(h.len())
+	h.ascend(func(field, value string) bool {
+		reply(field, value)
+		return true
+	})
+}
+
+// hstrlenCommand is HSTRLEN key field. Replies with the length of the value
+// in bytes, or zero for a missing field.
+func hstrlenCommand(c *client) {
+	if len(c.args) != 3 {
+		c.replyAritryError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if h == nil {
+		c.replyInt(0)
+		return
+	}
+	value, _ := h.get(c.args[2])
+	c.replyInt(len(value))
+}
+
+// hincrbyCommand is HINCRBY key field increment. A missing field is zero.
+func hincrbyCommand(c *client) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	delta, err := atoi(c.args[3])
+	if err != nil {
+		c.replyInvalidIntError()
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	var n int
+	if h != nil {
+		if value, ok := h.get(c.args[2]); ok {
+			n, err = atoi(value)
+			if err != nil {
+				c.replyError("hash value is not an integer")
+				return
+			}
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) ||
+		(delta < 0 && n < math.MinInt64-delta) {
+		c.replyError("increment or decrement would overflow")
+		return
+	}
+	n += delta
+	if h == nil {
+		h, _ = c.db.getHash(c.args[1], true)
+	}
+	h.set(c.args[2], itoa(n))
+	c.replyInt(n)
+	c.dirty++
+}
+
+// hincrbyfloatCommand is HINCRBYFLOAT key field increment. A missing field is
+// zero, and the result is formatted like INCRBYFLOAT.
+func hincrbyfloatCommand(c *client) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	delta, err := parseFloat(c.args[3])
+	if err != nil {
+		c.replyError("value is not a valid float")
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	var n float64
+	if h != nil {
+		if value, ok := h.get(c.args[2]); ok {
+			n, err = parseFloat(value)
+			if err != nil {
+				c.replyError("hash value is not a float")
+				return
+			}
+		}
+	}
+	n += delta
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		c.replyError("increment would produce NaN or Infinity")
+		return
+	}
+	if h == nil {
+		h, _ = c.db.getHash(c.args[1], true)
+	}
+	res := strconv.FormatFloat(n, 'f', -1, 64)
+	h.set(c.args[2], res)
+	c.replyBulk(res)
+	c.dirty++
+}
+
+// hrandfieldCommand is HRANDFIELD key [count [WITHVALUES]]. A positive count
+// picks distinct fields, up to all of them, and a negative count picks
+// -count fields that may repeat.
+func hrandfieldCommand(c *client) {
+	if len(c.args) < 2 || len(c.args) > 4 {
+		c.replyAritryError()
+		return
+	}
+	countSpecified := false
+	count := 1
+	withValues := false
+	if len(c.args) > 2 {
+		n, err := strconv.ParseInt(c.args[2], 10, 64)
+		if err != nil {
+			c.replyInvalidIntError()
+			return
+		}
+		if n < -math.MaxInt64/2 {
+			c.replyError("value is out of range")
+			return
+		}
+		count = int(n)
+		countSpecified = true
+		if len(c.args) == 4 {
+			if strings.ToLower(c.args[3]) != "withvalues" {
+				c.replySyntaxError()
+				return
+			}
+			withValues = true
+		}
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if h == nil {
+		if countSpecified {
+			c.replyMultiBulkLen(0)
+		} else {
+			c.replyNull()
+		}
+		return
+	}
+	fields := h.fields()
+	if !countSpecified {
+		c.replyBulk(fields[rand.Intn(len(fields))])
+		return
+	}
+	reply := func(field string) {
+		c.replyBulk(field)
+		if withValues {
+			c.replyBulk(h.m[field])
+		}
+	}
+	n := 1
+	if withValues {
+		n = 2
+	}
+	if count < 0 {
+		// like SRANDMEMBER, the fields are written as they are picked
+		count = -count
+		c.replyMultiBulkLen(count * n)
+		for i := 0; i < count; i++ {
+			if i%randMemberChunk == 0 && c.writeFailed() {
+				return
+			}
+			reply(fields[rand.Intn(len(fields))])
+		}
+		return
+	}
+	if count > len(fields) {
+		count = len(fields)
+	}
+	// the first count fields of a partial shuffle
+	for i := 0; i < count; i++ {
+		j := i + rand.Intn(len(fields)-i)
+		fields[i], fields[j] = fields[j], fields[i]
+	}
+	c.replyMultiBulkLen(count * n)
+	for _, field := range fields[:count] {
+		reply(field)
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestHashAOF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	s, addr := testNewServer(t, aofPath)
+	stop := testServe(t, s, addr)
+	defer func() { stop() }()
+
+	// interleave the writes, including a hash that's emptied and created again
+	for i := 0; i < 100; i++ {
+		field := "f" + strconv.Itoa(i%10)
+		s.Do("HSET", "hash", field, strconv.Itoa(i), "x", "y")
+		if i%3 == 0 {
+			s.Do("HDEL", "hash", "f"+strconv.Itoa((i+5)%10))
+		}
+		s.Do("HSET", "gone", field, "1")
+		if i%7 == 0 {
+			s.Do("HDEL", "gone", "f0", "f1", "f2", "f3", "f4", "f5", "f6",
+				"f7", "f8", "f9")
+		}
+	}
+	s.Do("HDEL", "gone", "f0", "f1", "f2", "f3", "f4", "f5", "f6", "f7",
+		"f8", "f9")
+	digest, err := s.Do("DEBUG", "DIGEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hlen, _ := s.Do("HLEN", "hash")
+
+	// the keyspace is the same after a restart, before and after a rewrite
+	for _, rewrite := range []bool{false, true} {
+		if rewrite {
+			if _, err := s.Do("SAVE"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stop()
+		s, addr = testNewServer(t, aofPath)
+		stop = testServe(t, s, addr)
+		if v, _ := s.Do("DEBUG", "DIGEST"); v != digest {
+			t.Fatalf("expected digest %v, got %v", digest, v)
+		}
+		if v, _ := s.Do("HLEN", "hash"); v != hlen {
+			t.Fatalf("expected %v fields, got %v", hlen, v)
+		}
+		if v, _ := s.Do("HGET", "hash", "f9"); v != "99" {
+			t.Fatalf("expected '99', got %v", v)
+		}
+		if v, _ := s.Do("EXISTS", "gone"); v != 0 {
+			t.Fatalf("expected the emptied hash to be deleted, got %v", v)
+		}
+	}
+}
+
+func TestHrandfield(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"))
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+	conn.do("HSET", "hash", "a", "1", "b", "2", "c", "3")
+
+	// a negative count repeats fields
+	res := conn.do("HRANDFIELD", "hash", "-3000", "WITHVALUES").([]interface{})
+	if len(res) != 6000 {
+		t.Fatalf("expected 6000 elements, got %d", len(res))
+	}
+	seen := make(map[interface{}]int)
+	for i := 0; i < len(res); i += 2 {
+		field, value := res[i].(string), res[i+1]
+		if value != string('1'+field[0]-'a') {
+			t.Fatalf("unexpected pair %v %v", field, value)
+		}
+		seen[field]++
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected all fields to be picked, got %v", seen)
+	}
+
+	// a positive count picks distinct fields
+	for i := 0; i < 20; i++ {
+		res := conn.do("HRANDFIELD", "hash", "2").([]interface{})
+		if len(res) != 2 || res[0] == res[1] {
+			t.Fatalf("expected 2 distinct fields, got %v", res)
+		}
+	}
+	picked := make(map[interface{}]bool)
+	for i := 0; i < 100; i++ {
+		picked[conn.do("HRANDFIELD", "hash")] = true
+	}
+	if len(picked) != 3 {
+		t.Fatalf("expected all fields to be picked, got %v", picked)
+	}
+}
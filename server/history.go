@@ -0,0 +1,169 @@
+package server
+
+import (
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Each client keeps a ring of its last commands, for DEBUG CLIENT and for the
+// log when a command panics. Only the command names and a few of the key
+// names are kept, never the values, which bounds the memory of a ring to the
+// client-history-len entries of historyMaxKeys short keys.
+
+const (
+	historyMaxKeys   = 4  // keys kept per command
+	historyMaxKeyLen = 64 // bytes kept per key
+	historyMaxLen    = 1024
+)
+
+type historyEntry struct {
+	name     string
+	keys     []string
+	time     time.Time
+	duration time.Duration
+	reply    string // the type of the reply, such as "bulk" or "error"
+	trace    string // the TRACEID of the command, if any
+}
+
+// commandHistory is a ring of the last commands of a client. It has its own
+// lock because it's read by other clients, and the commands that don't take
+// the server lock add to it.
+type commandHistory struct {
+	mu      sync.Mutex
+	entries []historyEntry
+	next    int // the index of the next entry
+	full    bool
+}
+
+// add adds an entry to the ring. The ring is reset when its size changes.
+func (h *commandHistory) add(e historyEntry, size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if size != len(h.entries) {
+		h.entries = make([]historyEntry, size)
+		h.next, h.full = 0, false
+	}
+	if size == 0 {
+		return
+	}
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % size
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the entries, the oldest first.
+func (h *commandHistory) list() []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var entries []historyEntry
+	if h.full {
+		entries = append(entries, h.entries[h.next:]...)
+	}
+	return append(entries, h.entries[:h.next]...)
+}
+
+// replyTypes are the names of the reply types in the history.
+var replyTypes = map[byte]string{
+	'+': "status", '-': "error", '$': "bulk", '_': "null", ':': "integer",
+	'*': "array", '#': "boolean", ',': "double",
+}
+
+// recordHistory adds the command that just ran to the history of the client.
+func (c *client) recordHistory(cmd *command, start time.Time) {
+	size := int(atomic.LoadInt64(&c.s.historyLen))
+	if size == 0 && len(c.history.entries) == 0 {
+		return
+	}
+	e := historyEntry{name: cmd.name, time: start, duration: time.Since(start),
+		reply: replyTypes[c.replyType], trace: c.trace}
+	if e.reply == "" {
+		e.reply = "none"
+	}
+	for _, key := range cmd.keys(c.args) {
+		if len(e.keys) == historyMaxKeys {
+			break
+		}
+		if len(key) > historyMaxKeyLen {
+			key = key[:historyMaxKeyLen]
+		}
+		// copy the key so that the ring doesn't keep the args alive
+		e.keys = append(e.keys, string([]byte(key)))
+	}
+	c.history.add(e, size)
+}
+
+// logPanic writes the panic, the stack, and the command history of every
+// client to the log. The server lock may already be held by the client that
+// panicked.
+func (s *Server) logPanic(c *client, r interface{}) {
+	s.lwarningf("=== %s BUG REPORT START ===", strings.ToUpper(s.options.AppName))
+	s.lwarningf("panic: %v, client id=%d addr=%s%s", r, c.id, c.addr, traceField(c.trace))
+	for _, line := range strings.Split(strings.TrimSpace(string(debug.Stack())), "\n") {
+		s.lwarningf("%s", line)
+	}
+	if !c.locked {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+	}
+	for cl := range s.clients {
+		entries := cl.history.list()
+		if len(entries) == 0 {
+			continue
+		}
+		s.lwarningf("client id=%d addr=%s history:", cl.id, cl.addr)
+		for _, e := range entries {
+			s.lwarningf("  %s %s keys=[%s] duration=%s reply=%s%s",
+				e.time.Format(time.RFC3339Nano), e.name,
+				strings.Join(e.keys, " "), e.duration, e.reply, traceField(e.trace))
+		}
+	}
+	s.lwarningf("=== %s BUG REPORT END ===", strings.ToUpper(s.options.AppName))
+}
+
+// debugClientCommand is DEBUG CLIENT id, which replies with the command
+// history of a client. Each entry is the command name, the keys, the unix
+// time and the duration in microseconds, the reply type, and the TRACEID when
+// the command had one.
+func debugClientCommand(c *client) {
+	if len(c.args) != 3 {
+		replyArgsError(c)
+		return
+	}
+	var target *client
+	for cl := range c.s.clients {
+		if strconv.Itoa(cl.id) == c.args[2] {
+			target = cl
+			break
+		}
+	}
+	if target == nil {
+		c.replyError("No such client")
+		return
+	}
+	entries := target.history.list()
+	c.replyMultiBulkLen(len(entries))
+	for _, e := range entries {
+		if e.trace != "" {
+			c.replyMultiBulkLen(6)
+		} else {
+			c.replyMultiBulkLen(5)
+		}
+		c.replyBulk(e.name)
+		c.replyMultiBulkLen(len(e.keys))
+		for _, key := range e.keys {
+			c.replyBulk(key)
+		}
+		c.replyInt(int(e.time.UnixNano() / int64(time.Microsecond)))
+		c.replyInt(int(e.duration / time.Microsecond))
+		c.replyBulk(e.reply)
+		if e.trace != "" {
+			c.replyBulk(e.trace)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hot keys are the keys that get the most commands. Every command with keys
+// counts them in a count-min sketch, which estimates the count of any key in
+// a fixed amount of memory, and the keys with the highest estimates are kept
+// as the candidates for HOTKEYS. Reads and writes have their own sketches.
+// Unlike redis-cli --hotkeys, this works with any maxmemory-policy and
+// doesn't scan the keyspace.
+//
+// The counts are over a sliding window of hotkeys-window seconds. The counts
+// of the current window are added to the counts of the previous window,
+// weighted by the share of the previous window that's still in the sliding
+// window. When hotkeys-warn-share is set, a key that gets more than that
+// percent of the commands is logged as a warning, once per window.
+
+const (
+	hotKeysDepth      = 4    // rows of a sketch
+	hotKeysWidth      = 2048 // counters per row
+	hotKeysTop        = 64   // candidates kept per window
+	hotKeysWarnMinOps = 1000 // commands in the window before a key is warned about
+)
+
+type hotKey struct {
+	db  int
+	key string
+}
+
+// hotKeysSketch is a count-min sketch. The estimate of a key is the lowest of
+// its counters, which is never lower than its count.
+type hotKeysSketch [hotKeysDepth][hotKeysWidth]uint32
+
+// hotKeyHash hashes a key of a database with FNV-1a.
+func hotKeyHash(db int, key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < 8; i++ {
+		h ^= uint64(byte(db >> (i * 8)))
+		h *= 1099511628211
+	}
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// index returns the counter of a hash in a row, the rows are derived from the
+// two halves of the hash.
+func (sk *hotKeysSketch) index(h uint64, row int) int {
+	return int((uint32(h) + uint32(row)*uint32(h>>32|1)) % hotKeysWidth)
+}
+
+func (sk *hotKeysSketch) add(h uint64) {
+	for row := range sk {
+		i := sk.index(h, row)
+		if sk[row][i] < ^uint32(0) {
+			sk[row][i]++
+		}
+	}
+}
+
+func (sk *hotKeysSketch) estimate(h uint64) int64 {
+	min := ^uint32(0)
+	for row := range sk {
+		if n := sk[row][sk.index(h, row)]; n < min {
+			min = n
+		}
+	}
+	return int64(min)
+}
+
+// hotKeysWindow is the counts of a window.
+type hotKeysWindow struct {
+	start  time.Time
+	ops    int64
+	reads  hotKeysSketch
+	writes hotKeysSketch
+	top    map[hotKey]int64 // the candidates and their latest estimates
+	min    int64            // not higher than the lowest estimate in top
+	warned map[hotKey]bool
+}
+
+func newHotKeysWindow(start time.Time) *hotKeysWindow {
+	return &hotKeysWindow{
+		start:  start,
+		top:    make(map[hotKey]int64),
+		warned: make(map[hotKey]bool),
+	}
+}
+
+func (w *hotKeysWindow) estimate(h uint64) (reads, writes int64) {
+	return w.reads.estimate(h), w.writes.estimate(h)
+}
+
+// offer makes the key a candidate when its estimate is higher than the lowest
+// candidate's.
+func (w *hotKeysWindow) offer(k hotKey, est int64) {
+	if _, ok := w.top[k]; ok || len(w.top) < hotKeysTop {
+		w.top[k] = est
+		return
+	}
+	if est <= w.min {
+		return
+	}
+	var minKey hotKey
+	minEst := int64(-1)
+	for k2, est2 := range w.top {
+		if minEst == -1 || est2 < minEst {
+			minKey, minEst = k2, est2
+		}
+	}
+	w.min = minEst
+	if est > minEst {
+		delete(w.top, minKey)
+		w.top[k] = est
+	}
+}
+
+// hotKeys keeps the windows. It has its own lock so that HOTKEYS works while a
+// command holds the server lock.
+type hotKeys struct {
+	mu     sync.Mutex
+	window time.Duration // the hotkeys-window
+	share  int           // the hotkeys-warn-share, 0 to disable
+	cur    *hotKeysWindow
+	prev   *hotKeysWindow
+}
+
+// configure is called by configChanged.
+func (hk *hotKeys) configure(window time.Duration, share int) {
+	hk.mu.Lock()
+	hk.window, hk.share = window, share
+	hk.mu.Unlock()
+}
+
+// rotate starts a new window when the current one is over, and returns the
+// weight of the previous window.
+func (hk *hotKeys) rotate(now time.Time) float64 {
+	if hk.cur == nil || now.Sub(hk.cur.start) >= hk.window {
+		if hk.cur != nil && now.Sub(hk.cur.start) < hk.window*2 {
+			hk.prev = hk.cur
+		} else {
+			hk.prev = nil
+		}
+		hk.cur = newHotKeysWindow(now)
+	}
+	if hk.prev == nil {
+		return 0
+	}
+	weight := 1 - float64(now.Sub(hk.cur.start))/float64(hk.window)
+	if weight < 0 {
+		return 0
+	}
+	return weight
+}
+
+// record counts the keys of a command, and returns the keys that crossed the
+// hotkeys-warn-share.
+func (hk *hotKeys) record(db int, keys []string, write bool, now time.Time) []hotKey {
+	if len(keys) == 0 {
+		return nil
+	}
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	weight := hk.rotate(now)
+	w := hk.cur
+	var warn []hotKey
+	for _, key := range keys {
+		k := hotKey{db, key}
+		h := hotKeyHash(db, key)
+		w.ops++
+		if write {
+			w.writes.add(h)
+		} else {
+			w.reads.add(h)
+		}
+		reads, writes := w.estimate(h)
+		w.offer(k, reads+writes)
+		if hk.share == 0 || w.warned[k] {
+			continue
+		}
+		est, ops := float64(reads+writes), float64(w.ops)
+		if hk.prev != nil {
+			reads, writes := hk.prev.estimate(h)
+			est += float64(reads+writes) * weight
+			ops += float64(hk.prev.ops) * weight
+		}
+		if ops >= hotKeysWarnMinOps && est*100 > ops*float64(hk.share) {
+			w.warned[k] = true
+			warn = append(warn, k)
+		}
+	}
+	return warn
+}
+
+// hotKeyCount is an entry of HOTKEYS.
+type hotKeyCount struct {
+	hotKey
+	reads, writes int64
+}
+
+// top returns the candidates with the highest estimates in the sliding
+// window, the highest first.
+func (hk *hotKeys) top(n int, now time.Time) []hotKeyCount {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	if hk.cur == nil {
+		return nil
+	}
+	weight := hk.rotate(now)
+	var counts []hotKeyCount
+	seen := make(map[hotKey]bool)
+	for _, w := range []*hotKeysWindow{hk.cur, hk.prev} {
+		if w == nil {
+			continue
+		}
+		for k := range w.top {
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			h := hotKeyHash(k.db, k.key)
+			reads, writes := hk.cur.estimate(h)
+			if hk.prev != nil {
+				preads, pwrites := hk.prev.estimate(h)
+				reads += int64(float64(preads) * weight)
+				writes += int64(float64(pwrites) * weight)
+			}
+			if reads+writes > 0 {
+				counts = append(counts, hotKeyCount{k, reads, writes})
+			}
+		}
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		a, b := counts[i], counts[j]
+		if a.reads+a.writes != b.reads+b.writes {
+			return a.reads+a.writes > b.reads+b.writes
+		}
+		if a.db != b.db {
+			return a.db < b.db
+		}
+		return a.key < b.key
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// recordHotKeys is called by exec after the command ran.
+func (s *Server) recordHotKeys(c *client, cmd *command, dbnum int) {
+	if c.loading || cmd.firstKey == 0 {
+		return
+	}
+	for _, k := range s.hotKeys.record(dbnum, cmd.keys(c.args), cmd.write, time.Now()) {
+		s.lwarningf("Hot key '%s' in db%d got more than %d%% of the commands",
+			k.key, k.db, s.hotKeys.warnShare())
+	}
+}
+
+func (hk *hotKeys) warnShare() int {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	return hk.share
+}
+
+// hotkeysCommand is HOTKEYS [COUNT count]. Replies with the keys that got the
+// most commands, as arrays of the key, its database, and the approximate
+// number of reads and writes.
+func hotkeysCommand(c *client) {
+	count := 10
+	switch len(c.args) {
+	case 1:
+	case 3:
+		if strings.ToLower(c.args[1]) != "count" {
+			c.replySyntaxError()
+			return
+		}
+		n, err := strconv.Atoi(c.args[2])
+		if err != nil {
+			c.replyInvalidIntError()
+			return
+		}
+		if n < 1 || n > hotKeysTop {
+			c.replyError("COUNT must be 1 to " + strconv.Itoa(hotKeysTop))
+			return
+		}
+		count = n
+	default:
+		c.replySyntaxError()
+		return
+	}
+	counts := c.s.hotKeys.top(count, time.Now())
+	c.replyMultiBulkLen(len(counts))
+	for _, e := range counts {
+		c.replyMultiBulkLen(4)
+		c.replyBulk(e.key)
+		c.replyInt(e.db)
+		c.replyInt(int(e.reads))
+		c.replyInt(int(e.writes))
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHotKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"),
+		"--hotkeys-warn-share", "8")
+	var log testLog
+	s.options.LogWriter = &log
+	stop := testServe(t, s, addr)
+	defer stop()
+
+	// a skewed workload over many more keys than the sketch has counters
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 50000; i++ {
+		switch {
+		case i%5 == 0:
+			s.Do("GET", "hot:read")
+		case i%10 == 1:
+			s.Do("SET", "hot:write", "1")
+		case i%20 == 2:
+			s.Do("MGET", "warm", "cold:"+strconv.Itoa(rng.Intn(20000)))
+		default:
+			s.Do("GET", "cold:"+strconv.Itoa(rng.Intn(20000)))
+		}
+	}
+	v, err := s.Do("HOTKEYS", "COUNT", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	top := v.([]interface{})
+	if len(top) != 3 {
+		t.Fatalf("expected 3 keys, got %v", top)
+	}
+	for i, expect := range []struct {
+		key           string
+		reads, writes int
+	}{{"hot:read", 10000, 0}, {"hot:write", 0, 5000}, {"warm", 2500, 0}} {
+		e := top[i].([]interface{})
+		if e[0] != expect.key || e[1] != 0 {
+			t.Fatalf("expected %s at %d, got %v", expect.key, i, top)
+		}
+		// the estimates are never lower than the counts
+		reads, writes := e[2].(int), e[3].(int)
+		if reads < expect.reads || reads > expect.reads+500 ||
+			writes < expect.writes || writes > expect.writes+500 {
+			t.Fatalf("expected about %d reads and %d writes of %s, got %v",
+				expect.reads, expect.writes, expect.key, e)
+		}
+	}
+
+	// the hot keys are warned about once
+	for _, key := range []string{"hot:read", "hot:write"} {
+		if n := strings.Count(log.String(), "Hot key '"+key+"' in db0"); n != 1 {
+			t.Fatalf("expected one warning for %s, got %d in %q", key, n, log.String())
+		}
+	}
+	if strings.Contains(log.String(), "'warm'") {
+		t.Fatalf("expected no warning for warm, got %q", log.String())
+	}
+
+	// the counts leave the sliding window
+	s.Do("CONFIG", "SET", "hotkeys-window", "1")
+	time.Sleep(time.Millisecond * 2100)
+	if v, _ := s.Do("HOTKEYS"); len(v.([]interface{})) != 0 {
+		t.Fatalf("expected no hot keys, got %v", v)
+	}
+
+	for _, args := range [][]string{
+		{"HOTKEYS", "COUNT"}, {"HOTKEYS", "COUNT", "0"}, {"HOTKEYS", "COUNT", "x"},
+		{"HOTKEYS", "LIMIT", "1"},
+	} {
+		if _, err := s.Do(args...); err == nil {
+			t.Fatalf("%v: expected an error", args)
+		}
+	}
+}
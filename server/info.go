@@ -7,8 +7,10 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -69,7 +71,7 @@ func infoCommand(c *client) {
 			writeInfoCommandStats(c, wr)
 		case "cluster":
 			writeInfoCluster(c, wr)
-		case "Keyspace":
+		case "keyspace":
 			writeInfoKeyspace(c, wr)
 		}
 	}
@@ -83,7 +85,11 @@ const ptrSize = 32 << (uint64(^uintptr(0)) >> 63)
 
 func writeInfoServer(c *client, w io.Writer) {
 	now := time.Now()
-	fmt.Fprintf(w, "redis_version:%s\n", c.s.options.Version)
+	_, sha, date := buildInfo()
+	fmt.Fprintf(w, "redis_version:%s\n", c.s.cfg.compatRedisVersion)
+	fmt.Fprintf(w, "sider_version:%s\n", c.s.options.Version)
+	fmt.Fprintf(w, "sider_git_sha1:%s\n", sha)
+	fmt.Fprintf(w, "sider_build_date:%s\n", date)
 	fmt.Fprintf(w, "redis_mode:%s\n", c.s.mode)
 	osOnce.Do(func() {
 		osb, err := exec.Command("uname", "-smr").Output()
@@ -115,26 +121,112 @@ func human(m uint64) string {
 	return fmt.Sprintf("%.2fG", f/1024/1024/1024)
 }
 
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func writeInfoMemory(c *client, w io.Writer) {
 	runtime.GC()
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
 	fmt.Fprintf(w, "used_memory:%d\n", m.Alloc)
 	fmt.Fprintf(w, "used_memory_human:%s\n", human(m.Alloc))
+	fmt.Fprintf(w, "maxmemory:%d\n", c.s.cfg.maxMemory)
+	fmt.Fprintf(w, "maxmemory_human:%s\n", human(uint64(c.s.cfg.maxMemory)))
+	fmt.Fprintf(w, "maxmemory_policy:%s\n", c.s.cfg.maxMemoryPolicy)
+	fmt.Fprintf(w, "mem_clients_normal:%d\n", atomic.LoadInt64(&c.s.clientsMem))
+	rss := residentMemory()
+	fmt.Fprintf(w, "used_memory_rss:%d\n", rss)
+	fmt.Fprintf(w, "used_memory_rss_human:%s\n", human(rss))
+	if m.Alloc > 0 {
+		fmt.Fprintf(w, "mem_fragmentation_ratio:%.2f\n", float64(rss)/float64(m.Alloc))
+	}
+	fmt.Fprintf(w, "active_defrag_running:%d\n", btoi(c.s.defragRunning))
+	fmt.Fprintf(w, "active_defrag_hits:%d\n", c.s.defragHits)
+	fmt.Fprintf(w, "active_defrag_bytes_reclaimed:%d\n", c.s.defragReclaimed)
 	// total_system_memory:17179869184
 	// total_system_memory_human:16.00G
 }
 func writeInfoPersistence(c *client, w io.Writer) {
-	// aof_enabled:0
-	// aof_rewrite_in_progress:0
+	fmt.Fprintf(w, "audit_log_enabled:%d\n", btoi(c.s.cfg.auditLog))
+	if a := c.s.audit; a != nil {
+		fmt.Fprintf(w, "audit_log_events:%d\n", atomic.LoadUint64(&a.written))
+		fmt.Fprintf(w, "audit_log_dropped_events:%d\n", atomic.LoadUint64(&a.dropped))
+	}
+	fmt.Fprintf(w, "read_through_loads:%d\n", atomic.LoadUint64(&c.s.readThroughLoads))
+	if q := c.s.writeBehind; q != nil {
+		fmt.Fprintf(w, "write_behind_writes:%d\n", atomic.LoadUint64(&q.sent))
+		fmt.Fprintf(w, "write_behind_dropped:%d\n", atomic.LoadUint64(&q.dropped))
+	}
+	status := "ok"
+	if c.s.aofRewriteErr != nil {
+		status = "err"
+	}
+	fmt.Fprintf(w, "loading:%d\n", btoi(c.s.Loading()))
+	if c.s.Loading() {
+		writeInfoLoading(c, w)
+	}
+	// BGSAVE rewrites the aof, there are no rdb snapshots
+	fmt.Fprintf(w, "rdb_changes_since_last_save:%d\n", c.s.dirty)
+	fmt.Fprintf(w, "rdb_last_bgsave_status:%s\n", status)
+	fmt.Fprintf(w, "aof_enabled:%d\n", btoi(c.s.cfg.appendOnly))
+	fmt.Fprintf(w, "aof_rewrite_in_progress:%d\n", btoi(c.s.aofrewrite))
+	fmt.Fprintf(w, "aof_load_skipped_commands:%d\n", c.s.aofLoadSkipped)
 	// aof_rewrite_scheduled:0
 	// aof_last_rewrite_time_sec:-1
 	// aof_current_rewrite_time_sec:-1
-	// aof_last_bgrewrite_status:ok
+	fmt.Fprintf(w, "aof_last_bgrewrite_status:%s\n", status)
+	if c.s.aof != nil {
+		fmt.Fprintf(w, "aof_offset:%d\n", c.s.aofOffset)
+		fmt.Fprintf(w, "aof_fsync_offset:%d\n", c.s.aofSynced)
+		fmt.Fprintf(w, "aof_current_size:%d\n", c.s.aofSize)
+		fmt.Fprintf(w, "aof_base_size:%d\n", c.s.aofBaseSize)
+		// rewrites are never scheduled behind a save, there are no rdb saves
+		fmt.Fprintf(w, "aof_pending_rewrite:0\n")
+		fmt.Fprintf(w, "aof_buffer_length:%d\n", c.s.aofbuf.Len())
+		fmt.Fprintf(w, "aof_delayed_fsync:%d\n", c.s.aofDelayedSyncs)
+	}
 	// aof_last_write_status:ok
 }
 
-func writeInfoStats(c *client, w io.Writer) {}
+// writeInfoLoading writes the progress of the aof that's being loaded. The
+// eta assumes the rest of the aof loads at the same rate.
+func writeInfoLoading(c *client, w io.Writer) {
+	start := time.Unix(0, atomic.LoadInt64(&c.s.loadingStart))
+	total := atomic.LoadInt64(&c.s.loadingTotal)
+	loaded := atomic.LoadInt64(&c.s.loadingLoaded)
+	var perc float64
+	if total > 0 {
+		perc = float64(loaded) / float64(total) * 100
+	}
+	eta := 1
+	if elapsed := time.Since(start); loaded > 0 {
+		eta = int(time.Duration(float64(elapsed)*float64(total-loaded)/float64(loaded)) / time.Second)
+	}
+	phase, _ := c.s.loadingPhase.Load().(string)
+	fmt.Fprintf(w, "loading_phase:%s\n", phase)
+	fmt.Fprintf(w, "loading_start_time:%d\n", start.Unix())
+	fmt.Fprintf(w, "loading_total_bytes:%d\n", total)
+	fmt.Fprintf(w, "loading_loaded_bytes:%d\n", loaded)
+	fmt.Fprintf(w, "loading_loaded_perc:%.2f\n", perc)
+	fmt.Fprintf(w, "loading_eta_seconds:%d\n", eta)
+}
+
+func writeInfoStats(c *client, w io.Writer) {
+	fmt.Fprintf(w, "rejected_connections:%d\n", atomic.LoadUint64(&c.s.rejectedConns))
+	fmt.Fprintf(w, "expired_keys:%d\n", atomic.LoadUint64(&c.s.expiredKeys))
+	fmt.Fprintf(w, "evicted_keys:%d\n", atomic.LoadUint64(&c.s.evictedKeys))
+	fmt.Fprintf(w, "tombstone_rejected_writes:%d\n", atomic.LoadUint64(&c.s.tombstoneRejects))
+	fmt.Fprintf(w, "send_timeout_disconnections:%d\n", atomic.LoadUint64(&c.s.sendTimeouts))
+	fmt.Fprintf(w, "handshake_timeout_disconnections:%d\n", atomic.LoadUint64(&c.s.handshakeTimeouts))
+	fmt.Fprintf(w, "rejected_connections_per_ip:%d\n", atomic.LoadUint64(&c.s.ipRejectedConns))
+	fmt.Fprintf(w, "acl_access_denied_auth:%d\n", atomic.LoadUint64(&c.s.authFailures))
+	fmt.Fprintf(w, "watchdog_stuck_commands:%d\n", atomic.LoadUint64(&c.s.watchdogTrips))
+	fmt.Fprintf(w, "evicted_clients:%d\n", atomic.LoadUint64(&c.s.evictedClients))
+}
 func writeInfoReplication(c *client, w io.Writer) {
 	// role:master
 	// connected_slaves:0
@@ -147,8 +239,33 @@ func writeInfoReplication(c *client, w io.Writer) {
 func writeInfoCPU(c *client, w io.Writer)          {}
 func writeInfoCommandStats(c *client, w io.Writer) {}
 func writeInfoCluster(c *client, w io.Writer)      {}
-func writeInfoKeyspace(c *client, w io.Writer)     {}
 
 func writeInfoClients(c *client, w io.Writer) {
 	fmt.Fprintf(w, "connected_clients:%d\n", len(c.s.clients))
+	fmt.Fprintf(w, "blocked_clients:%d\n", c.s.blocked.count)
+	fmt.Fprintf(w, "maxmemory_clients:%d\n", c.s.cfg.maxMemoryClients)
+}
+
+// writeInfoKeyspace writes the keys and the keys with an expiration of each
+// database that has keys, and the histogram of the time left of its keys,
+// see ttlstats.go. These are counts that the database keeps, so this doesn't
+// scan the keys.
+func writeInfoKeyspace(c *client, w io.Writer) {
+	nums := make([]int, 0, len(c.s.dbs))
+	for num, db := range c.s.dbs {
+		if db.len() > 0 {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+	now := time.Now()
+	for _, num := range nums {
+		db := c.s.dbs[num]
+		fmt.Fprintf(w, "db%d:keys=%d,expires=%d,avg_ttl=0", num, db.len(), len(db.expires))
+		h := db.ttlHistogram(now)
+		for i, b := range ttlBuckets {
+			fmt.Fprintf(w, ",ttl_%s=%d", b.name, h[i])
+		}
+		fmt.Fprintf(w, ",ttl_later=%d,ttl_never=%d\n", h[ttlLater], h[ttlNever])
+	}
 }
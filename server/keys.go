@@ -1,6 +1,8 @@
 package server
 
 import (
+	"fmt"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
@@ -19,6 +21,7 @@ func delCommand(c *client) {
 		}
 	}
 	c.dirty += count
+	leaveTombstones(c, c.args[1:])
 	c.replyInt(count)
 }
 
@@ -27,13 +30,10 @@ func renameCommand(c *client) {
 		c.replyAritryError()
 		return
 	}
-	key, ok := c.db.get(c.args[1])
-	if !ok {
-		c.replyError("no such key")
+	if !c.db.move(c.args[1], c.db, c.args[2]) {
+		c.replyNoSuchKeyError()
 		return
 	}
-	c.db.del(c.args[1])
-	c.db.set(c.args[2], key)
 	c.dirty++
 	c.replyString("OK")
 }
@@ -43,39 +43,70 @@ func renamenxCommand(c *client) {
 		c.replyAritryError()
 		return
 	}
-	key, ok := c.db.get(c.args[1])
-	if !ok {
-		c.replyError("no such key")
+	if _, ok := c.db.get(c.args[1]); !ok {
+		c.replyNoSuchKeyError()
 		return
 	}
-	_, ok = c.db.get(c.args[2])
-	if ok {
+	if _, ok := c.db.get(c.args[2]); ok {
 		c.replyInt(0)
 		return
 	}
-	c.db.del(c.args[1])
-	c.db.set(c.args[2], key)
+	c.db.move(c.args[1], c.db, c.args[2])
 	c.replyInt(1)
 	c.dirty++
 }
 
+// keysChunk is the number of keys written between checks of the connection
+// by KEYS.
+const keysChunk = 1024
+
+// keysCommand is KEYS pattern. The pattern has the rules of Match. The keys
+// are counted first, and then written to the connection as they are found,
+// so the reply is never held in memory, and the keys are in no order. More
+// keys than keys-max-results is an error, rather than a partial reply.
 func keysCommand(c *client) {
 	if len(c.args) != 2 {
 		c.replyAritryError()
 		return
 	}
-	var keys []string
 	pattern := parsePattern(c.args[1])
-	c.db.ascend(func(key string, value interface{}) bool {
+	if !pattern.glob {
+		// a pattern without special characters matches one key
+		if _, ok := c.db.get(pattern.value); ok {
+			c.replyMultiBulkLen(1)
+			c.replyBulk(pattern.value)
+		} else {
+			c.replyMultiBulkLen(0)
+		}
+		return
+	}
+	max := c.s.cfg.keysMaxResults
+	now := time.Now()
+	count := 0
+	c.db.ascendAt(now, func(key string, value interface{}) bool {
 		if pattern.match(key) {
-			keys = append(keys, key)
+			count++
 		}
-		return true
+		return max == 0 || count <= max
 	})
-	c.replyMultiBulkLen(len(keys))
-	for _, key := range keys {
-		c.replyString(key)
+	if max > 0 && count > max {
+		c.replyError(fmt.Sprintf("KEYS matched more than %d keys, "+
+			"see keys-max-results, use SCAN instead", max))
+		return
 	}
+	c.replyMultiBulkLen(count)
+	written := 0
+	c.db.ascendAt(now, func(key string, value interface{}) bool {
+		if !pattern.match(key) {
+			return true
+		}
+		if written%keysChunk == 0 && c.writeFailed() {
+			return false
+		}
+		c.replyBulk(key)
+		written++
+		return written < count
+	})
 }
 
 func typeCommand(c *client) {
@@ -87,20 +118,21 @@ func typeCommand(c *client) {
 	c.replyString(typ)
 }
 
+// randomkeyTries is the number of expired keys that RANDOMKEY picks before it
+// gives up, like in Redis.
+const randomkeyTries = 100
+
 func randomkeyCommand(c *client) {
 	if len(c.args) != 1 {
 		c.replyAritryError()
 		return
 	}
-	got := false
-	c.db.ascend(func(key string, value interface{}) bool {
-		c.replyBulk(key)
-		got = true
-		return false
-	})
-	if !got {
+	key, ok := c.db.randomKey(randomkeyTries)
+	if !ok {
 		c.replyNull()
+		return
 	}
+	c.replyBulk(key)
 }
 
 func existsCommand(c *client) {
@@ -117,23 +149,136 @@ func existsCommand(c *client) {
 	c.replyInt(count)
 }
 func expireCommand(c *client) {
-	if len(c.args) != 3 {
+	genericExpireCommand(c, time.Second, false)
+}
+
+func pexpireCommand(c *client) {
+	genericExpireCommand(c, time.Millisecond, false)
+}
+
+// genericExpireCommand is used by EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT. A
+// time that is not in the future deletes the key, which is appended to the aof
+// as a DEL. The NX, XX, GT and LT options set the time only when the key has
+// no time, has a time, or the new time is greater or less than the current
+// time. A key without a time has an infinite time for GT and LT. The time is
+// appended to the aof as PEXPIREAT.
+func genericExpireCommand(c *client, unit time.Duration, unix bool) {
+	if len(c.args) < 3 {
 		c.replyAritryError()
 		return
 	}
-	seconds, err := strconv.ParseInt(c.args[2], 10, 64)
+	var nx, xx, gt, lt bool
+	for _, arg := range c.args[3:] {
+		switch strings.ToLower(arg) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "gt":
+			gt = true
+		case "lt":
+			lt = true
+		default:
+			c.replyError("Unsupported option " + arg)
+			return
+		}
+	}
+	if nx && (xx || gt || lt) {
+		c.replyError("NX and XX, GT or LT options at the same time are not compatible")
+		return
+	}
+	if gt && lt {
+		c.replyError("GT and LT options at the same time are not compatible")
+		return
+	}
+	n, err := strconv.ParseInt(c.args[2], 10, 64)
 	if err != nil {
-		c.replyError("value is not an integer or out of range")
+		c.replyInvalidIntError()
 		return
 	}
-	if c.db.expire(c.args[1], time.Now().Add(time.Duration(seconds)*time.Second)) {
-		c.replyInt(1)
-		c.dirty++
+	when, ok := expireTime(n, unit, unix)
+	if !ok {
+		c.replyInvalidExpireError()
+		return
+	}
+	if nx || xx || gt || lt {
+		_, current, ok := c.db.getExpires(c.args[1])
+		if !ok || (nx && !current.IsZero()) || (xx && current.IsZero()) ||
+			(gt && (current.IsZero() || !when.After(current))) ||
+			(lt && !current.IsZero() && !when.Before(current)) {
+			c.replyBoolOrInt(false)
+			return
+		}
+		// the condition is not checked again when the aof is loaded
+		c.propagate(c.args[0], c.args[1], c.args[2])
+	}
+	ok, deleted := c.db.setExpire(c.args[1], when)
+	if !ok {
+		c.replyBoolOrInt(false)
+		return
+	}
+	if deleted {
+		c.propagate("DEL", c.args[1])
 	} else {
-		c.replyInt(0)
+		propagateExpireAt(c, c.args[1], when)
+	}
+	c.replyBoolOrInt(true)
+	c.dirty++
+}
+
+// propagateExpireAt appends an expire to the aof as PEXPIREAT, so that the
+// time left doesn't start again when the aof is loaded. An aof-compat-level
+// older than PEXPIREAT gets the command as it was received.
+func propagateExpireAt(c *client, key string, when time.Time) {
+	if c.s.aofCompatible("pexpireat") {
+		c.propagate("PEXPIREAT", key, unixMillis(when))
+	}
+}
+
+// unixMillis returns a time as milliseconds since the unix epoch.
+func unixMillis(when time.Time) int64 {
+	return when.UnixNano() / int64(time.Millisecond)
+}
+
+// expireTime converts a ttl, or a unix time when unix is true, into an
+// absolute time. Returns false if the value is out of range.
+func expireTime(n int64, unit time.Duration, unix bool) (time.Time, bool) {
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return time.Time{}, false
+	}
+	if unix {
+		return time.Unix(0, 0).Add(time.Duration(n) * unit), true
+	}
+	return time.Now().Add(time.Duration(n) * unit), true
+}
+
+// parseSetExpire parses the expire argument of SET, SETEX, PSETEX and GETEX.
+// Unlike EXPIRE, the value must be positive. Returns false after replying
+// with an error.
+func parseSetExpire(c *client, arg string, unit time.Duration, unix bool) (time.Time, bool) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		c.replyInvalidIntError()
+		return time.Time{}, false
 	}
+	when, ok := expireTime(n, unit, unix)
+	if !ok || n <= 0 {
+		c.replyInvalidExpireError()
+		return time.Time{}, false
+	}
+	return when, true
 }
 func ttlCommand(c *client) {
+	genericTTLCommand(c, time.Second)
+}
+
+func pttlCommand(c *client) {
+	genericTTLCommand(c, time.Millisecond)
+}
+
+// genericTTLCommand is used by TTL and PTTL. The remaining time is rounded up,
+// so a key that has not expired never reports zero.
+func genericTTLCommand(c *client, unit time.Duration) {
 	if len(c.args) != 2 {
 		c.replyAritryError()
 		return
@@ -144,9 +289,10 @@ func ttlCommand(c *client) {
 	} else if expires.IsZero() {
 		c.replyInt(-1)
 	} else {
-		c.replyInt(int(expires.Sub(time.Now()) / time.Second))
+		c.replyInt(int((expires.Sub(time.Now()) + unit - 1) / unit))
 	}
 }
+
 func moveCommand(c *client) {
 	if len(c.args) != 3 {
 		c.replyAritryError()
@@ -158,19 +304,16 @@ func moveCommand(c *client) {
 		return
 	}
 
-	value, ok := c.db.get(c.args[1])
-	if !ok {
+	if _, ok := c.db.get(c.args[1]); !ok {
 		c.replyInt(0)
 		return
 	}
 	db := c.s.selectDB(int(num))
-	_, ok = db.get(c.args[1])
-	if ok {
+	if _, ok := db.get(c.args[1]); ok {
 		c.replyInt(0)
 		return
 	}
-	db.set(c.args[1], value)
-	c.db.del(c.args[1])
+	c.db.move(c.args[1], db, c.args[1])
 	c.replyInt(1)
 	c.dirty++
 }
@@ -336,19 +479,19 @@ func sortCommand(c *client) {
 			store = c.args[i]
 		case "limit":
 			i += 2
-			if i == len(c.args) {
+			if i >= len(c.args) {
 				c.replySyntaxError()
 				return
 			}
 			limitProvided = true
 			n1, err := strconv.ParseInt(c.args[i-1], 10, 64)
 			if err != nil {
-				c.replyError("value is not an integer or out of range")
+				c.replyInvalidIntError()
 				return
 			}
 			n2, err := strconv.ParseInt(c.args[i], 10, 64)
 			if err != nil {
-				c.replyError("value is not an integer or out of range")
+				c.replyInvalidIntError()
 				return
 			}
 			if n1 < 0 {
@@ -364,28 +507,25 @@ func sortCommand(c *client) {
 	if false {
 		println(asc, alpha, store, storeProvided, offset, count, limitProvided, by, byProvided, gets)
 	}
-	key, ok := c.db.get(c.args[1])
-	if !ok || key == nil {
-		c.replyMultiBulkLen(0)
-		return
-	}
-
 	var arr []string
-	switch v := key.(type) {
+	value, _ := c.db.get(c.args[1])
+	switch v := value.(type) {
 	default:
 		c.replyTypeError()
 		return
+	case nil:
+		// a missing key is empty
 	case *list:
 		arr = v.strArr()
 	case *set:
 		arr = v.strArr()
+	case *zset:
+		arr = v.members()
 	}
 	if limitProvided {
 		if offset >= len(arr) {
-			c.replyMultiBulkLen(0)
-			return
-		}
-		if offset+count > len(arr) {
+			offset, count = 0, 0
+		} else if offset+count > len(arr) {
 			count = len(arr) - offset
 		}
 	}
@@ -411,9 +551,7 @@ func sortCommand(c *client) {
 	if storeProvided {
 		l := newList()
 		l.rpush(arr...)
-		c.db.set(store, l)
-		c.replyInt(l.len())
-		c.dirty++
+		c.storeResult(store, l, l.len())
 		return
 	}
 	c.replyMultiBulkLen(len(arr))
@@ -423,19 +561,104 @@ func sortCommand(c *client) {
 }
 
 func expireatCommand(c *client) {
-	if len(c.args) != 3 {
+	genericExpireCommand(c, time.Second, true)
+}
+
+func pexpireatCommand(c *client) {
+	genericExpireCommand(c, time.Millisecond, true)
+}
+
+// persistCommand is PERSIST key, which removes the expiration time of a key.
+func persistCommand(c *client) {
+	if len(c.args) != 2 {
 		c.replyAritryError()
 		return
 	}
-	seconds, err := strconv.ParseInt(c.args[2], 10, 64)
-	if err != nil {
-		c.replyError("value is not an integer or out of range")
+	if !c.db.persist(c.args[1]) {
+		c.replyBoolOrInt(false)
+		return
+	}
+	c.replyBoolOrInt(true)
+	c.dirty++
+}
+
+// touchCommand is TOUCH key [key ...]. The keys are touched even when the
+// client is in NO-TOUCH mode.
+func touchCommand(c *client) {
+	if len(c.args) == 1 {
+		c.replyAritryError()
+		return
+	}
+	var count int
+	for i := 1; i < len(c.args); i++ {
+		if item, ok := c.db.lookup(c.args[i]); ok {
+			item.touch()
+			count++
+		}
+	}
+	c.replyInt(count)
+}
+
+// objectCommand is OBJECT subcommand key. The key is not touched.
+func objectCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	sub := strings.ToLower(c.args[1])
+	if sub == "help" {
+		msgs := []string{
+			"OBJECT <subcommand> key. Subcommands:",
+			"refcount -- Return the number of references of the value associated with the specified key.",
+			"encoding -- Return the kind of internal representation used in order to store the value associated with a key.",
+			"idletime -- Return the idle time of the key, that is the approximated number of seconds elapsed since the last access to the key.",
+			"freq -- Return the access frequency index of the key. The returned integer is proportional to the logarithm of the recent access frequency of the key.",
+		}
+		c.replyMultiBulkLen(len(msgs))
+		for _, msg := range msgs {
+			c.replyBulk(msg)
+		}
+		return
+	}
+	if len(c.args) != 3 {
+		c.replyError("Unknown subcommand or wrong number of arguments for '" + c.args[1] + "'. Try OBJECT HELP.")
+		return
+	}
+	item, ok := c.db.lookup(c.args[2])
+	if !ok {
+		c.replyNull()
 		return
 	}
-	if c.db.expire(c.args[1], time.Unix(seconds, 0)) {
+	switch sub {
+	default:
+		c.replyError("Unknown subcommand or wrong number of arguments for '" + c.args[1] + "'. Try OBJECT HELP.")
+	case "refcount":
 		c.replyInt(1)
-		c.dirty++
-	} else {
-		c.replyInt(0)
+	case "encoding":
+		c.replyBulk(objectEncoding(item.value))
+	case "idletime":
+		c.replyInt(int(item.idle(lruClock())))
+	case "freq":
+		c.replyError("An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+	}
+}
+
+// objectEncoding returns the Redis name of the encoding of a value.
+func objectEncoding(value interface{}) string {
+	switch value.(type) {
+	default:
+		return "unknown"
+	case int:
+		return "int"
+	case string:
+		return "raw"
+	case *list:
+		return "linkedlist"
+	case *set:
+		return "hashtable"
+	case *hash:
+		return "hashtable"
+	case *zset:
+		return "skiplist"
 	}
 }
@@ -0,0 +1,850 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExpireBoundaries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	addr, stop := testStartServer(t, aofPath)
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	pastms := strconv.FormatInt(time.Now().Add(-time.Hour).UnixNano()/1e6, 10)
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	futurems := strconv.FormatInt(time.Now().Add(time.Hour).UnixNano()/1e6, 10)
+	invalid := func(cmd string) string {
+		return "ERR invalid expire time in '" + cmd + "' command"
+	}
+
+	// Each case starts with an empty database and "key" set to "value". The
+	// exists field is the state of "key" after the command.
+	tests := []struct {
+		args   []string
+		reply  interface{}
+		exists bool
+	}{
+		{[]string{"SET", "key", "v", "EX", "0"}, invalid("set"), true},
+		{[]string{"SET", "key", "v", "EX", "-1"}, invalid("set"), true},
+		{[]string{"SET", "key", "v", "PX", "0"}, invalid("set"), true},
+		{[]string{"SET", "key", "v", "EX", "abc"}, "ERR value is not an integer or out of range", true},
+		{[]string{"SET", "key", "v", "EX", "9223372036854775807"}, invalid("set"), true},
+		{[]string{"SET", "key", "v", "EX", "1"}, "OK", true},
+		{[]string{"SETEX", "key", "0", "v"}, invalid("setex"), true},
+		{[]string{"SETEX", "key", "-1", "v"}, invalid("setex"), true},
+		{[]string{"SETEX", "key", "10", "v"}, "OK", true},
+		{[]string{"PSETEX", "key", "0", "v"}, invalid("psetex"), true},
+		{[]string{"PSETEX", "key", "10000", "v"}, "OK", true},
+		{[]string{"EXPIRE", "key", "-1"}, 1, false},
+		{[]string{"EXPIRE", "key", "0"}, 1, false},
+		{[]string{"EXPIRE", "key", "10"}, 1, true},
+		{[]string{"EXPIRE", "missing", "-1"}, 0, true},
+		{[]string{"EXPIRE", "key", "9223372036854775807"}, invalid("expire"), true},
+		{[]string{"EXPIREAT", "key", past}, 1, false},
+		{[]string{"EXPIREAT", "key", future}, 1, true},
+		{[]string{"PEXPIRE", "key", "0"}, 1, false},
+		{[]string{"PEXPIRE", "key", "10000"}, 1, true},
+		{[]string{"PEXPIRE", "key", "9223372036854775807"}, invalid("pexpire"), true},
+		{[]string{"PEXPIREAT", "key", pastms}, 1, false},
+		{[]string{"PEXPIREAT", "key", futurems}, 1, true},
+		{[]string{"GETEX", "key", "EX", "0"}, invalid("getex"), true},
+		{[]string{"GETEX", "key", "EXAT", past}, "value", false},
+		{[]string{"GETEX", "key", "PXAT", pastms}, "value", false},
+		{[]string{"GETEX", "key", "EXAT", future}, "value", true},
+		{[]string{"GETEX", "key", "PERSIST"}, "value", true},
+		{[]string{"GETEX", "missing", "EXAT", past}, nil, true},
+	}
+	for _, tt := range tests {
+		conn.do("FLUSHDB")
+		conn.do("SET", "key", "value")
+		reply := conn.do(tt.args...)
+		if err, ok := reply.(error); ok {
+			reply = err.Error()
+		}
+		if reply != tt.reply {
+			t.Fatalf("%v: expected '%v', got '%v'", tt.args, tt.reply, reply)
+		}
+		if exists := conn.do("EXISTS", "key") == 1; exists != tt.exists {
+			t.Fatalf("%v: expected exists %v, got %v", tt.args, tt.exists, exists)
+		}
+	}
+
+	// the remaining time is rounded up, so a key that is about to expire
+	// never reports zero
+	conn.do("SET", "key", "value", "PX", "300")
+	if v := conn.do("TTL", "key"); v != 1 {
+		t.Fatalf("expected 1, got %v", v)
+	}
+	if v := conn.do("PTTL", "key").(int); v <= 0 || v > 300 {
+		t.Fatalf("expected 1 to 300, got %v", v)
+	}
+
+	// a key that expires between commands is never returned
+	conn.do("FLUSHDB")
+	conn.do("SET", "key", "value", "PX", "1")
+	conn.do("RPUSH", "list", "a")
+	conn.do("EXPIREAT", "list", strconv.FormatInt(time.Now().Unix()+1, 10))
+	time.Sleep(time.Millisecond * 1100)
+	for _, args := range [][]string{
+		{"GET", "key"}, {"GETEX", "key", "PERSIST"}, {"EXISTS", "key"},
+		{"TYPE", "key"}, {"TTL", "key"}, {"PTTL", "key"}, {"KEYS", "*"},
+		{"EXPIRE", "key", "10"}, {"PEXPIRE", "key", "10"},
+		{"LRANGE", "list", "0", "-1"}, {"DEL", "list"},
+	} {
+		reply := fmt.Sprint(conn.do(args...))
+		switch reply {
+		case "<nil>", "0", "-2", "none", "[]":
+		default:
+			t.Fatalf("%v: expected an expired reply, got '%v'", args, reply)
+		}
+	}
+	if v := conn.do("INCR", "key"); v != 1 {
+		t.Fatalf("expected '1', got '%v'", v)
+	}
+	if v := conn.do("TTL", "key"); v != -1 {
+		t.Fatalf("expected '-1', got '%v'", v)
+	}
+
+	// deletes caused by an expire time in the past are appended as a DEL
+	conn.do("SET", "key", "value")
+	conn.do("EXPIRE", "key", "-1")
+	data, err := ioutil.ReadFile(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(data), string(encodeMultiBulk([]string{"DEL", "key"}))) {
+		t.Fatalf("expected the aof to end with a DEL, got %q", data)
+	}
+}
+
+// TestUnsweptExpires checks keys that have expired but have not yet been
+// deleted by the expire loop.
+func TestUnsweptExpires(t *testing.T) {
+	db := newDB(0)
+	expired := func() {
+		db.flush()
+		db.set("key", "value")
+		db.setExpire("key", time.Now().Add(time.Hour))
+		db.expires["key"] = time.Now().Add(-time.Second)
+	}
+	expired()
+	if _, ok := db.get("key"); ok {
+		t.Fatal("expected get to miss")
+	}
+	if _, _, ok := db.getExpires("key"); ok {
+		t.Fatal("expected getExpires to miss")
+	}
+	if _, ok := db.lookup("key"); ok {
+		t.Fatal("expected lookup to miss")
+	}
+	if typ := db.getType("key"); typ != "none" {
+		t.Fatalf("expected 'none', got '%v'", typ)
+	}
+	db.ascend(func(key string, value interface{}) bool {
+		t.Fatalf("expected ascend to skip '%v'", key)
+		return true
+	})
+	if key, ok := db.randomKey(randomkeyTries); ok {
+		t.Fatalf("expected randomKey to skip '%v'", key)
+	}
+	if ok, _ := db.setExpire("key", time.Now().Add(time.Hour)); ok {
+		t.Fatal("expected setExpire to miss")
+	}
+	if db.persist("key") {
+		t.Fatal("expected persist to miss")
+	}
+	if _, ok := db.del("key"); ok {
+		t.Fatal("expected del to miss")
+	}
+	expired()
+	db.update("key", "new")
+	if _, when, ok := db.getExpires("key"); !ok || !when.IsZero() {
+		t.Fatal("expected update to create a key without an expiration")
+	}
+	expired()
+	if deleted := db.deleteExpires(); len(deleted) != 1 || db.len() != 0 {
+		t.Fatalf("expected one deleted key, got %v", deleted)
+	}
+}
+
+// TestRandomKey checks that the keys used by RANDOMKEY follow the items
+// through sets, deletes, expires and a defrag, and that every key is picked.
+func TestRandomKey(t *testing.T) {
+	db := newDB(0)
+	if _, ok := db.randomKey(randomkeyTries); ok {
+		t.Fatal("expected an empty database to have no random key")
+	}
+	check := func() {
+		t.Helper()
+		if len(db.keys) != len(db.items) {
+			t.Fatalf("expected %d keys, got %d", len(db.items), len(db.keys))
+		}
+		for i, key := range db.keys {
+			if item, ok := db.items[key]; !ok || item.index != i {
+				t.Fatalf("expected '%s' at %d", key, i)
+			}
+		}
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		key := strconv.Itoa(rng.Intn(1000))
+		switch rng.Intn(5) {
+		case 0, 1:
+			db.set(key, "value")
+		case 2:
+			db.del(key)
+		case 3:
+			db.setExpire(key, time.Now().Add(-time.Second))
+		case 4:
+			db.setExpire(key, time.Now().Add(time.Hour))
+		}
+	}
+	check()
+	db.startDefrag()
+	for _, key := range db.keys[:len(db.keys)/2] {
+		db.del(key)
+	}
+	for {
+		if _, done := db.stepDefrag(100); done {
+			break
+		}
+	}
+	check()
+
+	// every key is picked, and expired keys are not
+	db.flush()
+	for i := 0; i < 10; i++ {
+		db.set(strconv.Itoa(i), "value")
+	}
+	db.set("expired", "value")
+	db.setExpire("expired", time.Now().Add(time.Hour))
+	db.expires["expired"] = time.Now().Add(-time.Second)
+	picked := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		key, ok := db.randomKey(randomkeyTries)
+		if !ok || key == "expired" {
+			t.Fatalf("expected a key that exists, got '%v'", key)
+		}
+		picked[key] = true
+	}
+	if len(picked) != 10 {
+		t.Fatalf("expected all 10 keys to be picked, got %d", len(picked))
+	}
+}
+
+// TestExpireExactlyOnce checks that a key which is noticed as expired by both
+// a write and the expire loop is deleted once, and appended to the aof as a
+// single DEL.
+func TestExpireExactlyOnce(t *testing.T) {
+	const numKeys = 2000
+	const numReaders = 4
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	addr, stop := testStartServer(t, aofPath)
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	// the keys expire over a period of 500ms
+	for i := 0; i < numKeys; i++ {
+		conn.send("SET", "key:"+strconv.Itoa(i), "value",
+			"PX", strconv.Itoa(1+i%500))
+	}
+	for i := 0; i < numKeys; i++ {
+		if _, err := conn.read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(time.Millisecond * 700)
+	for i := 0; i < numReaders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(i)))
+			conn := testDial(t, addr)
+			defer conn.close()
+			for time.Now().Before(deadline) {
+				key := "key:" + strconv.Itoa(rng.Intn(numKeys))
+				if rng.Intn(2) == 0 {
+					conn.send("GET", key)
+				} else {
+					conn.send("APPEND", key, "x")
+				}
+				if _, err := conn.read(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// wait for the expire loop to sweep the keys that were not touched
+	time.Sleep(time.Millisecond * 1100)
+	info := conn.do("INFO", "stats").(string)
+	if !strings.Contains(info, "expired_keys:"+strconv.Itoa(numKeys)+"\n") {
+		t.Fatalf("expected %d expired keys, got\n%s", numKeys, info)
+	}
+	stop()
+
+	f, err := os.Open(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	dels := make(map[string]int)
+	rd := newCommandReader(f)
+	for {
+		_, args, _, err := rd.readCommand()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.ToLower(args[0]) == "del" {
+			dels[args[1]]++
+		}
+	}
+	if len(dels) != numKeys {
+		t.Fatalf("expected a DEL for %d keys, got %d", numKeys, len(dels))
+	}
+	for key, n := range dels {
+		if n != 1 {
+			t.Fatalf("expected one DEL for '%s', got %d", key, n)
+		}
+	}
+}
+
+// TestExpireAOF checks that the relative ttls are appended to the aof as
+// absolute times, and written so by a rewrite, so that they keep counting
+// down while the server is stopped.
+func TestExpireAOF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	s, addr := testNewServer(t, aofPath)
+	stop := testServe(t, s, addr)
+	defer func() { stop() }()
+
+	at := strconv.FormatInt(unixMillis(time.Now().Add(time.Second*3)), 10)
+	for _, args := range [][]string{
+		{"SET", "expire", "v"}, {"EXPIRE", "expire", "3"},
+		{"SET", "pexpire", "v"}, {"PEXPIRE", "pexpire", "3000", "NX"},
+		{"SET", "pexpireat", "v"}, {"PEXPIREAT", "pexpireat", at},
+		{"SET", "ex", "v", "EX", "3"},
+		{"SET", "px", "v", "PX", "3000", "GET"},
+		{"SETEX", "setex", "3", "v"},
+		{"PSETEX", "psetex", "3000", "v"},
+		{"SET", "gone", "v"}, {"PEXPIRE", "gone", "1000"},
+	} {
+		if _, err := s.Do(args...); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+	data, err := ioutil.ReadFile(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, relative := range []string{"\r\nEXPIRE\r\n", "\r\nPEXPIRE\r\n", "\r\nEX\r\n", "\r\nPX\r\n",
+		"\r\nSETEX\r\n", "\r\nPSETEX\r\n"} {
+		if strings.Contains(string(data), relative) {
+			t.Fatalf("expected no %q in the aof, got %q", relative, data)
+		}
+	}
+
+	// the ttls keep counting down while the server is stopped, before and
+	// after a rewrite
+	for _, left := range []int{1900, 800} {
+		if left == 800 {
+			if _, err := s.Do("SAVE"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stop()
+		time.Sleep(time.Millisecond * 1100)
+		s, addr = testNewServer(t, aofPath)
+		stop = testServe(t, s, addr)
+		for _, key := range []string{"expire", "pexpire", "pexpireat", "ex", "px", "setex", "psetex"} {
+			if v, err := s.Do("PTTL", key); err != nil || v.(int) <= 0 || v.(int) > left {
+				t.Fatalf("%s: expected at most %dms left, got %v, %v", key, left, v, err)
+			}
+		}
+		if v, _ := s.Do("EXISTS", "gone"); v != 0 {
+			t.Fatalf("expected the key to expire while the server was stopped, got %v", v)
+		}
+	}
+
+	// an older aof-compat-level gets the command as it was received
+	s.Do("CONFIG", "SET", "aof-compat-level", "1")
+	s.Do("SET", "old", "v")
+	s.Do("EXPIRE", "old", "100")
+	data, err = ioutil.ReadFile(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(data), "\r\nEXPIRE\r\n$3\r\nold\r\n$3\r\n100\r\n") {
+		t.Fatalf("expected an EXPIRE at the end of the aof, got %q", data)
+	}
+}
+
+// TestActiveExpire checks that keys which are never accessed again are
+// deleted by the expire loop, and that the deletes survive a restart.
+func TestActiveExpire(t *testing.T) {
+	const numKeys = 1000
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	addr, stop := testStartServer(t, aofPath)
+	conn := testDial(t, addr)
+	defer conn.close()
+	for i := 0; i < numKeys; i++ {
+		conn.send("SET", "short:"+strconv.Itoa(i), "value", "PX", "50")
+		conn.send("SET", "none:"+strconv.Itoa(i), "value")
+	}
+	for i := 0; i < 10; i++ {
+		conn.send("SET", "long:"+strconv.Itoa(i), "value", "EX", "1000")
+	}
+	for i := 0; i < numKeys*2+10; i++ {
+		if _, err := conn.read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	for {
+		info := conn.do("INFO", "stats").(string)
+		if strings.Contains(info, "expired_keys:"+strconv.Itoa(numKeys)+"\n") {
+			break
+		}
+		if time.Since(start) > time.Second*2 {
+			t.Fatalf("timeout waiting for the keys to expire\n%s", info)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := conn.do("DBSIZE").(int); n != numKeys+10 {
+		t.Fatalf("expected %d keys, got %d", numKeys+10, n)
+	}
+	conn.close()
+	stop()
+
+	addr, stop = testStartServer(t, aofPath)
+	defer stop()
+	conn = testDial(t, addr)
+	defer conn.close()
+	if n := conn.do("DBSIZE").(int); n != numKeys+10 {
+		t.Fatalf("expected %d keys after restart, got %d", numKeys+10, n)
+	}
+	if v := conn.do("EXISTS", "short:0"); v != 0 {
+		t.Fatalf("expected the expired key to be gone, got %v", v)
+	}
+}
+
+func TestMaxKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"),
+		"--maxkeys", "3")
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	maxErr := "ERR max keys reached"
+	tests := []struct {
+		args  []string
+		reply interface{}
+	}{
+		{[]string{"SET", "a", "1"}, "OK"},
+		{[]string{"RPUSH", "b", "1"}, 1},
+		{[]string{"MSET", "c", "1", "d", "1"}, maxErr},
+		{[]string{"MSET", "c", "1", "a", "2"}, "OK"}, // exactly at the limit
+		{[]string{"SET", "d", "1"}, maxErr},
+		{[]string{"SADD", "d", "1"}, maxErr},
+		{[]string{"INCR", "d"}, maxErr},
+		{[]string{"SELECT", "1"}, "OK"},
+		{[]string{"SET", "d", "1"}, maxErr},
+		{[]string{"SELECT", "0"}, "OK"},
+		{[]string{"SET", "a", "3"}, "OK"},
+		{[]string{"RPUSH", "b", "2"}, 2},
+		{[]string{"RPOPLPUSH", "b", "b"}, "2"},
+		{[]string{"RPOPLPUSH", "b", "d"}, maxErr},
+		{[]string{"LMOVE", "b", "d", "LEFT", "LEFT"}, maxErr},
+		{[]string{"RENAME", "a", "d"}, "OK"},
+		{[]string{"DEL", "d"}, 1},
+		{[]string{"SET", "d", "1"}, "OK"},
+		{[]string{"CONFIG", "SET", "maxkeys", "0"}, "OK"},
+		{[]string{"SET", "e", "1"}, "OK"},
+	}
+	for _, tt := range tests {
+		reply := conn.do(tt.args...)
+		if err, ok := reply.(error); ok {
+			reply = err.Error()
+		}
+		if reply != tt.reply {
+			t.Fatalf("%v: expected '%v', got '%v'", tt.args, tt.reply, reply)
+		}
+	}
+}
+
+func TestTTLOnOverwrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"))
+	stop := testServe(t, s, addr)
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	str := []string{"SET", "key", "1"}
+	lst := []string{"RPUSH", "key", "a", "b"}
+	st := []string{"SADD", "key", "a", "b"}
+	hs := []string{"HSET", "key", "a", "1", "b", "2"}
+	zs := []string{"ZADD", "key", "1", "a", "2", "b"}
+	other := []string{"SADD", "other", "z"}
+	otherList := []string{"RPUSH", "other", "1", "2"}
+
+	// Each case runs the setup commands, sets a ttl on "key", runs the
+	// command, and checks the ttl of the check key in the check database.
+	tests := []struct {
+		setup   [][]string
+		args    []string
+		checkDB int
+		check   string
+		policy  ttlPolicy
+	}{
+		{[][]string{str}, []string{"SET", "key", "2"}, 0, "key", ttlClear},
+		{[][]string{str}, []string{"SET", "key", "2", "KEEPTTL"}, 0, "key", ttlKeep},
+		{[][]string{str}, []string{"GETSET", "key", "2"}, 0, "key", ttlClear},
+		{[][]string{str}, []string{"MSET", "key", "2", "a", "3"}, 0, "key", ttlClear},
+		{[][]string{str}, []string{"SETEX", "key", "1000", "2"}, 0, "key", ttlClear},
+		{[][]string{str}, []string{"PSETEX", "key", "1000000", "2"}, 0, "key", ttlClear},
+		{[][]string{str}, []string{"APPEND", "key", "2"}, 0, "key", ttlKeep},
+		{[][]string{str}, []string{"SETRANGE", "key", "3", "2"}, 0, "key", ttlKeep},
+		{[][]string{str}, []string{"INCR", "key"}, 0, "key", ttlKeep},
+		{[][]string{str}, []string{"INCRBY", "key", "2"}, 0, "key", ttlKeep},
+		{[][]string{str}, []string{"DECR", "key"}, 0, "key", ttlKeep},
+		{[][]string{str}, []string{"DECRBY", "key", "2"}, 0, "key", ttlKeep},
+		{[][]string{str}, []string{"INCRBYFLOAT", "key", "0.5"}, 0, "key", ttlKeep},
+		{[][]string{lst}, []string{"LPUSH", "key", "c"}, 0, "key", ttlKeep},
+		{[][]string{lst}, []string{"RPUSH", "key", "c"}, 0, "key", ttlKeep},
+		{[][]string{lst}, []string{"LPOP", "key"}, 0, "key", ttlKeep},
+		{[][]string{lst}, []string{"RPOP", "key"}, 0, "key", ttlKeep},
+		{[][]string{lst}, []string{"LPOP", "key", "1"}, 0, "key", ttlKeep},
+		{[][]string{lst}, []string{"LREM", "key", "1", "a"}, 0, "key", ttlKeep},
+		{[][]string{lst}, []string{"LSET", "key", "0", "c"}, 0, "key", ttlKeep},
+		{[][]string{lst}, []string{"LTRIM", "key", "0", "0"}, 0, "key", ttlKeep},
+		{[][]string{lst}, []string{"LINSERT", "key", "BEFORE", "a", "c"}, 0, "key", ttlKeep},
+		{[][]string{lst, otherList}, []string{"RPOPLPUSH", "other", "key"}, 0, "key", ttlKeep},
+		{[][]string{lst, otherList}, []string{"LMOVE", "other", "key", "LEFT", "RIGHT"}, 0, "key", ttlKeep},
+		{[][]string{lst}, []string{"BLPOP", "key", "0"}, 0, "key", ttlKeep},
+		{[][]string{lst}, []string{"BRPOP", "key", "0"}, 0, "key", ttlKeep},
+		{[][]string{lst, otherList}, []string{"BLMOVE", "other", "key", "LEFT", "RIGHT", "0"}, 0, "key", ttlKeep},
+		{[][]string{lst, otherList}, []string{"BRPOPLPUSH", "other", "key", "0"}, 0, "key", ttlKeep},
+		{[][]string{st}, []string{"SADD", "key", "c"}, 0, "key", ttlKeep},
+		{[][]string{st}, []string{"SPOP", "key"}, 0, "key", ttlKeep},
+		{[][]string{st}, []string{"SREM", "key", "a"}, 0, "key", ttlKeep},
+		{[][]string{st, other}, []string{"SMOVE", "other", "key", "z"}, 0, "key", ttlKeep},
+		{[][]string{st, other}, []string{"SDIFFSTORE", "key", "key", "other"}, 0, "key", ttlClear},
+		{[][]string{st, other}, []string{"SINTERSTORE", "key", "key", "key"}, 0, "key", ttlClear},
+		{[][]string{st, other}, []string{"SUNIONSTORE", "key", "key", "other"}, 0, "key", ttlClear},
+		{[][]string{hs}, []string{"HSET", "key", "c", "3"}, 0, "key", ttlKeep},
+		{[][]string{hs}, []string{"HDEL", "key", "a"}, 0, "key", ttlKeep},
+		{[][]string{hs}, []string{"HSETNX", "key", "c", "3"}, 0, "key", ttlKeep},
+		{[][]string{hs}, []string{"HINCRBY", "key", "a", "2"}, 0, "key", ttlKeep},
+		{[][]string{hs}, []string{"HINCRBYFLOAT", "key", "a", "0.5"}, 0, "key", ttlKeep},
+		{[][]string{zs}, []string{"ZADD", "key", "3", "c"}, 0, "key", ttlKeep},
+		{[][]string{zs}, []string{"ZREM", "key", "a"}, 0, "key", ttlKeep},
+		{[][]string{zs}, []string{"ZREMRANGEBYRANK", "key", "0", "0"}, 0, "key", ttlKeep},
+		{[][]string{zs}, []string{"ZREMRANGEBYSCORE", "key", "1", "1"}, 0, "key", ttlKeep},
+		{[][]string{zs}, []string{"ZREMRANGEBYLEX", "key", "[a", "[a"}, 0, "key", ttlKeep},
+		{[][]string{lst, otherList}, []string{"SORT", "other", "STORE", "key"}, 0, "key", ttlClear},
+		{[][]string{str}, []string{"RENAME", "key", "dst"}, 0, "dst", ttlMove},
+		{[][]string{str, {"SET", "dst", "2"}}, []string{"RENAME", "key", "dst"}, 0, "dst", ttlMove},
+		{[][]string{str}, []string{"RENAMENX", "key", "dst"}, 0, "dst", ttlMove},
+		{[][]string{str}, []string{"MOVE", "key", "1"}, 1, "key", ttlMove},
+	}
+	covered := make(map[string]bool)
+	for _, tt := range tests {
+		conn.do("FLUSHALL")
+		for _, args := range tt.setup {
+			conn.do(args...)
+		}
+		conn.do("EXPIRE", "key", "100")
+		if reply, ok := conn.do(tt.args...).(error); ok {
+			t.Fatalf("%v: %v", tt.args, reply)
+		}
+		conn.do("SELECT", strconv.Itoa(tt.checkDB))
+		ttl := conn.do("TTL", tt.check).(int)
+		conn.do("SELECT", "0")
+		kept := ttl > 0 && ttl <= 100
+		cleared := ttl == -1 || ttl > 100
+		switch tt.policy {
+		case ttlKeep, ttlMove:
+			if !kept {
+				t.Fatalf("%v: expected the ttl to be kept, got %d", tt.args, ttl)
+			}
+		case ttlClear:
+			if !cleared {
+				t.Fatalf("%v: expected the ttl to be cleared, got %d", tt.args, ttl)
+			}
+		}
+		name := strings.ToLower(tt.args[0])
+		covered[name] = true
+		// KEEPTTL overrides the policy of SET
+		if cmd := s.cmds[name]; cmd.ttl != tt.policy && name != "set" {
+			t.Fatalf("%s: expected policy %d in the command table, got %d",
+				name, tt.policy, cmd.ttl)
+		}
+	}
+
+	// every command that writes values must declare a policy
+	noValues := map[string]bool{"del": true, "expire": true, "expireat": true, "persist": true,
+		"pexpire": true, "pexpireat": true,
+		"getex": true, "flushdb": true, "flushall": true}
+	onlyNewKeys := map[string]bool{"setnx": true, "msetnx": true}
+	for name, cmd := range s.cmds {
+		if name != cmd.name || !cmd.aof {
+			continue
+		}
+		switch {
+		case noValues[name]:
+			if cmd.ttl != ttlNone {
+				t.Fatalf("%s: expected no ttl policy", name)
+			}
+		case onlyNewKeys[name]:
+			if cmd.ttl != ttlClear {
+				t.Fatalf("%s: expected the clear ttl policy", name)
+			}
+		case cmd.ttl == ttlNone:
+			t.Fatalf("%s: missing a ttl policy", name)
+		case !covered[name]:
+			t.Fatalf("%s: missing a test case", name)
+		}
+	}
+}
+
+// TestObjectIdleTime checks that reads touch keys while OBJECT IDLETIME
+// reports the idle time without touching them.
+func TestObjectIdleTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"))
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+	conn.do("SET", "busy", "value")
+	conn.do("SET", "idle", "value")
+
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(time.Millisecond * 2500)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn := testDial(t, addr)
+			defer conn.close()
+			for time.Now().Before(deadline) {
+				conn.send("GET", "busy")
+				conn.send("OBJECT", "IDLETIME", "busy")
+				conn.send("OBJECT", "IDLETIME", "idle")
+				for j := 0; j < 3; j++ {
+					if _, err := conn.read(); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v := conn.do("OBJECT", "IDLETIME", "busy"); v != 0 && v != 1 {
+		t.Fatalf("expected an idle time of 0 or 1, got '%v'", v)
+	}
+	if v, ok := conn.do("OBJECT", "IDLETIME", "idle").(int); !ok || v < 1 || v > 4 {
+		t.Fatalf("expected an idle time of about 2, got '%v'", v)
+	}
+	if v := conn.do("TOUCH", "idle", "missing"); v != 1 {
+		t.Fatalf("expected '1', got '%v'", v)
+	}
+	if v := conn.do("OBJECT", "IDLETIME", "idle"); v != 0 && v != 1 {
+		t.Fatalf("expected an idle time of 0 or 1 after TOUCH, got '%v'", v)
+	}
+	if v := conn.do("OBJECT", "IDLETIME", "missing"); v != nil {
+		t.Fatalf("expected nil, got '%v'", v)
+	}
+	if v := conn.do("OBJECT", "ENCODING", "busy"); v != "raw" {
+		t.Fatalf("expected 'raw', got '%v'", v)
+	}
+	if _, ok := conn.do("OBJECT", "FREQ", "busy").(error); !ok {
+		t.Fatal("expected an error without an LFU policy")
+	}
+	if v := conn.do("DEBUG", "OBJECT", "busy").(string); !strings.Contains(v, " lru_seconds_idle:") {
+		t.Fatalf("expected an idle time, got '%v'", v)
+	}
+}
+
+// TestKeysStreamed checks that KEYS writes a large reply as it goes, rather
+// than collecting it first.
+func TestKeysStreamed(t *testing.T) {
+	const numKeys = 1000000
+	if testing.Short() {
+		t.Skip("a million keys")
+	}
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"))
+	stop := testServe(t, s, addr)
+	defer stop()
+	s.mu.Lock()
+	db := s.selectDB(0)
+	for i := 0; i < numKeys; i++ {
+		db.set("key:"+strconv.Itoa(i), "")
+	}
+	s.mu.Unlock()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	conn.send("KEYS", "key:*")
+	line, err := conn.rd.ReadSlice('\n')
+	if err != nil || string(line) != "*"+strconv.Itoa(numKeys)+"\r\n" {
+		t.Fatalf("expected %d keys, got %q, %v", numKeys, line, err)
+	}
+	for i := 0; i < numKeys*2; i++ {
+		// ReadSlice doesn't allocate
+		if _, err := conn.rd.ReadSlice('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runtime.ReadMemStats(&after)
+	// collecting the keys first would allocate at least 16MB
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 4*1024*1024 {
+		t.Fatalf("expected less than 4MB allocated, got %d bytes", alloc)
+	}
+
+	s.Do("CONFIG", "SET", "keys-max-results", "1000")
+	if v, ok := conn.do("KEYS", "*").(error); !ok || !strings.Contains(v.Error(), "SCAN") {
+		t.Fatalf("expected an error that points to SCAN, got %v", v)
+	}
+	if v := conn.do("KEYS", "key:99999?").([]interface{}); len(v) != 10 {
+		t.Fatalf("expected 10 keys, got %d", len(v))
+	}
+}
+
+// TestEmptyString checks the empty key and the empty value through both
+// framings of the protocol, the keyspace commands, and the aof.
+func TestEmptyString(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	s, addr := testNewServer(t, aofPath)
+	stop := testServe(t, s, addr)
+	defer func() { stop() }()
+	conn := testDial(t, addr)
+	defer func() { conn.close() }()
+
+	// a multibulk with empty bulks, and an inline command with empty quotes
+	if _, err := conn.conn.Write([]byte("*3\r\n$3\r\nSET\r\n$0\r\n\r\n$0\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := conn.read(); err != nil || v != "OK" {
+		t.Fatalf("expected 'OK', got '%v', %v", v, err)
+	}
+	if _, err := conn.conn.Write([]byte("SET key \"\"\r\nGET ''\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"OK", ""} {
+		if v, err := conn.read(); err != nil || v != expect {
+			t.Fatalf("expected '%s', got '%v', %v", expect, v, err)
+		}
+	}
+
+	// the empty key is the only key of db 1
+	conn.do("SELECT", "1")
+	conn.do("SET", "", "one")
+	if v := conn.do("RANDOMKEY"); v != "" {
+		t.Fatalf("expected the empty key, got '%v'", v)
+	}
+	if v := conn.do("SCAN", "0", "COUNT", "100").([]interface{}); len(v[1].([]interface{})) != 1 ||
+		v[1].([]interface{})[0] != "" {
+		t.Fatalf("expected the empty key, got %v", v)
+	}
+	if v := conn.do("SCAN", "0", "MATCH", "?*").([]interface{}); len(v[1].([]interface{})) != 0 {
+		t.Fatalf("expected no keys, got %v", v)
+	}
+
+	// the empty key and value are loaded from the aof, and from a rewrite
+	for _, rewrite := range []bool{false, true} {
+		if rewrite {
+			if v := conn.do("SAVE"); v != "OK" {
+				t.Fatalf("expected 'OK', got '%v'", v)
+			}
+		}
+		conn.close()
+		stop()
+		s, addr = testNewServer(t, aofPath)
+		stop = testServe(t, s, addr)
+		conn = testDial(t, addr)
+		for _, tt := range []struct {
+			db, key string
+			value   interface{}
+		}{{"0", "", ""}, {"0", "key", ""}, {"1", "", "one"}} {
+			conn.do("SELECT", tt.db)
+			if v := conn.do("GET", tt.key); v != tt.value {
+				t.Fatalf("db %s: expected '%v' for '%s', got '%v'", tt.db,
+					tt.value, tt.key, v)
+			}
+		}
+	}
+	conn.do("SELECT", "0")
+	if v := conn.do("DEL", ""); v != 1 {
+		t.Fatalf("expected 1, got '%v'", v)
+	}
+	if v := conn.do("EXISTS", ""); v != 0 {
+		t.Fatalf("expected 0, got '%v'", v)
+	}
+}
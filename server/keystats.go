@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Key statistics aggregate the keyspace by key prefix, for capacity planning.
+// They are computed in the background like an export, the keys are collected
+// under the read lock and their values are read in batches. The result is
+// kept until the next KEYSTATS.
+
+// keyStatsEntry is the aggregate of the keys of a database that share a
+// prefix.
+type keyStatsEntry struct {
+	db      int
+	prefix  string
+	keys    int
+	memory  int
+	types   map[string]int
+	expires int // keys with an expiration
+}
+
+// keyStatsState is the progress and the result of the KEYSTATS command.
+type keyStatsState struct {
+	depth   int
+	delim   string
+	started time.Time
+	elapsed time.Duration
+	scanned int64 // atomic
+	running bool
+	entries []*keyStatsEntry
+}
+
+// keyPrefix returns the first depth fields of the key, including the
+// delimiter that follows them. A key with fewer fields is counted by the
+// fields it has, and a key without the delimiter has an empty prefix.
+func keyPrefix(key, delim string, depth int) string {
+	var n int
+	for i := 0; i < depth; i++ {
+		j := strings.Index(key[n:], delim)
+		if j == -1 {
+			break
+		}
+		n += j + len(delim)
+	}
+	return key[:n]
+}
+
+// keyStats aggregates the keys of all databases. The entries are ordered by
+// their estimated memory, the largest first.
+func (s *Server) keyStats(depth int, delim string, scanned *int64) []*keyStatsEntry {
+	type statsKey struct {
+		db     int
+		prefix string
+	}
+	stats := make(map[statsKey]*keyStatsEntry)
+	s.mu.RLock()
+	dbs := make([]*database, 0, len(s.dbs))
+	for _, db := range s.dbs {
+		dbs = append(dbs, db)
+	}
+	s.mu.RUnlock()
+	for _, db := range dbs {
+		s.mu.RLock()
+		keys := make([]string, 0, db.len())
+		db.ascend(func(key string, value interface{}) bool {
+			keys = append(keys, key)
+			return true
+		})
+		s.mu.RUnlock()
+		for len(keys) > 0 {
+			n := exportBatchSize
+			if n > len(keys) {
+				n = len(keys)
+			}
+			s.mu.RLock()
+			for _, key := range keys[:n] {
+				value, when, ok := db.getExpires(key)
+				if !ok {
+					continue
+				}
+				sk := statsKey{db.num, keyPrefix(key, delim, depth)}
+				e := stats[sk]
+				if e == nil {
+					e = &keyStatsEntry{db: sk.db, prefix: sk.prefix,
+						types: make(map[string]int)}
+					stats[sk] = e
+				}
+				e.keys++
+				e.memory += memoryUsage(key, value, 5)
+				e.types[db.getType(key)]++
+				if !when.IsZero() {
+					e.expires++
+				}
+			}
+			s.mu.RUnlock()
+			atomic.AddInt64(scanned, int64(n))
+			keys = keys[n:]
+		}
+	}
+	entries := make([]*keyStatsEntry, 0, len(stats))
+	for _, e := range stats {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].memory != entries[j].memory {
+			return entries[i].memory > entries[j].memory
+		}
+		if entries[i].db != entries[j].db {
+			return entries[i].db < entries[j].db
+		}
+		return entries[i].prefix < entries[j].prefix
+	})
+	return entries
+}
+
+// keystatsCommand is KEYSTATS [DEPTH depth] [DELIMITER delimiter], which
+// starts the statistics in the background, or KEYSTATS RESULT.
+func keystatsCommand(c *client) {
+	if len(c.args) == 2 && strings.ToLower(c.args[1]) == "result" {
+		keystatsResultCommand(c)
+		return
+	}
+	if len(c.args)%2 != 1 {
+		c.replySyntaxError()
+		return
+	}
+	depth, delim := 1, ":"
+	for i := 1; i < len(c.args); i += 2 {
+		switch strings.ToLower(c.args[i]) {
+		default:
+			c.replySyntaxError()
+			return
+		case "depth":
+			n, err := strconv.Atoi(c.args[i+1])
+			if err != nil || n < 1 {
+				c.replyError("DEPTH must be a positive integer")
+				return
+			}
+			depth = n
+		case "delimiter":
+			if c.args[i+1] == "" {
+				c.replyError("DELIMITER must not be empty")
+				return
+			}
+			delim = c.args[i+1]
+		}
+	}
+	c.s.jobsMu.Lock()
+	defer c.s.jobsMu.Unlock()
+	if c.s.keyStatsState != nil && c.s.keyStatsState.running {
+		c.replyError("Key statistics already in progress")
+		return
+	}
+	state := &keyStatsState{depth: depth, delim: delim, started: time.Now(),
+		running: true}
+	c.s.keyStatsState = state
+	c.s.workers.start(workerJobs, func(ctx context.Context) {
+		entries := c.s.keyStats(depth, delim, &state.scanned)
+		c.s.jobsMu.Lock()
+		state.running = false
+		state.entries = entries
+		state.elapsed = time.Since(state.started)
+		c.s.jobsMu.Unlock()
+	})
+	c.replyString("Background key statistics started")
+}
+
+// keystatsResultCommand replies with the progress and, when they are done,
+// the entries of the last KEYSTATS.
+func keystatsResultCommand(c *client) {
+	c.s.jobsMu.Lock()
+	defer c.s.jobsMu.Unlock()
+	state := c.s.keyStatsState
+	if state == nil {
+		c.replyMultiBulkLen(2)
+		c.replyBulk("status")
+		c.replyBulk("none")
+		return
+	}
+	status, elapsed := "done", state.elapsed
+	if state.running {
+		status, elapsed = "running", time.Since(state.started)
+	}
+	c.replyMultiBulkLen(12)
+	c.replyBulk("status")
+	c.replyBulk(status)
+	c.replyBulk("depth")
+	c.replyInt(state.depth)
+	c.replyBulk("delimiter")
+	c.replyBulk(state.delim)
+	c.replyBulk("keys-scanned")
+	c.replyInt(int(atomic.LoadInt64(&state.scanned)))
+	c.replyBulk("elapsed-ms")
+	c.replyInt(int(elapsed / time.Millisecond))
+	c.replyBulk("prefixes")
+	c.replyMultiBulkLen(len(state.entries))
+	for _, e := range state.entries {
+		types := make([]string, 0, len(e.types))
+		for typ := range e.types {
+			types = append(types, typ)
+		}
+		sort.Strings(types)
+		c.replyMultiBulkLen(12)
+		c.replyBulk("db")
+		c.replyInt(e.db)
+		c.replyBulk("prefix")
+		c.replyBulk(e.prefix)
+		c.replyBulk("keys")
+		c.replyInt(e.keys)
+		c.replyBulk("memory")
+		c.replyInt(e.memory)
+		c.replyBulk("types")
+		c.replyMultiBulkLen(len(types) * 2)
+		for _, typ := range types {
+			c.replyBulk(typ)
+			c.replyInt(e.types[typ])
+		}
+		c.replyBulk("expires")
+		c.replyInt(e.expires)
+	}
+}
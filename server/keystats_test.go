@@ -0,0 +1,91 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestKeyPrefix(t *testing.T) {
+	for _, tt := range []struct {
+		key, delim string
+		depth      int
+		prefix     string
+	}{
+		{"user:1:name", ":", 1, "user:"},
+		{"user:1:name", ":", 2, "user:1:"},
+		{"user:1:name", ":", 3, "user:1:"},
+		{"user", ":", 1, ""},
+		{"a::b", "::", 1, "a::"},
+	} {
+		if prefix := keyPrefix(tt.key, tt.delim, tt.depth); prefix != tt.prefix {
+			t.Fatalf("%q depth %d: expected %q, got %q", tt.key, tt.depth, tt.prefix, prefix)
+		}
+	}
+}
+
+func TestKeyStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"))
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	if _, ok := conn.do("KEYSTATS", "DEPTH", "0").(error); !ok {
+		t.Fatal("expected an error for a zero depth")
+	}
+	for i := 0; i < 250; i++ {
+		conn.do("SET", "user:"+strconv.Itoa(i), "value")
+	}
+	conn.do("SET", "user:0", "value", "EX", "100")
+	conn.do("RPUSH", "user:list", "a", "b")
+	conn.do("SADD", "session:1", strconv.Itoa(1))
+	conn.do("SET", "flat", "value")
+	if v := conn.do("KEYSTATS"); v != "Background key statistics started" {
+		t.Fatalf("unexpected reply '%v'", v)
+	}
+	var res []interface{}
+	for start := time.Now(); ; {
+		res = conn.do("KEYSTATS", "RESULT").([]interface{})
+		if res[1] == "done" {
+			break
+		}
+		if time.Since(start) > time.Second*10 {
+			t.Fatal("timeout waiting for the key statistics")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if res[7] != 253 {
+		t.Fatalf("expected 253 keys scanned, got '%v'", res[7])
+	}
+	entries := make(map[string][]interface{})
+	for _, e := range res[11].([]interface{}) {
+		e := e.([]interface{})
+		entries[e[3].(string)] = e
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 prefixes, got %v", entries)
+	}
+	user := entries["user:"]
+	if user[5] != 251 || user[11] != 1 {
+		t.Fatalf("expected 251 keys with 1 expire, got %v", user)
+	}
+	if types := user[9].([]interface{}); len(types) != 4 || types[0] != "list" ||
+		types[1] != 1 || types[3] != 250 {
+		t.Fatalf("unexpected types %v", types)
+	}
+	// the largest prefix is first
+	if first := res[11].([]interface{})[0].([]interface{}); first[3] != "user:" {
+		t.Fatalf("expected 'user:' first, got %v", first)
+	}
+	if flat := entries[""]; flat == nil || flat[5] != 1 {
+		t.Fatalf("expected 1 key without a prefix, got %v", flat)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyEvent is the latest and the max latency of an event.
+type latencyEvent struct {
+	time   time.Time     // when the latest latency was recorded
+	latest time.Duration // the latest latency
+	max    time.Duration // the max latency since the event was reset
+	trace  string        // the TRACEID of the command of the latest latency
+}
+
+// latencyMonitor keeps the latency events. It has its own lock so that the
+// LATENCY command works while a command holds the server lock.
+type latencyMonitor struct {
+	mu     sync.Mutex
+	events map[string]*latencyEvent
+}
+
+func (m *latencyMonitor) add(name string, latency time.Duration, trace string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.events == nil {
+		m.events = make(map[string]*latencyEvent)
+	}
+	e := m.events[name]
+	if e == nil {
+		e = &latencyEvent{}
+		m.events[name] = e
+	}
+	e.time = time.Now()
+	e.latest = latency
+	e.trace = trace
+	if latency > e.max {
+		e.max = latency
+	}
+}
+
+// latencyCommand is LATENCY LATEST|RESET|HELP.
+func latencyCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	m := &c.s.latency
+	switch strings.ToLower(c.args[1]) {
+	default:
+		c.replyError("Unknown subcommand or wrong number of arguments for '" + c.args[1] + "'. Try LATENCY HELP.")
+	case "help":
+		msgs := []string{
+			"LATENCY <subcommand> [arg]. Subcommands:",
+			"latest -- Return the latest latency samples for all events.",
+			"reset [event ...] -- Reset the latency data of the events, or of all events.",
+		}
+		c.replyMultiBulkLen(len(msgs))
+		for _, msg := range msgs {
+			c.replyBulk(msg)
+		}
+	case "latest":
+		if len(c.args) != 2 {
+			c.replyError("Unknown subcommand or wrong number of arguments for '" + c.args[1] + "'. Try LATENCY HELP.")
+			return
+		}
+		m.mu.Lock()
+		names := make([]string, 0, len(m.events))
+		for name := range m.events {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		c.replyMultiBulkLen(len(names))
+		for _, name := range names {
+			e := m.events[name]
+			if e.trace != "" {
+				// the TRACEID of the latest sample follows the fields of Redis
+				c.replyMultiBulkLen(5)
+			} else {
+				c.replyMultiBulkLen(4)
+			}
+			c.replyBulk(name)
+			c.replyInt(int(e.time.Unix()))
+			c.replyInt(int(e.latest / time.Millisecond))
+			c.replyInt(int(e.max / time.Millisecond))
+			if e.trace != "" {
+				c.replyBulk(e.trace)
+			}
+		}
+		m.mu.Unlock()
+	case "reset":
+		m.mu.Lock()
+		var n int
+		if len(c.args) == 2 {
+			n = len(m.events)
+			m.events = nil
+		} else {
+			for _, name := range c.args[2:] {
+				if _, ok := m.events[name]; ok {
+					delete(m.events, name)
+					n++
+				}
+			}
+		}
+		m.mu.Unlock()
+		c.replyInt(n)
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -180,33 +181,26 @@ func (l *list) set(idx int, value string) bool {
 	return false
 }
 
+// rem removes up to count elements that are equal to the value, from the
+// head when the count is positive, from the tail when it's negative, or all
+// of them when it's zero. Returns the number of removed elements.
 func (l *list) rem(count int, value string) int {
-	if count < 0 {
-		return 0
+	tail := count < 0
+	if tail {
+		count = -count
 	}
-	n := 0
 	el := l.front
-	for el != nil {
-		if n == count {
-			break
-		}
+	if tail {
+		el = l.back
+	}
+	n := 0
+	for el != nil && (count == 0 || n < count) {
 		nel := el.next
+		if tail {
+			nel = el.prev
+		}
 		if el.value == value {
-			if el.prev == nil {
-				if el.next == nil {
-					l.front, l.back = nil, nil
-				} else {
-					el.next.prev = nil
-					l.front = el.next
-				}
-			} else if el.next == nil {
-				el.prev.next = nil
-				l.back = el.prev
-			} else {
-				el.prev.next = el.next
-				el.next.prev = el.prev
-			}
-			l.count--
+			l.unlink(el)
 			n++
 		}
 		el = nel
@@ -214,6 +208,53 @@ func (l *list) rem(count int, value string) int {
 	return n
 }
 
+// unlink removes an element.
+func (l *list) unlink(el *listItem) {
+	if el.prev == nil {
+		l.front = el.next
+	} else {
+		el.prev.next = el.next
+	}
+	if el.next == nil {
+		l.back = el.prev
+	} else {
+		el.next.prev = el.prev
+	}
+	l.count--
+}
+
+// insert inserts the value before or after the first element that's equal
+// to the pivot. Returns the length of the list, or -1 when the pivot isn't
+// found.
+func (l *list) insert(pivot, value string, before bool) int {
+	for el := l.front; el != nil; el = el.next {
+		if el.value != pivot {
+			continue
+		}
+		nel := &listItem{value: value}
+		if before {
+			nel.prev, nel.next = el.prev, el
+			if el.prev == nil {
+				l.front = nel
+			} else {
+				el.prev.next = nel
+			}
+			el.prev = nel
+		} else {
+			nel.prev, nel.next = el, el.next
+			if el.next == nil {
+				l.back = nel
+			} else {
+				el.next.prev = nel
+			}
+			el.next = nel
+		}
+		l.count++
+		return l.count
+	}
+	return -1
+}
+
 func (l *list) ascend(iterator func(value string) bool) {
 	el := l.front
 	for el != nil {
@@ -225,16 +266,8 @@ func (l *list) ascend(iterator func(value string) bool) {
 }
 
 func (l *list) lrange(start, stop int, count func(n int), iterator func(value string) bool) {
-	var ok bool
-	if start, _, ok = l.ridx(start, true); !ok {
-		count(0)
-		return
-	}
-	if stop, _, ok = l.ridx(stop, true); !ok {
-		count(0)
-		return
-	}
-	if start > stop {
+	start, stop, ok := rangeIndexes(start, stop, l.count, false)
+	if !ok {
 		count(0)
 		return
 	}
@@ -335,19 +368,8 @@ func (l *list) numArr() []float64 {
 }
 
 func (l *list) trim(start, stop int) {
-	var ok bool
-	var ostart, ostop int
-	if start, ostart, ok = l.ridx(start, true); !ok {
-		l.clear()
-		return
-	}
-	if stop, ostop, ok = l.ridx(stop, true); !ok {
-		l.clear()
-		return
-	}
-
-	if ostart > ostop ||
-		((ostart < 0 || ostart >= l.count) && (ostop < 0 || ostop >= l.count)) {
+	start, stop, ok := rangeIndexes(start, stop, l.count, false)
+	if !ok {
 		l.clear()
 		return
 	}
@@ -393,6 +415,7 @@ func lpushCommand(c *client) {
 	l.lpush(c.args[2:]...)
 	c.replyInt(l.len())
 	c.dirty++
+	c.s.signalList(c.db, c.args[1])
 }
 
 func rpushCommand(c *client) {
@@ -408,6 +431,7 @@ func rpushCommand(c *client) {
 	l.rpush(c.args[2:]...)
 	c.replyInt(l.len())
 	c.dirty++
+	c.s.signalList(c.db, c.args[1])
 }
 
 func lrangeCommand(c *client) {
@@ -460,57 +484,67 @@ func llenCommand(c *client) {
 	c.replyInt(l.len())
 }
 
+// lpopCommand is LPOP key [count].
 func lpopCommand(c *client) {
-	if len(c.args) != 2 {
-		c.replyAritryError()
-		return
-	}
-	l, ok := c.db.getList(c.args[1], false)
-	if !ok {
-		c.replyTypeError()
-		return
-	}
-	if l == nil {
-		c.replyNull()
-		return
-	}
-	value, ok := l.lpop()
-	if !ok {
-		c.replyNull()
-		return
-	}
-	if l.len() == 0 {
-		c.db.del(c.args[1])
-	}
-	c.replyBulk(value)
-	c.dirty++
-
+	popCommand(c, true)
 }
 
+// rpopCommand is RPOP key [count].
 func rpopCommand(c *client) {
-	if len(c.args) != 2 {
+	popCommand(c, false)
+}
+
+// popCommand pops from the head or the tail of a list. Without a count the
+// reply is the element, and with a count it's an array of up to count
+// elements, or a null array when the list doesn't exist.
+func popCommand(c *client, left bool) {
+	if len(c.args) != 2 && len(c.args) != 3 {
 		c.replyAritryError()
 		return
 	}
+	count := 1
+	if len(c.args) == 3 {
+		n, err := strconv.ParseInt(c.args[2], 10, 64)
+		if err != nil || n < 0 || n > math.MaxInt32 {
+			c.replyError("value is out of range, must be positive")
+			return
+		}
+		count = int(n)
+	}
 	l, ok := c.db.getList(c.args[1], false)
 	if !ok {
 		c.replyTypeError()
 		return
 	}
 	if l == nil {
-		c.replyNull()
+		if len(c.args) == 3 {
+			c.replyNullArray()
+		} else {
+			c.replyNull()
+		}
 		return
 	}
-	value, ok := l.rpop()
-	if !ok {
-		c.replyNull()
-		return
+	if count > l.len() {
+		count = l.len()
+	}
+	if len(c.args) == 3 {
+		c.replyMultiBulkLen(count)
+	}
+	for i := 0; i < count; i++ {
+		var value string
+		if left {
+			value, _ = l.lpop()
+		} else {
+			value, _ = l.rpop()
+		}
+		c.replyBulk(value)
 	}
 	if l.len() == 0 {
 		c.db.del(c.args[1])
 	}
-	c.replyBulk(value)
-	c.dirty++
+	if count > 0 {
+		c.dirty++
+	}
 }
 
 func lindexCommand(c *client) {
@@ -567,6 +601,39 @@ func lremCommand(c *client) {
 	c.replyInt(n)
 }
 
+// linsertCommand is LINSERT key BEFORE|AFTER pivot element. Replies with
+// the length of the list, -1 when the pivot isn't found, or 0 when the list
+// doesn't exist.
+func linsertCommand(c *client) {
+	if len(c.args) != 5 {
+		c.replyAritryError()
+		return
+	}
+	var before bool
+	switch strings.ToLower(c.args[2]) {
+	default:
+		c.replySyntaxError()
+		return
+	case "before":
+		before = true
+	case "after":
+	}
+	l, ok := c.db.getList(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if l == nil {
+		c.replyInt(0)
+		return
+	}
+	n := l.insert(c.args[3], c.args[4], before)
+	if n != -1 {
+		c.dirty++
+	}
+	c.replyInt(n)
+}
+
 func lsetCommand(c *client) {
 	if len(c.args) != 4 {
 		c.replyAritryError()
@@ -632,35 +699,74 @@ func ltrimCommand(c *client) {
 	c.replyString("OK")
 }
 
+// rpoplpushCommand is RPOPLPUSH source destination, which is the same as
+// LMOVE source destination RIGHT LEFT.
 func rpoplpushCommand(c *client) {
 	if len(c.args) != 3 {
 		c.replyAritryError()
 		return
 	}
-	l1, ok := c.db.getList(c.args[1], false)
+	lmoveGeneric(c, false, true)
+}
+
+// lmoveCommand is LMOVE source destination LEFT|RIGHT LEFT|RIGHT.
+func lmoveCommand(c *client) {
+	if len(c.args) != 5 {
+		c.replyAritryError()
+		return
+	}
+	var ends [2]bool
+	for i, arg := range c.args[3:] {
+		switch strings.ToLower(arg) {
+		default:
+			c.replySyntaxError()
+			return
+		case "left":
+			ends[i] = true
+		case "right":
+		}
+	}
+	lmoveGeneric(c, ends[0], ends[1])
+}
+
+// lmoveGeneric pops an element from the head or the tail of the source list
+// and pushes it to the head or the tail of the destination list, which may
+// be the same list. Replies with the element, or with a null when the source
+// doesn't exist, in which case the destination isn't created.
+func lmoveGeneric(c *client, fromLeft, toLeft bool) {
+	src, ok := c.db.getList(c.args[1], false)
 	if !ok {
 		c.replyTypeError()
 		return
 	}
-	l2, ok := c.db.getList(c.args[2], false)
+	dst, ok := c.db.getList(c.args[2], false)
 	if !ok {
 		c.replyTypeError()
 		return
 	}
-	if l1 == nil {
+	if src == nil {
 		c.replyNull()
 		return
 	}
-	v, ok := l1.rpop()
-	if !ok {
-		c.replyNull()
-		return
+	var value string
+	if fromLeft {
+		value, _ = src.lpop()
+	} else {
+		value, _ = src.rpop()
+	}
+	if src.len() == 0 && src != dst {
+		c.db.del(c.args[1])
+	}
+	if dst == nil {
+		dst = newList()
+		c.db.set(c.args[2], dst)
 	}
-	if l2 == nil {
-		l2 = newList()
-		c.db.set(c.args[2], l2)
+	if toLeft {
+		dst.lpush(value)
+	} else {
+		dst.rpush(value)
 	}
-	l2.lpush(v)
-	c.replyBulk(v)
+	c.replyBulk(value)
 	c.dirty++
+	c.s.signalList(c.db, c.args[2])
 }
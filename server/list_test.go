@@ -1,6 +1,55 @@
 package server
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestListAOF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	s, addr := testNewServer(t, aofPath)
+	stop := testServe(t, s, addr)
+	defer func() { stop() }()
+
+	// rotate the lists into each other, including into themselves
+	s.Do("RPUSH", "a", "1", "2", "3", "4", "5")
+	for i := 0; i < 100; i++ {
+		v := strconv.Itoa(i)
+		switch i % 6 {
+		case 0:
+			s.Do("LMOVE", "a", "b", "LEFT", "RIGHT")
+		case 1:
+			s.Do("RPOPLPUSH", "b", "a")
+		case 2:
+			s.Do("LMOVE", "a", "a", "RIGHT", "LEFT")
+		case 3:
+			s.Do("LINSERT", "a", "AFTER", "3", v)
+		case 4:
+			s.Do("LREM", "a", "-1", strconv.Itoa(i-1))
+		case 5:
+			s.Do("LPOP", "b", "2")
+			s.Do("RPUSH", "b", v)
+		}
+	}
+	digest, err := s.Do("DEBUG", "DIGEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	s, addr = testNewServer(t, aofPath)
+	stop = testServe(t, s, addr)
+	if v, _ := s.Do("DEBUG", "DIGEST"); v != digest {
+		t.Fatalf("expected digest %v, got %v", digest, v)
+	}
+}
 
 func testMakeSimpleList(t testing.TB) *list {
 	l := newList()
@@ -114,7 +163,9 @@ func TestList(t *testing.T) {
 	testListRem(t, l, 3, "a", 0)
 	testListRem(t, l, 3, "A", 1)
 	testListRem(t, l, 3, "Z", 1)
-	testListRem(t, l, -1, "2", 0)
+	testListRem(t, l, -1, "4", 1)
+	testListString(t, l, "4 5 c b 1 2 3")
+	l.rpush("4")
 
 	testListString(t, l, "4 5 c b 1 2 3 4")
 
@@ -149,3 +200,44 @@ func TestList(t *testing.T) {
 	testListString(t, l, "1")
 
 }
+
+func TestListInsertRem(t *testing.T) {
+	l := newList()
+	if n := l.insert("a", "x", true); n != -1 {
+		t.Fatalf("expected -1, got %v", n)
+	}
+	l.rpush("a", "b", "a")
+	// the first pivot from the head, at both ends
+	l.insert("a", "0", true)
+	l.insert("a", "1", false)
+	l.insert("b", "2", false)
+	if n := l.insert("a", "3", false); n != 7 {
+		t.Fatalf("expected 7, got %v", n)
+	}
+	testListString(t, l, "0 a 3 1 b 2 a")
+	l.insert("2", "4", false)
+	l.insert("a", "z", false)
+	testListString(t, l, "0 a z 3 1 b 2 4 a")
+	if l.front.value != "0" || l.back.value != "a" || l.front.prev != nil ||
+		l.back.next != nil || l.back.prev.value != "4" {
+		t.Fatal("invalid ends")
+	}
+
+	l = newList()
+	l.rpush("a", "b", "a", "c", "a", "a")
+	testListRem(t, l, -2, "a", 2)
+	testListString(t, l, "a b a c")
+	testListRem(t, l, 1, "a", 1)
+	testListString(t, l, "b a c")
+	l.rpush("a", "b")
+	testListRem(t, l, 0, "a", 2)
+	testListString(t, l, "b c b")
+	testListRem(t, l, -5, "b", 2)
+	testListString(t, l, "c")
+	testListRem(t, l, 0, "c", 1)
+	testListString(t, l, "")
+	testListLen(t, l, 0)
+	if l.front != nil || l.back != nil {
+		t.Fatal("expected an empty list")
+	}
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The sizes used by the MEMORY USAGE estimator. These are the sizes of the Go
+// structures on a 64-bit platform, plus a rough share of the map buckets.
+const (
+	memStringHeader = 16  // the string header
+	memKeyOverhead  = 88  // the map entries of a key, its dbItem, its expire and its keys entry
+	memListNode     = 40  // a listItem without its value
+	memSetMember    = 32  // a set map entry without its member
+	memHashField    = 48  // a hash map entry without its field and value
+	memZSetMember   = 120 // a sorted set map entry and skiplist node, which share the member
+)
+
+// Thresholds and limits of MEMORY DOCTOR.
+const (
+	memDoctorFragRatio    = 1.4              // rss/used ratio that's considered high
+	memDoctorFragMinRSS   = 1024 * 1024 * 16 // ignore fragmentation below this rss
+	memDoctorOutputBuffer = 1024 * 1024 * 8  // output that's considered large
+	memDoctorBigKey       = 1024 * 1024 * 16 // estimated size that's considered large
+	memDoctorSamples      = 1000             // keys sampled for big keys
+	memDoctorSampleTime   = time.Millisecond * 10
+	memDoctorExemptRatio  = 0.5 // exempt/maxmemory ratio that's considered high
+)
+
+func memoryCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	switch strings.ToLower(c.args[1]) {
+	default:
+		c.replyError("Unknown MEMORY subcommand or wrong number of arguments for '" + c.args[1] + "'")
+	case "help":
+		if len(c.args) != 2 {
+			c.replyAritryError()
+			return
+		}
+		msgs := []string{
+			"MEMORY <subcommand> arg arg ... arg. Subcommands:",
+			"DOCTOR - Return memory problems reports.",
+			"PURGE -- Return free memory to the operating system.",
+			"USAGE <key> [SAMPLES <count>] -- Return memory in bytes used by <key> and its value. Nested values are sampled up to <count> times (default: 5).",
+		}
+		c.replyMultiBulkLen(len(msgs))
+		for _, msg := range msgs {
+			c.replyBulk(msg)
+		}
+	case "usage":
+		memoryUsageCommand(c)
+	case "doctor":
+		if len(c.args) != 2 {
+			c.replyAritryError()
+			return
+		}
+		c.replyBulk(c.s.memoryDoctor())
+	case "purge":
+		if len(c.args) != 2 {
+			c.replyAritryError()
+			return
+		}
+		before := residentMemory()
+		debug.FreeOSMemory()
+		after := residentMemory()
+		var returned uint64
+		if after < before {
+			returned = before - after
+		}
+		c.s.lnoticef("MEMORY PURGE returned %s to the operating system", human(returned))
+		c.replyString("OK")
+	}
+}
+
+// memoryUsageCommand is MEMORY USAGE key [SAMPLES count]
+func memoryUsageCommand(c *client) {
+	if len(c.args) != 3 && len(c.args) != 5 {
+		c.replyAritryError()
+		return
+	}
+	samples := 5
+	if len(c.args) == 5 {
+		if strings.ToLower(c.args[3]) != "samples" {
+			c.replySyntaxError()
+			return
+		}
+		n, err := strconv.ParseInt(c.args[4], 10, 32)
+		if err != nil || n < 0 {
+			c.replyInvalidIntError()
+			return
+		}
+		samples = int(n)
+	}
+	item, ok := c.db.lookup(c.args[2])
+	if !ok {
+		c.replyNull()
+		return
+	}
+	c.replyInt(memoryUsage(c.args[2], item.value, samples))
+}
+
+// memoryUsage estimates the number of bytes used by a key and its value. The
+// elements of lists, sets and hashes are sampled up to samples times and the average
+// is used for the rest. Zero samples all of the elements.
+func memoryUsage(key string, value interface{}, samples int) int {
+	size := memKeyOverhead + memStringHeader + len(key)
+	switch v := value.(type) {
+	case int:
+		size += 8
+	case string:
+		size += memStringHeader + len(v)
+	case *list:
+		var n, total int
+		for item := v.front; item != nil; item = item.next {
+			if samples > 0 && n == samples {
+				break
+			}
+			total += memListNode + memStringHeader + len(item.value)
+			n++
+		}
+		if n > 0 {
+			size += total / n * v.count
+		}
+	case *set:
+		var n, total int
+		for member := range v.m {
+			if samples > 0 && n == samples {
+				break
+			}
+			total += memSetMember + memStringHeader + len(member)
+			n++
+		}
+		if n > 0 {
+			size += total / n * len(v.m)
+		}
+	case *hash:
+		var n, total int
+		for field, value := range v.m {
+			if samples > 0 && n == samples {
+				break
+			}
+			total += memHashField + memStringHeader*2 + len(field) + len(value)
+			n++
+		}
+		if n > 0 {
+			size += total / n * len(v.m)
+		}
+	case *zset:
+		var n, total int
+		for member := range v.m {
+			if samples > 0 && n == samples {
+				break
+			}
+			total += memZSetMember + len(member)
+			n++
+		}
+		if n > 0 {
+			size += total / n * len(v.m)
+		}
+	}
+	return size
+}
+
+// residentMemory returns the resident set size of the process. The memory
+// obtained from the OS minus what has been returned is used on platforms
+// without /proc.
+func residentMemory() uint64 {
+	if data, err := ioutil.ReadFile("/proc/self/statm"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) > 1 {
+			pages, err := strconv.ParseUint(fields[1], 10, 64)
+			if err == nil {
+				return pages * uint64(os.Getpagesize())
+			}
+		}
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.Sys - m.HeapReleased
+}
+
+// memoryDoctor returns a human readable report of memory problems. The big
+// keys are found by sampling random keys for at most memDoctorSampleTime. Must
+// be called while holding the read lock.
+func (s *Server) memoryDoctor() string {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	rss := residentMemory()
+	var reports []string
+
+	if rss >= memDoctorFragMinRSS && m.Alloc > 0 &&
+		float64(rss)/float64(m.Alloc) > memDoctorFragRatio {
+		reports = append(reports, fmt.Sprintf("High fragmentation: The "+
+			"process is using %s of memory but only %s is allocated, a ratio "+
+			"of %.2f. Running MEMORY PURGE returns the free memory to the "+
+			"operating system, and 'activedefrag yes' rebuilds the "+
+			"databases that have shrunk.", human(rss), human(m.Alloc),
+			float64(rss)/float64(m.Alloc)))
+	}
+
+	var bigClients []string
+	for c := range s.clients {
+		if c.cw == nil {
+			continue
+		}
+		if n := atomic.LoadInt64(&c.cw.pending); n >= memDoctorOutputBuffer {
+			bigClients = append(bigClients, fmt.Sprintf("%s (%s)",
+				c.addr, human(uint64(n))))
+		}
+	}
+	if len(bigClients) > 0 {
+		reports = append(reports, fmt.Sprintf("Big client output buffers: "+
+			"%d clients are waiting to receive a large reply: %s. These are "+
+			"usually slow consumers or clients using MONITOR, see "+
+			"'send-timeout' to disconnect them.", len(bigClients),
+			strings.Join(bigClients, ", ")))
+	}
+
+	var bigKeys []string
+	var sampled int
+	start := time.Now()
+sample:
+	for _, db := range s.dbs {
+		// map iteration starts at a random position, which makes the first
+		// keys a random sample
+		for key, item := range db.items {
+			if sampled == memDoctorSamples || time.Since(start) > memDoctorSampleTime {
+				break sample
+			}
+			sampled++
+			if item.expires && db.checkExpired(key, start) {
+				continue
+			}
+			if n := memoryUsage(key, item.value, 5); n >= memDoctorBigKey {
+				bigKeys = append(bigKeys, fmt.Sprintf("'%s' in db %d (%s)",
+					key, db.num, human(uint64(n))))
+			}
+		}
+	}
+	if len(bigKeys) > 0 {
+		reports = append(reports, fmt.Sprintf("Big keys: %d of %d sampled "+
+			"keys are very large: %s. Large keys take a long time to delete "+
+			"and to write to the append only file.", len(bigKeys), sampled,
+			strings.Join(bigKeys, ", ")))
+	}
+
+	if exempt := s.exemptMemory(); s.cfg.maxMemory > 0 &&
+		float64(exempt) > float64(s.cfg.maxMemory)*memDoctorExemptRatio {
+		reports = append(reports, fmt.Sprintf("Eviction exempt keys: The "+
+			"keys that are exempt from eviction use about %s, which is %.0f%% "+
+			"of maxmemory. These keys are never evicted, so writes will fail "+
+			"with OOM errors when they alone reach maxmemory. See "+
+			"'eviction-exempt-patterns' and 'eviction-exempt-dbs'.",
+			human(uint64(exempt)),
+			float64(exempt)/float64(s.cfg.maxMemory)*100))
+	}
+
+	if len(reports) == 0 {
+		return "Hi Sam, I can't find any memory issue in your instance. " +
+			"I can only account for what occurs on this base."
+	}
+	return "Sam, I detected a few issues in this " + s.options.AppName +
+		" instance memory implants:\n\n * " + strings.Join(reports, "\n\n * ") +
+		"\n\nI'm here to keep you safe, Sam. I want to help you.\n"
+}
+
+// exemptMemory estimates the bytes used by the keys that are exempt from
+// eviction. Up to memDoctorSamples keys of each database are sampled and the
+// result is scaled to the size of the database.
+func (s *Server) exemptMemory() int {
+	if len(s.cfg.evictionExemptPatterns) == 0 && len(s.cfg.evictionExemptDBs) == 0 {
+		return 0
+	}
+	var total int
+	for _, db := range s.dbs {
+		var sampled, size int
+		for key, item := range db.items {
+			if sampled == memDoctorSamples {
+				break
+			}
+			sampled++
+			if s.evictionExempt(db.num, key) {
+				size += memoryUsage(key, item.value, 5)
+			}
+		}
+		if sampled > 0 {
+			total += size * len(db.items) / sampled
+		}
+	}
+	return total
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMemoryCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"))
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	if v := conn.do("MEMORY", "USAGE", "missing"); v != nil {
+		t.Fatalf("expected nil, got '%v'", v)
+	}
+	conn.do("SET", "small", "value")
+	conn.do("SET", "large", strings.Repeat("x", 1000))
+	small := conn.do("MEMORY", "USAGE", "small").(int)
+	large := conn.do("MEMORY", "USAGE", "large").(int)
+	if large-small != 995 {
+		t.Fatalf("expected a difference of 995 bytes, got %d and %d", small, large)
+	}
+
+	// a sampled estimate of uniform elements matches the full count
+	for i := 0; i < 100; i++ {
+		conn.do("RPUSH", "list", "item:"+strconv.Itoa(i%10))
+		conn.do("SADD", "set", "member:"+strconv.Itoa(1000+i))
+	}
+	for _, key := range []string{"list", "set"} {
+		sampled := conn.do("MEMORY", "USAGE", key).(int)
+		full := conn.do("MEMORY", "USAGE", key, "SAMPLES", "0").(int)
+		if sampled != full || full < 100*memListNode {
+			t.Fatalf("%s: expected equal estimates, got %d and %d", key, sampled, full)
+		}
+	}
+	if _, ok := conn.do("MEMORY", "USAGE", "small", "SAMPLE", "1").(error); !ok {
+		t.Fatal("expected a syntax error")
+	}
+
+	if report := conn.do("MEMORY", "DOCTOR").(string); strings.Contains(report, "Big keys") {
+		t.Fatalf("expected no big keys, got\n%s", report)
+	}
+	conn.do("SET", "huge", strings.Repeat("x", memDoctorBigKey))
+	report := conn.do("MEMORY", "DOCTOR").(string)
+	if !strings.Contains(report, "Big keys") || !strings.Contains(report, "'huge' in db 0") {
+		t.Fatalf("expected a big key report, got\n%s", report)
+	}
+	conn.do("DEL", "huge")
+	if v := conn.do("MEMORY", "PURGE"); v != "OK" {
+		t.Fatalf("expected 'OK', got '%v'", v)
+	}
+}
@@ -1,7 +1,9 @@
 package server
 
-import "path"
+import "strings"
 
+// pattern is a parsed glob pattern. The greaterOrEqual field is the literal
+// prefix of the pattern, which every match starts with.
 type pattern struct {
 	value          string
 	all            bool
@@ -21,7 +23,7 @@ func parsePattern(value string) *pattern {
 		value: value,
 	}
 	for i, c := range value {
-		if c == '[' || c == '*' || c == '?' {
+		if c == '[' || c == '*' || c == '?' || c == '\\' {
 			p.greaterOrEqual = value[:i]
 			p.glob = true
 			break
@@ -32,18 +34,128 @@ func parsePattern(value string) *pattern {
 	} else if p.greaterOrEqual != "" {
 		c := p.greaterOrEqual[len(p.greaterOrEqual)-1]
 		if c == 0xFF {
-			p.lessThan = p.greaterOrEqual + string(0)
+			p.lessThan = p.greaterOrEqual + "\x00"
 		} else {
-			p.lessThan = p.greaterOrEqual[:len(p.greaterOrEqual)-1] + string(c+1)
+			p.lessThan = p.greaterOrEqual[:len(p.greaterOrEqual)-1] + string([]byte{c + 1})
 		}
 	}
 	return p
 }
 
+// matchAny returns true if s matches any of the patterns.
+func matchAny(patterns []*pattern, s string) bool {
+	for _, p := range patterns {
+		if p.match(s) {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *pattern) match(s string) bool {
 	if p.all {
 		return true
 	}
-	matched, _ := path.Match(p.value, s)
-	return matched
+	if !p.glob {
+		return s == p.value
+	}
+	return strings.HasPrefix(s, p.greaterOrEqual) && Match(p.value, s)
+}
+
+// Match returns true if s matches the glob-style pattern, with the rules of
+// Redis:
+//
+//	h*llo     a star matches any sequence of bytes, including an empty one
+//	h?llo     a question mark matches any single byte
+//	h[ae]llo  one of the bytes in the brackets
+//	h[^e]llo  any byte that's not in the brackets
+//	h[a-b]llo a byte in the range, in either order
+//	h\*llo    the byte after a backslash, with no special meaning
+//
+// An unterminated bracket ends at the end of the pattern. Matching is by
+// bytes, not by runes.
+func Match(pattern, s string) bool {
+	var skipLonger bool
+	return match(pattern, s, &skipLonger, 0)
+}
+
+// match is Match for the rest of the pattern and the string. When a star
+// fails to match every suffix of the string, skipLonger is set, because the
+// stars before it can't do better with a shorter suffix. Otherwise a pattern
+// with many stars would take exponential time.
+func match(p, s string, skipLonger *bool, nesting int) bool {
+	if nesting > 1000 {
+		return false
+	}
+	for len(p) > 0 && len(s) > 0 {
+		switch p[0] {
+		case '*':
+			for len(p) > 1 && p[1] == '*' {
+				p = p[1:]
+			}
+			if len(p) == 1 {
+				return true
+			}
+			for len(s) > 0 {
+				if match(p[1:], s, skipLonger, nesting+1) {
+					return true
+				}
+				if *skipLonger {
+					return false
+				}
+				s = s[1:]
+			}
+			*skipLonger = true
+			return false
+		case '?':
+			s = s[1:]
+		case '[':
+			p = p[1:]
+			not := len(p) > 0 && p[0] == '^'
+			if not {
+				p = p[1:]
+			}
+			var matched bool
+			for len(p) > 0 && p[0] != ']' {
+				if p[0] == '\\' && len(p) >= 2 {
+					p = p[1:]
+					matched = matched || p[0] == s[0]
+				} else if len(p) >= 3 && p[1] == '-' {
+					start, end := p[0], p[2]
+					if start > end {
+						start, end = end, start
+					}
+					p = p[2:]
+					matched = matched || (s[0] >= start && s[0] <= end)
+				} else {
+					matched = matched || p[0] == s[0]
+				}
+				p = p[1:]
+			}
+			if matched == not {
+				return false
+			}
+			s = s[1:]
+		case '\\':
+			if len(p) >= 2 {
+				p = p[1:]
+			}
+			fallthrough
+		default:
+			if p[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		if len(p) > 0 {
+			p = p[1:]
+		}
+		if len(s) == 0 {
+			for len(p) > 0 && p[0] == '*' {
+				p = p[1:]
+			}
+			break
+		}
+	}
+	return len(p) == 0 && len(s) == 0
 }
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*", "", false}, // as in Redis
+		{"*", "anything", true},
+		{"", "", true},
+		{"", "a", false},
+		{"hello", "hello", true},
+		{"hello", "hell", false},
+		{"h*llo", "hllo", true},
+		{"h*llo", "heeeello", true},
+		{"h*llo", "hello!", false},
+		{"user:*", "user:1", true},
+		{"user:*", "user:", true},
+		{"user:*", "users:1", false},
+		{"*/*", "a/b", true}, // a star crosses slashes
+		{"a**b", "ab", true},
+		{"*a*b*", "xxaxxbxx", true},
+		{"*a*b*", "xxbxxaxx", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h[\\]]llo", "h]llo", true},
+		{"h[-]llo", "h-llo", true},
+		{"h[ae", "ha", true}, // an unterminated bracket ends with the pattern
+		{"h[ae", "hb", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"h\\?", "h?", true},
+		{"h\\[a]", "h[a]", true},
+		{"h\\", "h\\", true},
+		{"\xff*", "\xff\x00", true},
+	}
+	for _, tt := range tests {
+		if match := Match(tt.pattern, tt.s); match != tt.match {
+			t.Fatalf("Match(%q, %q): expected %v, got %v", tt.pattern, tt.s,
+				tt.match, match)
+		}
+		p := parsePattern(tt.pattern)
+		if match := p.match(tt.s); match != tt.match && !p.all {
+			t.Fatalf("pattern %q match %q: expected %v, got %v", tt.pattern,
+				tt.s, tt.match, match)
+		}
+	}
+
+	// many stars on a string that doesn't match must not take exponential
+	// time
+	pattern := strings.Repeat("a*", 30) + "b"
+	if Match(pattern, strings.Repeat("a", 100)) {
+		t.Fatal("expected no match")
+	}
+}
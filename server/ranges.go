@@ -0,0 +1,45 @@
+package server
+
+// The range commands, GETRANGE, BITCOUNT, LRANGE, LTRIM and ZRANGE, take
+// inclusive start and end indexes where a negative index is from the end, so
+// -1 is the last element. They all resolve the indexes with rangeIndexes, the
+// way Redis does:
+//
+//   - both indexes are from the end and the start is after the end: empty
+//   - an index from the end that's before the first element is the first
+//     element
+//   - an end after the last element is the last element
+//   - a start after the end, or after the last element: empty
+//
+// The strings and the lists differ in one thing. For GETRANGE and BITCOUNT
+// an end that's before the first element is the first element, so
+// GETRANGE key 0 -100 is the first byte, but for LRANGE, LTRIM, ZRANGE and
+// ZREMRANGEBYRANK the range is empty.
+
+// rangeIndexes resolves the start and end indexes of a range of a sequence of
+// n elements. The clampEnd is true for the strings. Returns false when the
+// range is empty.
+func rangeIndexes(start, end, n int, clampEnd bool) (int, int, bool) {
+	if start < 0 && end < 0 && start > end {
+		return 0, 0, false
+	}
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 && clampEnd {
+		end = 0
+	}
+	if end >= n {
+		end = n - 1
+	}
+	if start > end || start >= n {
+		return 0, 0, false
+	}
+	return start, end, true
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRangeCommands checks the boundary cases of the range commands against
+// the replies of Redis 7.2, for a string and a list of 5 elements.
+func TestRangeCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"))
+	stop := testServe(t, s, addr)
+	defer stop()
+	s.Do("SET", "str", "abcde")
+
+	for _, tt := range []struct {
+		start, end string
+		str        string // GETRANGE, and the bytes of BITCOUNT
+		list       string // LRANGE, and the elements kept by LTRIM
+	}{
+		{"0", "-1", "abcde", "abcde"},
+		{"2", "2", "c", "c"},
+		{"-1", "-1", "e", "e"},
+		{"-5", "-1", "abcde", "abcde"},
+		{"-6", "-1", "abcde", "abcde"},
+		{"-3", "100", "cde", "cde"},
+		{"0", "5", "abcde", "abcde"},
+		{"0", "6", "abcde", "abcde"},
+		{"4", "5", "e", "e"},
+		{"5", "6", "", ""},
+		{"6", "-1", "", ""},
+		{"0", "-5", "a", "a"},
+		{"0", "-6", "a", ""},
+		{"-6", "-6", "a", ""},
+		{"-7", "-6", "a", ""},
+		{"-6", "-7", "", ""},
+		{"3", "1", "", ""},
+		{"-1", "-2", "", ""},
+	} {
+		args := tt.start + " " + tt.end
+		if v, _ := s.Do("GETRANGE", "str", tt.start, tt.end); v != tt.str {
+			t.Fatalf("GETRANGE %s: expected %q, got %q", args, tt.str, v)
+		}
+		var ones int
+		for i := 0; i < len(tt.str); i++ {
+			ones += bits.OnesCount8(tt.str[i])
+		}
+		if v, _ := s.Do("BITCOUNT", "str", tt.start, tt.end); v != ones {
+			t.Fatalf("BITCOUNT %s: expected %d, got %v", args, ones, v)
+		}
+		s.Do("DEL", "list")
+		s.Do("RPUSH", "list", "a", "b", "c", "d", "e")
+		v, _ := s.Do("LRANGE", "list", tt.start, tt.end)
+		if got := testJoinBulks(v); got != tt.list {
+			t.Fatalf("LRANGE %s: expected %q, got %q", args, tt.list, got)
+		}
+		s.Do("LTRIM", "list", tt.start, tt.end)
+		v, _ = s.Do("LRANGE", "list", "0", "-1")
+		if got := testJoinBulks(v); got != tt.list {
+			t.Fatalf("LTRIM %s: expected %q, got %q", args, tt.list, got)
+		}
+	}
+
+	// an empty range of a missing key
+	if v, _ := s.Do("GETRANGE", "missing", "0", "-1"); v != "" {
+		t.Fatalf("expected an empty string, got %q", v)
+	}
+	if v, _ := s.Do("BITCOUNT", "missing", "0", "-1"); v != 0 {
+		t.Fatalf("expected 0, got %v", v)
+	}
+	if v, _ := s.Do("LRANGE", "missing", "0", "-1"); testJoinBulks(v) != "" {
+		t.Fatalf("expected an empty array, got %v", v)
+	}
+}
+
+// testJoinBulks joins the bulks of an array reply.
+func testJoinBulks(v interface{}) string {
+	var elems []string
+	for _, e := range v.([]interface{}) {
+		elems = append(elems, e.(string))
+	}
+	return strings.Join(elems, "")
+}
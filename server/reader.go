@@ -7,6 +7,15 @@ import (
 	"strconv"
 )
 
+const (
+	maxMultiBulkLen = 1024 * 1024       // the maximum number of args per command
+	maxBulkLen      = 512 * 1024 * 1024 // the maximum size of a single arg
+	maxInlineLen    = 64 * 1024         // the maximum size of a telnet line
+
+	readBufMin = 4 * 1024  // the read buffer of a connection that's mostly idle
+	readBufMax = 64 * 1024 // the read buffer of a connection that's busy
+)
+
 type protocolError struct {
 	msg string
 }
@@ -16,17 +25,17 @@ func (err *protocolError) Error() string {
 }
 
 type commandReader struct {
-	rd     io.Reader
-	rbuf   []byte
-	buf    []byte
-	copied bool
-	args   []string
+	rd   io.Reader
+	rbuf []byte
+	buf  []byte
+	args []string
+	read func() // called after each read, for the client memory
 }
 
 func newCommandReader(rd io.Reader) *commandReader {
 	return &commandReader{
 		rd:   rd,
-		rbuf: make([]byte, 64*1024),
+		rbuf: make([]byte, readBufMin),
 	}
 }
 
@@ -44,6 +53,11 @@ func autoConvertArgsToMultiBulk(raw []byte, args []string, telnet, flush bool) (
 	return raw, args, flush, nil
 }
 
+// readCommand returns the next command from the connection. Inline commands
+// are converted to multibulk so both framings look the same to the caller.
+// The flush hint is true when no complete command remains in the buffer,
+// which means the next call will block on the network and any pending
+// replies should be written first.
 func (rd *commandReader) readCommand() (raw []byte, args []string, flush bool, err error) {
 	if len(rd.buf) > 0 {
 		// there is already data in the buffer, do we have enough to make a full command?
@@ -51,41 +65,93 @@ func (rd *commandReader) readCommand() (raw []byte, args []string, flush bool, e
 		if err != nil {
 			return nil, nil, false, err
 		}
-		if len(raw) == len(rd.buf) {
-			// we have a command and it's exactly the size of the buffer.
-			// clear out the buffer and return the command
-			// notify the caller that we should flush after this command.
-			rd.buf = nil
-			if telnet {
-				return autoConvertArgsToMultiBulk(raw, args, telnet, true)
-			}
-			return raw, args, true, nil
-		}
 		if len(raw) > 0 {
-			// have a command, but there's still data in the buffer.
-			// notify the caller that we should flush *only* when there's copied data.
-			rd.buf = rd.buf[len(raw):]
-			if telnet {
-				return autoConvertArgsToMultiBulk(raw, args, telnet, rd.copied)
+			if len(raw) == len(rd.buf) {
+				rd.buf = nil
+			} else {
+				rd.buf = rd.buf[len(raw):]
 			}
-			return raw, args, rd.copied, nil
+			return autoConvertArgsToMultiBulk(raw, args, telnet,
+				!hasBufferedCommand(rd.buf))
 		}
 		// only have a partial command, read more data
 	}
+	if err := rd.fill(); err != nil {
+		return nil, nil, false, err
+	}
+	return rd.readCommand()
+}
+
+// fill reads once from the connection and appends the data to the buffer.
+func (rd *commandReader) fill() error {
 	n, err := rd.rd.Read(rd.rbuf)
 	if err != nil {
-		return nil, nil, false, err
+		return err
 	}
-	if len(rd.buf) == 0 {
-		// copy the data rather than assign a slice, otherwise string
-		// corruption may occur on the next network read.
-		rd.buf = append([]byte(nil), rd.rbuf[:n]...)
-		rd.copied = false
-	} else {
-		rd.buf = append(rd.buf, rd.rbuf[:n]...)
-		rd.copied = true
+	// copy the data rather than assign a slice, otherwise string
+	// corruption may occur on the next network read.
+	rd.buf = append(rd.buf[:len(rd.buf):len(rd.buf)], rd.rbuf[:n]...)
+	// the read buffer grows for a connection that fills it, and shrinks
+	// back once the reads are small, so that the many idle connections
+	// don't each hold a large buffer.
+	if n == len(rd.rbuf) && n < readBufMax {
+		rd.rbuf = make([]byte, n*2)
+	} else if n < len(rd.rbuf)/4 && len(rd.rbuf) > readBufMin {
+		rd.rbuf = make([]byte, readBufMin)
 	}
-	return rd.readCommand()
+	if rd.read != nil {
+		rd.read()
+	}
+	return nil
+}
+
+// hasBufferedCommand returns true when data starts with a complete command,
+// or with bytes that readBufferedCommand will reject as a protocol error.
+// It only scans the framing, the args are not decoded.
+func hasBufferedCommand(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	if data[0] != '*' {
+		return bytes.IndexByte(data, '\n') != -1 || len(data) > maxInlineLen
+	}
+	i := bytes.IndexByte(data, '\n')
+	if i == -1 {
+		return false
+	}
+	if i < 2 || data[i-1] != '\r' {
+		return true
+	}
+	n, err := atoi(string(data[1 : i-1]))
+	if err != nil || n > maxMultiBulkLen {
+		return true
+	}
+	i++
+	for j := 0; j < n; j++ {
+		if i == len(data) {
+			return false
+		}
+		if data[i] != '$' {
+			return true
+		}
+		k := bytes.IndexByte(data[i:], '\n')
+		if k == -1 {
+			return false
+		}
+		if k < 2 || data[i+k-1] != '\r' {
+			return true
+		}
+		n2, err := atoui(string(data[i+1 : i+k-1]))
+		if err != nil || n2 > maxBulkLen {
+			return true
+		}
+		i += k + 1
+		if len(data)-i < n2+2 {
+			return false
+		}
+		i += n2 + 2
+	}
+	return true
 }
 
 func (rd *commandReader) readBufferedCommand(data []byte) ([]byte, []string, bool, error) {
@@ -98,7 +164,7 @@ func (rd *commandReader) readBufferedCommand(data []byte) ([]byte, []string, boo
 				return nil, nil, false, &protocolError{"invalid multibulk length"}
 			}
 			n, err := atoi(string(data[1 : i-1]))
-			if err != nil {
+			if err != nil || n > maxMultiBulkLen {
 				return nil, nil, false, &protocolError{"invalid multibulk length"}
 			}
 			if n <= 0 {
@@ -131,7 +197,7 @@ func (rd *commandReader) readBufferedCommand(data []byte) ([]byte, []string, boo
 							return nil, nil, false, &protocolError{"invalid bulk length"}
 						}
 						n2, err := atoui(string(data[ii : i-1]))
-						if err != nil {
+						if err != nil || n2 > maxBulkLen {
 							return nil, nil, false, &protocolError{"invalid bulk length"}
 						}
 						i++
@@ -154,10 +220,10 @@ func (rd *commandReader) readBufferedCommand(data []byte) ([]byte, []string, boo
 }
 
 func readBufferedTelnetCommand(data []byte) ([]byte, []string, bool, error) {
-	for i := 1; i < len(data); i++ {
+	for i := 0; i < len(data); i++ {
 		if data[i] == '\n' {
 			var line []byte
-			if data[i-1] == '\r' {
+			if i > 0 && data[i-1] == '\r' {
 				line = data[:i-1]
 			} else {
 				line = data[:i]
@@ -172,61 +238,129 @@ func readBufferedTelnetCommand(data []byte) ([]byte, []string, bool, error) {
 			return data[:i+1], args, true, nil
 		}
 	}
+	if len(data) > maxInlineLen {
+		return nil, nil, true, &protocolError{"too big inline request"}
+	}
 	return nil, nil, true, nil
 }
 
+// parseArgsFromTelnetLine splits an inline command into arguments using the
+// same rules as Redis' sdssplitargs. Arguments are separated by whitespace and
+// may be wrapped in double quotes, which support escape sequences such as
+// "\n" and "\x41", or single quotes, which only support "\'". A closing quote
+// must be followed by whitespace or the end of the line.
 func parseArgsFromTelnetLine(line []byte) ([]string, error) {
 	var args []string
-	var s int
-	lspace := true
-	quote := false
-	lquote := false
-	for i := 0; i < len(line); i++ {
+	i := 0
+	for {
+		for i < len(line) && isTelnetSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		var arg []byte
 		switch line[i] {
 		default:
-			lspace = false
+			for i < len(line) && !isTelnetSpace(line[i]) {
+				arg = append(arg, line[i])
+				i++
+			}
 		case '"':
-			if quote {
-				args = append(args, string(line[s+1:i]))
-				quote = false
-				s = i + 1
-				lquote = true
-				continue
+			i++
+			for {
+				if i == len(line) {
+					return nil, &protocolError{"unbalanced quotes in request"}
+				}
+				c := line[i]
+				if c == '"' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					default:
+						c = line[i]
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					case 'x':
+						if i+2 < len(line) && isHexDigit(line[i+1]) &&
+							isHexDigit(line[i+2]) {
+							n, _ := strconv.ParseUint(string(line[i+1:i+3]), 16, 8)
+							c = byte(n)
+							i += 2
+						} else {
+							c = 'x'
+						}
+					}
+				}
+				arg = append(arg, c)
+				i++
 			}
-			if !lspace {
+			if i < len(line) && !isTelnetSpace(line[i]) {
 				return nil, &protocolError{"unbalanced quotes in request"}
 			}
-			lspace = false
-			quote = true
-		case ' ':
-			if lquote {
-				s++
-				continue
+		case '\'':
+			i++
+			for {
+				if i == len(line) {
+					return nil, &protocolError{"unbalanced quotes in request"}
+				}
+				c := line[i]
+				if c == '\'' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					c = '\''
+				}
+				arg = append(arg, c)
+				i++
+			}
+			if i < len(line) && !isTelnetSpace(line[i]) {
+				return nil, &protocolError{"unbalanced quotes in request"}
 			}
-			args = append(args, string(line[s:i]))
-			s = i + 1
-			lspace = true
 		}
+		args = append(args, string(arg))
 	}
-	if quote {
-		return nil, &protocolError{"unbalanced quotes in request"}
-	}
-	if s < len(line) {
-		args = append(args, string(line[s:]))
-	}
-	return args, nil
 }
 
+func isTelnetSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// atoi converts a string to an int. Unlike strconv.Atoi a leading '+' is not
+// allowed. An error is returned when the value overflows.
 func atoi(s string) (int, error) {
 	if len(s) == 0 {
 		return 0, errors.New("invalid integer")
 	}
 	var sign bool
-	var n int
+	var n uint64
 	for i := 0; i < len(s); i++ {
 		c := s[i]
 		if c >= '0' && c <= '9' {
-			n = n*10 + int(c-'0')
+			if n > (1<<63)/10 {
+				return 0, errors.New("invalid integer")
+			}
+			n = n*10 + uint64(c-'0')
+			if n > 1<<63 {
+				return 0, errors.New("invalid integer")
+			}
 		} else if c == '-' {
 			if i != 0 || len(s) == 1 {
 				return 0, errors.New("invalid integer")
@@ -237,15 +371,20 @@ func atoi(s string) (int, error) {
 		}
 	}
 	if sign {
-		n *= -1
+		return int(-int64(n)), nil
 	}
-	return n, nil
+	if n > 1<<63-1 {
+		return 0, errors.New("invalid integer")
+	}
+	return int(n), nil
 }
 
 func itoa(n int) string {
 	return strconv.Itoa(n)
 }
 
+// atoui converts a string to a non-negative int. An error is returned when the
+// value overflows.
 func atoui(s string) (int, error) {
 	if len(s) == 0 {
 		return 0, errors.New("invalid integer")
@@ -254,6 +393,9 @@ func atoui(s string) (int, error) {
 	for i := 0; i < len(s); i++ {
 		c := s[i]
 		if c >= '0' && c <= '9' {
+			if n > (1<<63-1-9)/10 {
+				return 0, errors.New("invalid integer")
+			}
 			n = n*10 + int(s[i]-'0')
 		} else {
 			return 0, errors.New("invalid integer")
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"testing"
+)
+
+var readerSeeds = []string{
+	"*1\r\n$4\r\nPING\r\n",
+	"*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n",
+	"*2\r\n$3\r\nGET\r\n$0\r\n\r\n",
+	"*0\r\n",
+	"*-1\r\n",
+	"PING\r\n",
+	"set key \"hello world\"\r\n",
+	"get key\n",
+	"\r\n",
+	"*1\r\n$4\r\nPING\r\nPING\r\n*1\r\n$4\r\nPING\r\n",
+	// protocol errors
+	"*a\r\n",
+	"*1\n",
+	"*1\r\n+PING\r\n",
+	"*1\r\n$a\r\n",
+	"*1\r\n$4\nPING\r\n",
+	"set \"key\r\n",
+	"set k\"ey\"\r\n",
+	// hostile length headers
+	"*99999999999\r\n",
+	"*9223372036854775807\r\n",
+	"*99999999999999999999999\r\n",
+	"*1\r\n$99999999999999999999\r\n",
+	"*1\r\n$9223372036854775807\r\n",
+	"*1\r\n$4294967296\r\nPING\r\n",
+}
+
+// oneByteReader feeds the underlying data one byte per Read.
+type oneByteReader struct {
+	data []byte
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+// readAllCommands reads every command from rd until an error occurs. The
+// returned string is the error message, or empty on a clean EOF.
+func readAllCommands(rd io.Reader) ([][]string, string) {
+	cr := newCommandReader(rd)
+	var cmds [][]string
+	for {
+		_, args, _, err := cr.readCommand()
+		if err != nil {
+			if err == io.EOF {
+				return cmds, ""
+			}
+			return cmds, err.Error()
+		}
+		cmds = append(cmds, append([]string(nil), args...))
+	}
+}
+
+func encodeMultiBulk(args []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.FormatInt(int64(len(args)), 10) + "\r\n")
+	for _, arg := range args {
+		buf.WriteString("$" + strconv.FormatInt(int64(len(arg)), 10) + "\r\n")
+		buf.WriteString(arg + "\r\n")
+	}
+	return buf.Bytes()
+}
+
+// encodeInline encodes the args as an inline command, which quotes the args
+// that would not parse back as they are.
+func encodeInline(args []string) []byte {
+	var buf bytes.Buffer
+	for i, arg := range args {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		plain := len(arg) > 0 && arg[0] != '"' && arg[0] != '\''
+		for j := 0; j < len(arg) && plain; j++ {
+			plain = arg[j] != '\n' && !isTelnetSpace(arg[j])
+		}
+		if plain {
+			buf.WriteString(arg)
+			continue
+		}
+		buf.WriteByte('"')
+		for j := 0; j < len(arg); j++ {
+			switch c := arg[j]; {
+			case c == '"' || c == '\\':
+				buf.WriteString("\\" + string(c))
+			case c < ' ' || c > '~':
+				fmt.Fprintf(&buf, "\\x%02x", c)
+			default:
+				buf.WriteByte(c)
+			}
+		}
+		buf.WriteByte('"')
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// checkInline checks that the args of an inline command re-serialize into a
+// command that reads back whole with the same args, and that the args of a
+// raw line without quotes are its words, in order.
+func checkInline(t *testing.T, raw []byte, args []string) {
+	t.Helper()
+	enc := encodeInline(args)
+	raw2, args2, _, err := readBufferedTelnetCommand(enc)
+	if err != nil || !bytes.Equal(raw2, enc) {
+		t.Fatalf("re-serialized %q read back as %q: %v", enc, raw2, err)
+	}
+	if !equalCommands([][]string{args}, [][]string{args2}) {
+		t.Fatalf("expected %q, got %q", args, args2)
+	}
+	if bytes.ContainsAny(raw, "\"'") {
+		return
+	}
+	rest := raw
+	for _, arg := range args {
+		i := bytes.Index(rest, []byte(arg))
+		if i == -1 {
+			t.Fatalf("arg %q is not in the rest %q of %q", arg, rest, raw)
+		}
+		rest = rest[i+len(arg):]
+	}
+}
+
+func equalCommands(a, b [][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for j := range a[i] {
+			if a[i][j] != b[i][j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func FuzzReadBufferedCommand(f *testing.F) {
+	for _, seed := range readerSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) == 0 || data[0] != '*' {
+			return
+		}
+		rd := newCommandReader(nil)
+		raw, args, _, err := rd.readBufferedCommand(data)
+		if err != nil || raw == nil {
+			return
+		}
+		if !bytes.HasPrefix(data, raw) {
+			t.Fatalf("raw %q is not a prefix of %q", raw, data)
+		}
+		// the args must re-serialize into a command that parses the same
+		raw2, args2, _, err := newCommandReader(nil).readBufferedCommand(
+			encodeMultiBulk(args))
+		if err != nil || raw2 == nil {
+			t.Fatalf("re-serialized %q failed to parse: %v", args, err)
+		}
+		if !equalCommands([][]string{args}, [][]string{args2}) {
+			t.Fatalf("expected %q, got %q", args, args2)
+		}
+	})
+}
+
+func FuzzReadBufferedTelnetCommand(f *testing.F) {
+	for _, seed := range readerSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) == 0 || data[0] == '*' {
+			return
+		}
+		raw, args, _, err := readBufferedTelnetCommand(data)
+		if err != nil || raw == nil {
+			return
+		}
+		if !bytes.HasPrefix(data, raw) {
+			t.Fatalf("raw %q is not a prefix of %q", raw, data)
+		}
+		raw2, args2, _, err := newCommandReader(nil).readBufferedCommand(
+			encodeMultiBulk(args))
+		if err != nil || raw2 == nil {
+			t.Fatalf("re-serialized %q failed to parse: %v", args, err)
+		}
+		if !equalCommands([][]string{args}, [][]string{args2}) {
+			t.Fatalf("expected %q, got %q", args, args2)
+		}
+		checkInline(t, raw, args)
+	})
+}
+
+func FuzzParseArgsFromTelnetLine(f *testing.F) {
+	for _, seed := range readerSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		if bytes.IndexByte(line, '\n') != -1 {
+			return
+		}
+		args, err := parseArgsFromTelnetLine(line)
+		if err != nil {
+			return
+		}
+		for _, arg := range args {
+			if len(arg) > len(line) {
+				t.Fatalf("arg %q is larger than line %q", arg, line)
+			}
+		}
+		checkInline(t, line, args)
+	})
+}
+
+func FuzzReadCommandStream(f *testing.F) {
+	for _, seed := range readerSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		all, allErr := readAllCommands(bytes.NewReader(data))
+		one, oneErr := readAllCommands(&oneByteReader{data: data})
+		if allErr != oneErr {
+			t.Fatalf("expected error %q, got %q", allErr, oneErr)
+		}
+		if !equalCommands(all, one) {
+			t.Fatalf("expected %q, got %q", all, one)
+		}
+	})
+}
+
+// chunkReader returns each chunk from a separate Read.
+type chunkReader struct {
+	chunks [][]byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	if n == len(r.chunks[0]) {
+		r.chunks = r.chunks[1:]
+	} else {
+		r.chunks[0] = r.chunks[0][n:]
+	}
+	return n, nil
+}
+
+func TestReadCommandMixedFraming(t *testing.T) {
+	segs := []struct {
+		data string
+		args []string
+	}{
+		{"PING\r\n", []string{"PING"}},
+		{"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n", []string{"SET", "k", "v"}},
+		{"get k\n", []string{"get", "k"}},
+		{"\r\n", []string{}},
+		{"*2\r\n$4\r\nECHO\r\n$5\r\na b c\r\n", []string{"ECHO", "a b c"}},
+		{"echo \"x y\"\r\n", []string{"echo", "x y"}},
+		{"*0\r\n", []string{}},
+		{"*1\r\n$4\r\nPING\r\n", []string{"PING"}},
+	}
+	var data []byte
+	var ends []int
+	for _, seg := range segs {
+		data = append(data, seg.data...)
+		ends = append(ends, len(data))
+	}
+	// split the stream into two segments at every position, the single
+	// segment case is the split at zero.
+	for split := 0; split < len(data); split++ {
+		var chunks [][]byte
+		if split > 0 {
+			chunks = append(chunks, data[:split])
+		}
+		chunks = append(chunks, data[split:])
+		cr := newCommandReader(&chunkReader{chunks: chunks})
+		for i, seg := range segs {
+			raw, args, flush, err := cr.readCommand()
+			if err != nil {
+				t.Fatalf("split %d: command %d: %v", split, i, err)
+			}
+			if !equalCommands([][]string{args}, [][]string{seg.args}) {
+				t.Fatalf("split %d: command %d: expected %q, got %q",
+					split, i, seg.args, args)
+			}
+			if !bytes.Equal(raw, encodeMultiBulk(seg.args)) {
+				t.Fatalf("split %d: command %d: expected raw %q, got %q",
+					split, i, encodeMultiBulk(seg.args), raw)
+			}
+			// flush exactly when the next command hasn't fully arrived.
+			received := len(data)
+			if ends[i] <= split {
+				received = split
+			}
+			expect := i == len(segs)-1 || ends[i+1] > received
+			if flush != expect {
+				t.Fatalf("split %d: command %d: expected flush %v, got %v",
+					split, i, expect, flush)
+			}
+		}
+		if _, _, _, err := cr.readCommand(); err != io.EOF {
+			t.Fatalf("split %d: expected EOF, got %v", split, err)
+		}
+	}
+}
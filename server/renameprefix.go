@@ -0,0 +1,193 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RENAMEPREFIX renames the keys of a prefix to a new prefix, in batches of
+// renamePrefixBatch keys, and releases the lock between the batches so that
+// the other clients are served while it runs. The keys have no order in the
+// database, so the keys of the prefix are collected and sorted first, and the
+// keys that are deleted while the lock is released are skipped. Each batch is
+// appended to the aof as the RENAMEs that it did, before the lock is
+// released, so that the aof replays the renames in their order with the
+// writes of the other clients.
+
+// renamePrefixBatch is the number of keys that RENAMEPREFIX renames before it
+// releases the lock.
+const renamePrefixBatch = 1000
+
+// renameprefixCommand is RENAMEPREFIX oldprefix newprefix [REPLACE|ABORT]
+// [LIMIT count] [CURSOR cursor]. A key whose new name exists is skipped,
+// unless REPLACE overwrites it, and ABORT fails without renaming any key. A
+// new name that's created while the lock is released stops ABORT at its key.
+// LIMIT stops after count keys, and the reply has the cursor to continue
+// from, which is nil when all the keys are done. The renames are written to
+// the aof as RENAMEs, and the command itself is not. The keys that are
+// renamed or skipped are touched, like the keys of RENAME. Each RENAME is
+// audited and queued for write-behind, and a renamed list serves the clients
+// that are blocked on its new name.
+func renameprefixCommand(c *client) {
+	if len(c.args) < 3 {
+		c.replyAritryError()
+		return
+	}
+	oldPrefix, newPrefix := c.args[1], c.args[2]
+	var replace, abort, hasCursor bool
+	var limit int
+	var cursor string
+	for i := 3; i < len(c.args); i++ {
+		switch strings.ToLower(c.args[i]) {
+		case "replace":
+			replace = true
+		case "abort":
+			abort = true
+		case "limit":
+			if i+1 == len(c.args) {
+				c.replySyntaxError()
+				return
+			}
+			n, err := strconv.ParseInt(c.args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				c.replyError("LIMIT must be positive")
+				return
+			}
+			limit = int(n)
+			i++
+		case "cursor":
+			if i+1 == len(c.args) {
+				c.replySyntaxError()
+				return
+			}
+			cursor, hasCursor = c.args[i+1], true
+			i++
+		default:
+			c.replySyntaxError()
+			return
+		}
+	}
+	if replace && abort {
+		c.replyError("REPLACE and ABORT options at the same time are not compatible")
+		return
+	}
+	// a renamed key must not have the old prefix, or it would be renamed
+	// again by the next call
+	if strings.HasPrefix(newPrefix, oldPrefix) || strings.HasPrefix(oldPrefix, newPrefix) {
+		c.replyError("the old and the new prefix can't be prefixes of each other")
+		return
+	}
+	var keys []string
+	c.db.ascendAt(time.Now(), func(key string, value interface{}) bool {
+		if strings.HasPrefix(key, oldPrefix) && (!hasCursor || key > cursor) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	sort.Strings(keys)
+	more := false
+	if limit > 0 && len(keys) > limit {
+		keys, more = keys[:limit], true
+	}
+	newKey := func(key string) string {
+		return newPrefix + key[len(oldPrefix):]
+	}
+	if abort {
+		for _, key := range keys {
+			if _, ok := c.db.get(newKey(key)); ok {
+				c.replyError("target key " + newKey(key) + " exists")
+				return
+			}
+		}
+	}
+
+	var renamed, skipped, done int
+	var raw []byte
+	var batch [][2]string
+	rename := c.s.cmds["rename"]
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		c.s.appendAOF(c.db.num, raw)
+		c.s.dirty += len(batch)
+		// the hooks of the dispatcher run for each RENAME, as if it was
+		// sent by the client
+		args := c.args
+		for _, keys := range batch {
+			c.args = []string{"rename", keys[0], keys[1]}
+			c.s.auditCommand(c, rename, auditSourceClient)
+			c.s.queueWriteBehind(c, rename)
+		}
+		c.args = args
+		if len(c.s.blocked.ready) > 0 {
+			c.s.serveBlocked()
+		}
+		if c.s.cfg.appendFsync == "always" && c.s.aof != nil {
+			if err := c.s.syncAOF(); err != nil {
+				c.s.fatalError(err)
+			}
+		}
+		raw, batch = raw[:0], batch[:0]
+	}
+next:
+	for _, key := range keys {
+		if done > 0 && done%renamePrefixBatch == 0 {
+			flush()
+			c.s.lockReleased()
+			c.s.mu.Unlock()
+			c.s.mu.Lock()
+			c.s.lockAcquired(c, c.s.cmds["renameprefix"])
+			if c.context().Err() != nil {
+				// the client is gone
+				break
+			}
+		}
+		dst := newKey(key)
+		_, exists := c.db.get(key)
+		_, taken := c.db.get(dst)
+		switch {
+		case exists && taken && abort:
+			break next
+		case !exists || (taken && !replace):
+			// the keys are touched like the keys of a RENAMENX that
+			// fails, and a renamed key is touched when it's stored
+			if !c.notouch {
+				for _, key := range [...]string{key, dst} {
+					if item, ok := c.db.lookup(key); ok {
+						item.touch()
+					}
+				}
+			}
+			skipped++
+		default:
+			c.db.move(key, c.db, dst)
+			if l, _ := c.db.getList(dst, false); l != nil {
+				c.s.signalList(c.db, dst)
+			}
+			raw = append(raw, buildCommand("RENAME", key, dst)...)
+			batch = append(batch, [2]string{key, dst})
+			renamed++
+		}
+		done++
+	}
+	flush()
+	c.dirty += renamed
+
+	c.replyMapLen(3)
+	c.replyBulk("renamed")
+	c.replyInt(renamed)
+	c.replyBulk("skipped")
+	c.replyInt(skipped)
+	c.replyBulk("cursor")
+	switch {
+	case done == len(keys) && !more:
+		c.replyNull()
+	case done > 0:
+		c.replyBulk(keys[done-1])
+	default:
+		c.replyBulk(cursor)
+	}
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRenamePrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"))
+	stop := testServe(t, s, addr)
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	do := func(want string, args ...string) {
+		t.Helper()
+		if v := fmt.Sprint(conn.do(args...)); v != want {
+			t.Fatalf("%v: expected %s, got %s", args, want, v)
+		}
+	}
+	conn.do("SET", "old:a", "1")
+	conn.do("SET", "old:b", "2", "EX", "1000")
+	conn.do("RPUSH", "old:c", "x")
+	conn.do("SET", "new:c", "taken")
+	conn.do("SET", "other", "3")
+	do("[renamed 2 skipped 1 cursor <nil>]", "RENAMEPREFIX", "old:", "new:")
+	do("1", "GET", "new:a")
+	do("0", "EXISTS", "old:a")
+	if v := conn.do("TTL", "new:b"); v.(int) <= 0 {
+		t.Fatalf("expected the ttl to be kept, got %v", v)
+	}
+	do("taken", "GET", "new:c")
+	do("1", "EXISTS", "old:c")
+	do("3", "GET", "other")
+
+	// REPLACE overwrites, and ABORT renames nothing
+	conn.do("SET", "old:a", "4")
+	do("ERR target key new:a exists", "RENAMEPREFIX", "old:", "new:", "ABORT")
+	do("1", "EXISTS", "old:a")
+	do("[renamed 2 skipped 0 cursor <nil>]", "RENAMEPREFIX", "old:", "new:", "REPLACE")
+	do("4", "GET", "new:a")
+	do("list", "TYPE", "new:c")
+	do("[renamed 0 skipped 0 cursor <nil>]", "RENAMEPREFIX", "old:", "new:")
+
+	// LIMIT stops at a cursor, which continues after the last key
+	for i := 0; i < 5; i++ {
+		conn.do("SET", "page:"+strconv.Itoa(i), "v")
+	}
+	do("[renamed 2 skipped 0 cursor page:1]", "RENAMEPREFIX", "page:", "p:", "LIMIT", "2")
+	do("[renamed 2 skipped 0 cursor page:3]", "RENAMEPREFIX", "page:", "p:", "LIMIT", "2", "CURSOR", "page:1")
+	do("[renamed 1 skipped 0 cursor <nil>]", "RENAMEPREFIX", "page:", "p:", "LIMIT", "2", "CURSOR", "page:3")
+	do("0", "EXISTS", "page:0", "page:1", "page:2", "page:3", "page:4")
+	do("5", "EXISTS", "p:0", "p:1", "p:2", "p:3", "p:4")
+
+	// the renamed and the skipped keys are touched, like the keys of RENAME
+	conn.do("SET", "t:a", "1")
+	conn.do("SET", "t:b", "2")
+	conn.do("SET", "u:b", "taken")
+	idle := func(keys ...string) {
+		s.mu.Lock()
+		for _, key := range keys {
+			s.dbs[0].items[key].lru = lruClock() - 100
+		}
+		s.mu.Unlock()
+	}
+	idle("t:a", "t:b", "u:b")
+	do("[renamed 1 skipped 1 cursor <nil>]", "RENAMEPREFIX", "t:", "u:")
+	for _, key := range []string{"u:a", "t:b", "u:b"} {
+		if v, ok := conn.do("OBJECT", "IDLETIME", key).(int); !ok || v > 1 {
+			t.Fatalf("expected %s to be touched, got '%v'", key, v)
+		}
+	}
+	idle("t:b", "u:b")
+	conn.do("CLIENT", "NO-TOUCH", "ON")
+	do("[renamed 0 skipped 1 cursor <nil>]", "RENAMEPREFIX", "t:", "u:")
+	for _, key := range []string{"t:b", "u:b"} {
+		if v, ok := conn.do("OBJECT", "IDLETIME", key).(int); !ok || v < 100 {
+			t.Fatalf("expected %s to not be touched, got '%v'", key, v)
+		}
+	}
+	conn.do("CLIENT", "NO-TOUCH", "OFF")
+
+	// errors
+	do("ERR the old and the new prefix can't be prefixes of each other", "RENAMEPREFIX", "a", "ab")
+	do("ERR the old and the new prefix can't be prefixes of each other", "RENAMEPREFIX", "ab", "a")
+	do("ERR REPLACE and ABORT options at the same time are not compatible",
+		"RENAMEPREFIX", "a", "b", "REPLACE", "ABORT")
+	do("ERR LIMIT must be positive", "RENAMEPREFIX", "a", "b", "LIMIT", "0")
+	do("ERR syntax error", "RENAMEPREFIX", "a", "b", "LIMIT")
+	do("ERR syntax error", "RENAMEPREFIX", "a", "b", "FOO")
+}
+
+// TestRenamePrefixAOF renames more keys than a batch, and checks that the
+// aof has the renames rather than the command, and loads the same keys.
+func TestRenamePrefixAOF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	s, addr := testNewServer(t, aofPath)
+	stop := testServe(t, s, addr)
+	defer func() { stop() }()
+
+	n := renamePrefixBatch*2 + 500
+	for i := 0; i < n; i++ {
+		s.Do("SET", "tenant1:"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	s.Do("SET", "tenant2:7", "taken")
+	s.Do("EXPIRE", "tenant1:9", "1000")
+	v, err := s.Do("RENAMEPREFIX", "tenant1:", "tenant2:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("[renamed %d skipped 1 cursor <nil>]", n-1); fmt.Sprint(v) != want {
+		t.Fatalf("expected %s, got %v", want, v)
+	}
+	data, err := ioutil.ReadFile(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strings.ToLower(string(data)), "renameprefix") {
+		t.Fatal("expected the aof to have the renames, not the command")
+	}
+	if c := strings.Count(string(data), "RENAME\r\n"); c != n-1 {
+		t.Fatalf("expected %d renames in the aof, got %d", n-1, c)
+	}
+	digest, _ := s.Do("DEBUG", "DIGEST")
+	stop()
+	s, addr = testNewServer(t, aofPath)
+	stop = testServe(t, s, addr)
+	if v, _ := s.Do("DEBUG", "DIGEST"); v != digest {
+		t.Fatalf("expected digest %v, got %v", digest, v)
+	}
+	if v, _ := s.Do("TTL", "tenant2:9"); v.(int) <= 0 {
+		t.Fatalf("expected the ttl to be kept, got %v", v)
+	}
+}
+
+// TestRenamePrefixHooks checks that each RENAME of RENAMEPREFIX is audited,
+// queued for write-behind, and serves the clients blocked on its new name,
+// like a RENAME that's sent by a client.
+func TestRenamePrefixHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	auditPath := filepath.Join(dir, "audit.log")
+	var mu sync.Mutex
+	var writes []KeyWrite
+	s, addr := testNewServerOptions(t, &Options{
+		AppendOnlyPath: filepath.Join(dir, "appendonly.aof"),
+		WriteBehind: func(batch []KeyWrite) error {
+			mu.Lock()
+			writes = append(writes, batch...)
+			mu.Unlock()
+			return nil
+		},
+	}, "--audit-log", "yes", "--audit-log-file", auditPath,
+		"--write-behind-patterns", "a:* b:*")
+	stop := testServe(t, s, addr)
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	conn.do("SET", "a:1", "x")
+	conn.do("SET", "a:2", "y")
+	if v := fmt.Sprint(conn.do("RENAMEPREFIX", "a:", "b:")); v != "[renamed 2 skipped 0 cursor <nil>]" {
+		t.Fatalf("expected 2 renames, got %v", v)
+	}
+	testWaitForAudit(t, conn, 4)
+	var events []string
+	for _, e := range testReadAudit(t, auditPath) {
+		events = append(events, e.Command+" "+strings.Join(e.Keys, " "))
+	}
+	if v := strings.Join(events, ","); v != "set a:1,set a:2,rename a:1 b:1,rename a:2 b:2" {
+		t.Fatalf("expected the renames in the audit log, got %v", v)
+	}
+	expect := []KeyWrite{
+		{0, "a:1", "set", "x"},
+		{0, "a:2", "set", "y"},
+		{0, "a:1", "rename", nil},
+		{0, "b:1", "rename", "x"},
+		{0, "a:2", "rename", nil},
+		{0, "b:2", "rename", "y"},
+	}
+	for start := time.Now(); ; time.Sleep(time.Millisecond * 10) {
+		mu.Lock()
+		n := len(writes)
+		mu.Unlock()
+		if n >= len(expect) {
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("timeout waiting for writes")
+		}
+	}
+	mu.Lock()
+	if !reflect.DeepEqual(writes, expect) {
+		t.Fatalf("expected %v, got %v", expect, writes)
+	}
+	mu.Unlock()
+
+	// a client blocked on the new name of a list is served
+	blocked := testDial(t, addr)
+	defer blocked.close()
+	blocked.send("BLPOP", "m:list", "0")
+	for start := time.Now(); ; time.Sleep(time.Millisecond * 10) {
+		if info := conn.do("INFO", "clients").(string); strings.Contains(info, "blocked_clients:1\n") {
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("expected the client to block")
+		}
+	}
+	conn.do("RPUSH", "l:list", "z")
+	conn.do("RENAMEPREFIX", "l:", "m:")
+	blocked.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if v, err := blocked.read(); err != nil || fmt.Sprint(v) != "[m:list z]" {
+		t.Fatalf("expected '[m:list z]', got '%v', %v", v, err)
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// SanityReport is the result of a SanityCheck.
+type SanityReport struct {
+	Keys    int         // the total number of keys
+	Expires int         // the number of keys with an expiration
+	DBKeys  map[int]int // the number of keys in each database
+	Digest  string      // the dataset digest, same as DEBUG DIGEST
+}
+
+// SanityCheck loads and verifies the append only file without accepting
+// connections, and then writes a summary to the log. The file is not
+// modified. Returns an error when the file is missing, cannot be fully
+// loaded, or contains invalid data.
+func (s *Server) SanityCheck() (*SanityReport, error) {
+	report, err := s.sanityCheck()
+	if err != nil {
+		s.lwarningf("Sanity check failed: %v", err)
+		return nil, err
+	}
+	s.lnoticef("Sanity check passed: %d keys, %d with an expiration, digest %s",
+		report.Keys, report.Expires, report.Digest)
+	var nums []int
+	for num := range report.DBKeys {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	for _, num := range nums {
+		s.lnoticef("db%d: keys=%d", num, report.DBKeys[num])
+	}
+	return report, nil
+}
+
+func (s *Server) sanityCheck() (*SanityReport, error) {
+	files, err := s.readAOFManifest()
+	if err != nil {
+		return nil, err
+	}
+	s.aofSegments, s.aofActive = files[:len(files)-1], files[len(files)-1]
+	f, err := os.Open(s.aofActive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s.aof = f
+	if err := s.loadAOF(); err != nil {
+		return nil, err
+	}
+	if s.aofTruncated > 0 {
+		return nil, fmt.Errorf("the last %d bytes of the append only file "+
+			"are an incomplete command", s.aofTruncated)
+	}
+	report := &SanityReport{DBKeys: make(map[int]int)}
+	for _, db := range s.dbs {
+		var keys int
+		db.ascend(func(key string, value interface{}) bool {
+			switch value.(type) {
+			default:
+				err = fmt.Errorf("invalid type for key '%s' in db%d", key, db.num)
+				return false
+			case string, *list, *set, *hash, *zset:
+			}
+			if _, when, _ := db.getExpires(key); !when.IsZero() {
+				report.Expires++
+			}
+			keys++
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if keys > 0 {
+			report.DBKeys[db.num] = keys
+			report.Keys += keys
+		}
+	}
+	report.Digest = s.digest()
+	return report, nil
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSanityCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+
+	s, _ := testNewServer(t, aofPath)
+	if _, err := s.SanityCheck(); err == nil {
+		t.Fatal("expected an error for a missing aof")
+	}
+
+	addr, stop := testStartServer(t, aofPath)
+	conn := testDial(t, addr)
+	conn.do("SET", "key1", "value")
+	conn.do("SET", "key2", "value", "EX", "100")
+	conn.do("RPUSH", "list", "a", "b")
+	conn.do("SELECT", "3")
+	conn.do("SADD", "set", "a", "b", "c")
+	digest := conn.do("DEBUG", "DIGEST").(string)
+	conn.close()
+	stop()
+
+	s, _ = testNewServer(t, aofPath)
+	report, err := s.SanityCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Keys != 4 || report.Expires != 1 ||
+		report.DBKeys[0] != 3 || report.DBKeys[3] != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if report.Digest != digest {
+		t.Fatalf("expected digest %s, got %s", digest, report.Digest)
+	}
+
+	// a truncated file fails the check, and is left unchanged
+	data, err := ioutil.ReadFile(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = data[:len(data)-3]
+	if err := ioutil.WriteFile(aofPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, _ = testNewServer(t, aofPath)
+	if _, err := s.SanityCheck(); err == nil {
+		t.Fatal("expected an error for a truncated aof")
+	}
+	if data2, _ := ioutil.ReadFile(aofPath); len(data2) != len(data) {
+		t.Fatal("expected the aof to be unchanged")
+	}
+
+	// a normal start removes the incomplete command
+	addr, stop = testStartServer(t, aofPath)
+	conn = testDial(t, addr)
+	conn.do("SET", "key3", "value")
+	conn.close()
+	stop()
+	s, _ = testNewServer(t, aofPath)
+	if report, err := s.SanityCheck(); err != nil || report.Keys != 4 {
+		t.Fatalf("expected 4 keys, got %+v, %v", report, err)
+	}
+}
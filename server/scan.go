@@ -0,0 +1,363 @@
+package server
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The keys are in a map, and iterating a map can't be resumed from a key, so
+// SCAN 0 takes a snapshot of the keys of the database, like an export does,
+// and the cursor is the snapshot number and the position in it. Each call
+// checks the next COUNT keys of the snapshot and replies with the ones that
+// still exist and match. A key that exists for the whole iteration is
+// returned exactly once, a key that's deleted before its turn is not
+// returned, and a key that's added after SCAN 0 is not returned.
+//
+// HSCAN, SSCAN and ZSCAN iterate the fields of a hash, the members of a set
+// and the members of a sorted set the same way, from a snapshot of the fields or members taken by the first call.
+// A field that's in the hash for the whole iteration is returned exactly
+// once, with its value at the time of the call that returns it, and the
+// fields that are added during the iteration are not returned, however many
+// are added. A collection that fits in COUNT is returned by the first call
+// without a snapshot.
+//
+// The snapshots are kept by the server, because clients with a connection
+// pool may continue an iteration on another connection. A cursor is only
+// read, so calling SCAN again with the same cursor replies with the same
+// batch. A snapshot is dropped when its iteration ends, when it's not used
+// for scanCursorIdle, or when it's the oldest one of scanMaxCursors, and
+// continuing it then replies with an invalid cursor error.
+
+const (
+	scanDefaultCount = 10
+	scanMaxCursors   = 128
+	scanCursorIdle   = time.Minute * 5
+)
+
+// scanSnapshot is the keys of a database, or the elements of a collection,
+// when an iteration started.
+type scanSnapshot struct {
+	id    uint64
+	db    int
+	key   string // the key of the collection, empty for SCAN
+	elems []string
+	used  time.Time
+}
+
+// scanCursors are the snapshots of the iterations in progress. It has its own
+// lock because the SCAN commands hold the server read lock.
+type scanCursors struct {
+	mu        sync.Mutex
+	next      uint64
+	snapshots map[uint64]*scanSnapshot
+}
+
+// start keeps a snapshot of the elements of an iteration.
+func (sc *scanCursors) start(db int, key string, elems []string) *scanSnapshot {
+	snap := &scanSnapshot{db: db, key: key, elems: elems}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.snapshots == nil {
+		sc.snapshots = make(map[uint64]*scanSnapshot)
+		// cursors from before a restart must not continue a new snapshot
+		sc.next = uint64(rand.Int31())
+	}
+	now := time.Now()
+	var oldest *scanSnapshot
+	for id, s := range sc.snapshots {
+		if now.Sub(s.used) > scanCursorIdle {
+			delete(sc.snapshots, id)
+		} else if oldest == nil || s.used.Before(oldest.used) {
+			oldest = s
+		}
+	}
+	if len(sc.snapshots) >= scanMaxCursors {
+		delete(sc.snapshots, oldest.id)
+	}
+	sc.next = (sc.next + 1) & 0x7fffffff
+	if sc.next == 0 {
+		sc.next = 1
+	}
+	snap.id = sc.next
+	snap.used = now
+	sc.snapshots[snap.id] = snap
+	return snap
+}
+
+// get returns the snapshot of a cursor. Returns nil if the snapshot was
+// dropped or it's of another database or key.
+func (sc *scanCursors) get(id uint64, db int, key string) *scanSnapshot {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	snap := sc.snapshots[id]
+	if snap == nil || snap.db != db || snap.key != key {
+		return nil
+	}
+	snap.used = time.Now()
+	return snap
+}
+
+// end drops the snapshot of an iteration that ended.
+func (sc *scanCursors) end(id uint64) {
+	sc.mu.Lock()
+	delete(sc.snapshots, id)
+	sc.mu.Unlock()
+}
+
+// scanArgs are the cursor and the options of a SCAN command.
+type scanArgs struct {
+	cursor   uint64
+	match    *pattern
+	count    int
+	typ      string // the TYPE of SCAN
+	novalues bool   // the NOVALUES of HSCAN
+}
+
+// parseScanArgs parses the cursor at c.args[i] and the options after it.
+// TYPE is only allowed for SCAN and NOVALUES only for HSCAN.
+func parseScanArgs(c *client, i int) (scanArgs, bool) {
+	a := scanArgs{count: scanDefaultCount}
+	var err error
+	a.cursor, err = strconv.ParseUint(c.args[i], 10, 64)
+	if err != nil {
+		c.replyError("invalid cursor")
+		return a, false
+	}
+	cmd := strings.ToLower(c.args[0])
+	for i++; i < len(c.args); i += 2 {
+		opt := strings.ToLower(c.args[i])
+		if opt == "novalues" && cmd == "hscan" {
+			a.novalues = true
+			i--
+			continue
+		}
+		if i+1 == len(c.args) {
+			c.replySyntaxError()
+			return a, false
+		}
+		switch {
+		default:
+			c.replySyntaxError()
+			return a, false
+		case opt == "match":
+			a.match = parsePattern(c.args[i+1])
+		case opt == "count":
+			n, err := strconv.Atoi(c.args[i+1])
+			if err != nil {
+				c.replyInvalidIntError()
+				return a, false
+			}
+			if n < 1 {
+				c.replySyntaxError()
+				return a, false
+			}
+			a.count = n
+		case opt == "type" && cmd == "scan":
+			a.typ = strings.ToLower(c.args[i+1])
+		}
+	}
+	return a, true
+}
+
+// scanNext returns the next batch of an iteration of the elements of a
+// database or of a collection, and the cursor that continues it. The elems
+// function is called by the first call of the iteration, while holding the
+// server lock.
+func scanNext(c *client, a scanArgs, key string, elems func() []string) (batch []string, next string, ok bool) {
+	var snap *scanSnapshot
+	pos := int(a.cursor & 0xffffffff)
+	if a.cursor == 0 {
+		all := elems()
+		if len(all) <= a.count {
+			return all, "0", true
+		}
+		snap = c.s.scans.start(c.db.num, key, all)
+	} else {
+		snap = c.s.scans.get(a.cursor>>32, c.db.num, key)
+		if snap == nil || pos > len(snap.elems) {
+			c.replyError("invalid cursor")
+			return nil, "", false
+		}
+	}
+	end := len(snap.elems)
+	if a.count < end-pos {
+		end = pos + a.count
+	}
+	next = "0"
+	if end < len(snap.elems) {
+		next = strconv.FormatUint(snap.id<<32|uint64(end), 10)
+	} else {
+		c.s.scans.end(snap.id)
+	}
+	return snap.elems[pos:end], next, true
+}
+
+// replyScan replies with the cursor and the elements of a batch.
+func replyScan(c *client, next string, elems []string) {
+	c.replyMultiBulkLen(2)
+	c.replyBulk(next)
+	c.replyMultiBulkLen(len(elems))
+	for _, elem := range elems {
+		c.replyBulk(elem)
+	}
+}
+
+// scanCommand is SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]. The
+// cursor is the snapshot id in the high 32 bits and the position in the low
+// 32 bits.
+func scanCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	a, ok := parseScanArgs(c, 1)
+	if !ok {
+		return
+	}
+	batch, next, ok := scanNext(c, a, "", func() []string {
+		keys := make([]string, 0, c.db.len())
+		c.db.ascend(func(key string, value interface{}) bool {
+			keys = append(keys, key)
+			return true
+		})
+		return keys
+	})
+	if !ok {
+		return
+	}
+	var keys []string
+	for _, key := range batch {
+		if a.match != nil && !a.match.match(key) {
+			continue
+		}
+		if a.typ != "" {
+			if c.db.getType(key) != a.typ {
+				continue
+			}
+		} else if _, ok := c.db.get(key); !ok {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	replyScan(c, next, keys)
+}
+
+// sscanCommand is SSCAN key cursor [MATCH pattern] [COUNT count].
+func sscanCommand(c *client) {
+	if len(c.args) < 3 {
+		c.replyAritryError()
+		return
+	}
+	a, ok := parseScanArgs(c, 2)
+	if !ok {
+		return
+	}
+	st, ok := c.db.getSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	batch, next, ok := scanNext(c, a, c.args[1], func() []string {
+		if st == nil {
+			return nil
+		}
+		return st.strArr()
+	})
+	if !ok {
+		return
+	}
+	var members []string
+	for _, member := range batch {
+		if st == nil || !st.isMember(member) ||
+			(a.match != nil && !a.match.match(member)) {
+			continue
+		}
+		members = append(members, member)
+	}
+	replyScan(c, next, members)
+}
+
+// hscanCommand is HSCAN key cursor [MATCH pattern] [COUNT count] [NOVALUES].
+// The reply has the fields and their values, or only the fields with
+// NOVALUES.
+func hscanCommand(c *client) {
+	if len(c.args) < 3 {
+		c.replyAritryError()
+		return
+	}
+	a, ok := parseScanArgs(c, 2)
+	if !ok {
+		return
+	}
+	h, ok := c.db.getHash(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	batch, next, ok := scanNext(c, a, c.args[1], func() []string {
+		if h == nil {
+			return nil
+		}
+		return h.fields()
+	})
+	if !ok {
+		return
+	}
+	var elems []string
+	for _, field := range batch {
+		if h == nil || (a.match != nil && !a.match.match(field)) {
+			continue
+		}
+		value, ok := h.get(field)
+		if !ok {
+			continue
+		}
+		elems = append(elems, field)
+		if !a.novalues {
+			elems = append(elems, value)
+		}
+	}
+	replyScan(c, next, elems)
+}
+
+// zscanCommand is ZSCAN key cursor [MATCH pattern] [COUNT count]. The reply
+// has the members and their scores.
+func zscanCommand(c *client) {
+	if len(c.args) < 3 {
+		c.replyAritryError()
+		return
+	}
+	a, ok := parseScanArgs(c, 2)
+	if !ok {
+		return
+	}
+	z, ok := c.db.getZSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	batch, next, ok := scanNext(c, a, c.args[1], func() []string {
+		if z == nil {
+			return nil
+		}
+		return z.members()
+	})
+	if !ok {
+		return
+	}
+	var elems []string
+	for _, member := range batch {
+		if z == nil || (a.match != nil && !a.match.match(member)) {
+			continue
+		}
+		score, ok := z.score(member)
+		if !ok {
+			continue
+		}
+		elems = append(elems, member, formatDouble(score))
+	}
+	replyScan(c, next, elems)
+}
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testScan iterates SCAN with the options and returns the number of times
+// that each key was returned.
+func testScan(t *testing.T, conn *testConn, between func(seen map[string]int),
+	opts ...string,
+) map[string]int {
+	t.Helper()
+	return testScanCommand(t, conn, []string{"SCAN"}, between, opts...)
+}
+
+// testScanCommand iterates a SCAN command, which is the args before the
+// cursor, such as HSCAN and its key.
+func testScanCommand(t *testing.T, conn *testConn, cmd []string,
+	between func(seen map[string]int), opts ...string,
+) map[string]int {
+	t.Helper()
+	seen := make(map[string]int)
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		args := append(append(append([]string{}, cmd...), cursor), opts...)
+		v, ok := conn.do(args...).([]interface{})
+		if !ok || len(v) != 2 {
+			t.Fatalf("expected a cursor and keys, got %v", v)
+		}
+		for _, key := range v[1].([]interface{}) {
+			seen[key.(string)]++
+		}
+		cursor = v[0].(string)
+		if cursor == "0" {
+			return seen
+		}
+		if calls > 10000 {
+			t.Fatal("the iteration doesn't end")
+		}
+		if between != nil {
+			between(seen)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"))
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	if v := conn.do("SCAN", "0"); fmt.Sprint(v) != "[0 []]" {
+		t.Fatalf("expected an empty iteration, got %v", v)
+	}
+	for i := 0; i < 1000; i++ {
+		conn.do("SET", fmt.Sprintf("key:%d", i), "v")
+	}
+	conn.do("SADD", "set:1", "a")
+	conn.do("RPUSH", "list:1", "a")
+
+	seen := testScan(t, conn, nil, "COUNT", "7")
+	if len(seen) != 1002 {
+		t.Fatalf("expected 1002 keys, got %d", len(seen))
+	}
+	for key, n := range seen {
+		if n != 1 {
+			t.Fatalf("expected '%s' once, got %d", key, n)
+		}
+	}
+	seen = testScan(t, conn, nil, "MATCH", "key:1?", "COUNT", "100")
+	if len(seen) != 10 {
+		t.Fatalf("expected 10 keys, got %v", seen)
+	}
+	seen = testScan(t, conn, nil, "TYPE", "set", "COUNT", "1000")
+	if len(seen) != 1 || seen["set:1"] != 1 {
+		t.Fatalf("expected set:1, got %v", seen)
+	}
+
+	// COUNT bounds the keys checked by a call
+	v := conn.do("SCAN", "0", "COUNT", "5").([]interface{})
+	if n := len(v[1].([]interface{})); n != 5 {
+		t.Fatalf("expected 5 keys, got %d", n)
+	}
+	// the same cursor replies with the same batch
+	cursor := v[0].(string)
+	a := fmt.Sprint(conn.do("SCAN", cursor, "COUNT", "5"))
+	b := fmt.Sprint(conn.do("SCAN", cursor, "COUNT", "5"))
+	if a != b {
+		t.Fatalf("expected the same batch, got %s and %s", a, b)
+	}
+	// a cursor continues on another connection, but not in another database
+	conn2 := testDial(t, addr)
+	defer conn2.close()
+	if v, ok := conn2.do("SCAN", cursor).([]interface{}); !ok || len(v) != 2 {
+		t.Fatalf("expected the iteration to continue, got %v", v)
+	}
+	conn2.do("SELECT", "1")
+	if err, ok := conn2.do("SCAN", cursor).(error); !ok ||
+		!strings.HasPrefix(err.Error(), "ERR invalid cursor") {
+		t.Fatalf("expected 'ERR invalid cursor', got %v", err)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"SCAN"}, "ERR wrong number of arguments"},
+		{[]string{"SCAN", "x"}, "ERR invalid cursor"},
+		{[]string{"SCAN", "12345"}, "ERR invalid cursor"},
+		{[]string{"SCAN", "0", "COUNT", "0"}, "ERR syntax error"},
+		{[]string{"SCAN", "0", "COUNT", "x"}, "ERR value is not an integer"},
+		{[]string{"SCAN", "0", "MATCH"}, "ERR syntax error"},
+		{[]string{"SCAN", "0", "FOO", "1"}, "ERR syntax error"},
+	} {
+		err, ok := conn.do(tt.args...).(error)
+		if !ok || !strings.HasPrefix(strings.ToLower(err.Error()), strings.ToLower(tt.err)) {
+			t.Fatalf("%v: expected '%s', got '%v'", tt.args, tt.err, err)
+		}
+	}
+}
+
+func TestScanConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"))
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	for i := 0; i < 2000; i++ {
+		conn.do("SET", fmt.Sprintf("stay:%d", i), "v")
+		conn.do("SET", fmt.Sprintf("gone:%d", i), "v")
+	}
+
+	// another client deletes the gone keys and adds new keys while the
+	// iteration runs
+	var wg sync.WaitGroup
+	wg.Add(1)
+	done := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		conn := testDial(t, addr)
+		defer conn.close()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if i < 2000 {
+				conn.do("DEL", fmt.Sprintf("gone:%d", i))
+			}
+			conn.do("SET", fmt.Sprintf("new:%d", i), "v")
+		}
+	}()
+	// a key that's not returned yet and is deleted between the calls is not
+	// returned afterwards
+	var deleted []string
+	next := 1999
+	seen := testScan(t, conn, func(seen map[string]int) {
+		for ; next >= 0; next-- {
+			key := fmt.Sprintf("gone:%d", next)
+			if seen[key] == 0 {
+				conn.do("DEL", key)
+				deleted = append(deleted, key)
+				next--
+				return
+			}
+		}
+	}, "COUNT", "20")
+	close(done)
+	wg.Wait()
+
+	for i := 0; i < 2000; i++ {
+		if n := seen[fmt.Sprintf("stay:%d", i)]; n != 1 {
+			t.Fatalf("expected 'stay:%d' once, got %d", i, n)
+		}
+	}
+	for key, n := range seen {
+		if n != 1 {
+			t.Fatalf("expected '%s' once, got %d", key, n)
+		}
+	}
+	if len(deleted) == 0 {
+		t.Fatal("expected deletes between the calls")
+	}
+	for _, key := range deleted {
+		if seen[key] != 0 {
+			t.Fatalf("expected '%s' to not be returned after it was deleted", key)
+		}
+	}
+}
+
+func TestSubScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"))
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	for i := 0; i < 1000; i++ {
+		conn.do("HSET", "hash", fmt.Sprintf("f:%d", i), fmt.Sprintf("v:%d", i))
+		conn.do("SADD", "set", fmt.Sprintf("m:%d", i))
+		conn.do("ZADD", "zset", fmt.Sprint(i), fmt.Sprintf("z:%d", i))
+	}
+	conn.do("HSET", "small", "a", "1", "b", "2")
+	conn.do("SET", "str", "value")
+
+	// another client adds fields or members once the iteration started
+	concurrent := func(args func(i int) []string) (between func(map[string]int), wait func()) {
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		done := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn := testDial(t, addr)
+			defer conn.close()
+			<-start
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				conn.do(args(i)...)
+			}
+		}()
+		var once sync.Once
+		return func(map[string]int) { once.Do(func() { close(start) }) },
+			func() {
+				once.Do(func() { close(start) })
+				close(done)
+				wg.Wait()
+			}
+	}
+	between, wait := concurrent(func(i int) []string {
+		return []string{"HSET", "hash", fmt.Sprintf("new:%d", i), "v"}
+	})
+	fields := testScanCommand(t, conn, []string{"HSCAN", "hash"}, between,
+		"COUNT", "7", "NOVALUES")
+	wait()
+	between, wait = concurrent(func(i int) []string {
+		return []string{"SADD", "set", fmt.Sprintf("new:%d", i)}
+	})
+	members := testScanCommand(t, conn, []string{"SSCAN", "set"}, between,
+		"COUNT", "7")
+	wait()
+	between, wait = concurrent(func(i int) []string {
+		return []string{"ZADD", "zset", "0", fmt.Sprintf("new:%d", i)}
+	})
+	zmembers := testScanCommand(t, conn, []string{"ZSCAN", "zset"}, between,
+		"COUNT", "7")
+	wait()
+	for i := 0; i < 1000; i++ {
+		if n := fields[fmt.Sprintf("f:%d", i)]; n != 1 {
+			t.Fatalf("expected 'f:%d' once, got %d", i, n)
+		}
+		if n := members[fmt.Sprintf("m:%d", i)]; n != 1 {
+			t.Fatalf("expected 'm:%d' once, got %d", i, n)
+		}
+		// the scores are in the replies too
+		if n := zmembers[fmt.Sprintf("z:%d", i)]; n != 1 {
+			t.Fatalf("expected 'z:%d' once, got %d", i, n)
+		}
+	}
+	for elem, n := range fields {
+		if n != 1 || strings.HasPrefix(elem, "new:") {
+			t.Fatalf("expected only the fields of HSCAN 0, got '%s' %d times", elem, n)
+		}
+	}
+	for elem, n := range members {
+		if n != 1 || strings.HasPrefix(elem, "new:") {
+			t.Fatalf("expected only the members of SSCAN 0, got '%s' %d times", elem, n)
+		}
+	}
+	for elem := range zmembers {
+		if strings.HasPrefix(elem, "new:") {
+			t.Fatalf("expected only the members of ZSCAN 0, got '%s'", elem)
+		}
+	}
+	// the scores follow their members
+	v := conn.do("ZSCAN", "zset", "0", "MATCH", "z:1?", "COUNT", "2000").([]interface{})
+	if fmt.Sprint(v) != "[0 [z:10 10 z:11 11 z:12 12 z:13 13 z:14 14 z:15 15 "+
+		"z:16 16 z:17 17 z:18 18 z:19 19]]" {
+		t.Fatalf("expected 10 members and scores, got %v", v)
+	}
+
+	// the values follow their fields
+	v = conn.do("HSCAN", "hash", "0", "MATCH", "f:1?", "COUNT", "2000").([]interface{})
+	elems := v[1].([]interface{})
+	if v[0] != "0" || len(elems) != 20 {
+		t.Fatalf("expected 10 fields and values, got %v", v)
+	}
+	for i := 0; i < len(elems); i += 2 {
+		if "v"+elems[i].(string)[1:] != elems[i+1] {
+			t.Fatalf("expected the value of %v, got %v", elems[i], elems[i+1])
+		}
+	}
+	// a small collection is returned by the first call
+	if v := conn.do("HSCAN", "small", "0"); fmt.Sprint(v) != "[0 [a 1 b 2]]" &&
+		fmt.Sprint(v) != "[0 [b 2 a 1]]" {
+		t.Fatalf("expected the whole hash, got %v", v)
+	}
+	if v := conn.do("SSCAN", "missing", "0"); fmt.Sprint(v) != "[0 []]" {
+		t.Fatalf("expected an empty iteration, got %v", v)
+	}
+	// a cursor continues the iteration of its own key only
+	cursor := conn.do("HSCAN", "hash", "0").([]interface{})[0].(string)
+	if err, ok := conn.do("HSCAN", "small", cursor).(error); !ok ||
+		!strings.HasPrefix(err.Error(), "ERR invalid cursor") {
+		t.Fatalf("expected 'ERR invalid cursor', got %v", err)
+	}
+	if err, ok := conn.do("SCAN", cursor).(error); !ok ||
+		!strings.HasPrefix(err.Error(), "ERR invalid cursor") {
+		t.Fatalf("expected 'ERR invalid cursor', got %v", err)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"HSCAN", "hash"}, "ERR wrong number of arguments"},
+		{[]string{"HSCAN", "str", "0"}, "WRONGTYPE"},
+		{[]string{"SSCAN", "hash", "0"}, "WRONGTYPE"},
+		{[]string{"ZSCAN", "set", "0"}, "WRONGTYPE"},
+		{[]string{"ZSCAN", "zset", "0", "NOVALUES"}, "ERR syntax error"},
+		{[]string{"SSCAN", "set", "0", "NOVALUES"}, "ERR syntax error"},
+		{[]string{"HSCAN", "hash", "0", "TYPE", "string"}, "ERR syntax error"},
+		{[]string{"SCAN", "0", "NOVALUES"}, "ERR syntax error"},
+		{[]string{"HSCAN", "hash", "x"}, "ERR invalid cursor"},
+	} {
+		err, ok := conn.do(tt.args...).(error)
+		if !ok || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Fatalf("%v: expected '%s', got '%v'", tt.args, tt.err, err)
+		}
+	}
+}
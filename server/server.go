@@ -3,15 +3,19 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"os/signal"
 	"path"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -19,88 +23,185 @@ func (s *Server) commandTable() {
 	// "+" append aof
 	// "w" write lock
 	// "r" read lock
-	s.register("get", getCommand, "r")           // Strings
-	s.register("getset", getsetCommand, "w+")    // Strings
-	s.register("set", setCommand, "w+")          // Strings
-	s.register("append", appendCommand, "w+")    // Strings
-	s.register("bitcount", bitcountCommand, "r") // Strings
-	s.register("incr", incrCommand, "w+")        // Strings
-	s.register("incrby", incrbyCommand, "w+")    // Strings
-	s.register("decr", decrCommand, "w+")        // Strings
-	s.register("decrby", decrbyCommand, "w+")    // Strings
-	s.register("mget", mgetCommand, "r")         // Strings
-	s.register("setnx", setnxCommand, "w+")      // Strings
-	s.register("mset", msetCommand, "w+")        // Strings
-	s.register("msetnx", msetnxCommand, "w+")    // Strings
-
-	s.register("lpush", lpushCommand, "w+")         // Lists
-	s.register("rpush", rpushCommand, "w+")         // Lists
-	s.register("lrange", lrangeCommand, "r")        // Lists
-	s.register("llen", llenCommand, "r")            // Lists
-	s.register("lpop", lpopCommand, "w+")           // Lists
-	s.register("rpop", rpopCommand, "w+")           // Lists
-	s.register("lindex", lindexCommand, "r")        // Lists
-	s.register("lrem", lremCommand, "w+")           // Lists
-	s.register("lset", lsetCommand, "w+")           // Lists
-	s.register("ltrim", ltrimCommand, "w+")         // Lists
-	s.register("rpoplpush", rpoplpushCommand, "w+") // Lists
-
-	s.register("sadd", saddCommand, "w+")               // Sets
-	s.register("scard", scardCommand, "r")              // Sets
-	s.register("smembers", smembersCommand, "r")        // Sets
-	s.register("sismember", sismembersCommand, "r")     // Sets
-	s.register("sdiff", sdiffCommand, "r")              // Sets
-	s.register("sinter", sinterCommand, "r")            // Sets
-	s.register("sunion", sunionCommand, "r")            // Sets
-	s.register("sdiffstore", sdiffstoreCommand, "w+")   // Sets
-	s.register("sinterstore", sinterstoreCommand, "w+") // Sets
-	s.register("sunionstore", sunionstoreCommand, "w+") // Sets
-	s.register("spop", spopCommand, "w+")               // Sets
-	s.register("srandmember", srandmemberCommand, "r")  // Sets
-	s.register("srem", sremCommand, "w+")               // Sets
-	s.register("smove", smoveCommand, "w+")             // Sets
-
-	s.register("echo", echoCommand, "")      // Connection
-	s.register("ping", pingCommand, "")      // Connection
-	s.register("select", selectCommand, "w") // Connection
-
-	s.register("flushdb", flushdbCommand, "w+")          // Server
-	s.register("flushall", flushallCommand, "w+")        // Server
-	s.register("dbsize", dbsizeCommand, "r")             // Server
-	s.register("debug", debugCommand, "w")               // Server
-	s.register("bgrewriteaof", bgrewriteaofCommand, "w") // Server
-	s.register("bgsave", bgsaveCommand, "w")             // Server
-	s.register("save", saveCommand, "w")                 // Server
-	s.register("lastsave", lastsaveCommand, "r")         // Server
-	s.register("shutdown", shutdownCommand, "w")         // Server
-	s.register("info", infoCommand, "r")                 // Server
-	s.register("monitor", monitorCommand, "w")           // Server
-	s.register("config", configCommand, "w")             // Server
-	s.register("auth", authCommand, "r")                 // Server
-
-	s.register("del", delCommand, "w+")            // Keys
-	s.register("keys", keysCommand, "r")           // Keys
-	s.register("rename", renameCommand, "w+")      // Keys
-	s.register("renamenx", renamenxCommand, "w+")  // Keys
-	s.register("type", typeCommand, "r")           // Keys
-	s.register("randomkey", randomkeyCommand, "r") // Keys
-	s.register("exists", existsCommand, "r")       // Keys
-	s.register("expire", expireCommand, "w+")      // Keys
-	s.register("ttl", ttlCommand, "r")             // Keys
-	s.register("move", moveCommand, "w+")          // Keys
-	s.register("sort", sortCommand, "w+")          // Keys
-	s.register("expireat", expireatCommand, "w+")  // Keys
+	// "m" may create keys, refused when maxkeys is reached
+	// "l" may run while the aof is loading
+	// "f" fast, never touches the keyspace and runs without a lock
+	// "k" keeps the ttl of a key it modifies (LPUSH into an existing key)
+	// "c" clears the ttl of a key it overwrites (SET without KEEPTTL)
+	// "t" transfers the ttl along with the key (RENAME)
+	// "n" does not update the lru clock of its keys (OBJECT)
+	// followed by the first key, last key, and key step
+	s.register("get", getCommand, "r", 1, 1, 1)                    // Strings
+	s.register("getset", getsetCommand, "w+mc", 1, 1, 1)           // Strings
+	s.register("set", setCommand, "w+mc", 1, 1, 1)                 // Strings
+	s.register("append", appendCommand, "w+mk", 1, 1, 1)           // Strings
+	s.register("bitcount", bitcountCommand, "r", 1, 1, 1)          // Strings
+	s.register("getrange", getrangeCommand, "r", 1, 1, 1)          // Strings
+	s.register("setrange", setrangeCommand, "w+mk", 1, 1, 1)       // Strings
+	s.register("incr", incrCommand, "w+mk", 1, 1, 1)               // Strings
+	s.register("incrby", incrbyCommand, "w+mk", 1, 1, 1)           // Strings
+	s.register("decr", decrCommand, "w+mk", 1, 1, 1)               // Strings
+	s.register("decrby", decrbyCommand, "w+mk", 1, 1, 1)           // Strings
+	s.register("incrbyfloat", incrbyfloatCommand, "w+mk", 1, 1, 1) // Strings
+	s.register("mget", mgetCommand, "r", 1, -1, 1)                 // Strings
+	s.register("setnx", setnxCommand, "w+mc", 1, 1, 1)             // Strings
+	s.register("mset", msetCommand, "w+mc", 1, -1, 2)              // Strings
+	s.register("msetnx", msetnxCommand, "w+mc", 1, -1, 2)          // Strings
+	s.register("setex", setexCommand, "w+mc", 1, 1, 1)             // Strings
+	s.register("psetex", psetexCommand, "w+mc", 1, 1, 1)           // Strings
+	s.register("getex", getexCommand, "w+", 1, 1, 1)               // Strings
+
+	s.register("lpush", lpushCommand, "w+mk", 1, 1, 1)           // Lists
+	s.register("rpush", rpushCommand, "w+mk", 1, 1, 1)           // Lists
+	s.register("lrange", lrangeCommand, "r", 1, 1, 1)            // Lists
+	s.register("llen", llenCommand, "r", 1, 1, 1)                // Lists
+	s.register("lpop", lpopCommand, "w+k", 1, 1, 1)              // Lists
+	s.register("rpop", rpopCommand, "w+k", 1, 1, 1)              // Lists
+	s.register("lindex", lindexCommand, "r", 1, 1, 1)            // Lists
+	s.register("lrem", lremCommand, "w+k", 1, 1, 1)              // Lists
+	s.register("lset", lsetCommand, "w+k", 1, 1, 1)              // Lists
+	s.register("ltrim", ltrimCommand, "w+k", 1, 1, 1)            // Lists
+	s.register("linsert", linsertCommand, "w+mk", 1, 1, 1)       // Lists
+	s.register("rpoplpush", rpoplpushCommand, "w+mk", 1, 2, 1)   // Lists
+	s.register("lmove", lmoveCommand, "w+mk", 1, 2, 1)           // Lists
+	s.register("blpop", blpopCommand, "w+k", 1, -2, 1)           // Lists
+	s.register("brpop", brpopCommand, "w+k", 1, -2, 1)           // Lists
+	s.register("blmove", blmoveCommand, "w+mk", 1, 2, 1)         // Lists
+	s.register("brpoplpush", brpoplpushCommand, "w+mk", 1, 2, 1) // Lists
+
+	s.register("sadd", saddCommand, "w+mk", 1, 1, 1)                // Sets
+	s.register("scard", scardCommand, "r", 1, 1, 1)                 // Sets
+	s.register("smembers", smembersCommand, "r", 1, 1, 1)           // Sets
+	s.register("sismember", sismembersCommand, "r", 1, 1, 1)        // Sets
+	s.register("sdiff", sdiffCommand, "r", 1, -1, 1)                // Sets
+	s.register("sinter", sinterCommand, "r", 1, -1, 1)              // Sets
+	s.register("sunion", sunionCommand, "r", 1, -1, 1)              // Sets
+	s.register("sdiffstore", sdiffstoreCommand, "w+mc", 1, -1, 1)   // Sets
+	s.register("sinterstore", sinterstoreCommand, "w+mc", 1, -1, 1) // Sets
+	s.register("sunionstore", sunionstoreCommand, "w+mc", 1, -1, 1) // Sets
+	s.register("spop", spopCommand, "w+k", 1, 1, 1)                 // Sets
+	s.register("srandmember", srandmemberCommand, "r", 1, 1, 1)     // Sets
+	s.register("srem", sremCommand, "w+k", 1, 1, 1)                 // Sets
+	s.register("smove", smoveCommand, "w+mk", 1, 2, 1)              // Sets
+	s.register("sscan", sscanCommand, "r", 1, 1, 1)                 // Sets
+
+	s.register("hset", hsetCommand, "w+mk", 1, 1, 1)                 // Hashes
+	s.register("hget", hgetCommand, "r", 1, 1, 1)                    // Hashes
+	s.register("hdel", hdelCommand, "w+k", 1, 1, 1)                  // Hashes
+	s.register("hgetall", hgetallCommand, "r", 1, 1, 1)              // Hashes
+	s.register("hlen", hlenCommand, "r", 1, 1, 1)                    // Hashes
+	s.register("hexists", hexistsCommand, "r", 1, 1, 1)              // Hashes
+	s.register("hsetnx", hsetnxCommand, "w+mk", 1, 1, 1)             // Hashes
+	s.register("hmget", hmgetCommand, "r", 1, 1, 1)                  // Hashes
+	s.register("hkeys", hkeysCommand, "r", 1, 1, 1)                  // Hashes
+	s.register("hvals", hvalsCommand, "r", 1, 1, 1)                  // Hashes
+	s.register("hstrlen", hstrlenCommand, "r", 1, 1, 1)              // Hashes
+	s.register("hincrby", hincrbyCommand, "w+mk", 1, 1, 1)           // Hashes
+	s.register("hincrbyfloat", hincrbyfloatCommand, "w+mk", 1, 1, 1) // Hashes
+	s.register("hrandfield", hrandfieldCommand, "r", 1, 1, 1)        // Hashes
+	s.register("hscan", hscanCommand, "r", 1, 1, 1)                  // Hashes
+
+	s.register("zadd", zaddCommand, "w+mk", 1, 1, 1)                        // Sorted Sets
+	s.register("zscore", zscoreCommand, "r", 1, 1, 1)                       // Sorted Sets
+	s.register("zrange", zrangeCommand, "r", 1, 1, 1)                       // Sorted Sets
+	s.register("zrem", zremCommand, "w+k", 1, 1, 1)                         // Sorted Sets
+	s.register("zcard", zcardCommand, "r", 1, 1, 1)                         // Sorted Sets
+	s.register("zrangebyscore", zrangebyscoreCommand, "r", 1, 1, 1)         // Sorted Sets
+	s.register("zrevrangebyscore", zrevrangebyscoreCommand, "r", 1, 1, 1)   // Sorted Sets
+	s.register("zrangebylex", zrangebylexCommand, "r", 1, 1, 1)             // Sorted Sets
+	s.register("zremrangebyrank", zremrangebyrankCommand, "w+k", 1, 1, 1)   // Sorted Sets
+	s.register("zremrangebyscore", zremrangebyscoreCommand, "w+k", 1, 1, 1) // Sorted Sets
+	s.register("zremrangebylex", zremrangebylexCommand, "w+k", 1, 1, 1)     // Sorted Sets
+	s.register("zscan", zscanCommand, "r", 1, 1, 1)                         // Sorted Sets
+
+	s.register("echo", echoCommand, "fl", 0, 0, 0)     // Connection
+	s.register("ping", pingCommand, "fl", 0, 0, 0)     // Connection
+	s.register("select", selectCommand, "wl", 0, 0, 0) // Connection
+	s.register("client", clientCommand, "fl", 0, 0, 0) // Connection
+	s.register("reset", resetCommand, "fl", 0, 0, 0)   // Connection
+
+	s.register("flushdb", flushdbCommand, "w+", 0, 0, 0)          // Server
+	s.register("flushall", flushallCommand, "w+", 0, 0, 0)        // Server
+	s.register("dbsize", dbsizeCommand, "r", 0, 0, 0)             // Server
+	s.register("debug", debugCommand, "wl", 0, 0, 0)              // Server
+	s.register("bgrewriteaof", bgrewriteaofCommand, "w", 0, 0, 0) // Server
+	s.register("bgsave", bgsaveCommand, "w", 0, 0, 0)             // Server
+	s.register("save", saveCommand, "w", 0, 0, 0)                 // Server
+	s.register("lastsave", lastsaveCommand, "r", 0, 0, 0)         // Server
+	s.register("shutdown", shutdownCommand, "wl", 0, 0, 0)        // Server
+	s.register("info", infoCommand, "rl", 0, 0, 0)                // Server
+	s.register("monitor", monitorCommand, "wl", 0, 0, 0)          // Server
+	s.register("config", configCommand, "wl", 0, 0, 0)            // Server
+	s.register("auth", authCommand, "fl", 0, 0, 0)                // Server
+	s.register("hello", helloCommand, "fl", 0, 0, 0)              // Server
+	s.register("traceid", traceidCommand, "fl", 0, 0, 0)          // Server
+	s.register("time", timeCommand, "f", 0, 0, 0)                 // Server
+	s.register("acl", aclCommand, "fl", 0, 0, 0)                  // Server
+	s.register("memory", memoryCommand, "rn", 2, 2, 1)            // Server
+	s.register("export", exportCommand, "r", 0, 0, 0)             // Server
+	s.register("waitaof", waitaofCommand, "w", 0, 0, 0)           // Server
+	s.register("aof", aofCommand, "w", 0, 0, 0)                   // Server
+	s.register("keystats", keystatsCommand, "r", 0, 0, 0)         // Server
+	s.register("bigkeys", bigkeysCommand, "r", 0, 0, 0)           // Server
+	s.register("ttlstats", ttlstatsCommand, "r", 0, 0, 0)         // Server
+	s.register("latency", latencyCommand, "fl", 0, 0, 0)          // Server
+	s.register("hotkeys", hotkeysCommand, "fl", 0, 0, 0)          // Server
+
+	s.register("del", delCommand, "w+", 1, -1, 1)                 // Keys
+	s.register("keys", keysCommand, "r", 0, 0, 0)                 // Keys
+	s.register("scan", scanCommand, "r", 0, 0, 0)                 // Keys
+	s.register("rename", renameCommand, "w+t", 1, 2, 1)           // Keys
+	s.register("renamenx", renamenxCommand, "w+t", 1, 2, 1)       // Keys
+	s.register("renameprefix", renameprefixCommand, "w", 0, 0, 0) // Keys
+	s.register("type", typeCommand, "rn", 1, 1, 1)                // Keys
+	s.register("randomkey", randomkeyCommand, "r", 0, 0, 0)       // Keys
+	s.register("exists", existsCommand, "rn", 1, -1, 1)           // Keys
+	s.register("expire", expireCommand, "w+", 1, 1, 1)            // Keys
+	s.register("ttl", ttlCommand, "rn", 1, 1, 1)                  // Keys
+	s.register("move", moveCommand, "w+t", 1, 1, 1)               // Keys
+	s.register("sort", sortCommand, "w+c", 1, 1, 1)               // Keys
+	s.register("expireat", expireatCommand, "w+", 1, 1, 1)        // Keys
+	s.register("persist", persistCommand, "w+", 1, 1, 1)          // Keys
+	s.register("pexpire", pexpireCommand, "w+", 1, 1, 1)          // Keys
+	s.register("pexpireat", pexpireatCommand, "w+", 1, 1, 1)      // Keys
+	s.register("pttl", pttlCommand, "rn", 1, 1, 1)                // Keys
+	s.register("touch", touchCommand, "rn", 1, -1, 1)             // Keys
+	s.register("object", objectCommand, "rn", 2, 2, 1)            // Keys
 }
 
 var errShutdownSave = errors.New("shutdown and save")
 var errShutdownNoSave = errors.New("shutdown and nosave")
 
 type command struct {
-	name  string
-	aof   bool
-	read  bool
-	write bool
-	funct func(c *client)
+	name     string
+	aof      bool
+	read     bool
+	write    bool
+	grow     bool      // the command may create keys
+	loading  bool      // the command may run while the aof is loading
+	fast     bool      // the command never touches the keyspace and runs without the lock
+	ttl      ttlPolicy // what the command does to the ttl of the keys it writes
+	notouch  bool      // the command does not update the lru clock of its keys
+	funct    func(c *client)
+	firstKey int // first argument that is a key, 0 for no keys
+	lastKey  int // last argument that is a key, negative counts from the end
+	keyStep  int // step between keys
+}
+
+// keys returns the arguments of a command that are keys.
+func (cmd *command) keys(args []string) []string {
+	if cmd.firstKey == 0 {
+		return nil
+	}
+	last := cmd.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+	var keys []string
+	for i := cmd.firstKey; i <= last && i < len(args); i += cmd.keyStep {
+		keys = append(keys, args[i])
+	}
+	return keys
 }
 
 // Options alter the behavior of the server.
@@ -113,6 +214,23 @@ type Options struct {
 	AppendOnlyPath   string
 	AppName, Version string
 	Args             []string
+	SanityCheck      bool // Start only runs a SanityCheck and exits
+
+	// SeedPath is a rewritten aof, such as a backup, that's loaded before the
+	// aof. The aof is then the changes since the seed. A seed with a .digest
+	// file next to it must match the SHA-256 in that file. Rewriting the aof
+	// makes it a full copy of the data, after which the seed is not needed.
+	SeedPath string
+
+	// KeyLoader is called when GET misses a key that matches the
+	// read-through-patterns config. It's called outside of the server lock,
+	// and only once at a time per key. The ctx is the one of the client that
+	// missed the key, which is cancelled when the connection closes.
+	KeyLoader func(ctx context.Context, key string) (value interface{}, ttl time.Duration, ok bool)
+	// WriteBehind is called with batches of changes to keys that match the
+	// write-behind-patterns config. A batch is retried when an error is
+	// returned.
+	WriteBehind func(writes []KeyWrite) error
 }
 
 // Server represents a server object.
@@ -124,35 +242,163 @@ type Server struct {
 	cmds    map[string]*command
 	dbs     map[int]*database
 	started time.Time
+	ready   chan struct{} // closed when the server accepts connections
 
 	clients  map[*client]bool // connected clients
 	monitors map[*client]bool // clients monitoring
 
+	nextClientID  int            // the id of the last connected client
+	exportState   *exportState   // the last EXPORT, nil when there was none
+	keyStatsState *keyStatsState // the last KEYSTATS, nil when there was none
+	bigKeysState  *bigKeysState  // the last BIGKEYS, nil when there was none
+	jobsMu        sync.Mutex     // guards the three states above
+	scans         scanCursors    // the SCAN iterations in progress
+	blocked       blockedClients // the clients blocked by BLPOP and BRPOP
+
 	follower   bool
 	mode       string
 	executable string
+	logfile    *logFile // the log file, when the logfile directive is set
 
 	expiresdone bool // flag for when the expires loop ends
 
-	aof        *os.File // the aof file handle
-	aofdbnum   int      // the db num of the last "select" written to the aof
-	aofclosed  bool     // flag for when the aof file is closed
-	aofrewrite bool     // flag for when the aof is in the process of being rewritten
-	aofPath    string   // the full absolute path to the aof file
+	defragdone      bool   // flag for when the defrag loop ends
+	defragRunning   bool   // a database is being rebuilt
+	defragHits      int    // number of keys copied by the defrag loop
+	defragReclaimed uint64 // heap bytes returned by completed rebuilds
+
+	aof         *os.File     // the aof file handle
+	aofbuf      bytes.Buffer // commands waiting to be written to the aof
+	aofdbnum    int          // the db num of the last "select" written to the aof
+	aofclosed   bool         // flag for when the aof file is closed
+	aofrewrite  bool         // flag for when the aof is in the process of being rewritten
+	aofPath     string       // the full absolute path to the aof file
+	aofActive   string       // the file that's appended to, see aofrotate.go
+	aofSegments []string     // the finished files that are loaded ahead of it
+
+	aofOffset   int64         // bytes appended to the aof since the server started
+	aofSynced   int64         // the aofOffset that's known to be on disk
+	aofSyncWait chan struct{} // closed and replaced after every sync
+	aofSyncNow  chan struct{} // asks for a sync ahead of the next second
+
+	aofSize         int64 // the size of the aof file
+	aofBaseSize     int64 // the size of the aof file after the last rewrite
+	aofDelayedSyncs int   // number of syncs that took longer than aofDelayedSync
+
+	loadingStart  int64        // when the aof started loading, unix nanoseconds, atomic
+	loadingTotal  int64        // the size of the aof being loaded, atomic
+	loadingLoaded int64        // bytes of the aof that are loaded, atomic
+	loadingPhase  atomic.Value // "seed" or "aof", the file that's loading
+
+	dirty int // the changes since the last successful rewrite of the aof
+
+	aofTruncated  int   // number of incomplete bytes at the end of the loaded aof
+	aofRewriteErr error // the error of the last rewrite, nil when it succeeded
+	loading       int32 // the loads in progress, atomic
+
+	aofLoadSkipped int // unknown commands skipped by aof-load-mode tolerant
+
+	auth      atomic.Value // *authConfig, read by fast commands without the lock
+	compat    atomic.Value // the compat-redis-version, read by HELLO without the lock
+	nmonitors int32        // number of clients monitoring, atomic
+
+	sendTimeout      int64  // the send-timeout in milliseconds, atomic
+	historyLen       int64  // the client-history-len, atomic
+	sendTimeouts     uint64 // number of clients disconnected by the send-timeout, atomic
+	expiredKeys      uint64 // number of keys deleted because they expired, atomic
+	evictedKeys      uint64 // number of keys evicted by maxmemory, atomic
+	tombstoneRejects uint64 // number of writes refused by a tombstone, atomic
+
+	ipConns           ipConns // open connections per source ip
+	handshakeTimeout  int64   // the handshake-timeout in milliseconds, atomic
+	maxClientsPerIP   int64   // the maxclients-per-ip, atomic
+	handshakeTimeouts uint64  // number of clients disconnected by the handshake-timeout, atomic
+	ipRejectedConns   uint64  // number of clients refused by maxclients-per-ip, atomic
+
+	evictPool   evictionPool // the best candidates for the lru policies
+	evictFreed  int          // estimated bytes evicted since the last GC
+	evictGCs    uint64       // the GC count when evictFreed was reset
+	evictAllocs uint64       // the bytes allocated when evictFreed was reset
+
+	acllog        aclLog // recent authentication failures
+	authFailures  uint64 // number of failed AUTH commands, atomic
+	rejectedConns uint64 // number of clients denied by protected mode, atomic
+
+	audit *auditLog // the audit log writer
+
+	loads            loadGroup         // KeyLoader calls in progress
+	readThroughLoads uint64            // number of KeyLoader calls, atomic
+	writeBehind      *writeBehindQueue // writes waiting for the WriteBehind option
+
+	lockHolder     lockHolder     // the command that holds the write lock
+	watchdogPeriod int64          // the watchdog-period in milliseconds, atomic
+	watchdogTrips  uint64         // number of commands reported by the watchdog, atomic
+	latency        latencyMonitor // the LATENCY events
+
+	hotKeys hotKeys // the keys that get the most commands
+
+	clientsMem       int64      // memory of the connection buffers of all clients, atomic
+	maxMemoryClients int64      // the maxmemory-clients in bytes, atomic
+	evictedClients   uint64     // number of clients evicted by maxmemory-clients, atomic
+	clientsEvicting  sync.Mutex // held by the connection that evicts clients
 
 	ferr     error      // a fatal error. setting this should happen in the fatalError function
 	ferrcond *sync.Cond // synchronize the watch
 	ferrdone bool       // flag for when the fatal error watch is complete
 
+	workers  workers       // the background routines, see workers.go
+	serving  int32         // ListenAndServe was called, atomic
+	closed   chan struct{} // closed when ListenAndServe returns
+	closeErr error         // the error of ListenAndServe, read after closed
+}
+
+// Loading returns true while the server is loading the aof.
+func (s *Server) Loading() bool {
+	return atomic.LoadInt32(&s.loading) > 0
+}
+
+// maxKeysReached returns true when the command would create keys beyond the
+// maxkeys limit. Commands that only overwrite or delete keys are allowed.
+func (s *Server) maxKeysReached(c *client, cmd *command) bool {
+	if !cmd.grow || s.cfg.maxKeys == 0 {
+		return false
+	}
+	var total int
+	for _, db := range s.dbs {
+		total += db.len()
+	}
+	keys := cmd.keys(c.args)
+	if total+len(keys) <= s.cfg.maxKeys {
+		return false
+	}
+	newKeys := make(map[string]bool)
+	for _, key := range keys {
+		if _, ok := c.db.get(key); !ok {
+			newKeys[key] = true
+		}
+	}
+	return total+len(newKeys) > s.cfg.maxKeys
+}
+
+// writesStopped returns true when the last rewrite of the aof failed and the
+// command modifies the data set. DEL is allowed because it frees memory.
+// This must be called while holding the server lock.
+func (s *Server) writesStopped(cmd *command) bool {
+	return cmd.aof && cmd.name != "del" && s.cfg.stopWrites && s.aofRewriteErr != nil
 }
 
 // register is called from the commandTable() function. The command map will contains
 // two entries assigned to the same command. One with an all uppercase key and one with
-// an all lower case key.
-func (s *Server) register(commandName string, f func(c *client), opts string) {
+// an all lower case key. The firstKey, lastKey, and keyStep describe which arguments
+// are keys.
+func (s *Server) register(commandName string, f func(c *client), opts string,
+	firstKey, lastKey, keyStep int) {
 	var cmd command
 	cmd.name = commandName
 	cmd.funct = f
+	cmd.firstKey = firstKey
+	cmd.lastKey = lastKey
+	cmd.keyStep = keyStep
 	for _, c := range []byte(opts) {
 		switch c {
 		case '+':
@@ -161,8 +407,25 @@ func (s *Server) register(commandName string, f func(c *client), opts string) {
 			cmd.read = true
 		case 'w':
 			cmd.write = true
+		case 'm':
+			cmd.grow = true
+		case 'l':
+			cmd.loading = true
+		case 'f':
+			cmd.fast = true
+		case 'k':
+			cmd.ttl = ttlKeep
+		case 'c':
+			cmd.ttl = ttlClear
+		case 't':
+			cmd.ttl = ttlMove
+		case 'n':
+			cmd.notouch = true
 		}
 	}
+	if cmd.fast && (cmd.read || cmd.write || cmd.aof || cmd.grow) {
+		panic("fast command '" + commandName + "' must not access the keyspace")
+	}
 	s.cmds[strings.ToLower(commandName)] = &cmd
 	s.cmds[strings.ToUpper(commandName)] = &cmd
 }
@@ -215,22 +478,83 @@ func (s *Server) getFatalError() error {
 	return s.ferr
 }
 
-// startExpireLoop runs a background routine which watches for exipred keys
-// and forces their removal from the database. One second resolution.
+const (
+	activeExpireInterval = time.Millisecond * 100 // time between cycles
+	activeExpireSamples  = 20                     // keys checked per round
+	activeExpireBudget   = time.Millisecond * 25  // time per cycle
+)
+
+// startExpireLoop runs a background routine which deletes the expired keys
+// that are never accessed again. See activeExpireCycle.
 func (s *Server) startExpireLoop() {
-	go func() {
-		t := time.NewTicker(time.Second)
+	s.workers.start(workerExpire, func(ctx context.Context) {
+		t := time.NewTicker(activeExpireInterval)
 		defer t.Stop()
-		for range t.C {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			if !s.activeExpireCycle() {
+				return
+			}
+		}
+	})
+}
+
+// activeExpireCycle samples the keys that have an expiration time in each
+// database and deletes the expired ones, like the activeExpireCycle of
+// Redis. A database is sampled again while more than a quarter of the sample
+// was expired, until the time budget of the cycle is used. The lock is taken
+// for each round rather than for the whole cycle, so that clients are not
+// stalled. Returns false once the loop is stopped.
+func (s *Server) activeExpireCycle() bool {
+	start := time.Now()
+	s.mu.RLock()
+	if s.expiresdone {
+		s.mu.RUnlock()
+		return false
+	}
+	if s.follower {
+		s.mu.RUnlock()
+		return true
+	}
+	nums := make([]int, 0, len(s.dbs))
+	for num := range s.dbs {
+		nums = append(nums, num)
+	}
+	s.mu.RUnlock()
+	for _, num := range nums {
+		for {
 			s.mu.Lock()
 			if s.expiresdone {
 				s.mu.Unlock()
-				return
+				return false
+			}
+			now := time.Now()
+			sampled, expired := s.dbs[num].expireSample(activeExpireSamples, now)
+			if len(s.dbs[num].tombstones) > 0 {
+				tsampled, texpired := s.dbs[num].expireTombstones(activeExpireSamples,
+					tombstoneCutoff(now, s.tombstoneRetention()))
+				sampled += tsampled
+				expired += texpired
+			}
+			if expired > 0 {
+				if err := s.flushAOF(); err != nil {
+					s.fatalError(err)
+				}
 			}
-			s.forceDeleteExpires()
 			s.mu.Unlock()
+			if expired*4 <= sampled {
+				break
+			}
+			if time.Since(start) > activeExpireBudget {
+				return true
+			}
 		}
-	}()
+	}
+	return true
 }
 
 func (s *Server) forceDeleteExpires() {
@@ -239,7 +563,7 @@ func (s *Server) forceDeleteExpires() {
 	}
 	deleted := false
 	for _, db := range s.dbs {
-		if db.deleteExpires() {
+		if len(db.deleteExpires()) > 0 {
 			deleted = true
 		}
 	}
@@ -251,17 +575,28 @@ func (s *Server) forceDeleteExpires() {
 	}
 }
 
+// expired is called once for every key that is deleted because it expired.
+// The delete is appended to the aof as a DEL, ahead of the command that
+// noticed the key, if any.
+func (s *Server) expired(db *database, key string) {
+	atomic.AddUint64(&s.expiredKeys, 1)
+	if !s.follower {
+		s.appendAOF(db.num, buildCommand("DEL", key))
+	}
+}
+
 // stopExpireLoop will force delete all expires and stop the background routine
 func (s *Server) stopExpireLoop() {
 	s.mu.Lock()
 	s.forceDeleteExpires()
 	s.expiresdone = true
 	s.mu.Unlock()
+	s.stopWorkers(workerExpire)
 }
 
 // startFatalErrorWatch
 func (s *Server) startFatalErrorWatch() {
-	go func() {
+	s.workers.start(workerSignals, func(ctx context.Context) {
 		for {
 			s.ferrcond.L.Lock()
 			if s.ferrdone {
@@ -277,7 +612,7 @@ func (s *Server) startFatalErrorWatch() {
 			s.ferrcond.Wait()
 			s.ferrcond.L.Unlock()
 		}
-	}()
+	})
 }
 
 func (s *Server) stopFatalErrorWatch() {
@@ -291,12 +626,29 @@ func (s *Server) selectDB(num int) *database {
 	db, ok := s.dbs[num]
 	if !ok {
 		db = newDB(num)
+		db.onExpire = s.expired
 		s.dbs[num] = db
 	}
 	return db
 }
 
-func Start(options *Options) (err error) {
+// Start creates a new server and starts listening for connections. It
+// returns when the server is shut down.
+func Start(options *Options) error {
+	s, err := NewServer(options)
+	if err != nil {
+		return err
+	}
+	if s.options.SanityCheck {
+		_, err := s.SanityCheck()
+		return err
+	}
+	return s.ListenAndServe()
+}
+
+// NewServer returns a new server using the provided options. The server does
+// not accept connections until ListenAndServe is called.
+func NewServer(options *Options) (*Server, error) {
 	s := &Server{
 		cmds:     make(map[string]*command),
 		dbs:      make(map[int]*database),
@@ -305,9 +657,67 @@ func Start(options *Options) (err error) {
 		aofdbnum: -1,
 		ferrcond: sync.NewCond(&sync.Mutex{}),
 		started:  time.Now(),
+		ready:    make(chan struct{}),
+		closed:   make(chan struct{}),
 		mode:     "standalone",
 		follower: false,
 	}
+	options, configMap, configFile, ok := fillOptions(options)
+	s.options = options // this should be set even if there's an error.
+	if !ok {
+		return nil, errors.New("options failure")
+	}
+	var err error
+	s.cfg, err = fillConfig(configMap, configFile)
+	if err != nil {
+		//s.lwarningf("%v", err)
+		return nil, errors.New("config failure")
+	}
+	s.configChanged()
+	if s.cfg.logfile != "" {
+		s.logfile, err = openLogFile(s.cfg.logfile)
+		if err != nil {
+			log(s.options.LogWriter, '#', "Can't open the log file: %v", err)
+			return nil, errors.New("config failure")
+		}
+		s.options.LogWriter = s.logfile
+	}
+	_, warns := checkConfig(s.cfg, nil)
+	for _, warn := range warns {
+		s.lwarningf("Config warning: %s", warn)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		s.lwarningf("%v", err)
+		return nil, err
+	}
+	s.executable = path.Join(wd, os.Args[0])
+	s.aofPath = s.options.AppendOnlyPath
+	if !path.IsAbs(s.aofPath) {
+		dir := s.cfg.dir
+		if !path.IsAbs(dir) {
+			dir = path.Join(wd, dir)
+		}
+		s.aofPath = path.Join(dir, s.aofPath)
+	}
+	s.commandTable()
+	return s, nil
+}
+
+// ListenAndServe listens for and handles incoming connections. It returns
+// when the server is shut down, after its background routines have stopped.
+// A SIGHUP signal calls ReloadConfig.
+func (s *Server) ListenAndServe() (err error) {
+	if !atomic.CompareAndSwapInt32(&s.serving, 0, 1) {
+		return errors.New("the server was already started")
+	}
+	defer func() {
+		s.closeErr = err
+		close(s.closed)
+	}()
+	if s.logfile != nil {
+		defer s.logfile.Close()
+	}
 	var ready bool
 	defer func() {
 		if err == nil && s.ferr != nil {
@@ -321,97 +731,215 @@ func Start(options *Options) (err error) {
 			s.lwarningf("%s is now ready to exit, bye bye...", s.options.AppName)
 		}
 	}()
-	options, configMap, configFile, ok := fillOptions(options)
-	s.options = options // this should be set even if there's an error.
-	if !ok {
-		err = errors.New("options failure")
-		return
-	}
-	s.cfg, err = fillConfig(configMap, configFile)
-	if err != nil {
-		err = errors.New("config failure")
-		//s.lwarningf("%v", err)
-		return
-	}
 	s.lwarningf("Server started, %s version %s", s.options.AppName, s.options.Version)
-	s.commandTable()
 	ready = true
 
-	var wd string
-	wd, err = os.Getwd()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer s.stopWorkers(workerSignals)
+	s.workers.start(workerSignals, func(ctx context.Context) {
+		for {
+			select {
+			case <-sigs:
+				s.lnoticef("Received SIGHUP, reloading the config file")
+				s.ReloadConfig()
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+	defer signal.Stop(sigs)
+
+	s.startAuditLog()
+	defer s.stopAuditLog()
+	s.startWriteBehind()
+	defer s.stopWriteBehind()
+	// The connections are accepted while the data loads, and the commands
+	// that can't run while loading are refused with a LOADING error.
+	atomic.AddInt32(&s.loading, 1)
+	loaded := false
+	defer func() {
+		if !loaded {
+			atomic.AddInt32(&s.loading, -1)
+		}
+	}()
+	addr := s.cfg.kvm["bind"] + ":" + s.cfg.kvm["port"]
+	s.l, err = net.Listen("tcp", addr)
 	if err != nil {
 		s.lwarningf("%v", err)
 		return err
 	}
-	s.executable = path.Join(wd, os.Args[0])
-	s.aofPath = s.options.AppendOnlyPath
-	if !path.IsAbs(s.aofPath) {
-		s.aofPath = path.Join(wd, s.aofPath)
+	defer s.l.Close()
+	var ul net.Listener
+	if s.cfg.unixSocket != "" {
+		os.Remove(s.cfg.unixSocket)
+		ul, err = net.Listen("unix", s.cfg.unixSocket)
+		if err != nil {
+			s.lwarningf("%v", err)
+			return err
+		}
+		defer ul.Close()
+	}
+
+	// Start watching for fatal errors, which closes the listener.
+	s.startFatalErrorWatch()
+	defer s.stopFatalErrorWatch()
+	defer func() {
+		switch s.getFatalError() {
+		case errShutdownSave, errShutdownNoSave:
+			s.lwarningf("User requested shutdown...")
+		}
+	}()
+
+	var serveErr error
+	served := make(chan bool)
+	go func() {
+		serveErr = s.serve(s.l)
+		close(served)
+	}()
+	unixServed := make(chan bool)
+	go func() {
+		if ul != nil {
+			s.serve(ul)
+		}
+		close(unixServed)
+	}()
+	// stopServing closes the connections, waits for their commands, and stops
+	// the jobs that they started. It's deferred twice, so that the
+	// connections are closed before the aof when the server was started.
+	var stopOnce sync.Once
+	stopServing := func() {
+		stopOnce.Do(func() {
+			s.l.Close()
+			if ul != nil {
+				ul.Close()
+			}
+			<-served
+			<-unixServed
+			s.stopWorkers(workerClients)
+			s.stopWorkers(workerJobs)
+		})
+	}
+	defer stopServing()
+
+	loadStart := time.Now()
+	if err = s.loadSeed(); err != nil {
+		return s.loadFailed(err)
 	}
 	if err = s.openAOF(); err != nil {
-		s.lwarningf("%v", err)
-		return err
+		s.closeAOF()
+		return s.loadFailed(err)
 	}
+	load := time.Since(loadStart)
 	defer func() {
 		switch s.getFatalError() {
 		case errShutdownSave:
 			s.lnoticef("DB saved on disk")
 		}
 	}()
+	// the subsystems stop in the reverse order of these defers
 	defer s.closeAOF()
 	defer s.flushAOF()
+	startLRUClock()
 	s.startExpireLoop()
 	defer s.stopExpireLoop()
-	addr := s.cfg.kvm["bind"] + ":" + s.cfg.kvm["port"]
-	s.l, err = net.Listen("tcp", addr)
-	if err != nil {
-		s.lwarningf("%v", err)
-		return err
-	}
-	defer s.l.Close()
+	s.startDefragLoop()
+	defer s.stopDefragLoop()
+	s.startWatchdog()
+	defer s.stopWatchdog()
+	defer stopServing()
+	atomic.AddInt32(&s.loading, -1)
+	loaded = true
 
 	s.lnoticef("The server is now ready to accept connections on port %s", s.l.Addr().String()[strings.LastIndex(s.l.Addr().String(), ":")+1:])
+	if s.cfg.unixSocket != "" {
+		s.lnoticef("The server is now ready to accept connections at %s", s.cfg.unixSocket)
+	}
+	s.logStartup(load)
+	close(s.ready)
+	if err := sdNotify("READY=1"); err != nil {
+		s.lwarningf("Can't notify the service manager: %v", err)
+	}
+	defer sdNotify("STOPPING=1")
 
-	// Start watching for fatal errors.
-	s.startFatalErrorWatch()
-	defer s.stopFatalErrorWatch()
+	<-served
+	switch s.getFatalError() {
+	case errShutdownSave, errShutdownNoSave:
+		return nil
+	}
+	return serveErr
+}
 
-	conns := make(map[net.Conn]bool)
-	defer func() {
-		for conn := range conns {
-			conn.Close()
-			delete(conns, conn)
-		}
-	}()
-	defer func() {
-		switch s.getFatalError() {
-		case errShutdownSave, errShutdownNoSave:
-			s.lwarningf("User requested shutdown...")
-		}
-	}()
+// Close shuts the server down like SHUTDOWN, and waits for ListenAndServe to
+// return. The commands that are running finish, and their writes are in the
+// aof when Close returns. Returns the error of ListenAndServe, or nil when it
+// wasn't called.
+func (s *Server) Close() error {
+	s.fatalError(errShutdownSave)
+	if atomic.LoadInt32(&s.serving) == 0 {
+		return nil
+	}
+	<-s.closed
+	return s.closeErr
+}
 
+// loadFailed logs an error of the load, unless the load was stopped by a
+// SHUTDOWN.
+func (s *Server) loadFailed(err error) error {
+	switch err {
+	case errShutdownSave, errShutdownNoSave:
+	default:
+		s.lwarningf("%v", err)
+	}
+	return err
+}
+
+// serve handles the connections of a listener until it's closed, and then
+// closes them.
+func (s *Server) serve(l net.Listener) error {
+	conns := make(map[net.Conn]bool)
+	var err error
 	for {
-		conn, err := s.l.Accept()
+		var conn net.Conn
+		conn, err = l.Accept()
 		if err != nil {
-			ferr := s.getFatalError()
-			if ferr != errShutdownSave && ferr != errShutdownNoSave {
-				return err
-			} else {
-				return nil
-			}
+			break
 		}
 		conns[conn] = true
-		go handleConn(conn, s)
+		s.workers.start(workerClients, func(ctx context.Context) {
+			handleConn(conn, s)
+		})
+	}
+	for conn := range conns {
+		conn.Close()
+	}
+	s.cancelClients()
+	return err
+}
 
+// cancelClients cancels the context of the connected clients, which makes the
+// commands that wait give up, so that the connections can close.
+func (s *Server) cancelClients() {
+	s.mu.RLock()
+	for c := range s.clients {
+		c.cancel()
 	}
+	s.mu.RUnlock()
 }
 
-func (s *Server) broadcastMonitors(dbnum int, addr string, args []string) {
+func (s *Server) broadcastMonitors(dbnum int, addr, trace string, args []string) {
+	if atomic.LoadInt32(&s.nmonitors) == 0 {
+		return
+	}
 	s.mu.Lock()
 	t := float64(time.Now().UnixNano()) / float64(time.Second)
 	s.mu.Unlock()
 	w := &bytes.Buffer{}
-	fmt.Fprintf(w, "+%.6f [%d %s]", t, dbnum, addr)
+	if trace != "" {
+		fmt.Fprintf(w, "+%.6f [%d %s trace=%s]", t, dbnum, addr, trace)
+	} else {
+		fmt.Fprintf(w, "+%.6f [%d %s]", t, dbnum, addr)
+	}
 	for _, arg := range args {
 		w.WriteByte(' ')
 		w.WriteByte('"')
@@ -474,6 +1002,37 @@ func autocase(command string) string {
 	return command
 }
 
+// authConfig is a copy of the config that's needed to authenticate a client.
+type authConfig struct {
+	protected    bool
+	requirepass  string
+	aclLogMaxLen int
+}
+
+// configChanged updates the copies of the config that are read without the
+// server lock. This must be called while holding the server lock, or before
+// the server accepts connections.
+func (s *Server) configChanged() {
+	s.auth.Store(&authConfig{
+		protected:    s.protected(),
+		requirepass:  s.cfg.requirepass,
+		aclLogMaxLen: s.cfg.aclLogMaxLen,
+	})
+	atomic.StoreInt64(&s.sendTimeout, int64(s.cfg.sendTimeout))
+	atomic.StoreInt64(&s.historyLen, int64(s.cfg.clientHistoryLen))
+	atomic.StoreInt64(&s.handshakeTimeout, int64(s.cfg.handshakeTimeout))
+	atomic.StoreInt64(&s.maxClientsPerIP, int64(s.cfg.maxClientsPerIP))
+	atomic.StoreInt64(&s.watchdogPeriod, int64(s.cfg.watchdogPeriod))
+	atomic.StoreInt64(&s.maxMemoryClients, int64(s.cfg.maxMemoryClients))
+	s.hotKeys.configure(time.Duration(s.cfg.hotkeysWindow)*time.Second,
+		s.cfg.hotkeysWarnShare)
+	s.compat.Store(s.cfg.compatRedisVersion)
+}
+
+func (s *Server) authConfig() *authConfig {
+	return s.auth.Load().(*authConfig)
+}
+
 func (s *Server) protected() bool {
 	if !s.cfg.protectedMode {
 		return false
@@ -486,68 +1045,104 @@ func (s *Server) protected() bool {
 
 func handleConn(conn net.Conn, s *Server) {
 	defer conn.Close()
+	// the connection limits are checked without the server lock, so that a
+	// swarm of connections can't stall the other clients.
+	if _, ok := conn.(*net.UnixConn); !ok {
+		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if !s.ipConns.acquire(ip, int(atomic.LoadInt64(&s.maxClientsPerIP))) {
+			atomic.AddUint64(&s.ipRejectedConns, 1)
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			io.WriteString(conn, "-ERR max number of clients per ip reached\r\n")
+			return
+		}
+		defer s.ipConns.release(ip)
+	}
+	if timeout := atomic.LoadInt64(&s.handshakeTimeout); timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond))
+	}
 	rd := newCommandReader(conn)
-	wr := bufio.NewWriter(conn)
+	cw := &connWriter{s: s, conn: conn}
+	wr := bufio.NewWriter(cw)
 	defer wr.Flush()
-	c := &client{wr: wr, s: s}
-	c.addr = conn.RemoteAddr().String()
+	c := &client{wr: wr, s: s, cw: cw, rd: rd, bw: wr, created: time.Now()}
+	rd.read = c.updateMemory
+	// the context is for the commands and hooks that wait, such as WAITAOF
+	// and the KeyLoader. It's cancelled when the connection is closed.
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	defer c.cancel()
+	if _, ok := conn.(*net.UnixConn); ok {
+		c.unix = true
+		c.addr = s.cfg.unixSocket + ":0"
+	} else {
+		c.addr = conn.RemoteAddr().String()
+	}
 	defer c.flushAOF()
 	s.mu.Lock()
+	s.nextClientID++
+	c.id = s.nextClientID
 	s.clients[c] = true
 	c.db = s.selectDB(0)
 	s.mu.Unlock()
 	defer func() {
 		s.mu.Lock()
 		delete(s.clients, c)
-		delete(s.monitors, c)
+		if c.monitor {
+			delete(s.monitors, c)
+			atomic.AddInt32(&s.nmonitors, -1)
+		}
 		s.mu.Unlock()
+		c.releaseMemory()
+	}()
+	// deferred last so that it runs before the deferred functions above,
+	// which would wait on a lock that the panicking command may hold.
+	defer func() {
+		if r := recover(); r != nil {
+			s.logPanic(c, r)
+			s.crashAOF(c)
+			os.Exit(1)
+		}
 	}()
 	var flush bool
+	var handshaken bool // a command has been read
 	var err error
 	for {
-		dbnum := c.db.num
+		if cw.err != nil {
+			// don't run pipelined commands for a client that can't
+			// receive the replies.
+			return
+		}
 		c.errd = false
 		c.raw, c.args, flush, err = rd.readCommand()
 		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() && !handshaken {
+				atomic.AddUint64(&s.handshakeTimeouts, 1)
+				s.lverbosf("Client %s disconnected, handshake-timeout reached", c.addr)
+			}
 			if err, ok := err.(*protocolError); ok {
 				c.replyError(err.Error())
 			}
 			return
 		}
-		if len(c.args) == 0 {
-			continue
+		if !handshaken {
+			handshaken = true
+			conn.SetReadDeadline(time.Time{})
 		}
-		commandName := autocase(c.args[0])
-		if cmd, ok := s.cmds[commandName]; ok {
-			if c.authenticate(cmd) {
-				if cmd.write {
-					s.mu.Lock()
-				} else if cmd.read {
-					s.mu.RLock()
-				}
-				cmd.funct(c)
-				if c.dirty > 0 && cmd.aof {
-					c.db.aofbuf.Write(c.raw)
-				}
-
-				if cmd.write {
-					s.mu.Unlock()
-				} else if cmd.read {
-					s.mu.RUnlock()
-				}
-				if !c.errd && cmd.name != "monitor" {
-					s.broadcastMonitors(dbnum, c.addr, c.args)
+		if len(c.args) > 0 {
+			commandName := autocase(c.args[0])
+			if cmd, ok := s.cmds[commandName]; ok {
+				s.exec(c, cmd)
+			} else {
+				switch commandName {
+				default:
+					c.replyError("unknown command '" + c.args[0] + "'")
+				case "quit":
+					c.replyString("OK")
+					return
 				}
 			}
-		} else {
-			switch commandName {
-			default:
-				c.replyError("unknown command '" + c.args[0] + "'")
-			case "quit":
-				c.replyString("OK")
-				return
-			}
 		}
+		// an empty line or array has no reply, but the replies to the
+		// commands before it may still be waiting for a flush.
 		if flush {
 			if err := c.flushAOF(); err != nil {
 				return
@@ -556,13 +1151,122 @@ func handleConn(conn net.Conn, s *Server) {
 				return
 			}
 		}
+		c.updateMemory()
+	}
+}
+
+// exec runs a command for the client. The command waits on the lock that its
+// flags ask for, and its changes are appended to the aof.
+func (s *Server) exec(c *client, cmd *command) {
+	c.err = nil
+	c.ctxErr = nil
+	c.replyType = 0
+	c.startTrace(cmd)
+	defer c.recordHistory(cmd, time.Now())
+	if !c.authenticate(cmd) || c.loadingRefused(cmd) {
+		return
+	}
+	dbnum := c.db.num
+	switch {
+	case cmd.fast:
+		// never waits on the lock
+	case cmd.write:
+		s.mu.Lock()
+		c.locked = true
+		s.lockAcquired(c, cmd)
+	case cmd.read:
+		s.mu.RLock()
+		c.locked = true
+	}
+	if err := c.context().Err(); err != nil {
+		// the lock can't be abandoned, but a command that was cancelled
+		// while waiting on it must not start.
+		c.ctxErr = err
+		c.locked = false
+		if cmd.write {
+			s.lockReleased()
+			s.mu.Unlock()
+		} else if cmd.read {
+			s.mu.RUnlock()
+		}
+		return
+	}
+	dirty := c.dirty
+	if s.maxKeysReached(c, cmd) {
+		c.replyError("max keys reached")
+	} else if s.writesStopped(cmd) {
+		c.replyUniqueError("MISCONF " + s.options.AppName + " is configured to " +
+			"save the append only file, but it's currently unable to persist " +
+			"to disk. Commands that may modify the data set are disabled, " +
+			"because this instance is configured to report errors during " +
+			"writes if saving fails (stop-writes-on-bgsave-error option). " +
+			"Please check the logs for details about the error.")
+	} else if cmd.write && !s.freeMemory() && cmd.grow {
+		c.replyErr(ErrOOM)
+	} else {
+		cmd.funct(c)
+	}
+	if !cmd.notouch && !c.notouch {
+		c.touchKeys(cmd)
+	}
+	if c.dirty > dirty && cmd.aof {
+		s.appendAOF(c.db.num, c.raw)
+		c.aofOffset = s.aofOffset
+		s.dirty += c.dirty - dirty
+		s.auditCommand(c, cmd, auditSourceClient)
+		s.queueWriteBehind(c, cmd)
+		if len(s.blocked.ready) > 0 {
+			s.serveBlocked()
+		}
+		if s.cfg.appendFsync == "always" && s.aof != nil && !s.Loading() {
+			// sync before the reply is flushed to the client
+			if err := s.syncAOF(); err != nil {
+				s.fatalError(err)
+			}
+		}
+	}
+
+	c.locked = false
+	if cmd.write {
+		s.lockReleased()
+		s.mu.Unlock()
+	} else if cmd.read {
+		s.mu.RUnlock()
+	}
+	s.recordHotKeys(c, cmd, dbnum)
+	if c.loadKey != "" {
+		s.loadKey(c, cmd)
+	}
+	if !c.errd && cmd.name != "monitor" {
+		s.broadcastMonitors(dbnum, c.addr, c.trace, c.args)
 	}
 }
 
 /* Commands */
+// parseFlushMode checks the ASYNC or SYNC option of FLUSHDB and FLUSHALL.
+// Both are the same here. A flush replaces the maps of the database, which
+// takes the same time for any number of keys, and the garbage collector frees
+// the old maps in the background. The option is not written to the aof, so
+// that an aof-compat-level older than the option can still load the flush.
+func parseFlushMode(c *client) bool {
+	switch {
+	case len(c.args) > 2:
+		c.replySyntaxError()
+		return false
+	case len(c.args) == 2:
+		switch strings.ToLower(c.args[1]) {
+		case "async", "sync":
+		default:
+			c.replySyntaxError()
+			return false
+		}
+		c.raw = buildCommand(c.args[0])
+	}
+	return true
+}
+
 func flushdbCommand(c *client) {
-	if len(c.args) != 1 {
-		c.replyAritryError()
+	if !parseFlushMode(c) {
 		return
 	}
 	c.db.flush()
@@ -571,8 +1275,7 @@ func flushdbCommand(c *client) {
 }
 
 func flushallCommand(c *client) {
-	if len(c.args) != 1 {
-		c.replyAritryError()
+	if !parseFlushMode(c) {
 		return
 	}
 	for _, db := range c.s.dbs {
@@ -595,6 +1298,10 @@ func bgrewriteaofCommand(c *client) {
 		c.replyAritryError()
 		return
 	}
+	if c.s.aof == nil {
+		c.replyError("The append only file is disabled")
+		return
+	}
 	if ok := c.s.rewriteAOF(); !ok {
 		c.replyError("Background append only file rewriting already in progress")
 		return
@@ -607,6 +1314,10 @@ func bgsaveCommand(c *client) {
 		c.replyAritryError()
 		return
 	}
+	if c.s.aof == nil {
+		c.replyError("The append only file is disabled")
+		return
+	}
 	if ok := c.s.rewriteAOF(); !ok {
 		c.replyError("Background save already in progress")
 		return
@@ -619,6 +1330,10 @@ func lastsaveCommand(c *client) {
 		c.replyAritryError()
 		return
 	}
+	if c.s.aof == nil {
+		c.replyInt(int(c.s.started.Unix()))
+		return
+	}
 	fi, err := c.s.aof.Stat()
 	if err != nil {
 		c.replyError("Could not get the UNIX timestamp")
@@ -627,11 +1342,26 @@ func lastsaveCommand(c *client) {
 	c.replyInt(int(fi.ModTime().Unix()))
 }
 
+func timeCommand(c *client) {
+	if len(c.args) != 1 {
+		c.replyAritryError()
+		return
+	}
+	now := time.Now()
+	c.replyMultiBulkLen(2)
+	c.replyBulk(strconv.FormatInt(now.Unix(), 10))
+	c.replyBulk(strconv.FormatInt(int64(now.Nanosecond()/1000), 10))
+}
+
 func saveCommand(c *client) {
 	if len(c.args) != 1 {
 		c.replyAritryError()
 		return
 	}
+	if c.s.aof == nil {
+		c.replyError("The append only file is disabled")
+		return
+	}
 	if !c.s.rewriteAOF() {
 		c.replyError("Background save already in progress")
 		return
@@ -648,9 +1378,94 @@ func saveCommand(c *client) {
 		}
 	}
 	c.s.mu.Lock()
+	if c.s.aofRewriteErr != nil {
+		c.replyError("Background save failed, see the logs for details")
+		return
+	}
 	c.replyString("OK")
 }
 
+// waitaofCommand is WAITAOF numlocal numreplicas timeout. It blocks until the
+// previous writes of the client are synced to the aof, or until the timeout in
+// milliseconds, zero is forever. The reply is the number of local aofs and the
+// number of replicas that have the writes. There are no replicas, so a
+// numreplicas over zero always waits for the timeout. The wait is abandoned
+// without a reply when the context of the client is cancelled.
+func waitaofCommand(c *client) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	numlocal, err1 := strconv.Atoi(c.args[1])
+	numreplicas, err2 := strconv.Atoi(c.args[2])
+	timeout, err3 := strconv.Atoi(c.args[3])
+	if err1 != nil || err2 != nil || err3 != nil || numlocal < 0 || numreplicas < 0 {
+		c.replyInvalidIntError()
+		return
+	}
+	if timeout < 0 {
+		c.replyError("timeout is negative")
+		return
+	}
+	if c.s.follower {
+		c.replyError("WAITAOF cannot be used with replica instances. Please " +
+			"also note that writes to replicas are just local and are not " +
+			"propagated.")
+		return
+	}
+	if numlocal > 0 && c.s.aof == nil {
+		c.replyError("WAITAOF cannot be used when numlocal is set but " +
+			"appendonly is disabled.")
+		return
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+		defer t.Stop()
+		expired = t.C
+	}
+	synced := func() bool {
+		return c.s.aof != nil && c.s.aofSynced >= c.aofOffset
+	}
+wait:
+	for (numlocal > 0 && !synced()) || numreplicas > 0 {
+		if c.s.aofclosed {
+			break
+		}
+		var done chan struct{}
+		if c.s.aof != nil {
+			done = c.s.aofSyncWait
+			if !synced() {
+				// the waiting clients share the next sync
+				select {
+				case c.s.aofSyncNow <- struct{}{}:
+				default:
+				}
+			}
+		}
+		c.s.lockReleased()
+		c.s.mu.Unlock()
+		select {
+		case <-done:
+			c.s.mu.Lock()
+		case <-expired:
+			c.s.mu.Lock()
+			break wait
+		case <-c.context().Done():
+			c.s.mu.Lock()
+			if c.context().Err() == context.DeadlineExceeded {
+				// a deadline is the same as the timeout
+				break wait
+			}
+			c.ctxErr = c.context().Err()
+			return
+		}
+	}
+	c.replyMultiBulkLen(2)
+	c.replyInt(btoi(synced()))
+	c.replyInt(0)
+}
+
 func shutdownCommand(c *client) {
 	if len(c.args) != 1 && len(c.args) != 2 {
 		c.replyAritryError()
@@ -686,6 +1501,7 @@ func monitorCommand(c *client) {
 	}
 	c.monitor = true
 	c.s.monitors[c] = true
+	atomic.AddInt32(&c.s.nmonitors, 1)
 	c.replyString("OK")
 }
 
@@ -712,41 +1528,27 @@ func configGetCommand(c *client) {
 		c.replyError("Wrong number of arguments for CONFIG " + c.args[1])
 		return
 	}
-	switch c.args[2] {
-	default:
+	prop := findConfigProperty(c.args[2])
+	if prop == nil {
 		c.replyMultiBulkLen(0)
 		return
-	case "port", "bind", "protected-mode", "requirepass":
 	}
 	c.replyMultiBulkLen(2)
-	c.replyBulk(c.args[2])
-	c.replyBulk(c.s.cfg.kvm[c.args[2]])
+	c.replyBulk(prop.name)
+	c.replyBulk(c.s.cfg.kvm[prop.name])
 
 }
+
+// configSetCommand is CONFIG SET parameter value [parameter value ...]. The
+// parameters are set together, or not at all.
 func configSetCommand(c *client) {
-	if len(c.args) != 4 {
+	if len(c.args) < 4 || len(c.args)%2 != 0 {
 		c.replyError("Wrong number of arguments for CONFIG " + c.args[1])
 		return
 	}
-	switch strings.ToLower(c.args[2]) {
-	default:
-		c.replyError("Unsupported CONFIG parameter: " + c.args[2])
+	if err := c.s.setConfig(c.args[2:]...); err != nil {
+		c.replyError(err.Error())
 		return
-	case "requirepass":
-		c.s.cfg.kvm["requirepass"] = c.args[3]
-		c.s.cfg.requirepass = c.args[3]
-	case "protected-mode":
-		switch strings.ToLower(c.args[3]) {
-		default:
-			c.replyError("Invalid argument '" + c.args[3] + "' for CONFIG SET '" + c.args[2] + "'")
-			return
-		case "yes":
-			c.s.cfg.kvm["protected-mode"] = "yes"
-			c.s.cfg.protectedMode = true
-		case "no":
-			c.s.cfg.kvm["protected-mode"] = "no"
-			c.s.cfg.protectedMode = false
-		}
 	}
 	c.replyString("OK")
 }
@@ -774,10 +1576,97 @@ func authCommand(c *client) {
 		c.replyAritryError()
 		return
 	}
-	if c.s.cfg.requirepass != c.args[1] {
+	if c.s.authConfig().requirepass != c.args[1] {
+		c.authFailed()
 		c.replyError("invalid password")
 		return
 	}
 	c.authd = 2
 	c.replyString("OK")
 }
+
+// helloCommand is HELLO [protover [AUTH username password] [SETNAME name]].
+// It switches the protocol and replies with the details of the server. The
+// version is the compat-redis-version, which client libraries check for the
+// commands that they can use.
+func helloCommand(c *client) {
+	resp := 2
+	if c.resp == 3 {
+		resp = 3
+	}
+	if len(c.args) > 1 {
+		n, err := strconv.Atoi(c.args[1])
+		if err != nil {
+			c.replyError("Protocol version is not an integer or out of range")
+			return
+		}
+		if n != 2 && n != 3 {
+			c.replyUniqueError("NOPROTO unsupported protocol version")
+			return
+		}
+		resp = n
+	}
+	var user, pass, name string
+	var auth, setname bool
+	for i := 2; i < len(c.args); i++ {
+		switch strings.ToLower(c.args[i]) {
+		case "auth":
+			if i+2 >= len(c.args) {
+				c.replyError("Syntax error in HELLO option '" + c.args[i] + "'")
+				return
+			}
+			user, pass, auth = c.args[i+1], c.args[i+2], true
+			i += 2
+		case "setname":
+			if i+1 >= len(c.args) {
+				c.replyError("Syntax error in HELLO option '" + c.args[i] + "'")
+				return
+			}
+			name, setname = c.args[i+1], true
+			i++
+		default:
+			c.replyError("Syntax error in HELLO option '" + c.args[i] + "'")
+			return
+		}
+	}
+	requirepass := c.s.authConfig().requirepass
+	if auth {
+		if user != "default" || (requirepass != "" && requirepass != pass) {
+			c.authFailed()
+			c.replyUniqueError("WRONGPASS invalid username-password pair or user is disabled.")
+			return
+		}
+		c.authd = 2
+	} else if c.authd != 2 && requirepass != "" {
+		c.replyUniqueError("NOAUTH HELLO must be called with the client already " +
+			"authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option " +
+			"can be used to authenticate the client and select the RESP protocol " +
+			"version at the same time")
+		return
+	}
+	if setname {
+		if strings.IndexFunc(name, func(r rune) bool { return r <= ' ' || r > '~' }) != -1 {
+			c.replyError("Client names cannot contain spaces, newlines or special characters.")
+			return
+		}
+		c.name = name
+	}
+	c.resp = resp
+	c.replyMapLen(8)
+	c.replyBulk("server")
+	c.replyBulk("redis")
+	c.replyBulk("version")
+	c.replyBulk(c.s.compat.Load().(string))
+	c.replyBulk("sider_version")
+	c.replyBulk(c.s.options.Version)
+	c.replyBulk("proto")
+	c.replyInt(resp)
+	c.replyBulk("id")
+	c.replyInt(c.id)
+	c.replyBulk("mode")
+	c.replyBulk("standalone")
+	c.replyBulk("role")
+	c.replyBulk("master")
+	c.replyBulk("modules")
+	c.replyMultiBulkLen(0)
+}
@@ -0,0 +1,1142 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testStartServer starts a server on a random port using the provided aof
+// path. The returned stop function shuts down the server and waits for it
+// to exit.
+func testStartServer(t testing.TB, aofPath string, args ...string) (addr string, stop func()) {
+	s, addr := testNewServer(t, aofPath, args...)
+	return addr, testServe(t, s, addr)
+}
+
+// testNewServer creates a server for a random port.
+func testNewServer(t testing.TB, aofPath string, args ...string) (*Server, string) {
+	return testNewServerOptions(t, &Options{AppendOnlyPath: aofPath}, args...)
+}
+
+func testNewServerOptions(t testing.TB, opts *Options, args ...string) (*Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	port := addr[strings.LastIndex(addr, ":")+1:]
+	opts.LogWriter = ioutil.Discard
+	opts.Args = append(args, "--port", port)
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, addr
+}
+
+// testServe runs the server in the background and waits for it to accept
+// connections and load the aof.
+func testServe(t testing.TB, s *Server, addr string) (stop func()) {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ListenAndServe()
+	}()
+	start := time.Now()
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("server failed to start: %v", err)
+		default:
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("timeout waiting for server to start")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	// the connections are accepted while the aof loads
+	select {
+	case <-s.Ready():
+	case err := <-done:
+		t.Fatalf("server failed to start: %v", err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the server to load")
+	}
+	return func() {
+		conn := testDial(t, addr)
+		conn.send("SHUTDOWN")
+		io.Copy(ioutil.Discard, conn.rd)
+		conn.conn.Close()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type testConn struct {
+	t    testing.TB
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func testDial(t testing.TB, addr string) *testConn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testConn{t: t, conn: conn, rd: bufio.NewReader(conn)}
+}
+
+func (c *testConn) close() {
+	c.conn.Close()
+}
+
+func (c *testConn) send(args ...string) {
+	if _, err := c.conn.Write(encodeMultiBulk(args)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// do sends a command and returns the reply. Simple strings and bulks are
+// returned as strings, integers as ints, arrays as []interface{}, nulls as
+// nil, and error replies as errors.
+func (c *testConn) do(args ...string) interface{} {
+	c.send(args...)
+	v, err := c.read()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return v
+}
+
+func (c *testConn) read() (interface{}, error) {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid reply line %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return errors.New(line[1:]), nil
+	case ':':
+		return strconv.Atoi(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		arr := make([]interface{}, n)
+		for i := 0; i < n; i++ {
+			if arr[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("invalid reply line %q", line)
+}
+
+// testDumpDatasets returns a sorted, human readable dump of every key in
+// databases 0 through numdbs-1.
+func testDumpDatasets(t testing.TB, addr string, numdbs int) string {
+	conn := testDial(t, addr)
+	defer conn.close()
+	var lines []string
+	for num := 0; num < numdbs; num++ {
+		conn.do("SELECT", strconv.Itoa(num))
+		keys, _ := conn.do("KEYS", "*").([]interface{})
+		for _, key := range keys {
+			key := key.(string)
+			typ := conn.do("TYPE", key).(string)
+			var value string
+			switch typ {
+			case "string":
+				value = fmt.Sprint(conn.do("GET", key))
+			case "list":
+				value = fmt.Sprint(conn.do("LRANGE", key, "0", "-1"))
+			case "set":
+				var members []string
+				for _, member := range conn.do("SMEMBERS", key).([]interface{}) {
+					members = append(members, member.(string))
+				}
+				sort.Strings(members)
+				value = fmt.Sprint(members)
+			}
+			ttl := conn.do("TTL", key).(int) >= 0
+			lines = append(lines, fmt.Sprintf("db%d %s %s %s ttl=%v",
+				num, key, typ, value, ttl))
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// testRandomWorkload runs a random set of write commands that mostly target
+// the database dbnum, but will occasionally switch databases.
+func testRandomWorkload(t testing.TB, addr string, dbnum, numdbs, count int, rng *rand.Rand) {
+	conn := testDial(t, addr)
+	defer conn.close()
+	conn.do("SELECT", strconv.Itoa(dbnum))
+	key := func() string { return "key:" + strconv.Itoa(rng.Intn(20)) }
+	db := func() string { return strconv.Itoa(rng.Intn(numdbs)) }
+	for i := 0; i < count; i++ {
+		switch rng.Intn(16) {
+		case 0, 1, 2:
+			conn.do("SET", key(), strconv.Itoa(rng.Int()))
+		case 3:
+			conn.do("DEL", key())
+		case 4:
+			conn.do("INCR", key())
+		case 5, 6:
+			conn.do("RPUSH", key(), strconv.Itoa(rng.Intn(100)))
+		case 7:
+			conn.do("LPOP", key())
+		case 8, 9:
+			conn.do("SADD", key(), strconv.Itoa(rng.Intn(100)))
+		case 10:
+			conn.do("SREM", key(), strconv.Itoa(rng.Intn(100)))
+		case 11:
+			conn.do("RENAME", key(), key())
+		case 12:
+			conn.do("EXPIRE", key(), "100000")
+		case 13:
+			conn.do("MOVE", key(), db())
+		case 14:
+			conn.do("SELECT", db())
+		case 15:
+			if rng.Intn(50) == 0 {
+				conn.do("FLUSHDB")
+			} else {
+				conn.do("SELECT", strconv.Itoa(dbnum))
+			}
+		}
+	}
+}
+
+func testWaitForRewrite(t testing.TB, dir string) {
+	start := time.Now()
+	for {
+		matches, _ := filepath.Glob(filepath.Join(dir, "temp-rewrite-*.aof"))
+		if len(matches) == 0 {
+			return
+		}
+		if time.Since(start) > time.Second*10 {
+			t.Fatal("timeout waiting for aof rewrite")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestMultiDatabaseAOF(t *testing.T) {
+	const numdbs = 4
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	seed := time.Now().UnixNano()
+	t.Logf("seed: %d", seed)
+
+	workload := func(addr string, n int, rewrite bool) {
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			rng := rand.New(rand.NewSource(seed + int64(i)))
+			seed += 2
+			wg.Add(1)
+			go func(dbnum int) {
+				defer wg.Done()
+				testRandomWorkload(t, addr, dbnum, numdbs, n, rng)
+			}(i + 1)
+		}
+		if rewrite {
+			time.Sleep(time.Millisecond * 10)
+			conn := testDial(t, addr)
+			conn.do("BGREWRITEAOF")
+			conn.close()
+		}
+		wg.Wait()
+		testWaitForRewrite(t, dir)
+	}
+
+	// live dataset vs reloaded from the appended aof
+	addr, stop := testStartServer(t, aofPath)
+	workload(addr, 2000, false)
+	live := testDumpDatasets(t, addr, numdbs)
+	stop()
+	addr, stop = testStartServer(t, aofPath)
+	if reloaded := testDumpDatasets(t, addr, numdbs); reloaded != live {
+		t.Fatalf("reloaded dataset does not match\nexpected:\n%s\ngot:\n%s",
+			live, reloaded)
+	}
+
+	// live dataset vs reloaded from an aof rewritten during the workload
+	workload(addr, 2000, true)
+	live = testDumpDatasets(t, addr, numdbs)
+	stop()
+	addr, stop = testStartServer(t, aofPath)
+	defer stop()
+	if reloaded := testDumpDatasets(t, addr, numdbs); reloaded != live {
+		t.Fatalf("rewritten dataset does not match\nexpected:\n%s\ngot:\n%s",
+			live, reloaded)
+	}
+}
+
+func TestLoadingAOF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+
+	addr, stop := testStartServer(t, aofPath)
+	conn := testDial(t, addr)
+	conn.do("SET", "key1", "value")
+	conn.do("SET", "key2", "value", "EX", "100")
+	conn.do("EXPIRE", "key1", "100")
+	conn.do("EXPIREAT", "key1", "1") // deleted and written as a DEL
+	conn.do("SELECT", "1")
+	conn.do("RPUSH", "list", "a", "b")
+	conn.do("SADD", "set", "a")
+	conn.close()
+	stop()
+	fi, err := os.Stat(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := fi.Size()
+
+	// restarting must not append the replayed commands
+	for i := 0; i < 3; i++ {
+		s, addr := testNewServer(t, aofPath)
+		stop := testServe(t, s, addr)
+		if s.Loading() {
+			t.Fatal("expected the server to be done loading")
+		}
+		conn := testDial(t, addr)
+		if n := conn.do("EXISTS", "key1", "key2"); n != 1 {
+			t.Fatalf("expected 1, got %v", n)
+		}
+
+		// commands that can't run while loading
+		atomic.StoreInt32(&s.loading, 1)
+		if err, ok := conn.do("GET", "key2").(error); !ok ||
+			!strings.HasPrefix(err.Error(), "LOADING ") {
+			t.Fatalf("expected a loading error, got %v", err)
+		}
+		if v := conn.do("PING"); v != "PONG" {
+			t.Fatalf("expected PONG, got %v", v)
+		}
+		atomic.StoreInt32(&s.loading, 0)
+		conn.close()
+		stop()
+
+		fi, err := os.Stat(aofPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != size {
+			t.Fatalf("restart %d: expected aof size %d, got %d", i+1, size, fi.Size())
+		}
+	}
+}
+
+func TestAcceptWhileLoading(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	const n = 500000
+	cmds := make([][]string, n)
+	for i := range cmds {
+		cmds[i] = []string{"SET", "key:" + itoa(i), itoa(i)}
+	}
+	testWriteAOF(t, aofPath, cmds...)
+
+	// start returns a connection that was accepted while the aof loads
+	start := func() (*Server, *testConn, chan error) {
+		s, addr := testNewServer(t, aofPath)
+		done := make(chan error, 1)
+		go func() {
+			done <- s.ListenAndServe()
+		}()
+		for {
+			if conn, err := net.Dial("tcp", addr); err == nil {
+				conn.Close()
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return s, testDial(t, addr), done
+	}
+
+	s, conn, done := start()
+	// the connection takes the lock once, before the load is paused by
+	// holding the lock
+	conn.do("PING")
+	s.mu.Lock()
+	if !s.Loading() || atomic.LoadInt64(&s.loadingLoaded) == 0 {
+		s.mu.Unlock()
+		t.Fatal("expected the aof to be loading")
+	}
+	for _, args := range [][]string{{"GET", "key:1"}, {"SET", "x", "1"}, {"DBSIZE"}} {
+		if err, ok := conn.do(args...).(error); !ok ||
+			!strings.HasPrefix(err.Error(), "LOADING ") {
+			s.mu.Unlock()
+			t.Fatalf("%v: expected a loading error, got %v", args, err)
+		}
+	}
+	pong := conn.do("PING")
+	hello := conn.do("HELLO")
+	auth := conn.do("AUTH", "pass")
+	s.mu.Unlock()
+	if pong != "PONG" {
+		t.Fatalf("expected PONG, got %v", pong)
+	}
+	if _, ok := hello.([]interface{}); !ok {
+		t.Fatalf("expected the HELLO reply, got %v", hello)
+	}
+	if err, ok := auth.(error); !ok || strings.HasPrefix(err.Error(), "LOADING ") {
+		t.Fatalf("expected the AUTH error, got %v", auth)
+	}
+	// INFO runs between the batches of the load
+	info := conn.do("INFO", "persistence").(string)
+	if !strings.Contains(info, "loading:1") ||
+		!strings.Contains(info, "loading_phase:aof") {
+		t.Fatalf("expected the loading stats, got %q", info)
+	}
+	select {
+	case <-s.Ready():
+	case err := <-done:
+		t.Fatalf("server failed to start: %v", err)
+	case <-time.After(time.Second * 30):
+		t.Fatal("timeout waiting for the server to load")
+	}
+	if v := conn.do("GET", "key:"+itoa(n-1)); v != itoa(n-1) {
+		t.Fatalf("expected '%d', got '%v'", n-1, v)
+	}
+	if v := conn.do("DBSIZE"); v != n {
+		t.Fatalf("expected %d keys, got %v", n, v)
+	}
+	conn.send("SHUTDOWN")
+	io.Copy(ioutil.Discard, conn.rd)
+	conn.close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// a SHUTDOWN stops the load
+	s, conn, done = start()
+	conn.send("SHUTDOWN", "NOSAVE")
+	io.Copy(ioutil.Discard, conn.rd)
+	conn.close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 30):
+		t.Fatal("timeout waiting for the server to shut down")
+	}
+	select {
+	case <-s.Ready():
+		t.Fatal("expected the server to shut down before it loaded")
+	default:
+	}
+}
+
+func TestFastCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"))
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+	conn.do("CONFIG", "SET", "requirepass", "pass")
+	conn.do("AUTH", "pass")
+	defer conn.do("CONFIG", "SET", "requirepass", "")
+
+	// connecting takes the lock, so the probe connects first
+	probe := testDial(t, addr)
+	defer probe.close()
+
+	// hold the write lock
+	sleeper := testDial(t, addr)
+	defer sleeper.close()
+	sleeper.do("AUTH", "pass")
+	sleeper.send("DEBUG", "SLEEP", "0.5")
+	time.Sleep(time.Millisecond * 50)
+
+	const n = 20
+	start := time.Now()
+	if v := probe.do("AUTH", "pass"); v != "OK" {
+		t.Fatalf("expected OK, got %v", v)
+	}
+	for i := 0; i < n; i++ {
+		if v := probe.do("PING"); v != "PONG" {
+			t.Fatalf("expected PONG, got %v", v)
+		}
+	}
+	if v := probe.do("ECHO", "hello"); v != "hello" {
+		t.Fatalf("expected hello, got %v", v)
+	}
+	if v, ok := probe.do("TIME").([]interface{}); !ok || len(v) != 2 {
+		t.Fatalf("expected two elements, got %v", v)
+	}
+	if _, ok := probe.do("CLIENT", "ID").(int); !ok {
+		t.Fatal("expected the client id")
+	}
+	if v := probe.do("CLIENT", "NO-TOUCH", "ON"); v != "OK" {
+		t.Fatalf("expected OK, got %v", v)
+	}
+	if v, ok := probe.do("CLIENT", "INFO").(string); !ok || !strings.Contains(v, " flags=T ") {
+		t.Fatalf("expected the client info, got %v", v)
+	}
+	if v := probe.do("RESET"); v != "RESET" {
+		t.Fatalf("expected RESET, got %v", v)
+	}
+	elapsed := time.Since(start)
+	if elapsed > time.Millisecond*(n+7) {
+		t.Fatalf("expected less than 1ms per command, got %s for %d", elapsed, n+7)
+	}
+	if v, err := sleeper.read(); err != nil || v != "OK" {
+		t.Fatalf("expected OK, got %v, %v", v, err)
+	}
+}
+
+func TestMixedFramingPipeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"))
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	write := func(data string) {
+		if _, err := conn.conn.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(replies ...interface{}) {
+		conn.conn.SetReadDeadline(time.Now().Add(time.Second))
+		defer conn.conn.SetReadDeadline(time.Time{})
+		for i, reply := range replies {
+			v, err := conn.read()
+			if err != nil {
+				t.Fatalf("reply %d: %v", i, err)
+			}
+			if fmt.Sprint(v) != fmt.Sprint(reply) {
+				t.Fatalf("reply %d: expected %v, got %v", i, reply, v)
+			}
+		}
+	}
+
+	// one segment
+	write("SET k 1\r\n*2\r\n$4\r\nINCR\r\n$1\r\nk\r\nincr k\r\n" +
+		"*2\r\n$3\r\nGET\r\n$1\r\nk\r\nECHO \"a b\"\r\n")
+	expect("OK", 2, 3, "3", "a b")
+
+	// the replies before a partial command are flushed before the rest of
+	// it arrives, for either framing.
+	write("ECHO 1\r\n*2\r\n$4\r\nECHO\r\n$1\r\n2\r\n*2\r\n$4\r\nEC")
+	expect("1", "2")
+	write("HO\r\n$1\r\n3\r\nECHO 4\r\nEC")
+	expect("3", "4")
+	write("HO 5\r\n")
+	expect("5")
+
+	// an empty line or array at the end of a segment
+	write("ECHO 6\r\n\r\n")
+	expect("6")
+	write("*2\r\n$4\r\nECHO\r\n$1\r\n7\r\n*0\r\n")
+	expect("7")
+}
+
+// TestConnectionLimits checks that a swarm of silent connections is limited
+// per source ip, and dropped when the handshake-timeout is reached.
+func TestConnectionLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"),
+		"--handshake-timeout", "500", "--maxclients-per-ip", "20")
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+	if v := conn.do("PING"); v != "PONG" {
+		t.Fatalf("expected PONG, got %v", v)
+	}
+
+	// the swarm shares the ip of conn, so 19 are accepted
+	const swarm = 40
+	results := make(chan interface{}, swarm)
+	for i := 0; i < swarm; i++ {
+		silent := testDial(t, addr)
+		defer silent.close()
+		go func() {
+			silent.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+			v, err := silent.read()
+			if err != nil {
+				results <- err
+			} else {
+				results <- v
+			}
+		}()
+	}
+	var rejected, dropped int
+	for i := 0; i < swarm; i++ {
+		switch v := (<-results).(type) {
+		case error:
+			if strings.Contains(v.Error(), "max number of clients per ip") {
+				rejected++
+			} else if v == io.EOF {
+				dropped++
+			} else {
+				t.Fatalf("unexpected error %v", v)
+			}
+		default:
+			t.Fatalf("unexpected reply %v", v)
+		}
+	}
+	if rejected != swarm-19 || dropped != 19 {
+		t.Fatalf("expected %d rejected and 19 dropped, got %d and %d",
+			swarm-19, rejected, dropped)
+	}
+
+	// the client that sent a command is not dropped
+	if v := conn.do("PING"); v != "PONG" {
+		t.Fatalf("expected PONG, got %v", v)
+	}
+	info := conn.do("INFO", "stats").(string)
+	for _, field := range []string{
+		"handshake_timeout_disconnections:19\n",
+		"rejected_connections_per_ip:" + strconv.Itoa(swarm-19) + "\n",
+	} {
+		if !strings.Contains(info, field) {
+			t.Fatalf("expected %q in\n%s", field, info)
+		}
+	}
+
+	// the dropped connections are released
+	more := testDial(t, addr)
+	defer more.close()
+	if v := more.do("PING"); v != "PONG" {
+		t.Fatalf("expected PONG, got %v", v)
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"),
+		"--send-timeout", "100")
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+	value := strings.Repeat("x", 1000)
+	for i := 0; i < 10; i++ {
+		args := []string{"RPUSH", "list"}
+		for j := 0; j < 100; j++ {
+			args = append(args, value)
+		}
+		conn.do(args...)
+	}
+
+	// a client that sends commands and never reads the replies
+	stalled := testDial(t, addr)
+	defer stalled.close()
+	for i := 0; i < 100; i++ {
+		stalled.send("LRANGE", "list", "0", "-1")
+	}
+	start := time.Now()
+	for {
+		info := conn.do("INFO", "stats").(string)
+		if strings.Contains(info, "send_timeout_disconnections:1\n") {
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatalf("timeout waiting for the disconnect\n%s", info)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if v := conn.do("SET", "key", "value"); v != "OK" {
+		t.Fatalf("expected OK, got %v", v)
+	}
+
+	// the stalled client only receives whole replies, then the connection
+	// is closed.
+	stalled.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	var replies int
+	for {
+		reply, err := stalled.read()
+		if err != nil {
+			break
+		}
+		if arr, ok := reply.([]interface{}); !ok || len(arr) != 1000 {
+			t.Fatalf("expected a full reply, got %T", reply)
+		}
+		replies++
+	}
+	if replies == 100 {
+		t.Fatal("expected the connection to be closed before all replies")
+	}
+}
+
+// TestStopWritesOnBgsaveError checks that writes are refused after a failed
+// rewrite, until a rewrite succeeds.
+func TestStopWritesOnBgsaveError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"))
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+	conn.do("SET", "key", "value")
+	persistence := func() string {
+		return conn.do("INFO", "persistence").(string)
+	}
+	if info := persistence(); !strings.Contains(info, "aof_last_bgrewrite_status:ok\n") {
+		t.Fatalf("expected an ok status, got\n%s", info)
+	}
+
+	// a directory in place of the temporary file fails the rewrite
+	temp := filepath.Join(dir, fmt.Sprintf("temp-rewrite-%d.aof", os.Getpid()))
+	if err := os.Mkdir(temp, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := conn.do("SAVE").(error); !ok {
+		t.Fatal("expected SAVE to fail")
+	}
+	info := persistence()
+	if !strings.Contains(info, "rdb_last_bgsave_status:err\n") ||
+		!strings.Contains(info, "aof_last_bgrewrite_status:err\n") {
+		t.Fatalf("expected an err status, got\n%s", info)
+	}
+	if err, ok := conn.do("SET", "key", "value").(error); !ok || !strings.HasPrefix(err.Error(), "MISCONF ") {
+		t.Fatalf("expected a MISCONF error, got '%v'", err)
+	}
+	if v := conn.do("GET", "key"); v != "value" {
+		t.Fatalf("expected reads to be allowed, got '%v'", v)
+	}
+	if v := conn.do("DEL", "key"); v != 1 {
+		t.Fatalf("expected DEL to be allowed, got '%v'", v)
+	}
+	conn.do("CONFIG", "SET", "stop-writes-on-bgsave-error", "no")
+	if v := conn.do("SET", "key", "value"); v != "OK" {
+		t.Fatalf("expected 'OK', got '%v'", v)
+	}
+	conn.do("CONFIG", "SET", "stop-writes-on-bgsave-error", "yes")
+	if _, ok := conn.do("SET", "key", "value").(error); !ok {
+		t.Fatal("expected a MISCONF error")
+	}
+
+	// a successful save allows writes again
+	if err := os.Remove(temp); err != nil {
+		t.Fatal(err)
+	}
+	if v := conn.do("SAVE"); v != "OK" {
+		t.Fatalf("expected 'OK', got '%v'", v)
+	}
+	if v := conn.do("SET", "key", "value"); v != "OK" {
+		t.Fatalf("expected 'OK', got '%v'", v)
+	}
+	if info := persistence(); !strings.Contains(info, "aof_last_bgrewrite_status:ok\n") {
+		t.Fatalf("expected an ok status, got\n%s", info)
+	}
+}
+
+func TestWaitAOF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"))
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	// the waiting client asks for a sync ahead of the next second
+	conn.do("SET", "key", "value")
+	start := time.Now()
+	v := conn.do("WAITAOF", "1", "0", "0").([]interface{})
+	if v[0] != 1 || v[1] != 0 {
+		t.Fatalf("expected '[1 0]', got '%v'", v)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Fatalf("expected an early sync, waited %s", elapsed)
+	}
+	info := conn.do("INFO", "persistence").(string)
+	if !strings.Contains(info, "aof_fsync_offset:") ||
+		strings.Contains(info, "aof_fsync_offset:0\n") {
+		t.Fatalf("expected a synced offset, got\n%s", info)
+	}
+
+	// there are no replicas, so numreplicas waits for the timeout
+	start = time.Now()
+	v = conn.do("WAITAOF", "0", "1", "100").([]interface{})
+	if v[0] != 1 || v[1] != 0 {
+		t.Fatalf("expected '[1 0]', got '%v'", v)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*100 {
+		t.Fatalf("expected to wait for the timeout, waited %s", elapsed)
+	}
+	if _, ok := conn.do("WAITAOF", "1", "0", "-1").(error); !ok {
+		t.Fatal("expected an error for a negative timeout")
+	}
+
+	addr2, stop2 := testStartServer(t, filepath.Join(dir, "other.aof"), "--appendonly", "no")
+	defer stop2()
+	conn2 := testDial(t, addr2)
+	defer conn2.close()
+	if _, ok := conn2.do("WAITAOF", "1", "0", "0").(error); !ok {
+		t.Fatal("expected an error when appendonly is disabled")
+	}
+	if v := conn2.do("WAITAOF", "0", "0", "0").([]interface{}); v[0] != 0 {
+		t.Fatalf("expected '[0 0]', got '%v'", v)
+	}
+}
+
+// TestBlockedClientsScale blocks many clients with staggered timeouts. A
+// blocked client waits on a runtime timer in its own goroutine, so blocking
+// adds no goroutines, and the timeouts are served by the runtime timer heap.
+func TestBlockedClientsScale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the pipes aren't from the loopback interface
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"),
+		"--protected-mode", "no")
+	stop := testServe(t, s, addr)
+	defer stop()
+
+	const n = 10000
+	conns := make([]*testConn, n)
+	for i := range conns {
+		cc, sc := net.Pipe()
+		go handleConn(sc, s)
+		conns[i] = &testConn{t: t, conn: cc, rd: bufio.NewReader(cc)}
+		defer conns[i].close()
+		if v := conns[i].do("PING"); v != "PONG" {
+			t.Fatalf("expected PONG, got %v", v)
+		}
+	}
+	idle := runtime.NumGoroutine()
+
+	// there are no replicas, so WAITAOF waits for the timeout
+	type waiter struct {
+		conn     *testConn
+		timeout  time.Duration
+		deadline time.Time
+	}
+	waiters := make([]waiter, n)
+	for i, conn := range conns {
+		ms := 500 + (i*7919)%1000
+		conn.send("WAITAOF", "0", "1", strconv.Itoa(ms))
+		timeout := time.Duration(ms) * time.Millisecond
+		waiters[i] = waiter{conn, timeout, time.Now().Add(timeout)}
+	}
+	if blocked := runtime.NumGoroutine(); blocked > idle+100 {
+		t.Fatalf("expected about %d goroutines for %d blocked clients, got %d",
+			idle, n, blocked)
+	}
+
+	// the replies are read in the order of the deadlines
+	sort.Slice(waiters, func(i, j int) bool {
+		return waiters[i].deadline.Before(waiters[j].deadline)
+	})
+	var maxLate time.Duration
+	for _, w := range waiters {
+		v, err := w.conn.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := v.([]interface{}); !ok {
+			t.Fatalf("expected the WAITAOF reply, got %v", v)
+		}
+		now := time.Now()
+		if now.Before(w.deadline.Add(-w.timeout / 10)) {
+			t.Fatalf("expected the timeout of %s, got the reply %s early",
+				w.timeout, w.deadline.Sub(now))
+		}
+		if late := now.Sub(w.deadline); late > maxLate {
+			maxLate = late
+		}
+	}
+	if maxLate > time.Millisecond*500 {
+		t.Fatalf("expected the replies close to the deadlines, one was %s late", maxLate)
+	}
+
+	// a client that keeps sending while it's blocked in BLPOP is evicted,
+	// rather than buffering without a limit. The limit leaves a megabyte over
+	// the buffers of the idle clients.
+	info, _ := s.Do("INFO", "memory")
+	i := strings.Index(info.(string), "mem_clients_normal:")
+	line := info.(string)[i+len("mem_clients_normal:"):]
+	mem, _ := strconv.Atoi(strings.TrimSpace(line[:strings.IndexByte(line, '\n')]))
+	if _, err := s.Do("CONFIG", "SET", "maxmemory-clients", strconv.Itoa(mem+1024*1024)); err != nil {
+		t.Fatal(err)
+	}
+	blocked := conns[0]
+	blocked.send("BLPOP", "list", "0")
+	for start := time.Now(); ; time.Sleep(time.Millisecond * 10) {
+		if info, _ := s.Do("INFO", "clients"); strings.Contains(info.(string), "blocked_clients:1\n") {
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("expected the client to block")
+		}
+	}
+	head := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$10000000\r\n"
+	blocked.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	blocked.conn.Write([]byte(head + strings.Repeat("x", 2*1024*1024)))
+	blocked.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if v, err := blocked.read(); err == nil {
+		t.Fatalf("expected the blocked client to be evicted, got %v", v)
+	}
+	info, _ = s.Do("INFO", "stats")
+	if !strings.Contains(info.(string), "evicted_clients:1\n") {
+		t.Fatalf("expected one evicted client, got\n%s", info)
+	}
+}
+
+func TestAOFInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	s, addr := testNewServer(t, aofPath)
+	stop := testServe(t, s, addr)
+	conn := testDial(t, addr)
+	field := func(name string) string {
+		info := conn.do("INFO", "persistence").(string)
+		for _, line := range strings.Split(info, "\n") {
+			if strings.HasPrefix(line, name+":") {
+				return line[len(name)+1:]
+			}
+		}
+		t.Fatalf("missing %s in\n%s", name, info)
+		return ""
+	}
+	fileSize := func() string {
+		fi, err := os.Stat(aofPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strconv.FormatInt(fi.Size(), 10)
+	}
+	for i := 0; i < 10; i++ {
+		conn.do("SET", "key:"+strconv.Itoa(i), "value")
+	}
+	conn.do("DEL", "key:0", "key:1")
+	if size := field("aof_current_size"); size != fileSize() || size == "0" {
+		t.Fatalf("expected aof_current_size %s, got %s", fileSize(), size)
+	}
+	// a new aof only has the header
+	header := strconv.Itoa(len(buildCommand("AOFHEADER", aofFormat, s.options.Version)))
+	if v := field("aof_base_size"); v != header {
+		t.Fatalf("expected aof_base_size %s, got %s", header, v)
+	}
+	if v := field("aof_buffer_length"); v != "0" {
+		t.Fatalf("expected an empty buffer, got %s", v)
+	}
+	if v := field("loading"); v != "0" {
+		t.Fatalf("expected loading 0, got %s", v)
+	}
+
+	// the rewrite is the new base size
+	conn.do("SAVE")
+	if size := field("aof_base_size"); size != fileSize() || field("aof_current_size") != size {
+		t.Fatalf("expected aof_base_size %s, got %s", fileSize(), size)
+	}
+	conn.do("SET", "key:0", "value")
+	if size := field("aof_current_size"); size != fileSize() || size == field("aof_base_size") {
+		t.Fatalf("expected aof_current_size %s, got %s", fileSize(), size)
+	}
+	conn.close()
+	stop()
+
+	// a restart loads all of the aof, and the loaded aof is the base size
+	size := fileSize()
+	s, addr = testNewServer(t, aofPath)
+	stop = testServe(t, s, addr)
+	defer stop()
+	conn = testDial(t, addr)
+	defer conn.close()
+	if loaded := atomic.LoadInt64(&s.loadingLoaded); strconv.FormatInt(loaded, 10) != size {
+		t.Fatalf("expected %s loaded bytes, got %d", size, loaded)
+	}
+	if v := field("aof_base_size"); v != size {
+		t.Fatalf("expected aof_base_size %s, got %s", size, v)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seedPath := filepath.Join(dir, "seed.aof")
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	var seed bytes.Buffer
+	writeMultiBulk(&seed, "SET", "a", "1")
+	writeMultiBulk(&seed, "SET", "b", "2")
+	writeMultiBulk(&seed, "RPUSH", "list", "x", "y")
+	writeMultiBulk(&seed, "SELECT", "1")
+	writeMultiBulk(&seed, "SET", "c", "3")
+	if err := ioutil.WriteFile(seedPath, seed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(seed.Bytes())
+	digest := hex.EncodeToString(sum[:]) + "  seed.aof\n"
+	if err := ioutil.WriteFile(seedPath+".digest", []byte(digest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the tail changes the seeded keys
+	var tail bytes.Buffer
+	writeMultiBulk(&tail, "SET", "a", "changed")
+	writeMultiBulk(&tail, "DEL", "b")
+	writeMultiBulk(&tail, "RPUSH", "list", "z")
+	if err := ioutil.WriteFile(aofPath, tail.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	start := func() (*Server, func()) {
+		s, addr := testNewServerOptions(t, &Options{AppendOnlyPath: aofPath, SeedPath: seedPath})
+		return s, testServe(t, s, addr)
+	}
+	check := func(s *Server) {
+		t.Helper()
+		for _, tt := range []struct {
+			args []string
+			v    interface{}
+		}{
+			{[]string{"GET", "a"}, "changed"},
+			{[]string{"EXISTS", "b"}, 0},
+			{[]string{"LLEN", "list"}, 3},
+			{[]string{"LINDEX", "list", "2"}, "z"},
+		} {
+			if v, err := s.Do(tt.args...); err != nil || v != tt.v {
+				t.Fatalf("%v: expected '%v', got '%v', %v", tt.args, tt.v, v, err)
+			}
+		}
+	}
+	s, stop := start()
+	check(s)
+	if atomic.LoadInt64(&s.loadingLoaded) != int64(tail.Len()) {
+		t.Fatalf("expected the last phase to be the tail")
+	}
+	// the rewritten aof replaces the seeded keys, which are loaded again
+	if _, err := s.Do("SAVE"); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	s, stop = start()
+	check(s)
+	stop()
+
+	// a seed that does not match its digest is refused
+	if err := ioutil.WriteFile(seedPath+".digest", []byte("00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, _ = testNewServerOptions(t, &Options{AppendOnlyPath: aofPath, SeedPath: seedPath})
+	if err := s.ListenAndServe(); err == nil || !strings.Contains(err.Error(), "digest") {
+		t.Fatalf("expected a digest error, got %v", err)
+	}
+}
+
+// TestFlushAOF checks that the flushes are in the aof, without their option,
+// so that a restart doesn't bring the keys back.
+func TestFlushAOF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	s, addr := testNewServer(t, aofPath)
+	stop := testServe(t, s, addr)
+	s.Do("SET", "a", "1")
+	s.Do("FLUSHDB", "ASYNC")
+	s.Do("SET", "b", "2")
+	s.Do("SET", "c", "3")
+	s.Do("FLUSHALL", "SYNC")
+	s.Do("SET", "d", "4")
+	stop()
+
+	data, err := ioutil.ReadFile(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(bytes.ToUpper(data), []byte("SYNC")) {
+		t.Fatalf("expected the flushes without their option, got %q", data)
+	}
+	s, addr = testNewServer(t, aofPath)
+	stop = testServe(t, s, addr)
+	defer stop()
+	if v, _ := s.Do("DBSIZE"); v != 1 {
+		t.Fatalf("expected 1 key, got %v", v)
+	}
+	if v, _ := s.Do("GET", "d"); v != "4" {
+		t.Fatalf("expected '4', got %v", v)
+	}
+}
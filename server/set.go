@@ -1,6 +1,10 @@
 package server
 
-import "strconv"
+import (
+	"math"
+	"math/rand"
+	"strconv"
+)
 
 type set struct {
 	m map[string]bool
@@ -35,38 +39,45 @@ func (s *set) ascend(iterator func(s string) bool) {
 	}
 }
 
+// copy returns a new set with the same members.
+func (s *set) copy() *set {
+	s2 := &set{make(map[string]bool, len(s.m))}
+	for v := range s.m {
+		s2.m[v] = true
+	}
+	return s2
+}
+
 func (s1 *set) diff(s2 *set) *set {
 	s3 := newSet()
 	for v1 := range s1.m {
-		found := false
-		for v2 := range s2.m {
-			if v1 == v2 {
-				found = true
-				break
-			}
-		}
-		if !found {
+		if !s2.m[v1] {
 			s3.m[v1] = true
 		}
 	}
 	return s3
 }
 
-func (s1 *set) inter(s2 *set) *set {
-	s3 := newSet()
-	for v1 := range s1.m {
-		found := false
-		for v2 := range s2.m {
-			if v1 == v2 {
-				found = true
-				break
-			}
+// interAll returns the intersection of the sets. The members of the
+// smallest set are the only ones that are checked.
+func interAll(sets []*set) *set {
+	smallest := sets[0]
+	for _, st := range sets[1:] {
+		if st.len() < smallest.len() {
+			smallest = st
 		}
-		if found {
-			s3.m[v1] = true
+	}
+	result := newSet()
+next:
+	for member := range smallest.m {
+		for _, st := range sets {
+			if st != smallest && !st.m[member] {
+				continue next
+			}
 		}
+		result.m[member] = true
 	}
-	return s3
+	return result
 }
 
 func (s1 *set) union(s2 *set) *set {
@@ -80,15 +91,11 @@ func (s1 *set) union(s2 *set) *set {
 	return s3
 }
 
+// popRand returns up to count distinct members, which are removed from the
+// set when pop is true.
 func (s *set) popRand(count int, pop bool) []string {
-	many := false
 	if count < 0 {
-		if pop {
-			return nil
-		} else {
-			count *= -1
-			many = true
-		}
+		return nil
 	}
 	var res []string
 	if count > 1024 {
@@ -96,23 +103,19 @@ func (s *set) popRand(count int, pop bool) []string {
 	} else {
 		res = make([]string, 0, count)
 	}
-	for {
-		for key := range s.m {
-			if count <= 0 {
-				break
-			}
-			if pop {
-				delete(s.m, key)
-			}
-			res = append(res, key)
-			count--
-		}
-		if !many || count == 0 {
+	for key := range s.m {
+		if count <= 0 {
 			break
 		}
+		if pop {
+			delete(s.m, key)
+		}
+		res = append(res, key)
+		count--
 	}
 	return res
 }
+
 func (s *set) pop(count int) []string {
 	return s.popRand(count, true)
 }
@@ -219,17 +222,13 @@ func sismembersCommand(c *client) {
 		c.replyTypeError()
 		return
 	}
-	if st == nil {
-		c.replyInt(0)
-		return
-	}
-	if st.isMember(c.args[2]) {
-		c.replyInt(1)
-	} else {
-		c.replyInt(0)
-	}
+	c.replyBoolOrInt(st != nil && st.isMember(c.args[2]))
 }
 
+// sdiffinterunionGenericCommand runs SDIFF, SINTER and SUNION, and their
+// STORE variants. The type of every key is checked before the result is
+// computed, and the result is a new set, because the destination of a store
+// may also be one of the sources. A missing key is an empty set.
 func sdiffinterunionGenericCommand(c *client, diff, union bool, store bool) {
 	if (!store && len(c.args) < 2) || (store && len(c.args) < 3) {
 		c.replyAritryError()
@@ -239,56 +238,55 @@ func sdiffinterunionGenericCommand(c *client, diff, union bool, store bool) {
 	if store {
 		basei = 2
 	}
-	var st *set
+	sets := make([]*set, 0, len(c.args)-basei)
 	for i := basei; i < len(c.args); i++ {
-		stt, ok := c.db.getSet(c.args[i], false)
+		st, ok := c.db.getSet(c.args[i], false)
 		if !ok {
 			c.replyTypeError()
 			return
 		}
-		if stt == nil {
-			if diff || union {
-				continue
-			} else {
-				st = nil
-				break
+		sets = append(sets, st)
+	}
+	var result *set
+	switch {
+	case union:
+		result = newSet()
+		for _, st := range sets {
+			if st != nil {
+				result = result.union(st)
 			}
 		}
-		if st == nil {
-			st = stt
-		} else {
-			if diff {
-				st = st.diff(stt)
-			} else if union {
-				st = st.union(stt)
-			} else {
-				st = st.inter(stt)
+	case diff:
+		if sets[0] == nil {
+			result = newSet()
+			break
+		}
+		result = sets[0].copy()
+		for _, st := range sets[1:] {
+			if st != nil {
+				result = result.diff(st)
 			}
 		}
-	}
-	if store {
-		if st == nil || st.len() == 0 {
-			_, ok := c.db.del(c.args[1])
-			if ok {
-				c.dirty++
+	default:
+		for _, st := range sets {
+			if st == nil {
+				result = newSet()
+				break
 			}
-			c.replyInt(0)
-		} else {
-			c.db.set(c.args[1], st)
-			c.dirty++
-			c.replyInt(st.len())
 		}
-	} else {
-		if st == nil {
-			c.replyMultiBulkLen(0)
-			return
+		if result == nil {
+			result = interAll(sets)
 		}
-		c.replyMultiBulkLen(st.len())
-		st.ascend(func(s string) bool {
-			c.replyBulk(s)
-			return true
-		})
 	}
+	if store {
+		c.storeResult(c.args[1], result, result.len())
+		return
+	}
+	c.replyMultiBulkLen(result.len())
+	result.ascend(func(s string) bool {
+		c.replyBulk(s)
+		return true
+	})
 }
 func sdiffCommand(c *client) {
 	sdiffinterunionGenericCommand(c, true, false, false)
@@ -326,6 +324,10 @@ func srandmemberpopGenericCommand(c *client, pop bool) {
 			c.replyError("index out of range")
 			return
 		}
+		if n < -math.MaxInt64/2 {
+			c.replyError("value is out of range")
+			return
+		}
 		count = int(n)
 		countSpecified = true
 	}
@@ -342,10 +344,21 @@ func srandmemberpopGenericCommand(c *client, pop bool) {
 		}
 		return
 	}
+	if !pop && count < 0 {
+		srandmemberStream(c, st, -count)
+		return
+	}
 	var res []string
 	if pop {
 		res = st.pop(count)
 		c.dirty += len(res)
+		// the members are random, so the aof has the ones that were removed
+		args := make([]interface{}, 0, len(res)+2)
+		args = append(args, "srem", c.args[1])
+		for _, member := range res {
+			args = append(args, member)
+		}
+		c.raw = buildCommand(args...)
 	} else {
 		res = st.rand(count)
 	}
@@ -365,6 +378,26 @@ func srandmemberpopGenericCommand(c *client, pop bool) {
 	}
 }
 
+// randMemberChunk is the number of members written between checks of the
+// connection by SRANDMEMBER with a negative count.
+const randMemberChunk = 1024
+
+// srandmemberStream replies with count members that may repeat. The reply can
+// be far larger than the set, so the members are written to the connection
+// as they are picked rather than collected first. The command stops when the
+// connection fails, such as when the client can't keep up and reaches the
+// send-timeout.
+func srandmemberStream(c *client, st *set, count int) {
+	members := st.strArr()
+	c.replyMultiBulkLen(count)
+	for i := 0; i < count; i++ {
+		if i%randMemberChunk == 0 && c.writeFailed() {
+			return
+		}
+		c.replyBulk(members[rand.Intn(len(members))])
+	}
+}
+
 func srandmemberCommand(c *client) {
 	srandmemberpopGenericCommand(c, false)
 }
@@ -416,22 +449,30 @@ func smoveCommand(c *client) {
 		return
 	}
 	if src == nil {
-		c.replyInt(0)
+		c.replyBoolOrInt(false)
+		return
+	}
+	if src == dst {
+		// nothing moves, like in Redis
+		c.replyBoolOrInt(src.isMember(c.args[3]))
 		return
 	}
 	if !src.del(c.args[3]) {
-		c.replyInt(0)
+		c.replyBoolOrInt(false)
 		return
 	}
+	if src.len() == 0 {
+		c.db.del(c.args[1])
+	}
 	if dst == nil {
 		dst = newSet()
 		dst.add(c.args[3])
 		c.db.set(c.args[2], dst)
-		c.replyInt(1)
+		c.replyBoolOrInt(true)
 		c.dirty++
 		return
 	}
 	dst.add(c.args[3])
-	c.replyInt(1)
+	c.replyBoolOrInt(true)
 	c.dirty++
 }
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSrandmemberNegativeCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"),
+		"--send-timeout", "100")
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+	conn.do("SADD", "set", "a", "b", "c")
+
+	res := conn.do("SRANDMEMBER", "set", "-5000").([]interface{})
+	if len(res) != 5000 {
+		t.Fatalf("expected 5000 members, got %d", len(res))
+	}
+	seen := make(map[interface{}]bool)
+	for _, v := range res {
+		if v != "a" && v != "b" && v != "c" {
+			t.Fatalf("unexpected member %v", v)
+		}
+		seen[v] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected all members to be picked, got %v", seen)
+	}
+	if v := conn.do("SRANDMEMBER", "set", "-9223372036854775808"); v == nil ||
+		!strings.Contains(v.(error).Error(), "out of range") {
+		t.Fatalf("expected out of range error, got %v", v)
+	}
+
+	// a client that never reads a reply of ten million members is
+	// disconnected while the reply is being written.
+	stalled := testDial(t, addr)
+	defer stalled.close()
+	stalled.send("SRANDMEMBER", "set", "-10000000")
+	start := time.Now()
+	for {
+		info := conn.do("INFO", "stats").(string)
+		if strings.Contains(info, "send_timeout_disconnections:1\n") {
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatalf("timeout waiting for the disconnect\n%s", info)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	// the command has stopped and released the lock
+	if v := conn.do("SET", "key", "value"); v != "OK" {
+		t.Fatalf("expected OK, got %v", v)
+	}
+}
+
+func TestSpopAOF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	s, addr := testNewServer(t, aofPath)
+	stop := testServe(t, s, addr)
+	defer func() { stop() }()
+
+	var members []string
+	for i := 0; i < 100; i++ {
+		members = append(members, strconv.Itoa(i))
+	}
+	s.Do(append([]string{"SADD", "set"}, members...)...)
+	s.Do("SADD", "small", "a", "b")
+	for i := 0; i < 10; i++ {
+		s.Do("SPOP", "set")
+		s.Do("SPOP", "set", "3")
+	}
+	if v, _ := s.Do("SPOP", "small", "5"); len(v.([]interface{})) != 2 {
+		t.Fatalf("expected 2 members, got %v", v)
+	}
+	if v, _ := s.Do("SCARD", "set"); v != 60 {
+		t.Fatalf("expected 60, got %v", v)
+	}
+	data, err := ioutil.ReadFile(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strings.ToLower(string(data)), "spop") {
+		t.Fatalf("expected the pops to be in the aof as SREM, got %q", data)
+	}
+	digest, _ := s.Do("DEBUG", "DIGEST")
+	stop()
+	s, addr = testNewServer(t, aofPath)
+	stop = testServe(t, s, addr)
+	if v, _ := s.Do("DEBUG", "DIGEST"); v != digest {
+		t.Fatalf("expected digest %v, got %v", digest, v)
+	}
+	if v, _ := s.Do("EXISTS", "small"); v != 0 {
+		t.Fatalf("expected the emptied set to be deleted, got %v", v)
+	}
+}
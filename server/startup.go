@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The listeners accept connections while the data loads, but only the
+// commands that are allowed while loading run until it's loaded. When it's
+// loaded, the server logs a summary of how it started, closes the Ready
+// channel, and tells systemd that it's ready when NOTIFY_SOCKET is set, which
+// is how a Type=notify unit waits for it.
+
+// Ready returns a channel that's closed once the data is loaded and the
+// server runs all commands.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// logStartup logs the summary of the startup. The load is the time that it
+// took to load the seed and the aof.
+func (s *Server) logStartup(load time.Duration) {
+	s.lnoticef("--- Startup summary")
+	s.lnoticef("version: %s %s", s.options.AppName, s.options.Version)
+	if s.cfg.file != "" {
+		s.lnoticef("config file: %s", s.cfg.file)
+	} else {
+		s.lnoticef("config file: none")
+	}
+	s.lnoticef("listening: %s", s.l.Addr())
+	if s.cfg.unixSocket != "" {
+		s.lnoticef("listening: %s", s.cfg.unixSocket)
+	}
+	if s.cfg.appendOnly {
+		s.lnoticef("persistence: aof %s, appendfsync %s", s.aofActive,
+			s.cfg.appendFsync)
+	} else {
+		s.lnoticef("persistence: none")
+	}
+	s.mu.RLock()
+	var dbs []*database
+	for _, db := range s.dbs {
+		if db.len() > 0 {
+			dbs = append(dbs, db)
+		}
+	}
+	sort.Sort(dbsByNumber(dbs))
+	s.lnoticef("databases: %d with keys", len(dbs))
+	for _, db := range dbs {
+		s.lnoticef("db%d: %d keys loaded", db.num, db.len())
+	}
+	s.mu.RUnlock()
+	s.lnoticef("load time: %.3f seconds", load.Seconds())
+	s.lnoticef("--- Startup summary end")
+}
+
+// sdNotify sends a state, such as READY=1, to the service manager. It does
+// nothing when NOTIFY_SOCKET is not set.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if strings.HasPrefix(addr, "@") {
+		// an abstract socket
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReady(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	testWriteAOF(t, aofPath,
+		[]string{"SET", "a", "1"},
+		[]string{"SELECT", "2"},
+		[]string{"SET", "b", "2"},
+		[]string{"SET", "c", "3"},
+	)
+
+	// a service manager that waits for READY=1
+	notifyPath := filepath.Join(dir, "notify.sock")
+	notify, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: notifyPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notify.Close()
+	t.Setenv("NOTIFY_SOCKET", notifyPath)
+
+	s, addr := testNewServer(t, aofPath)
+	var log testLog
+	s.options.LogWriter = &log
+	select {
+	case <-s.Ready():
+		t.Fatal("expected the server to not be ready before it starts")
+	default:
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ListenAndServe()
+	}()
+	select {
+	case <-s.Ready():
+	case err := <-done:
+		t.Fatalf("server failed to start: %v", err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the server to be ready")
+	}
+
+	// no retries, the server accepts connections once it's ready
+	conn := testDial(t, addr)
+	if v := conn.do("PING"); v != "PONG" {
+		t.Fatalf("expected 'PONG', got '%v'", v)
+	}
+	conn.close()
+
+	notify.SetReadDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, 64)
+	n, err := notify.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Fatalf("expected 'READY=1', got %q, %v", buf[:n], err)
+	}
+	port := addr[strings.LastIndex(addr, ":"):]
+	for _, line := range []string{"version: ", port + "\n",
+		"persistence: aof " + aofPath, "databases: 2 with keys",
+		"db0: 1 keys loaded", "db2: 2 keys loaded", "load time: "} {
+		if !strings.Contains(log.String(), line) {
+			t.Fatalf("expected %q in the startup summary, got\n%s", line, log.String())
+		}
+	}
+
+	conn = testDial(t, addr)
+	conn.send("SHUTDOWN")
+	conn.read()
+	conn.close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	n, err = notify.Read(buf)
+	if err != nil || string(buf[:n]) != "STOPPING=1" {
+		t.Fatalf("expected 'STOPPING=1', got %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The external store hooks allow for the server to be used as a cache in
+// front of another database. Both hooks are opt-in per key pattern.
+//
+// Read-through: When GET misses a key that matches read-through-patterns,
+// the KeyLoader option is called outside of the server lock. Concurrent
+// misses on the same key share a single load, which gets the context of the
+// client that started it. The loaded value is stored and
+// the command is run again.
+//
+// Write-behind: Changes to keys that match write-behind-patterns are queued
+// and passed in batches to the WriteBehind option by a dedicated goroutine.
+// A batch that fails is retried with a backoff.
+
+const (
+	writeBehindQueueSize = 4096                   // number of writes waiting to be sent
+	writeBehindBatchSize = 100                    // max number of writes per batch
+	writeBehindInterval  = time.Millisecond * 100 // max time a write waits for a batch
+	writeBehindRetries   = 5                      // number of retries for a failed batch
+)
+
+// KeyWrite is a change to a key that is passed to the WriteBehind option.
+type KeyWrite struct {
+	DB      int         // the database number
+	Key     string      // the key that changed
+	Command string      // the command that changed the key
+	Value   interface{} // a string, a []string for lists and sets, a map[string]string for hashes and sorted sets, or nil when deleted
+}
+
+// loadCall is a KeyLoader call in progress.
+type loadCall struct {
+	wg    sync.WaitGroup
+	value string
+	ttl   time.Duration
+	ok    bool
+}
+
+// loadGroup makes sure that there's only one KeyLoader call per key.
+type loadGroup struct {
+	mu    sync.Mutex
+	calls map[string]*loadCall
+}
+
+// do calls the loader, or waits for the call in progress for the same key.
+// The caller that is not shared must call forget after storing the value.
+func (g *loadGroup) do(ctx context.Context, key string, loader func(context.Context, string) (interface{}, time.Duration, bool)) (call *loadCall, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*loadCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call, true
+	}
+	call = &loadCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	value, ttl, ok := loader(ctx, key)
+	if ok {
+		switch v := value.(type) {
+		case string:
+			call.value, call.ok = v, true
+		case []byte:
+			call.value, call.ok = string(v), true
+		}
+		call.ttl = ttl
+	}
+	call.wg.Done()
+	return call, false
+}
+
+func (g *loadGroup) forget(key string) {
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+}
+
+// readThrough is called by a command that missed the key. Returns true when
+// the key should be loaded, in which case the command must return without a
+// reply. The command is run again after the load.
+func (c *client) readThrough(key string) bool {
+	if c.loaded || c.loading || c.s.options.KeyLoader == nil ||
+		!matchAny(c.s.cfg.readThroughPatterns, key) {
+		return false
+	}
+	c.loadKey = key
+	return true
+}
+
+// loadKey loads the key requested by the command, and then runs the command
+// again. This must be called without holding the server lock.
+func (s *Server) loadKey(c *client, cmd *command) {
+	key := c.loadKey
+	c.loadKey = ""
+	call, shared := s.loads.do(c.context(), key, s.options.KeyLoader)
+	s.mu.Lock()
+	c.locked = true
+	defer func() {
+		c.locked = false
+		s.mu.Unlock()
+	}()
+	if !shared {
+		// keep the call until the value is stored so that concurrent misses
+		// don't load the key again.
+		defer s.loads.forget(key)
+		atomic.AddUint64(&s.readThroughLoads, 1)
+	}
+	if _, exists := c.db.get(key); call.ok && !exists {
+		c.dirty++
+		c.db.set(key, call.value)
+		if call.ttl > 0 {
+			when := time.Now().Add(call.ttl)
+			c.db.setExpire(key, when)
+			if s.aofCompatible("pexpireat") {
+				s.appendAOF(c.db.num, buildCommand("SET", key, call.value,
+					"PXAT", unixMillis(when)))
+			} else {
+				s.appendAOF(c.db.num, buildCommand("SET", key, call.value,
+					"PX", int64(call.ttl/time.Millisecond)))
+			}
+		} else {
+			s.appendAOF(c.db.num, buildCommand("SET", key, call.value))
+		}
+	}
+	c.loaded = true
+	cmd.funct(c)
+	c.loaded = false
+}
+
+type writeBehindQueue struct {
+	writes  chan KeyWrite
+	closed  bool   // no more writes are accepted
+	sent    uint64 // number of writes sent, atomic
+	dropped uint64 // number of writes dropped, atomic
+}
+
+// queueWriteBehind queues the keys changed by a write command. This must be
+// called while holding the server lock.
+func (s *Server) queueWriteBehind(c *client, cmd *command) {
+	q := s.writeBehind
+	if q == nil || q.closed || c.loading || len(s.cfg.writeBehindPatterns) == 0 {
+		return
+	}
+	for _, key := range cmd.keys(c.args) {
+		if !matchAny(s.cfg.writeBehindPatterns, key) {
+			continue
+		}
+		w := KeyWrite{DB: c.db.num, Key: key, Command: cmd.name}
+		if value, ok := c.db.get(key); ok {
+			switch v := value.(type) {
+			case string:
+				w.Value = v
+			case *list:
+				w.Value = v.strArr()
+			case *set:
+				var members []string
+				v.ascend(func(member string) bool {
+					members = append(members, member)
+					return true
+				})
+				w.Value = members
+			case *hash:
+				w.Value = v.copy().m
+			case *zset:
+				w.Value = v.scores()
+			}
+		}
+		select {
+		case q.writes <- w:
+		default:
+			atomic.AddUint64(&q.dropped, 1)
+		}
+	}
+}
+
+// startWriteBehind runs the background routine which sends batches of writes
+// to the WriteBehind option.
+func (s *Server) startWriteBehind() {
+	if s.options.WriteBehind == nil {
+		return
+	}
+	q := &writeBehindQueue{
+		writes: make(chan KeyWrite, writeBehindQueueSize),
+	}
+	s.writeBehind = q
+	s.workers.start(workerWrites, func(ctx context.Context) {
+		t := time.NewTicker(writeBehindInterval)
+		defer t.Stop()
+		var batch []KeyWrite
+		for {
+			select {
+			case w, ok := <-q.writes:
+				if !ok {
+					s.sendWriteBehind(batch)
+					return
+				}
+				batch = append(batch, w)
+				if len(batch) < writeBehindBatchSize {
+					continue
+				}
+			case <-t.C:
+			}
+			s.sendWriteBehind(batch)
+			batch = nil
+		}
+	})
+}
+
+func (s *Server) sendWriteBehind(batch []KeyWrite) {
+	if len(batch) == 0 {
+		return
+	}
+	q := s.writeBehind
+	backoff := writeBehindInterval
+	for i := 0; ; i++ {
+		err := s.options.WriteBehind(batch)
+		if err == nil {
+			atomic.AddUint64(&q.sent, uint64(len(batch)))
+			return
+		}
+		if i == writeBehindRetries {
+			s.lwarningf("Write behind failed, dropping %d writes: %v", len(batch), err)
+			atomic.AddUint64(&q.dropped, uint64(len(batch)))
+			return
+		}
+		s.lverbosf("Write behind failed, retrying in %s: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// stopWriteBehind sends the remaining writes and stops the background routine.
+func (s *Server) stopWriteBehind() {
+	q := s.writeBehind
+	if q == nil {
+		return
+	}
+	s.mu.Lock()
+	q.closed = true
+	close(q.writes)
+	s.mu.Unlock()
+	s.stopWorkers(workerWrites)
+}
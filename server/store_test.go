@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExternalStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var loads int32
+	var mu sync.Mutex
+	var writes []KeyWrite
+	var failed bool
+	s, addr := testNewServerOptions(t, &Options{
+		AppendOnlyPath: filepath.Join(dir, "appendonly.aof"),
+		KeyLoader: func(ctx context.Context, key string) (interface{}, time.Duration, bool) {
+			atomic.AddInt32(&loads, 1)
+			time.Sleep(time.Millisecond * 50)
+			switch key {
+			case "user:missing":
+				return nil, 0, false
+			case "user:ttl":
+				return []byte("loaded"), time.Hour, true
+			}
+			return "loaded:" + key, 0, true
+		},
+		WriteBehind: func(batch []KeyWrite) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if !failed {
+				failed = true
+				return errors.New("unavailable")
+			}
+			writes = append(writes, batch...)
+			return nil
+		},
+	}, "--read-through-patterns", "user:* order:*",
+		"--write-behind-patterns", "user:*")
+	stop := testServe(t, s, addr)
+	defer stop()
+
+	// a herd of misses on a single key
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn := testDial(t, addr)
+			defer conn.close()
+			if v := conn.do("GET", "user:1"); v != "loaded:user:1" {
+				t.Errorf("expected 'loaded:user:1', got '%v'", v)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Fatalf("expected 1 load, got %d", n)
+	}
+
+	conn := testDial(t, addr)
+	defer conn.close()
+	if v := conn.do("GET", "other:1"); v != nil {
+		t.Fatalf("expected nil, got '%v'", v)
+	}
+	if v := conn.do("GET", "user:missing"); v != nil {
+		t.Fatalf("expected nil, got '%v'", v)
+	}
+	if v := conn.do("GET", "user:ttl"); v != "loaded" {
+		t.Fatalf("expected 'loaded', got '%v'", v)
+	}
+	if v := conn.do("TTL", "user:ttl").(int); v <= 0 {
+		t.Fatalf("expected a ttl, got '%v'", v)
+	}
+	// the loaded ttl is appended as a time, not a duration
+	data, err := ioutil.ReadFile(filepath.Join(dir, "appendonly.aof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "$8\r\nuser:ttl\r\n$6\r\nloaded\r\n$4\r\nPXAT\r\n") {
+		t.Fatalf("expected a SET with PXAT in the aof, got %q", data)
+	}
+	if n := atomic.LoadInt32(&loads); n != 3 {
+		t.Fatalf("expected 3 loads, got %d", n)
+	}
+
+	// patterns can be changed at runtime
+	conn.do("CONFIG", "SET", "read-through-patterns", "")
+	if v := conn.do("GET", "order:1"); v != nil {
+		t.Fatalf("expected nil, got '%v'", v)
+	}
+
+	conn.do("SET", "user:2", "value")
+	conn.do("RPUSH", "user:3", "a", "b")
+	conn.do("DEL", "user:2")
+	conn.do("SET", "other:2", "value")
+	expect := []KeyWrite{
+		{0, "user:2", "set", "value"},
+		{0, "user:3", "rpush", []string{"a", "b"}},
+		{0, "user:2", "del", nil},
+	}
+	start := time.Now()
+	for {
+		mu.Lock()
+		n := len(writes)
+		mu.Unlock()
+		if n >= len(expect) {
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("timeout waiting for writes")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(writes, expect) {
+		t.Fatalf("expected %v, got %v", expect, writes)
+	}
+	info := conn.do("INFO", "persistence").(string)
+	if !strings.Contains(info, "write_behind_writes:3\n") {
+		t.Fatalf("expected 3 writes in info, got\n%s", info)
+	}
+}
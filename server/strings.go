@@ -1,6 +1,8 @@
 package server
 
 import (
+	"math"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -12,6 +14,9 @@ func getCommand(c *client) {
 	}
 	key, ok := c.db.get(c.args[1])
 	if !ok {
+		if c.readThrough(c.args[1]) {
+			return
+		}
 		c.replyNull()
 		return
 	}
@@ -64,7 +69,7 @@ func incrbyCommand(c *client) {
 	}
 	n, err := atoi(c.args[2])
 	if err != nil {
-		c.replyError("value is not an integer or out of range")
+		c.replyInvalidIntError()
 		return
 	}
 	genericIncrbyCommand(c, n)
@@ -85,48 +90,107 @@ func decrbyCommand(c *client) {
 	}
 	n, err := atoi(c.args[2])
 	if err != nil {
-		c.replyError("value is not an integer or out of range")
+		c.replyInvalidIntError()
+		return
+	}
+	if n == math.MinInt64 {
+		c.replyError("decrement would overflow")
 		return
 	}
 	genericIncrbyCommand(c, -n)
 }
 
+// genericIncrbyCommand adds delta to the integer value of the key. A missing
+// key is zero.
 func genericIncrbyCommand(c *client, delta int) {
 	var n int
 	value, ok := c.db.get(c.args[1])
 	if ok {
-		switch s := value.(type) {
-		default:
+		s, ok := value.(string)
+		if !ok {
 			c.replyTypeError()
 			return
-		case string:
-			var err error
-			n, err = atoi(s)
-			if err != nil {
-				c.replyTypeError()
-				return
-			}
-			n += int(delta)
 		}
-	} else {
-		n = 1
+		var err error
+		n, err = atoi(s)
+		if err != nil {
+			c.replyInvalidIntError()
+			return
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) ||
+		(delta < 0 && n < math.MinInt64-delta) {
+		c.replyError("increment or decrement would overflow")
+		return
 	}
+	n += delta
 	c.db.update(c.args[1], itoa(n))
-	c.replyInt(int(n))
+	c.replyInt(n)
 	c.dirty++
 }
 
+// incrbyfloatCommand is INCRBYFLOAT key increment. A missing key is zero. The
+// result is formatted without an exponent or trailing zeros. The reply is the
+// new string value under both protocols, not a RESP3 double, like in Redis,
+// because the clients read it as a string.
+func incrbyfloatCommand(c *client) {
+	if len(c.args) != 3 {
+		c.replyAritryError()
+		return
+	}
+	delta, err := parseFloat(c.args[2])
+	if err != nil {
+		c.replyError("value is not a valid float")
+		return
+	}
+	var n float64
+	value, ok := c.db.get(c.args[1])
+	if ok {
+		s, ok := value.(string)
+		if !ok {
+			c.replyTypeError()
+			return
+		}
+		n, err = parseFloat(s)
+		if err != nil {
+			c.replyError("value is not a valid float")
+			return
+		}
+	}
+	n += delta
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		c.replyError("increment would produce NaN or Infinity")
+		return
+	}
+	res := strconv.FormatFloat(n, 'f', -1, 64)
+	c.db.update(c.args[1], res)
+	c.replyBulk(res)
+	c.dirty++
+}
+
+// parseFloat parses a float that is neither NaN nor infinite.
+func parseFloat(s string) (float64, error) {
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, strconv.ErrSyntax
+	}
+	return n, nil
+}
+
 func setCommand(c *client) {
 	if len(c.args) < 3 {
 		c.replyAritryError()
 		return
 	}
-	var nx, xx bool
-	var ex, px time.Time
-	var expires bool
+	var nx, xx, get bool
+	var expires, keepTTL bool
 	var when time.Time
+	idt := int64(-1)
 	for i := 3; i < len(c.args); i++ {
-		switch strings.ToLower(c.args[i]) {
+		switch opt := strings.ToLower(c.args[i]); opt {
 		case "nx":
 			if xx {
 				c.replySyntaxError()
@@ -139,51 +203,180 @@ func setCommand(c *client) {
 				return
 			}
 			xx = true
-		case "ex":
-			if !px.IsZero() || i == len(c.args)-1 {
+		case "keepttl":
+			if expires {
 				c.replySyntaxError()
 				return
 			}
-			i++
-			n, err := atoi(c.args[i])
-			if err != nil {
+			keepTTL = true
+		case "get":
+			get = true
+		case "ex", "px", "exat", "pxat":
+			if expires || keepTTL || i == len(c.args)-1 {
 				c.replySyntaxError()
 				return
 			}
-			ex = time.Now().Add(time.Duration(n) * time.Second)
+			i++
+			unit := time.Second
+			if opt[0] == 'p' {
+				unit = time.Millisecond
+			}
+			var ok bool
+			if when, ok = parseSetExpire(c, c.args[i], unit, len(opt) == 4); !ok {
+				return
+			}
 			expires = true
-			when = ex
-		case "px":
-			if !ex.IsZero() || i == len(c.args)-1 {
+		case "idt":
+			if idt != -1 || i == len(c.args)-1 {
 				c.replySyntaxError()
 				return
 			}
 			i++
-			n, err := atoi(c.args[i])
-			if err != nil {
-				c.replySyntaxError()
+			n, err := strconv.ParseInt(c.args[i], 10, 64)
+			if err != nil || n < 0 {
+				c.replyInvalidIntError()
 				return
 			}
-			px = time.Now().Add(time.Duration(n) * time.Millisecond)
-			expires = true
-			when = px
+			idt = n
+		default:
+			c.replySyntaxError()
+			return
 		}
 	}
-	if nx || xx {
-		_, ok := c.db.get(c.args[1])
-		if (ok && nx) || (!ok && xx) {
+	if idt != -1 && !checkTombstone(c, c.args[1], idt) {
+		return
+	}
+	old, exists := c.db.get(c.args[1])
+	if _, ok := old.(string); exists && get && !ok {
+		c.replyTypeError()
+		return
+	}
+	if (exists && nx) || (!exists && xx) {
+		if !get {
 			c.replyNull()
 			return
 		}
+	} else {
+		setString(c, c.args[1], c.args[2], keepTTL, when)
+		if expires && c.s.aofCompatible("pexpireat") {
+			// the options were checked, and the ttl must not start again
+			// when the aof is loaded
+			c.propagate("SET", c.args[1], c.args[2], "PXAT", unixMillis(when))
+		}
 	}
-	c.db.set(c.args[1], c.args[2])
-	if expires {
-		c.db.expire(c.args[1], when)
+	// GET replies with the old value, whether or not the value was set.
+	switch {
+	case !get:
+		c.replyString("OK")
+	case !exists:
+		c.replyNull()
+	default:
+		c.replyBulk(old.(string))
+	}
+}
+
+// setString sets the key to a string value for SET and its variants. The ttl
+// is cleared, unless keepTTL is set, and then when is the new expire time, if
+// it's not zero.
+func setString(c *client, key, value string, keepTTL bool, when time.Time) {
+	if keepTTL {
+		c.db.update(key, value)
+	} else {
+		c.db.set(key, value)
+	}
+	if !when.IsZero() {
+		c.db.setExpire(key, when)
 	}
-	c.replyString("OK")
 	c.dirty++
 }
 
+func setexCommand(c *client) {
+	genericSetexCommand(c, time.Second)
+}
+
+func psetexCommand(c *client) {
+	genericSetexCommand(c, time.Millisecond)
+}
+
+func genericSetexCommand(c *client, unit time.Duration) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	when, ok := parseSetExpire(c, c.args[2], unit, false)
+	if !ok {
+		return
+	}
+	setString(c, c.args[1], c.args[3], false, when)
+	if c.s.aofCompatible("pexpireat") {
+		c.propagate("SET", c.args[1], c.args[3], "PXAT", unixMillis(when))
+	}
+	c.replyString("OK")
+}
+
+// getexCommand is GETEX key [EX s|PX ms|EXAT ts|PXAT ts|PERSIST]. Without an
+// option it's the same as GET.
+func getexCommand(c *client) {
+	if len(c.args) < 2 {
+		c.replyAritryError()
+		return
+	}
+	var expires, persist bool
+	var when time.Time
+	for i := 2; i < len(c.args); i++ {
+		switch opt := strings.ToLower(c.args[i]); opt {
+		case "ex", "px", "exat", "pxat":
+			if expires || persist || i == len(c.args)-1 {
+				c.replySyntaxError()
+				return
+			}
+			i++
+			unit := time.Second
+			if opt[0] == 'p' {
+				unit = time.Millisecond
+			}
+			var ok bool
+			if when, ok = parseSetExpire(c, c.args[i], unit, len(opt) == 4); !ok {
+				return
+			}
+			expires = true
+		case "persist":
+			if expires || persist {
+				c.replySyntaxError()
+				return
+			}
+			persist = true
+		default:
+			c.replySyntaxError()
+			return
+		}
+	}
+	key, ok := c.db.get(c.args[1])
+	if !ok {
+		c.replyNull()
+		return
+	}
+	s, ok := key.(string)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	// the aof gets the absolute expire time, so that a relative one does not
+	// start over when the aof is loaded.
+	if expires {
+		if _, deleted := c.db.setExpire(c.args[1], when); deleted {
+			c.propagate("DEL", c.args[1])
+		} else {
+			c.propagate("PEXPIREAT", c.args[1], unixMillis(when))
+		}
+		c.dirty++
+	} else if persist && c.db.persist(c.args[1]) {
+		c.propagate("PERSIST", c.args[1])
+		c.dirty++
+	}
+	c.replyBulk(s)
+}
+
 func setnxCommand(c *client) {
 	if len(c.args) != 3 {
 		c.replyAritryError()
@@ -191,12 +384,11 @@ func setnxCommand(c *client) {
 	}
 	_, ok := c.db.get(c.args[1])
 	if ok {
-		c.replyInt(0)
+		c.replyBoolOrInt(false)
 		return
 	}
-	c.db.set(c.args[1], c.args[2])
-	c.replyInt(1)
-	c.dirty++
+	setString(c, c.args[1], c.args[2], false, time.Time{})
+	c.replyBoolOrInt(true)
 }
 
 func msetCommand(c *client) {
@@ -217,7 +409,7 @@ func msetnxCommand(c *client) {
 		return
 	}
 	for i := 1; i < len(c.args); i += 2 {
-		_, ok := c.db.get(c.args[1])
+		_, ok := c.db.get(c.args[i])
 		if ok {
 			c.replyInt(0)
 			return
@@ -248,25 +440,103 @@ func appendCommand(c *client) {
 		return
 	case string:
 		s += c.args[2]
-		c.db.set(c.args[1], s)
+		c.db.update(c.args[1], s)
 		c.replyInt(len(s))
 		c.dirty++
 	}
 }
 
+// getrangeCommand is GETRANGE key start end. Negative offsets are from the
+// end of the string, and both ends are inclusive.
+func getrangeCommand(c *client) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	start, err1 := atoi(c.args[2])
+	end, err2 := atoi(c.args[3])
+	if err1 != nil || err2 != nil {
+		c.replyInvalidIntError()
+		return
+	}
+	key, ok := c.db.get(c.args[1])
+	if !ok {
+		c.replyBulk("")
+		return
+	}
+	s, ok := key.(string)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	start, end, ok = rangeIndexes(start, end, len(s), true)
+	if !ok {
+		c.replyBulk("")
+		return
+	}
+	c.replyBulk(s[start : end+1])
+}
+
+// setrangeCommand is SETRANGE key offset value. The string is padded with
+// zero bytes up to the offset. The reply is the length of the string.
+func setrangeCommand(c *client) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	offset, err := atoi(c.args[2])
+	if err != nil {
+		c.replyInvalidIntError()
+		return
+	}
+	if offset < 0 {
+		c.replyError("offset is out of range")
+		return
+	}
+	value := c.args[3]
+	var s string
+	key, ok := c.db.get(c.args[1])
+	if ok {
+		if s, ok = key.(string); !ok {
+			c.replyTypeError()
+			return
+		}
+	}
+	if len(value) == 0 {
+		// nothing is changed, or created
+		c.replyInt(len(s))
+		return
+	}
+	if offset > maxBulkLen-len(value) {
+		c.replyError("string exceeds maximum allowed size (proto-max-bulk-len)")
+		return
+	}
+	n := len(s)
+	if offset+len(value) > n {
+		n = offset + len(value)
+	}
+	b := make([]byte, n)
+	copy(b, s)
+	copy(b[offset:], value)
+	c.db.update(c.args[1], string(b))
+	c.replyInt(n)
+	c.dirty++
+}
+
 func bitcountCommand(c *client) {
 	var start, end int
 	var all bool
 	switch len(c.args) {
 	default:
 		c.replyAritryError()
+		return
 	case 2:
 		all = true
 	case 4:
 		n1, err1 := atoi(c.args[2])
 		n2, err2 := atoi(c.args[3])
 		if err1 != nil || err2 != nil {
-			c.replyError("value is not an integer or out of range")
+			c.replyInvalidIntError()
 			return
 		}
 		start, end = int(n1), int(n2)
@@ -283,22 +553,14 @@ func bitcountCommand(c *client) {
 	case string:
 		var count int
 		if all {
-			start, end = 0, len(s)
-		} else {
-			if start < 0 {
-				start = len(s) + start
-				if start < 0 {
-					start = 0
-				}
-			}
-			if end < 0 {
-				end = len(s) + end
-				if end < 0 {
-					end = 0
-				}
-			}
+			start, end = 0, -1
+		}
+		start, end, ok := rangeIndexes(start, end, len(s), true)
+		if !ok {
+			c.replyInt(0)
+			return
 		}
-		for i := start; i <= end && i < len(s); i++ {
+		for i := start; i <= end; i++ {
 			c := s[i]
 			for j := 0; j < 8; j++ {
 				count += int((c >> uint(j)) & 0x01)
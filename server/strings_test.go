@@ -0,0 +1,239 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// stringModel is a string command on a value that's only ever a raw string.
+// It returns the reply, and the value after the command, or an error reply.
+type stringModel func(value string) (reply interface{}, after string, err bool)
+
+// modelInt parses an integer like atoi, which is also strconv.ParseInt
+// without a leading '+'.
+func modelInt(s string) (int64, bool) {
+	if strings.HasPrefix(s, "+") {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+func modelIncrby(delta int64) stringModel {
+	return func(v string) (interface{}, string, bool) {
+		n, ok := modelInt(v)
+		if !ok {
+			return nil, v, true
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return nil, v, true
+		}
+		n += delta
+		return int(n), strconv.FormatInt(n, 10), false
+	}
+}
+
+func modelSetrange(offset int, s string) stringModel {
+	return func(v string) (interface{}, string, bool) {
+		if s == "" {
+			return len(v), v, false
+		}
+		for len(v) < offset+len(s) {
+			v += "\x00"
+		}
+		v = v[:offset] + s + v[offset+len(s):]
+		return len(v), v, false
+	}
+}
+
+func modelGetrange(start, end int) stringModel {
+	return func(v string) (interface{}, string, bool) {
+		start, end := start, end
+		if start < 0 {
+			start += len(v)
+		}
+		if end < 0 {
+			end += len(v)
+		}
+		if start < 0 {
+			start = 0
+		}
+		if end < 0 {
+			end = 0
+		}
+		if end >= len(v) {
+			end = len(v) - 1
+		}
+		if start > end || len(v) == 0 {
+			return "", v, false
+		}
+		return v[start : end+1], v, false
+	}
+}
+
+// TestStringTransitions applies every string command to values that look like
+// each encoding, and compares the replies and the bytes of the value after the
+// command with a model that only uses raw strings.
+func TestStringTransitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"))
+	stop := testServe(t, s, addr)
+	defer stop()
+
+	values := []string{
+		"0", "1", "12345", "-7", "9223372036854775807", "-9223372036854775808",
+		"9223372036854775808", "007", "+1", "-0", " 1", "1.5", "1e3",
+		"", "hello", "\x00\xff", strings.Repeat("x", 44), strings.Repeat("9", 100),
+	}
+	commands := []struct {
+		args  []string
+		model stringModel
+	}{
+		{[]string{"GET"}, func(v string) (interface{}, string, bool) {
+			return v, v, false
+		}},
+		{[]string{"APPEND", "9"}, func(v string) (interface{}, string, bool) {
+			return len(v) + 1, v + "9", false
+		}},
+		{[]string{"APPEND", "x"}, func(v string) (interface{}, string, bool) {
+			return len(v) + 1, v + "x", false
+		}},
+		{[]string{"APPEND", ""}, func(v string) (interface{}, string, bool) {
+			return len(v), v, false
+		}},
+		{[]string{"SETRANGE", "0", "9"}, modelSetrange(0, "9")},
+		{[]string{"SETRANGE", "1", "x"}, modelSetrange(1, "x")},
+		{[]string{"SETRANGE", "3", "42"}, modelSetrange(3, "42")},
+		{[]string{"SETRANGE", "0", ""}, modelSetrange(0, "")},
+		{[]string{"GETRANGE", "0", "-1"}, modelGetrange(0, -1)},
+		{[]string{"GETRANGE", "1", "2"}, modelGetrange(1, 2)},
+		{[]string{"GETRANGE", "-2", "-1"}, modelGetrange(-2, -1)},
+		{[]string{"INCR"}, modelIncrby(1)},
+		{[]string{"DECR"}, modelIncrby(-1)},
+		{[]string{"INCRBY", "100"}, modelIncrby(100)},
+		{[]string{"DECRBY", "-5"}, modelIncrby(5)},
+		{[]string{"INCRBYFLOAT", "0.5"}, func(v string) (interface{}, string, bool) {
+			n, err := parseFloat(v)
+			if err != nil {
+				return nil, v, true
+			}
+			after := strconv.FormatFloat(n+0.5, 'f', -1, 64)
+			return after, after, false
+		}},
+		{[]string{"GETSET", "77"}, func(v string) (interface{}, string, bool) {
+			return v, "77", false
+		}},
+		{[]string{"SET", "x1"}, func(v string) (interface{}, string, bool) {
+			return "OK", "x1", false
+		}},
+		{[]string{"SETNX", "1"}, func(v string) (interface{}, string, bool) {
+			return 0, v, false
+		}},
+		{[]string{"BITCOUNT"}, func(v string) (interface{}, string, bool) {
+			var n int
+			for i := 0; i < len(v); i++ {
+				for b := v[i]; b != 0; b >>= 1 {
+					n += int(b & 1)
+				}
+			}
+			return n, v, false
+		}},
+	}
+	for _, value := range values {
+		for _, tc := range commands {
+			name := fmt.Sprintf("%q %v", value, tc.args)
+			s.Do("SET", "key", value)
+			args := append([]string{tc.args[0], "key"}, tc.args[1:]...)
+			reply, err := s.Do(args...)
+			expect, after, expectErr := tc.model(value)
+			if expectErr {
+				if err == nil {
+					t.Fatalf("%s: expected an error, got '%v'", name, reply)
+				}
+			} else if err != nil || reply != expect {
+				t.Fatalf("%s: expected '%v', got '%v', %v", name, expect, reply, err)
+			}
+			if v, err := s.Do("GET", "key"); err != nil || v != after {
+				t.Fatalf("%s: expected the value %q, got %q, %v", name, after, v, err)
+			}
+			// the value is always stored as the raw bytes
+			if v, err := s.Do("OBJECT", "ENCODING", "key"); err != nil || v != "raw" {
+				t.Fatalf("%s: expected 'raw', got '%v', %v", name, v, err)
+			}
+		}
+	}
+}
+
+// TestGetexAOF checks that GETEX is only appended to the aof when it changes
+// the ttl, and then with the absolute expire time.
+func TestGetexAOF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	s, addr := testNewServer(t, aofPath)
+	stop := testServe(t, s, addr)
+	defer func() { stop() }()
+
+	aofSize := func() int64 {
+		fi, err := os.Stat(aofPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+	s.Do("SET", "key", "value")
+	size := aofSize()
+	for _, args := range [][]string{
+		{"GETEX", "key"}, {"GETEX", "key", "PERSIST"}, {"GETEX", "missing", "EX", "10"},
+	} {
+		if _, err := s.Do(args...); err != nil {
+			t.Fatal(err)
+		}
+		if aofSize() != size {
+			t.Fatalf("%v: expected nothing in the aof", args)
+		}
+	}
+	for _, tt := range []struct {
+		args []string
+		aof  string
+	}{
+		{[]string{"GETEX", "key", "EX", "100"}, "PEXPIREAT"},
+		{[]string{"GETEX", "key", "PERSIST"}, "PERSIST"},
+		{[]string{"GETEX", "key", "PXAT", "1"}, "DEL"},
+	} {
+		if v, err := s.Do(tt.args...); err != nil || v != "value" {
+			t.Fatalf("%v: expected 'value', got '%v', %v", tt.args, v, err)
+		}
+		data, err := ioutil.ReadFile(aofPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data[size:]), "\r\n"+tt.aof+"\r\n$3\r\nkey\r\n") {
+			t.Fatalf("%v: expected a %s in the aof, got %q", tt.args, tt.aof, data[size:])
+		}
+		size = int64(len(data))
+	}
+
+	// the expire time is kept when the aof is loaded later
+	s.Do("SET", "key", "value")
+	s.Do("GETEX", "key", "EX", "100")
+	stop()
+	s, addr = testNewServer(t, aofPath)
+	stop = testServe(t, s, addr)
+	if v, err := s.Do("TTL", "key"); err != nil || v != 100 {
+		t.Fatalf("expected '100', got '%v', %v", v, err)
+	}
+}
@@ -0,0 +1,319 @@
+package testsupport
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// CompareAddrEnv is the environment variable that holds the address of a real
+// Redis server. When it's set, RunScript also runs each script against that
+// server, which verifies that the expected replies are compatible with Redis.
+// The Redis server is flushed before each script.
+const CompareAddrEnv = "SIDER_COMPARE_ADDR"
+
+// A script is a text file with commands and the expected replies.
+//
+//	# comments and blank lines are ignored
+//	> SET key "hello world"
+//	+OK
+//	> GET key
+//	"hello world"
+//
+// Each command line starts with "> " and the args are separated by spaces.
+// Args may be double quoted using Go syntax. The line after the command is
+// the expected reply, which is one of:
+//
+//	+OK            a simple string
+//	-ERR syntax    an error, matched by prefix
+//	:1             an integer
+//	:*             any integer
+//	"value"        a bulk string
+//	~3.14          a bulk string with a number that is approximately equal
+//	(nil)          a null bulk string or null array
+//	[a, b]         an array, where each element is one of the above
+//	{a, b}         an array with elements in any order
+
+// RunScript runs the script file at path against the server at addr, and
+// against a real Redis server when CompareAddrEnv is set.
+func RunScript(t *testing.T, addr string, path string) {
+	t.Helper()
+	steps, err := parseScript(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runScript(t, addr, path, steps)
+	if redisAddr := os.Getenv(CompareAddrEnv); redisAddr != "" {
+		t.Run("redis", func(t *testing.T) {
+			conn, err := Dial(redisAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Do("FLUSHALL")
+			conn.Close()
+			runScript(t, redisAddr, path, steps)
+		})
+	}
+}
+
+type scriptStep struct {
+	line   int
+	args   []string
+	expect *matcher
+}
+
+func runScript(t *testing.T, addr, path string, steps []scriptStep) {
+	t.Helper()
+	conn, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, step := range steps {
+		reply, err := conn.Do(step.args...)
+		if err != nil {
+			t.Fatalf("%s:%d: %v", path, step.line, err)
+		}
+		if !step.expect.match(reply) {
+			t.Fatalf("%s:%d: %s\nexpected: %s\ngot:      %s", path, step.line,
+				strings.Join(step.args, " "), step.expect, reply)
+		}
+	}
+}
+
+func parseScript(path string) ([]scriptStep, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var steps []scriptStep
+	var step *scriptStep
+	sc := bufio.NewScanner(f)
+	for ln := 1; sc.Scan(); ln++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if step == nil {
+			if !strings.HasPrefix(line, "> ") {
+				return nil, fmt.Errorf("%s:%d: expected a command", path, ln)
+			}
+			args, err := splitArgs(line[2:])
+			if err != nil || len(args) == 0 {
+				return nil, fmt.Errorf("%s:%d: invalid command", path, ln)
+			}
+			step = &scriptStep{line: ln, args: args}
+			continue
+		}
+		step.expect, err = parseMatcher(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, ln, err)
+		}
+		steps = append(steps, *step)
+		step = nil
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if step != nil {
+		return nil, fmt.Errorf("%s:%d: missing reply", path, step.line)
+	}
+	return steps, nil
+}
+
+// splitArgs splits a command line into args.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			return args, nil
+		}
+		if line[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, err
+			}
+			arg, _ := strconv.Unquote(quoted)
+			args = append(args, arg)
+			line = line[len(quoted):]
+			continue
+		}
+		i := strings.IndexByte(line, ' ')
+		if i == -1 {
+			i = len(line)
+		}
+		args = append(args, line[:i])
+		line = line[i:]
+	}
+}
+
+type matcher struct {
+	kind  byte   // '+', '-', ':', '$', '~', 'n' for nil, '[', or '{'
+	str   string // simple string, error prefix, or bulk string
+	int   int64
+	any   bool // any integer
+	float float64
+	elems []*matcher
+}
+
+func (m *matcher) String() string {
+	switch m.kind {
+	case 'n':
+		return "(nil)"
+	case ':':
+		if m.any {
+			return ":*"
+		}
+		return ":" + strconv.FormatInt(m.int, 10)
+	case '$':
+		return strconv.Quote(m.str)
+	case '~':
+		return "~" + strconv.FormatFloat(m.float, 'g', -1, 64)
+	case '[', '{':
+		elems := make([]string, len(m.elems))
+		for i, elem := range m.elems {
+			elems[i] = elem.String()
+		}
+		end := "]"
+		if m.kind == '{' {
+			end = "}"
+		}
+		return string(m.kind) + strings.Join(elems, ", ") + end
+	}
+	return string(m.kind) + m.str
+}
+
+func (m *matcher) match(r Reply) bool {
+	switch m.kind {
+	case 'n':
+		return r.Null
+	case '+':
+		return r.Kind == '+' && r.Str == m.str
+	case '-':
+		return r.Kind == '-' && strings.HasPrefix(r.Str, m.str)
+	case ':':
+		return r.Kind == ':' && (m.any || r.Int == m.int)
+	case '$':
+		return r.Kind == '$' && !r.Null && r.Str == m.str
+	case '~':
+		if r.Kind != '$' || r.Null {
+			return false
+		}
+		f, err := strconv.ParseFloat(r.Str, 64)
+		return err == nil && math.Abs(f-m.float) <= 1e-6*math.Max(1, math.Abs(m.float))
+	case '[':
+		if r.Kind != '*' || r.Null || len(r.Array) != len(m.elems) {
+			return false
+		}
+		for i, elem := range m.elems {
+			if !elem.match(r.Array[i]) {
+				return false
+			}
+		}
+		return true
+	case '{':
+		if r.Kind != '*' || r.Null || len(r.Array) != len(m.elems) {
+			return false
+		}
+		used := make([]bool, len(r.Array))
+	next:
+		for _, elem := range m.elems {
+			for i, item := range r.Array {
+				if !used[i] && elem.match(item) {
+					used[i] = true
+					continue next
+				}
+			}
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// parseMatcher parses an expected reply line.
+func parseMatcher(line string) (*matcher, error) {
+	if line[0] == '+' || line[0] == '-' {
+		return &matcher{kind: line[0], str: line[1:]}, nil
+	}
+	m, rest, err := parseMatcherElem(line)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q", rest)
+	}
+	return m, nil
+}
+
+func parseMatcherElem(s string) (m *matcher, rest string, err error) {
+	s = strings.TrimLeft(s, " ")
+	if s == "" {
+		return nil, "", errors.New("missing reply")
+	}
+	switch s[0] {
+	case '"':
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return nil, "", err
+		}
+		str, _ := strconv.Unquote(quoted)
+		return &matcher{kind: '$', str: str}, s[len(quoted):], nil
+	case '[', '{':
+		m := &matcher{kind: s[0]}
+		end := byte(']')
+		if s[0] == '{' {
+			end = '}'
+		}
+		s = strings.TrimLeft(s[1:], " ")
+		for len(s) > 0 && s[0] != end {
+			elem, rest, err := parseMatcherElem(s)
+			if err != nil {
+				return nil, "", err
+			}
+			m.elems = append(m.elems, elem)
+			s = strings.TrimLeft(rest, " ")
+			if len(s) > 0 && s[0] == ',' {
+				s = s[1:]
+			}
+		}
+		if len(s) == 0 {
+			return nil, "", fmt.Errorf("missing '%c'", end)
+		}
+		return m, s[1:], nil
+	}
+	i := strings.IndexAny(s, ",]}")
+	if i == -1 {
+		i = len(s)
+	}
+	token, rest := strings.TrimSpace(s[:i]), s[i:]
+	if token == "" {
+		return nil, "", errors.New("missing reply")
+	}
+	switch {
+	case token == "(nil)":
+		return &matcher{kind: 'n'}, rest, nil
+	case token == ":*":
+		return &matcher{kind: ':', any: true}, rest, nil
+	case token[0] == ':':
+		n, err := strconv.ParseInt(token[1:], 10, 64)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid integer %q", token)
+		}
+		return &matcher{kind: ':', int: n}, rest, nil
+	case token[0] == '~':
+		f, err := strconv.ParseFloat(token[1:], 64)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid number %q", token)
+		}
+		return &matcher{kind: '~', float: f}, rest, nil
+	}
+	return nil, "", fmt.Errorf("invalid reply %q", token)
+}
@@ -0,0 +1,55 @@
+package testsupport
+
+import "testing"
+
+func TestMatcher(t *testing.T) {
+	tests := []struct {
+		expect string
+		reply  Reply
+		match  bool
+	}{
+		{"+OK", Reply{Kind: '+', Str: "OK"}, true},
+		{"+OK", Reply{Kind: '$', Str: "OK"}, false},
+		{"-ERR syntax", Reply{Kind: '-', Str: "ERR syntax error"}, true},
+		{"-ERR syntax", Reply{Kind: '-', Str: "ERR wrong"}, false},
+		{":1", Reply{Kind: ':', Int: 1}, true},
+		{":1", Reply{Kind: ':', Int: 2}, false},
+		{":*", Reply{Kind: ':', Int: 2}, true},
+		{`"a b"`, Reply{Kind: '$', Str: "a b"}, true},
+		{`"a b"`, Reply{Kind: '$', Null: true}, false},
+		{"~3.14", Reply{Kind: '$', Str: "3.1400000001"}, true},
+		{"~3.14", Reply{Kind: '$', Str: "3.15"}, false},
+		{"(nil)", Reply{Kind: '$', Null: true}, true},
+		{"(nil)", Reply{Kind: '*', Null: true}, true},
+		{`["a", :1, (nil)]`, Reply{Kind: '*', Array: []Reply{
+			{Kind: '$', Str: "a"}, {Kind: ':', Int: 1}, {Kind: '$', Null: true},
+		}}, true},
+		{`["a", "b"]`, Reply{Kind: '*', Array: []Reply{
+			{Kind: '$', Str: "b"}, {Kind: '$', Str: "a"},
+		}}, false},
+		{`{"a", "b"}`, Reply{Kind: '*', Array: []Reply{
+			{Kind: '$', Str: "b"}, {Kind: '$', Str: "a"},
+		}}, true},
+		{`{"a", "a"}`, Reply{Kind: '*', Array: []Reply{
+			{Kind: '$', Str: "a"}, {Kind: '$', Str: "b"},
+		}}, false},
+		{"[]", Reply{Kind: '*', Array: []Reply{}}, true},
+		{"[[:1], {}]", Reply{Kind: '*', Array: []Reply{
+			{Kind: '*', Array: []Reply{{Kind: ':', Int: 1}}}, {Kind: '*'},
+		}}, true},
+	}
+	for _, tt := range tests {
+		m, err := parseMatcher(tt.expect)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expect, err)
+		}
+		if m.match(tt.reply) != tt.match {
+			t.Fatalf("%s: expected match %v for %s", tt.expect, tt.match, tt.reply)
+		}
+	}
+	for _, expect := range []string{"[", "[:1,", ":a", "~x", "abc", `"a`, "[, ]"} {
+		if _, err := parseMatcher(expect); err == nil {
+			t.Fatalf("%s: expected an error", expect)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Package testsupport provides helpers for protocol level tests of the sider
+// server.
+package testsupport
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/sider/server"
+)
+
+// StartTestServer starts a server on an ephemeral port with an append only
+// file in a temporary directory. The args are passed to the server as command
+// line arguments. The server is shut down and the directory is removed when
+// the test completes.
+func StartTestServer(t testing.TB, args ...string) (addr string) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = l.Addr().String()
+	l.Close()
+	port := addr[strings.LastIndex(addr, ":")+1:]
+	s, err := server.NewServer(&server.Options{
+		LogWriter:      ioutil.Discard,
+		AppendOnlyPath: filepath.Join(dir, "appendonly.aof"),
+		Args:           append(args, "--port", port),
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ListenAndServe()
+	}()
+	t.Cleanup(func() {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			io.WriteString(conn, "*1\r\n$8\r\nSHUTDOWN\r\n")
+			io.Copy(ioutil.Discard, conn)
+			conn.Close()
+		}
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		os.RemoveAll(dir)
+	})
+	start := time.Now()
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("server failed to start: %v", err)
+		default:
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("timeout waiting for server to start")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// Reply is a reply from the server.
+type Reply struct {
+	Kind  byte    // '+', '-', ':', '$', or '*'
+	Str   string  // simple string, error, or bulk string
+	Int   int64   // integer
+	Array []Reply // array elements
+	Null  bool    // null bulk string or array
+}
+
+// String returns the reply in the same format that is used by scripts.
+func (r Reply) String() string {
+	switch {
+	case r.Null:
+		return "(nil)"
+	case r.Kind == ':':
+		return ":" + strconv.FormatInt(r.Int, 10)
+	case r.Kind == '$':
+		return strconv.Quote(r.Str)
+	case r.Kind == '*':
+		elems := make([]string, len(r.Array))
+		for i, elem := range r.Array {
+			elems[i] = elem.String()
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	}
+	return string(r.Kind) + r.Str
+}
+
+// Conn is a client connection.
+type Conn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// Dial connects to the server at addr.
+func Dial(addr string) (*Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{conn: conn, rd: bufio.NewReader(conn)}, nil
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends a command and reads the reply.
+func (c *Conn) Do(args ...string) (Reply, error) {
+	var buf []byte
+	buf = append(buf, "*"+strconv.Itoa(len(args))+"\r\n"...)
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return Reply{}, err
+	}
+	return c.read()
+}
+
+func (c *Conn) read() (Reply, error) {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return Reply{}, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return Reply{}, fmt.Errorf("invalid reply line %q", line)
+	}
+	r := Reply{Kind: line[0]}
+	line = line[1 : len(line)-2]
+	switch r.Kind {
+	case '+', '-':
+		r.Str = line
+	case ':':
+		r.Int, err = strconv.ParseInt(line, 10, 64)
+	case '$':
+		var n int
+		n, err = strconv.Atoi(line)
+		if err != nil || n < 0 {
+			r.Null = true
+			break
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(c.rd, buf); err == nil {
+			r.Str = string(buf[:n])
+		}
+	case '*':
+		var n int
+		n, err = strconv.Atoi(line)
+		if err != nil || n < 0 {
+			r.Null = true
+			break
+		}
+		r.Array = make([]Reply, n)
+		for i := 0; i < n && err == nil; i++ {
+			r.Array[i], err = c.read()
+		}
+	default:
+		err = fmt.Errorf("invalid reply line %q", line)
+	}
+	return r, err
+}
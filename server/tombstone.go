@@ -0,0 +1,142 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Tombstones protect deleted keys from writes that were delayed, such as
+// while dual-writing during a migration. When tombstone-retention is set, DEL
+// leaves a tombstone for each of its keys, whether or not the key existed,
+// that records when the key was deleted. A SET with IDT <ms>, the unix time
+// in milliseconds when the client issued the write, is refused while the key
+// has a tombstone that's newer than the write. A SET without IDT is always
+// applied, and a write doesn't remove the tombstone.
+//
+// The tombstones are kept apart from the keys, so that no read sees them. They
+// expire tombstone-retention seconds after the delete, and the expire loop
+// deletes them. FLUSHDB and FLUSHALL delete them along with the keys.
+//
+// The deletion time is appended to the aof after the DEL, and the rewrite
+// writes the tombstones that haven't expired, as:
+//
+//	TOMBSTONE <ms> key [key ...]
+//
+// Like AOFHEADER, TOMBSTONE is only read from an aof, it's not a command. A
+// DEL that's loaded from the aof doesn't leave a tombstone, because the time
+// of the delete is in the TOMBSTONE that follows it.
+
+// tombstoneRetention returns how long the tombstones are kept, or zero when
+// DEL doesn't leave tombstones. Must be called while holding the lock.
+func (s *Server) tombstoneRetention() time.Duration {
+	return time.Duration(s.cfg.tombstoneRetention) * time.Second
+}
+
+// setTombstone records that a key was deleted at ms.
+func (db *database) setTombstone(key string, ms int64) {
+	if db.tombstones == nil {
+		db.tombstones = make(map[string]int64)
+	}
+	db.tombstones[key] = ms
+}
+
+// tombstone returns when a key was deleted, if it has a tombstone that's
+// newer than the cutoff. This is safe to call while holding the read lock.
+func (db *database) tombstone(key string, cutoff int64) (int64, bool) {
+	ms, ok := db.tombstones[key]
+	return ms, ok && ms > cutoff
+}
+
+// expireTombstones checks up to count tombstones and deletes the ones that are
+// not newer than the cutoff.
+func (db *database) expireTombstones(count int, cutoff int64) (sampled, expired int) {
+	for key, ms := range db.tombstones {
+		if sampled == count {
+			break
+		}
+		sampled++
+		if ms <= cutoff {
+			delete(db.tombstones, key)
+			expired++
+		}
+	}
+	return sampled, expired
+}
+
+// tombstoneCutoff returns the unix time in milliseconds of the oldest
+// tombstone that has not expired, minus one.
+func tombstoneCutoff(now time.Time, retention time.Duration) int64 {
+	return now.Add(-retention).UnixNano() / 1e6
+}
+
+// leaveTombstones leaves tombstones for the keys of a DEL, and appends their
+// deletion time to the aof along with the DEL.
+func leaveTombstones(c *client, keys []string) {
+	if c.s.tombstoneRetention() == 0 || c.s.Loading() {
+		return
+	}
+	ms := time.Now().UnixNano() / 1e6
+	for _, key := range keys {
+		c.db.setTombstone(key, ms)
+	}
+	if c.s.aofCompatible("tombstone") {
+		args := make([]interface{}, 0, len(keys)+2)
+		args = append(args, "TOMBSTONE", ms)
+		for _, key := range keys {
+			args = append(args, key)
+		}
+		raw := make([]byte, 0, len(c.raw)*2)
+		raw = append(raw, c.raw...)
+		c.raw = append(raw, buildCommand(args...)...)
+	}
+	c.dirty++
+}
+
+// checkTombstone returns false, after replying with ErrTombstone, when the
+// write of a key at idt is older than the tombstone of the key.
+func checkTombstone(c *client, key string, idt int64) bool {
+	retention := c.s.tombstoneRetention()
+	if retention == 0 {
+		return true
+	}
+	ms, ok := c.db.tombstone(key, tombstoneCutoff(time.Now(), retention))
+	if !ok || idt >= ms {
+		return true
+	}
+	atomic.AddUint64(&c.s.tombstoneRejects, 1)
+	c.replyErr(ErrTombstone)
+	return false
+}
+
+// loadTombstone loads a TOMBSTONE of the aof.
+func (s *Server) loadTombstone(db *database, args []string) error {
+	if len(args) < 3 {
+		return errors.New("wrong number of arguments for TOMBSTONE")
+	}
+	ms, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errors.New("invalid TOMBSTONE time")
+	}
+	for _, key := range args[2:] {
+		db.setTombstone(key, ms)
+	}
+	return nil
+}
+
+// writeTombstones writes the tombstones of a database that haven't expired to
+// a rewrite of the aof.
+func (s *Server) writeTombstones(wr io.Writer, db *database, now time.Time) {
+	retention := s.tombstoneRetention()
+	if retention == 0 || !s.aofCompatible("tombstone") {
+		return
+	}
+	cutoff := tombstoneCutoff(now, retention)
+	for key, ms := range db.tombstones {
+		if ms > cutoff {
+			writeMultiBulk(wr, "TOMBSTONE", ms, key)
+		}
+	}
+}
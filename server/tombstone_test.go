@@ -0,0 +1,112 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTombstones(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	s, addr := testNewServer(t, aofPath, "--tombstone-retention", "3600")
+	stop := testServe(t, s, addr)
+	defer func() { stop() }()
+
+	ms := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(d).UnixNano()/1e6, 10)
+	}
+	expectSet := func(key, idt string, refused bool) {
+		t.Helper()
+		_, err := s.Do("SET", key, "value", "IDT", idt)
+		if refused != errors.Is(err, ErrTombstone) || (!refused && err != nil) {
+			t.Fatalf("SET %s IDT %s: expected refused %v, got %v", key, idt,
+				refused, err)
+		}
+	}
+
+	before := ms(-time.Minute)
+	s.Do("SET", "a", "1")
+	if v, _ := s.Do("DEL", "a", "never"); v != 1 {
+		t.Fatalf("expected 1, got %v", v)
+	}
+	// a delayed write is refused, also for a key that didn't exist
+	expectSet("a", before, true)
+	expectSet("never", before, true)
+	expectSet("other", before, false)
+	if v, _ := s.Do("GET", "a"); v != nil {
+		t.Fatalf("expected nil, got %v", v)
+	}
+	// the tombstones are invisible
+	if v, _ := s.Do("DBSIZE"); v != 1 {
+		t.Fatalf("expected 1 key, got %v", v)
+	}
+	if v, _ := s.Do("EXISTS", "a", "never"); v != 0 {
+		t.Fatalf("expected 0, got %v", v)
+	}
+	// a later write, or a write without IDT, is applied
+	expectSet("a", ms(time.Minute), false)
+	if _, err := s.Do("SET", "never", "value"); err != nil {
+		t.Fatal(err)
+	}
+	s.Do("DEL", "a")
+
+	if _, err := s.Do("SET", "a", "value", "IDT"); !errors.Is(err, ErrSyntax) {
+		t.Fatalf("expected a syntax error, got %v", err)
+	}
+	if _, err := s.Do("SET", "a", "value", "IDT", "x"); err == nil {
+		t.Fatal("expected an error")
+	}
+	info, _ := s.Do("INFO", "stats")
+	if !strings.Contains(info.(string), "tombstone_rejected_writes:2\n") {
+		t.Fatalf("expected 2 rejected writes, got\n%s", info)
+	}
+
+	// the tombstones survive a restart, before and after a rewrite
+	for _, rewrite := range []bool{false, true} {
+		if rewrite {
+			if _, err := s.Do("SAVE"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stop()
+		s, addr = testNewServer(t, aofPath, "--tombstone-retention", "3600")
+		stop = testServe(t, s, addr)
+		expectSet("a", before, true)
+		if v, _ := s.Do("GET", "never"); v != "value" {
+			t.Fatalf("expected 'value', got %v", v)
+		}
+	}
+
+	// the tombstones expire
+	s.Do("CONFIG", "SET", "tombstone-retention", "1")
+	time.Sleep(time.Millisecond * 1100)
+	expectSet("a", before, false)
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		s.mu.RLock()
+		n := len(s.selectDB(0).tombstones)
+		s.mu.RUnlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the expire loop to delete the tombstones, got %d", n)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	// no tombstones without a retention
+	s.Do("CONFIG", "SET", "tombstone-retention", "0")
+	s.Do("DEL", "a")
+	expectSet("a", before, false)
+}
@@ -0,0 +1,56 @@
+package server
+
+import "strconv"
+
+// TRACEID <id> tags the next command of the connection with an id of the
+// application, such as the id of the request that sent it, which ties the
+// command to that request wherever the server reports it: the MONITOR line,
+// the audit log, the watchdog report and its LATENCY sample, and the command
+// history. The tag is cleared when the next command runs, and a connection
+// that doesn't send TRACEID pays nothing but a string assignment per command.
+//
+// RESP3 attributes are not read by this server, so TRACEID is the only way to
+// set the tag. There's no SLOWLOG, the watchdog is what reports slow commands.
+
+const traceIDMaxLen = 64 // bytes
+
+// traceidCommand is TRACEID id.
+func traceidCommand(c *client) {
+	if len(c.args) != 2 {
+		c.replyAritryError()
+		return
+	}
+	id := c.args[1]
+	if len(id) == 0 || len(id) > traceIDMaxLen {
+		c.replyError("the trace id must be 1 to " +
+			strconv.Itoa(traceIDMaxLen) + " bytes")
+		return
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			c.replyError("the trace id must be printable and without spaces")
+			return
+		}
+	}
+	// copy the id so that it doesn't keep the args alive
+	c.nextTrace = string([]byte(id))
+	c.replyString("OK")
+}
+
+// startTrace moves the tag that TRACEID set to the command that's about to
+// run, which clears it for the commands after.
+func (c *client) startTrace(cmd *command) {
+	if cmd.name == "traceid" {
+		c.trace = ""
+		return
+	}
+	c.trace, c.nextTrace = c.nextTrace, ""
+}
+
+// traceField formats a TRACEID for a log line, or nothing without one.
+func traceField(trace string) string {
+	if trace == "" {
+		return ""
+	}
+	return " trace=" + trace
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	auditPath := filepath.Join(dir, "audit.log")
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"),
+		"--audit-log", "yes", "--audit-log-file", auditPath,
+		"--client-history-len", "8", "--watchdog-period", "50")
+	var log testLog
+	s.options.LogWriter = &log
+	stop := testServe(t, s, addr)
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+	mon := testDial(t, addr)
+	defer mon.close()
+	if v := mon.do("MONITOR"); v != "OK" {
+		t.Fatalf("expected 'OK', got '%v'", v)
+	}
+
+	for _, id := range []string{"", strings.Repeat("x", traceIDMaxLen+1), "a b", "a\x00"} {
+		if _, ok := conn.do("TRACEID", id).(error); !ok {
+			t.Fatalf("expected an error for %q", id)
+		}
+	}
+	if v := conn.do("TRACEID", "req-1"); v != "OK" {
+		t.Fatalf("expected 'OK', got '%v'", v)
+	}
+	conn.do("SET", "key", "value")
+	conn.do("SET", "key", "again") // the tag is cleared after one command
+	conn.do("TRACEID", "req-2")
+	conn.do("DEBUG", "SLEEP", "0.1")
+
+	// MONITOR has the tag in the brackets, after the address
+	var lines []string
+	for len(lines) < 3 {
+		v, err := mon.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line := v.(string); !strings.Contains(line, `"traceid"`) &&
+			!strings.Contains(line, `"TRACEID"`) {
+			lines = append(lines, line)
+		}
+	}
+	for i, expect := range []string{" trace=req-1] \"SET\" \"key\" \"value\"",
+		"] \"SET\" \"key\" \"again\"", " trace=req-2] \"DEBUG\""} {
+		if !strings.Contains(lines[i], expect) {
+			t.Fatalf("expected %q in %q", expect, lines[i])
+		}
+	}
+	if strings.Contains(lines[1], "trace=") {
+		t.Fatalf("expected no tag, got %q", lines[1])
+	}
+
+	// the audit log
+	testWaitForAudit(t, conn, 2)
+	events := testReadAudit(t, auditPath)
+	if len(events) != 2 || events[0].Trace != "req-1" || events[1].Trace != "" {
+		t.Fatalf("expected the tag on the first SET, got %+v", events)
+	}
+
+	// the watchdog report and its LATENCY sample
+	start := time.Now()
+	for !strings.Contains(log.String(), "trace=req-2 has held the lock") {
+		if time.Since(start) > time.Second*5 {
+			t.Fatalf("expected the tag in the watchdog report, got %q", log.String())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	e := conn.do("LATENCY", "LATEST").([]interface{})[0].([]interface{})
+	if len(e) != 5 || e[4] != "req-2" {
+		t.Fatalf("expected the tag in the latency sample, got %v", e)
+	}
+
+	// the history
+	id := conn.do("CLIENT", "ID")
+	var traces []string
+	for _, e := range conn.do("DEBUG", "CLIENT", itoa(id.(int))).([]interface{}) {
+		e := e.([]interface{})
+		if len(e) == 6 {
+			traces = append(traces, e[0].(string)+"="+e[5].(string))
+		}
+	}
+	if strings.Join(traces, " ") != "set=req-1 debug=req-2" {
+		t.Fatalf("expected the tags in the history, got %v", traces)
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"sort"
+	"time"
+)
+
+// Each database counts its keys by their expiration time, in slots of
+// ttlSlotSeconds, which is kept up to date as the expiration times are set,
+// removed, and as the keys expire. The counts are by the absolute time, so
+// they don't change as time passes, and the time left is worked out when the
+// histogram is read, by INFO keyspace and TTLSTATS. The time left is off by
+// up to a slot, and the keys that have expired and are not deleted yet are
+// counted as expiring within a minute.
+
+// ttlSlotSeconds is the width of the slots of the expiration times.
+const ttlSlotSeconds = 10
+
+// ttlBuckets are the time left of the histogram buckets, which are followed
+// by the keys that expire later and the keys that never expire.
+var ttlBuckets = []struct {
+	name string
+	max  time.Duration
+}{
+	{"1m", time.Minute},
+	{"10m", time.Minute * 10},
+	{"1h", time.Hour},
+	{"1d", time.Hour * 24},
+}
+
+const (
+	ttlLater = 4 // the bucket of the keys that expire after the last bucket
+	ttlNever = 5 // the bucket of the keys without an expiration time
+)
+
+// ttlHistogram is the number of keys in each bucket of ttlBuckets, then
+// ttlLater and ttlNever.
+type ttlHistogram [6]int
+
+// ttlSlot returns the slot of an expiration time.
+func ttlSlot(when time.Time) int64 {
+	return when.Unix() / ttlSlotSeconds
+}
+
+// setTTL sets the expiration time of a key, and moves the key to the slot of
+// the time.
+func (db *database) setTTL(key string, when time.Time) {
+	if old, ok := db.expires[key]; ok {
+		db.unslotTTL(old)
+	}
+	db.expires[key] = when
+	db.ttls[ttlSlot(when)]++
+}
+
+// clearTTL removes the expiration time of a key, if it has one.
+func (db *database) clearTTL(key string) {
+	if when, ok := db.expires[key]; ok {
+		delete(db.expires, key)
+		db.unslotTTL(when)
+	}
+}
+
+func (db *database) unslotTTL(when time.Time) {
+	slot := ttlSlot(when)
+	if db.ttls[slot] <= 1 {
+		delete(db.ttls, slot)
+	} else {
+		db.ttls[slot]--
+	}
+}
+
+// ttlHistogram returns the keys by the time that they have left. This is
+// safe to call while holding the read lock.
+func (db *database) ttlHistogram(now time.Time) ttlHistogram {
+	var h ttlHistogram
+	nowSlot := ttlSlot(now)
+next:
+	for slot, n := range db.ttls {
+		left := time.Duration(slot-nowSlot) * ttlSlotSeconds * time.Second
+		for i, b := range ttlBuckets {
+			if left < b.max {
+				h[i] += n
+				continue next
+			}
+		}
+		h[ttlLater] += n
+	}
+	h[ttlNever] = db.len() - len(db.expires)
+	return h
+}
+
+// add adds the counts of another histogram.
+func (h *ttlHistogram) add(h2 ttlHistogram) {
+	for i, n := range h2 {
+		h[i] += n
+	}
+}
+
+// ttlstatsCommand is TTLSTATS, which replies with the histogram of the time
+// left of the keys, for all the databases and for each database that has
+// keys.
+func ttlstatsCommand(c *client) {
+	if len(c.args) != 1 {
+		c.replyAritryError()
+		return
+	}
+	now := time.Now()
+	nums := make([]int, 0, len(c.s.dbs))
+	for num, db := range c.s.dbs {
+		if db.len() > 0 {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+	var total ttlHistogram
+	hists := make([]ttlHistogram, len(nums))
+	for i, num := range nums {
+		hists[i] = c.s.dbs[num].ttlHistogram(now)
+		total.add(hists[i])
+	}
+	c.replyMultiBulkLen(6)
+	c.replyBulk("slot-seconds")
+	c.replyInt(ttlSlotSeconds)
+	c.replyBulk("total")
+	replyTTLHistogram(c, total)
+	c.replyBulk("databases")
+	c.replyMultiBulkLen(len(nums))
+	for i, num := range nums {
+		c.replyMultiBulkLen(2)
+		c.replyInt(num)
+		replyTTLHistogram(c, hists[i])
+	}
+}
+
+// replyTTLHistogram replies with the keys and the buckets of a histogram.
+func replyTTLHistogram(c *client, h ttlHistogram) {
+	var keys int
+	for _, n := range h {
+		keys += n
+	}
+	c.replyMultiBulkLen(len(h)*2 + 2)
+	c.replyBulk("keys")
+	c.replyInt(keys)
+	for i, b := range ttlBuckets {
+		c.replyBulk("ttl-" + b.name)
+		c.replyInt(h[i])
+	}
+	c.replyBulk("ttl-later")
+	c.replyInt(h[ttlLater])
+	c.replyBulk("ttl-never")
+	c.replyInt(h[ttlNever])
+}
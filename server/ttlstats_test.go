@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTTLHistogram(t *testing.T) {
+	db := newDB(0)
+	now := time.Now()
+	for i, ttl := range []time.Duration{
+		time.Second * 30, time.Minute * 5, time.Minute * 30, time.Hour * 5,
+		time.Hour * 24 * 5, time.Hour * 24 * 400,
+	} {
+		key := fmt.Sprint("key:", i)
+		db.set(key, "x")
+		db.setExpire(key, now.Add(ttl))
+	}
+	db.set("forever", "x")
+	if h := db.ttlHistogram(now); fmt.Sprint(h) != "[1 1 1 1 2 1]" {
+		t.Fatalf("expected [1 1 1 1 2 1], got %v", h)
+	}
+
+	// moving, removing and replacing the expiration times
+	db.setExpire("key:5", now.Add(time.Second*20))
+	db.persist("key:4")
+	db.set("key:3", "y")
+	db.update("key:2", "y")
+	db.del("key:1")
+	if h := db.ttlHistogram(now); fmt.Sprint(h) != "[2 0 1 0 0 3]" {
+		t.Fatalf("expected [2 0 1 0 0 3], got %v", h)
+	}
+	var slotted int
+	for _, n := range db.ttls {
+		slotted += n
+	}
+	if slotted != 3 {
+		t.Fatalf("expected 3 keys in the slots, got %v", db.ttls)
+	}
+
+	// keys that expired are counted until they are deleted
+	if h := db.ttlHistogram(now.Add(time.Hour * 2)); fmt.Sprint(h) != "[3 0 0 0 0 3]" {
+		t.Fatalf("expected [3 0 0 0 0 3], got %v", h)
+	}
+	db.flush()
+	if h := db.ttlHistogram(now); fmt.Sprint(h) != "[0 0 0 0 0 0]" || len(db.ttls) != 0 {
+		t.Fatalf("expected an empty histogram, got %v %v", h, db.ttls)
+	}
+}
+
+func TestTTLStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, stop := testStartServer(t, filepath.Join(dir, "appendonly.aof"))
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	conn.do("SET", "soon", "x", "EX", "30")
+	conn.do("SET", "hour", "x", "EX", "1800")
+	conn.do("SET", "never", "x")
+	conn.do("SELECT", "2")
+	conn.do("SET", "week", "x", "EX", "604800")
+	conn.do("SET", "gone", "x", "PX", "1")
+	time.Sleep(time.Millisecond * 10)
+	if v := conn.do("DEL", "gone"); v != 0 {
+		t.Fatalf("expected the key to have expired, got %v", v)
+	}
+
+	res := conn.do("TTLSTATS").([]interface{})
+	if got := fmt.Sprint(res); got != "[slot-seconds 10 "+
+		"total [keys 4 ttl-1m 1 ttl-10m 0 ttl-1h 1 ttl-1d 0 ttl-later 1 ttl-never 1] "+
+		"databases [[0 [keys 3 ttl-1m 1 ttl-10m 0 ttl-1h 1 ttl-1d 0 ttl-later 0 ttl-never 1]] "+
+		"[2 [keys 1 ttl-1m 0 ttl-10m 0 ttl-1h 0 ttl-1d 0 ttl-later 1 ttl-never 0]]]]" {
+		t.Fatalf("unexpected reply %s", got)
+	}
+	info := conn.do("INFO", "keyspace").(string)
+	if !strings.Contains(info, "db0:keys=3,expires=2,avg_ttl=0,ttl_1m=1,ttl_10m=0,"+
+		"ttl_1h=1,ttl_1d=0,ttl_later=0,ttl_never=1\n") ||
+		!strings.Contains(info, "db2:keys=1,expires=1,avg_ttl=0,ttl_1m=0,ttl_10m=0,"+
+			"ttl_1h=0,ttl_1d=0,ttl_later=1,ttl_never=0\n") {
+		t.Fatalf("unexpected INFO keyspace\n%s", info)
+	}
+	if _, ok := conn.do("TTLSTATS", "x").(error); !ok {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"errors"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// The build metadata can be set when building, such as:
+//
+//	go build -ldflags "-X github.com/tidwall/sider/server.version=1.2.3 \
+//	  -X github.com/tidwall/sider/server.gitSHA=$(git rev-parse HEAD) \
+//	  -X github.com/tidwall/sider/server.buildDate=$(date -u +%FT%TZ)"
+//
+// Otherwise the module version and the vcs settings that go build stamps
+// into the binary are used.
+var (
+	version   string
+	gitSHA    string
+	buildDate string
+)
+
+// The Redis version that the server advertises in INFO and HELLO, unless the
+// compat-redis-version config changes it. Client libraries use it to decide
+// which commands they can send, so it's not the version of the server.
+const defaultCompatRedisVersion = "7.0.0"
+
+// buildInfo returns the version, the git sha, and the build date of the
+// binary. The unknown ones are empty.
+func buildInfo() (ver, sha, date string) {
+	ver, sha, date = version, gitSHA, buildDate
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ver, sha, date
+	}
+	if ver == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		ver = strings.TrimPrefix(info.Main.Version, "v")
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if sha == "" {
+				sha = setting.Value
+			}
+		case "vcs.time":
+			if date == "" {
+				date = setting.Value
+			}
+		}
+	}
+	return ver, sha, date
+}
+
+// parseCompatRedisVersion checks that a compat-redis-version is
+// major.minor.patch.
+func parseCompatRedisVersion(value string) (string, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return "", errors.New("argument must be a version such as " +
+			defaultCompatRedisVersion)
+	}
+	for _, part := range parts {
+		if _, err := strconv.ParseUint(part, 10, 16); err != nil {
+			return "", errors.New("argument must be a version such as " +
+				defaultCompatRedisVersion)
+		}
+	}
+	return value, nil
+}
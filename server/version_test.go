@@ -0,0 +1,140 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testVersionAtLeast checks a version the way client libraries do when they
+// decide which commands to use, such as GETDEL from 6.2.0.
+func testVersionAtLeast(version string, major, minor int) bool {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	vmajor, _ := strconv.Atoi(parts[0])
+	vminor, _ := strconv.Atoi(parts[1])
+	return vmajor > major || (vmajor == major && vminor >= minor)
+}
+
+func TestCompatRedisVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"))
+	stop := testServe(t, s, addr)
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	infoField := func(name string) string {
+		info := conn.do("INFO", "server").(string)
+		for _, line := range strings.Split(info, "\n") {
+			if strings.HasPrefix(line, name+":") {
+				return strings.TrimSpace(line[len(name)+1:])
+			}
+		}
+		t.Fatalf("expected %s in\n%s", name, info)
+		return ""
+	}
+	helloField := func(args ...string) map[string]interface{} {
+		v := conn.do(append([]string{"HELLO"}, args...)...).([]interface{})
+		m := make(map[string]interface{})
+		for i := 0; i < len(v); i += 2 {
+			m[v[i].(string)] = v[i+1]
+		}
+		return m
+	}
+
+	if v := infoField("redis_version"); v != defaultCompatRedisVersion {
+		t.Fatalf("expected '%s', got '%s'", defaultCompatRedisVersion, v)
+	}
+	if v := infoField("sider_version"); v != s.options.Version {
+		t.Fatalf("expected '%s', got '%s'", s.options.Version, v)
+	}
+	if !testVersionAtLeast(infoField("redis_version"), 6, 2) {
+		t.Fatal("expected GETDEL to be detected")
+	}
+
+	// an older advertised version turns the newer commands off in clients,
+	// while the version of the server stays the same
+	if v := conn.do("CONFIG", "SET", "compat-redis-version", "6.0.16"); v != "OK" {
+		t.Fatalf("expected 'OK', got '%v'", v)
+	}
+	if v := infoField("redis_version"); testVersionAtLeast(v, 6, 2) {
+		t.Fatalf("expected GETDEL to not be detected with '%s'", v)
+	}
+	if v := infoField("sider_version"); v != s.options.Version {
+		t.Fatalf("expected '%s', got '%s'", s.options.Version, v)
+	}
+	hello := helloField("2")
+	if hello["version"] != "6.0.16" || hello["sider_version"] != s.options.Version ||
+		hello["proto"] != 2 || hello["server"] != "redis" {
+		t.Fatalf("unexpected HELLO reply %v", hello)
+	}
+	for _, bad := range []string{"6", "6.2", "6.x.0", "6.2.0.1", ""} {
+		if _, ok := conn.do("CONFIG", "SET", "compat-redis-version", bad).(error); !ok {
+			t.Fatalf("expected an error for '%s'", bad)
+		}
+	}
+}
+
+func TestHello(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"), "--requirepass", "secret")
+	stop := testServe(t, s, addr)
+	conn := testDial(t, addr)
+	defer func() {
+		conn.do("CONFIG", "SET", "requirepass", "")
+		conn.close()
+		stop()
+	}()
+
+	for _, tt := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"HELLO", "4"}, "NOPROTO"},
+		{[]string{"HELLO", "x"}, "ERR Protocol version"},
+		{[]string{"HELLO", "2"}, "NOAUTH"},
+		{[]string{"HELLO", "2", "AUTH", "default", "wrong"}, "WRONGPASS"},
+		{[]string{"HELLO", "2", "AUTH", "default"}, "ERR Syntax error"},
+		{[]string{"HELLO", "2", "FOO"}, "ERR Syntax error"},
+	} {
+		err, ok := conn.do(tt.args...).(error)
+		if !ok || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Fatalf("%v: expected '%s', got '%v'", tt.args, tt.err, err)
+		}
+	}
+	v := conn.do("HELLO", "2", "AUTH", "default", "secret", "SETNAME", "worker")
+	if len(v.([]interface{})) != 16 {
+		t.Fatalf("expected 8 pairs, got %v", v)
+	}
+	if info := conn.do("CLIENT", "INFO").(string); !strings.Contains(info, " name=worker ") {
+		t.Fatalf("expected the name, got %q", info)
+	}
+	if _, ok := conn.do("HELLO", "2", "SETNAME", "a b").(error); !ok {
+		t.Fatal("expected an error for a name with a space")
+	}
+
+	// RESP3 replies with a map
+	conn.send("HELLO", "3")
+	if line, err := conn.rd.ReadString('\n'); err != nil || line != "%8\r\n" {
+		t.Fatalf("expected a map of 8 pairs, got %q, %v", line, err)
+	}
+	for i := 0; i < 16; i++ {
+		if _, err := conn.read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
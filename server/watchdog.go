@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With a single server lock, one slow command stalls every client. The
+// watchdog samples the command that holds the write lock, and when it has
+// held the lock for longer than the watchdog-period, the command, its keys,
+// its client, and the stack of every goroutine are logged. A command is only
+// reported once, and the time that it held the lock is recorded as the
+// "watchdog" event of LATENCY LATEST.
+
+const watchdogInterval = time.Millisecond * 10 // how often the holder is checked
+
+// lockHolder is the command that holds the write lock.
+type lockHolder struct {
+	mu       sync.Mutex
+	c        *client
+	cmd      *command
+	since    time.Time // zero when the lock is not held by a command
+	trace    string    // the TRACEID of the command
+	reported bool      // the watchdog has reported the command
+}
+
+// watchdogEnabled returns true when the write lock holder must be recorded.
+func (s *Server) watchdogEnabled() bool {
+	return atomic.LoadInt64(&s.watchdogPeriod) > 0
+}
+
+// lockAcquired is called by exec after the command took the write lock.
+func (s *Server) lockAcquired(c *client, cmd *command) {
+	if !s.watchdogEnabled() {
+		return
+	}
+	h := &s.lockHolder
+	h.mu.Lock()
+	h.c, h.cmd, h.since, h.reported = c, cmd, time.Now(), false
+	h.trace = c.trace
+	h.mu.Unlock()
+}
+
+// lockReleased is called before the command releases the write lock. WAITAOF
+// calls it before it waits without the lock, and the rest of it is not
+// watched, since it only writes the reply.
+func (s *Server) lockReleased() {
+	h := &s.lockHolder
+	h.mu.Lock()
+	if h.reported {
+		s.latency.add("watchdog", time.Since(h.since), h.trace)
+	}
+	h.c, h.cmd, h.since, h.reported = nil, nil, time.Time{}, false
+	h.trace = ""
+	h.mu.Unlock()
+}
+
+// startWatchdog runs a background routine that checks the write lock holder
+// until stopWatchdog is called.
+func (s *Server) startWatchdog() {
+	s.workers.start(workerWatchdog, func(ctx context.Context) {
+		t := time.NewTicker(watchdogInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				s.checkLockHolder()
+			}
+		}
+	})
+}
+
+func (s *Server) stopWatchdog() {
+	s.stopWorkers(workerWatchdog)
+}
+
+// checkLockHolder reports the command that holds the write lock for longer
+// than the watchdog-period.
+func (s *Server) checkLockHolder() {
+	period := time.Duration(atomic.LoadInt64(&s.watchdogPeriod)) * time.Millisecond
+	if period <= 0 {
+		return
+	}
+	h := &s.lockHolder
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.since.IsZero() || h.reported {
+		return
+	}
+	held := time.Since(h.since)
+	if held < period {
+		return
+	}
+	h.reported = true
+	atomic.AddUint64(&s.watchdogTrips, 1)
+	s.latency.add("watchdog", held, h.trace)
+	// the client's args belong to the command that holds the lock, which
+	// doesn't change them while it runs.
+	s.lwarningf("--- WATCHDOG: command '%s' keys=[%s] client id=%d addr=%s%s "+
+		"has held the lock for %s", h.cmd.name,
+		strings.Join(h.cmd.keys(h.c.args), " "), h.c.id, h.c.addr,
+		traceField(h.trace), held.Round(time.Millisecond))
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		s.lwarningf("%s", line)
+	}
+	s.lwarningf("--- WATCHDOG END")
+}
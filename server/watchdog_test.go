@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLog is a log writer that's safe to read while the server writes.
+type testLog struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *testLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *testLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+func TestWatchdog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, addr := testNewServer(t, filepath.Join(dir, "appendonly.aof"))
+	var log testLog
+	s.options.LogWriter = &log
+	stop := testServe(t, s, addr)
+	defer stop()
+	conn := testDial(t, addr)
+	defer conn.close()
+
+	// disabled by default
+	conn.do("DEBUG", "SLEEP", "0.1")
+	if strings.Contains(log.String(), "WATCHDOG") {
+		t.Fatal("expected no watchdog report")
+	}
+
+	conn.do("CONFIG", "SET", "watchdog-period", "50")
+	conn.do("SET", "key", "value")
+	if strings.Contains(log.String(), "WATCHDOG") {
+		t.Fatal("expected no watchdog report for a fast command")
+	}
+
+	// the LATENCY command doesn't wait on the lock
+	conn2 := testDial(t, addr)
+	defer conn2.close()
+	conn.send("DEBUG", "SLEEP", "0.3")
+	time.Sleep(time.Millisecond * 150)
+	if !strings.Contains(log.String(), "--- WATCHDOG: command 'debug'") {
+		t.Fatalf("expected a watchdog report, got %q", log.String())
+	}
+	v := conn2.do("LATENCY", "LATEST").([]interface{})
+	if len(v) != 1 || v[0].([]interface{})[0] != "watchdog" {
+		t.Fatalf("expected the watchdog event, got %v", v)
+	}
+	conn.read()
+
+	// the event has the time that the lock was held
+	e := conn.do("LATENCY", "LATEST").([]interface{})[0].([]interface{})
+	if latest := e[2].(int); latest < 300 {
+		t.Fatalf("expected at least 300 ms, got %d", latest)
+	}
+	if !strings.Contains(log.String(), "goroutine ") {
+		t.Fatal("expected the stacks in the report")
+	}
+	if info := conn.do("INFO", "stats").(string); !strings.Contains(info, "watchdog_stuck_commands:1") {
+		t.Fatalf("expected one stuck command, got %q", info)
+	}
+	if n := conn.do("LATENCY", "RESET"); n != 1 {
+		t.Fatalf("expected '1', got '%v'", n)
+	}
+	if v := conn.do("LATENCY", "LATEST").([]interface{}); len(v) != 0 {
+		t.Fatalf("expected no events, got %v", v)
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The background routines of the server are started with s.workers.start,
+// under the name of their subsystem, and stopped with s.workers.stop, which
+// cancels the context of the subsystem and waits for its routines. The
+// ListenAndServe function stops the subsystems in order when the server
+// shuts down:
+//
+//	stop accepting, and wait for the connections to finish their commands
+//	stop the background jobs, such as BIGKEYS and BGREWRITEAOF
+//	stop the expire, defrag and watchdog loops
+//	flush and close the aof, and stop its sync loop
+//	stop the audit log and the write behind, which send what's queued
+//
+// so that no routine outlives the server, and no write that was replied to
+// is missing from the aof. The lru clock is the exception, it's shared by
+// all the servers of the process.
+
+// workerStopTimeout is how long stop waits for the routines of a subsystem.
+const workerStopTimeout = time.Second * 10
+
+// Workers are the subsystems of the server.
+const (
+	workerClients  = "clients"  // the connection handlers
+	workerJobs     = "jobs"     // BIGKEYS, KEYSTATS, EXPORT and BGREWRITEAOF
+	workerExpire   = "expire"   // the active expire loop
+	workerDefrag   = "defrag"   // the active defrag loop
+	workerWatchdog = "watchdog" // the lock holder watchdog
+	workerAOF      = "aof"      // the aof sync loop
+	workerAudit    = "audit"    // the audit log writer
+	workerWrites   = "writes"   // the write behind
+	workerSignals  = "signals"  // the SIGHUP handler and the fatal error watch
+)
+
+// workerGroup are the routines of a subsystem.
+type workerGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	count  int // the routines that are running, guarded by workers.mu
+}
+
+// workers are the background routines of the server, by subsystem.
+type workers struct {
+	mu     sync.Mutex
+	groups map[string]*workerGroup
+}
+
+// start runs fn in a new routine of the subsystem. The context is cancelled
+// when the subsystem is stopped.
+func (w *workers) start(name string, fn func(ctx context.Context)) {
+	w.mu.Lock()
+	if w.groups == nil {
+		w.groups = make(map[string]*workerGroup)
+	}
+	g := w.groups[name]
+	if g == nil {
+		g = &workerGroup{}
+		g.ctx, g.cancel = context.WithCancel(context.Background())
+		w.groups[name] = g
+	}
+	g.count++
+	g.wg.Add(1)
+	w.mu.Unlock()
+	go func() {
+		defer func() {
+			w.mu.Lock()
+			g.count--
+			w.mu.Unlock()
+			g.wg.Done()
+		}()
+		fn(g.ctx)
+	}()
+}
+
+// stop cancels the context of the subsystem and waits for its routines,
+// for up to the timeout. Returns false when they are still running. The
+// routines that are started after stop belong to a new group.
+func (w *workers) stop(name string, timeout time.Duration) bool {
+	w.mu.Lock()
+	g := w.groups[name]
+	delete(w.groups, name)
+	w.mu.Unlock()
+	if g == nil {
+		return true
+	}
+	g.cancel()
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// running returns the number of routines of the subsystem.
+func (w *workers) running(name string) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if g := w.groups[name]; g != nil {
+		return g.count
+	}
+	return 0
+}
+
+// stopWorkers stops the subsystem, and logs the routines that didn't stop in
+// time.
+func (s *Server) stopWorkers(name string) {
+	if !s.workers.stop(name, workerStopTimeout) {
+		s.lwarningf("The %s routines didn't stop within %s", name, workerStopTimeout)
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkers(t *testing.T) {
+	var w workers
+	release := make(chan struct{})
+	w.start("a", func(ctx context.Context) { <-ctx.Done() })
+	w.start("a", func(ctx context.Context) { <-ctx.Done() })
+	w.start("b", func(ctx context.Context) { <-release })
+	if n := w.running("a"); n != 2 {
+		t.Fatalf("expected 2 routines, got %d", n)
+	}
+	if !w.stop("a", time.Second) {
+		t.Fatal("expected the routines to stop")
+	}
+	// a routine that doesn't watch its context
+	if w.stop("b", time.Millisecond*10) {
+		t.Fatal("expected the stop to time out")
+	}
+	close(release)
+	if !w.stop("missing", 0) {
+		t.Fatal("expected a missing group to be stopped")
+	}
+}
+
+// TestCloseLeaks runs a server with most of its background routines, closes
+// it while writes are in flight, and checks that no routine is left and that
+// every write that was replied to is in the aof.
+func TestCloseLeaks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+
+	// the lru clock is shared by the servers of the process
+	startLRUClock()
+	before := testGoroutines()
+
+	s, addr := testNewServerOptions(t, &Options{
+		AppendOnlyPath: aofPath,
+		WriteBehind:    func(batch []KeyWrite) error { return nil },
+	}, "--audit-log", "yes", "--audit-log-file", filepath.Join(dir, "audit.log"),
+		"--activedefrag", "yes", "--watchdog-period", "1000",
+		"--unixsocket", filepath.Join(dir, "sider.sock"),
+		"--write-behind-patterns", "*")
+	testServe(t, s, addr)
+
+	conn := testDial(t, addr)
+	defer conn.close()
+	for i := 0; i < 20000; i++ {
+		conn.send("SET", "key:"+strconv.Itoa(i), "x", "EX", "100")
+	}
+	for i := 0; i < 20000; i++ {
+		conn.read()
+	}
+	conn.do("BIGKEYS")
+	conn.do("KEYSTATS")
+	conn.do("BGREWRITEAOF")
+	blocked := testDial(t, addr)
+	defer blocked.close()
+	blocked.send("BLPOP", "queue", "0")
+	testWaitBlocked(t, s, 1)
+
+	// the writers count the increments that were replied to
+	const writers = 8
+	acked := make([]int, writers)
+	var wg, started sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn := testDial(t, addr)
+			defer conn.close()
+			for {
+				conn.send("INCR", "counter:"+strconv.Itoa(i))
+				v, err := conn.read()
+				if _, ok := v.(int); !ok || err != nil {
+					return
+				}
+				acked[i] = v.(int)
+				if acked[i] == 1 {
+					started.Done()
+				}
+			}
+		}(i)
+	}
+	started.Wait()
+	time.Sleep(time.Millisecond * 50)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	conn.close()
+	blocked.close()
+	testNoLeakedGoroutines(t, before)
+
+	s, addr = testNewServer(t, aofPath)
+	stop := testServe(t, s, addr)
+	defer stop()
+	if s.aofTruncated != 0 {
+		t.Fatalf("expected a complete aof, %d bytes were truncated", s.aofTruncated)
+	}
+	for i, n := range acked {
+		// the last increment may run without its reply being read
+		v, _ := s.Do("GET", "counter:"+strconv.Itoa(i))
+		if v != strconv.Itoa(n) && v != strconv.Itoa(n+1) {
+			t.Fatalf("writer %d: expected %d, got %v", i, n, v)
+		}
+	}
+	if v, _ := s.Do("DBSIZE"); v != 20000+writers {
+		t.Fatalf("expected %d keys, got %v", 20000+writers, v)
+	}
+}
+
+// testGoroutines returns the stacks of the running goroutines by their
+// header, such as "goroutine 7".
+func testGoroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+	stacks := make(map[string]string)
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		header := stack
+		if i := strings.Index(stack, " ["); i != -1 {
+			header = stack[:i]
+		}
+		stacks[header] = stack
+	}
+	return stacks
+}
+
+// testNoLeakedGoroutines waits for the goroutines that were started after
+// before to exit. The signal loop of the runtime is started once for the
+// process by the first signal.Notify.
+func testNoLeakedGoroutines(t *testing.T, before map[string]string) {
+	t.Helper()
+	var leaked []string
+	for start := time.Now(); time.Since(start) < time.Second*5; time.Sleep(time.Millisecond * 10) {
+		leaked = leaked[:0]
+		for header, stack := range testGoroutines() {
+			if _, ok := before[header]; !ok && !strings.Contains(stack, "testGoroutines") &&
+				!strings.Contains(stack, "os/signal.loop") {
+				leaked = append(leaked, stack)
+			}
+		}
+		if len(leaked) == 0 {
+			return
+		}
+	}
+	t.Fatalf("%d goroutines leaked:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+}
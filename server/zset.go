@@ -0,0 +1,834 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// A sorted set keeps the score of each member in a map, for ZSCORE, and the
+// members in a skiplist that's ordered by the score and then by the member,
+// like Redis. Each link of the skiplist has the number of nodes that it
+// skips, so that the node at a rank is found in O(log n), and ZRANGE walks
+// the list from there.
+
+const (
+	zslMaxLevel = 32   // enough for 2^64 members
+	zslP        = 0.25 // the chance of a node to be in the next level
+)
+
+type zslNode struct {
+	member   string
+	score    float64
+	backward *zslNode
+	level    []zslLevel
+}
+
+type zslLevel struct {
+	forward *zslNode
+	span    int // the number of nodes from this node to forward
+}
+
+type zset struct {
+	m      map[string]float64
+	header *zslNode
+	tail   *zslNode
+	level  int
+}
+
+func newZSet() *zset {
+	return &zset{
+		m:      make(map[string]float64),
+		header: &zslNode{level: make([]zslLevel, zslMaxLevel)},
+		level:  1,
+	}
+}
+
+func (z *zset) len() int {
+	return len(z.m)
+}
+
+// zslLess returns true when the score and the member of a node come before
+// score and member.
+func zslLess(x *zslNode, score float64, member string) bool {
+	return x.score < score || (x.score == score && x.member < member)
+}
+
+func zslRandomLevel() int {
+	level := 1
+	for level < zslMaxLevel && rand.Float64() < zslP {
+		level++
+	}
+	return level
+}
+
+// set sets the score of a member and returns true when the member is new.
+func (z *zset) set(member string, score float64) bool {
+	old, ok := z.m[member]
+	if ok {
+		if old == score {
+			return false
+		}
+		z.unlink(old, member)
+	}
+	z.m[member] = score
+	z.link(score, member)
+	return !ok
+}
+
+func (z *zset) score(member string) (float64, bool) {
+	score, ok := z.m[member]
+	return score, ok
+}
+
+func (z *zset) del(member string) bool {
+	score, ok := z.m[member]
+	if !ok {
+		return false
+	}
+	delete(z.m, member)
+	z.unlink(score, member)
+	return true
+}
+
+// link inserts a member that's not in the skiplist.
+func (z *zset) link(score float64, member string) {
+	var update [zslMaxLevel]*zslNode
+	var rank [zslMaxLevel]int
+	x := z.header
+	for i := z.level - 1; i >= 0; i-- {
+		if i < z.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && zslLess(x.level[i].forward, score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	// the map already has the member
+	length := len(z.m) - 1
+	level := zslRandomLevel()
+	if level > z.level {
+		for i := z.level; i < level; i++ {
+			update[i] = z.header
+			update[i].level[i].span = length
+		}
+		z.level = level
+	}
+	x = &zslNode{member: member, score: score, level: make([]zslLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < z.level; i++ {
+		update[i].level[i].span++
+	}
+	if update[0] != z.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		z.tail = x
+	}
+}
+
+// unlink removes a member from the skiplist.
+func (z *zset) unlink(score float64, member string) {
+	var update [zslMaxLevel]*zslNode
+	x := z.header
+	for i := z.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zslLess(x.level[i].forward, score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return
+	}
+	for i := 0; i < z.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		z.tail = x.backward
+	}
+	for z.level > 1 && z.header.level[z.level-1].forward == nil {
+		z.level--
+	}
+}
+
+// byRank returns the node at a rank, where the first node is 1.
+func (z *zset) byRank(rank int) *zslNode {
+	x := z.header
+	var traversed int
+	for i := z.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// ascend iterates over the members in order.
+func (z *zset) ascend(iterator func(member string, score float64) bool) {
+	for x := z.header.level[0].forward; x != nil; x = x.level[0].forward {
+		if !iterator(x.member, x.score) {
+			return
+		}
+	}
+}
+
+// members returns the members in order.
+func (z *zset) members() []string {
+	members := make([]string, 0, len(z.m))
+	z.ascend(func(member string, score float64) bool {
+		members = append(members, member)
+		return true
+	})
+	return members
+}
+
+// scores returns the members with their formatted scores.
+func (z *zset) scores() map[string]string {
+	scores := make(map[string]string, len(z.m))
+	for member, score := range z.m {
+		scores[member] = formatDouble(score)
+	}
+	return scores
+}
+
+// parseScore parses a score, which may be inf or -inf but not NaN.
+func parseScore(s string) (float64, error) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, strconv.ErrSyntax
+	}
+	return score, nil
+}
+
+// zaddCommand is ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score
+// member ...]. Replies with the number of new members, the number of new and
+// changed members with CH, or the new score with INCR, which is nil when the
+// options prevented the change.
+func zaddCommand(c *client) {
+	if len(c.args) < 4 {
+		c.replyAritryError()
+		return
+	}
+	var nx, xx, gt, lt, ch, incr bool
+	i := 2
+options:
+	for ; i < len(c.args); i++ {
+		switch strings.ToLower(c.args[i]) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "gt":
+			gt = true
+		case "lt":
+			lt = true
+		case "ch":
+			ch = true
+		case "incr":
+			incr = true
+		default:
+			break options
+		}
+	}
+	pairs := c.args[i:]
+	switch {
+	case len(pairs) == 0 || len(pairs)%2 != 0:
+		c.replySyntaxError()
+		return
+	case nx && xx:
+		c.replyError("XX and NX options at the same time are not compatible")
+		return
+	case (gt && lt) || (nx && (gt || lt)):
+		c.replyError("GT, LT, and/or NX options at the same time are not compatible")
+		return
+	case incr && len(pairs) > 2:
+		c.replyError("INCR option supports a single increment-element pair")
+		return
+	}
+	// the scores are checked before any member is changed
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		score, err := parseScore(pairs[j*2])
+		if err != nil {
+			c.replyError("value is not a valid float")
+			return
+		}
+		scores[j] = score
+	}
+	z, ok := c.db.getZSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	var added, changed int
+	var result float64
+	var skipped bool
+	for j, score := range scores {
+		member := pairs[j*2+1]
+		var cur float64
+		var exists bool
+		if z != nil {
+			cur, exists = z.score(member)
+		}
+		if !exists {
+			if xx {
+				skipped = true
+				continue
+			}
+			if z == nil {
+				z, _ = c.db.getZSet(c.args[1], true)
+			}
+			z.set(member, score)
+			added++
+			result = score
+			continue
+		}
+		if nx {
+			skipped = true
+			continue
+		}
+		if incr {
+			score += cur
+			if math.IsNaN(score) {
+				c.replyError("resulting score is not a number (NaN)")
+				return
+			}
+		}
+		if (gt && score <= cur) || (lt && score >= cur) {
+			skipped = true
+			continue
+		}
+		if score != cur {
+			z.set(member, score)
+			changed++
+		}
+		result = score
+	}
+	c.dirty += added + changed
+	switch {
+	case incr && skipped:
+		c.replyNull()
+	case incr:
+		c.replyDoubleOrBulk(result)
+	case ch:
+		c.replyInt(added + changed)
+	default:
+		c.replyInt(added)
+	}
+}
+
+func zscoreCommand(c *client) {
+	if len(c.args) != 3 {
+		c.replyAritryError()
+		return
+	}
+	z, ok := c.db.getZSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if z == nil {
+		c.replyNull()
+		return
+	}
+	score, ok := z.score(c.args[2])
+	if !ok {
+		c.replyNull()
+		return
+	}
+	c.replyDoubleOrBulk(score)
+}
+
+func zcardCommand(c *client) {
+	if len(c.args) != 2 {
+		c.replyAritryError()
+		return
+	}
+	z, ok := c.db.getZSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if z == nil {
+		c.replyInt(0)
+		return
+	}
+	c.replyInt(z.len())
+}
+
+// zremCommand is ZREM key member [member ...]. The key is deleted with its
+// last member.
+func zremCommand(c *client) {
+	if len(c.args) < 3 {
+		c.replyAritryError()
+		return
+	}
+	z, ok := c.db.getZSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if z == nil {
+		c.replyInt(0)
+		return
+	}
+	var count int
+	for _, member := range c.args[2:] {
+		if z.del(member) {
+			count++
+		}
+	}
+	if z.len() == 0 {
+		c.db.del(c.args[1])
+	}
+	c.dirty += count
+	c.replyInt(count)
+}
+
+// zrangeCommand is ZRANGE key start stop [REV] [WITHSCORES]. The indexes are
+// ranks, from the highest score with REV, and resolve like LRANGE. With
+// WITHSCORES each member is followed by its score, or is paired with it in
+// an array for RESP3.
+func zrangeCommand(c *client) {
+	if len(c.args) < 4 {
+		c.replyAritryError()
+		return
+	}
+	var rev, withScores bool
+	for _, arg := range c.args[4:] {
+		switch strings.ToLower(arg) {
+		case "rev":
+			rev = true
+		case "withscores":
+			withScores = true
+		default:
+			c.replySyntaxError()
+			return
+		}
+	}
+	start, err := strconv.ParseInt(c.args[2], 10, 64)
+	if err != nil {
+		c.replyInvalidIntError()
+		return
+	}
+	stop, err := strconv.ParseInt(c.args[3], 10, 64)
+	if err != nil {
+		c.replyInvalidIntError()
+		return
+	}
+	z, ok := c.db.getZSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if z == nil {
+		c.replyMultiBulkLen(0)
+		return
+	}
+	first, last, ok := rangeIndexes(int(start), int(stop), z.len(), false)
+	if !ok {
+		c.replyMultiBulkLen(0)
+		return
+	}
+	nodes := make([]*zslNode, 0, last-first+1)
+	var x *zslNode
+	if rev {
+		x = z.byRank(z.len() - first)
+	} else {
+		x = z.byRank(first + 1)
+	}
+	for ; len(nodes) < cap(nodes); x = x.next(rev) {
+		nodes = append(nodes, x)
+	}
+	replyZSetNodes(c, nodes, withScores)
+}
+
+// next returns the next node in order, or the previous one for rev.
+func (x *zslNode) next(rev bool) *zslNode {
+	if rev {
+		return x.backward
+	}
+	return x.level[0].forward
+}
+
+// replyZSetNodes replies with the members of nodes. With withScores each
+// member is followed by its score, or is paired with it in an array for
+// RESP3.
+func replyZSetNodes(c *client, nodes []*zslNode, withScores bool) {
+	if withScores && c.resp != 3 {
+		c.replyMultiBulkLen(len(nodes) * 2)
+	} else {
+		c.replyMultiBulkLen(len(nodes))
+	}
+	for _, x := range nodes {
+		if withScores && c.resp == 3 {
+			c.replyMultiBulkLen(2)
+		}
+		c.replyBulk(x.member)
+		if withScores {
+			c.replyDoubleOrBulk(x.score)
+		}
+	}
+}
+
+// The ranges by score and by member have a min and a max, which are
+// inclusive unless they start with '('. The score bounds are floats that
+// may be -inf and +inf, and the member bounds start with '[' or '(', or are
+// '-' and '+' for the lowest and the highest member. The ranges by member
+// expect the members to have the same score, like Redis, and are undefined
+// otherwise.
+
+// zslRange is a range of the nodes of a skiplist.
+type zslRange interface {
+	// gteMin returns true when the node is at or after the min.
+	gteMin(x *zslNode) bool
+	// lteMax returns true when the node is at or before the max.
+	lteMax(x *zslNode) bool
+}
+
+// zscoreRange is a range of scores.
+type zscoreRange struct {
+	min, max     float64
+	minex, maxex bool // the bounds are exclusive
+}
+
+func (r zscoreRange) gteMin(x *zslNode) bool {
+	if r.minex {
+		return x.score > r.min
+	}
+	return x.score >= r.min
+}
+
+func (r zscoreRange) lteMax(x *zslNode) bool {
+	if r.maxex {
+		return x.score < r.max
+	}
+	return x.score <= r.max
+}
+
+// parseScoreBound parses a bound of a range of scores.
+func parseScoreBound(s string) (score float64, ex bool, err error) {
+	if strings.HasPrefix(s, "(") {
+		s, ex = s[1:], true
+	}
+	score, err = parseScore(s)
+	return score, ex, err
+}
+
+// parseScoreRange parses the min and max of a range of scores.
+func parseScoreRange(min, max string) (zscoreRange, error) {
+	var r zscoreRange
+	var err error
+	if r.min, r.minex, err = parseScoreBound(min); err != nil {
+		return r, err
+	}
+	if r.max, r.maxex, err = parseScoreBound(max); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// zlexBound is a bound of a range of members.
+type zlexBound struct {
+	member string
+	ex     bool // the bound is exclusive
+	inf    int  // -1 for '-' and 1 for '+'
+}
+
+// zlexRange is a range of members.
+type zlexRange struct {
+	min, max zlexBound
+}
+
+func (r zlexRange) gteMin(x *zslNode) bool {
+	switch {
+	case r.min.inf != 0:
+		return r.min.inf < 0
+	case r.min.ex:
+		return x.member > r.min.member
+	default:
+		return x.member >= r.min.member
+	}
+}
+
+func (r zlexRange) lteMax(x *zslNode) bool {
+	switch {
+	case r.max.inf != 0:
+		return r.max.inf > 0
+	case r.max.ex:
+		return x.member < r.max.member
+	default:
+		return x.member <= r.max.member
+	}
+}
+
+// parseLexBound parses a bound of a range of members.
+func parseLexBound(s string) (zlexBound, error) {
+	switch {
+	case s == "-":
+		return zlexBound{inf: -1}, nil
+	case s == "+":
+		return zlexBound{inf: 1}, nil
+	case strings.HasPrefix(s, "["):
+		return zlexBound{member: s[1:]}, nil
+	case strings.HasPrefix(s, "("):
+		return zlexBound{member: s[1:], ex: true}, nil
+	}
+	return zlexBound{}, strconv.ErrSyntax
+}
+
+// parseLexRange parses the min and max of a range of members.
+func parseLexRange(min, max string) (zlexRange, error) {
+	var r zlexRange
+	var err error
+	if r.min, err = parseLexBound(min); err != nil {
+		return r, err
+	}
+	if r.max, err = parseLexBound(max); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// first returns the first node in the range, or nil.
+func (z *zset) first(r zslRange) *zslNode {
+	x := z.header
+	for i := z.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !r.lteMax(x) {
+		return nil
+	}
+	return x
+}
+
+// last returns the last node in the range, or nil.
+func (z *zset) last(r zslRange) *zslNode {
+	x := z.header
+	for i := z.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	if x == z.header || !r.gteMin(x) {
+		return nil
+	}
+	return x
+}
+
+// inRange returns the nodes in the range, in order or in reverse for rev,
+// after skipping offset nodes, and up to count nodes unless count is
+// negative.
+func (z *zset) inRange(r zslRange, rev bool, offset, count int) []*zslNode {
+	var nodes []*zslNode
+	var x *zslNode
+	if rev {
+		x = z.last(r)
+	} else {
+		x = z.first(r)
+	}
+	for ; x != nil && count != 0; x = x.next(rev) {
+		if (rev && !r.gteMin(x)) || (!rev && !r.lteMax(x)) {
+			break
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		nodes = append(nodes, x)
+		count--
+	}
+	return nodes
+}
+
+// zrangebyscoreCommand is ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT
+// offset count].
+func zrangebyscoreCommand(c *client) {
+	zrangeGenericCommand(c, false, false)
+}
+
+// zrevrangebyscoreCommand is ZREVRANGEBYSCORE key max min [WITHSCORES]
+// [LIMIT offset count].
+func zrevrangebyscoreCommand(c *client) {
+	zrangeGenericCommand(c, true, false)
+}
+
+// zrangebylexCommand is ZRANGEBYLEX key min max [LIMIT offset count].
+func zrangebylexCommand(c *client) {
+	zrangeGenericCommand(c, false, true)
+}
+
+// zrangeGenericCommand replies with the members in a range of scores, or of
+// members for lex, from the highest for rev. With LIMIT the offset first
+// members are skipped, and a negative count is no limit.
+func zrangeGenericCommand(c *client, rev, lex bool) {
+	if len(c.args) < 4 {
+		c.replyAritryError()
+		return
+	}
+	var withScores bool
+	offset, count := 0, -1
+	for i := 4; i < len(c.args); i++ {
+		switch strings.ToLower(c.args[i]) {
+		case "withscores":
+			if lex {
+				c.replySyntaxError()
+				return
+			}
+			withScores = true
+		case "limit":
+			if i+2 >= len(c.args) {
+				c.replySyntaxError()
+				return
+			}
+			n1, err1 := strconv.ParseInt(c.args[i+1], 10, 64)
+			n2, err2 := strconv.ParseInt(c.args[i+2], 10, 64)
+			if err1 != nil || err2 != nil {
+				c.replyInvalidIntError()
+				return
+			}
+			offset, count = int(n1), int(n2)
+			i += 2
+		default:
+			c.replySyntaxError()
+			return
+		}
+	}
+	min, max := c.args[2], c.args[3]
+	if rev {
+		min, max = max, min
+	}
+	var r zslRange
+	if lex {
+		lr, err := parseLexRange(min, max)
+		if err != nil {
+			c.replyError("min or max not valid string range item")
+			return
+		}
+		r = lr
+	} else {
+		sr, err := parseScoreRange(min, max)
+		if err != nil {
+			c.replyError("min or max is not a float")
+			return
+		}
+		r = sr
+	}
+	z, ok := c.db.getZSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if z == nil || offset < 0 {
+		c.replyMultiBulkLen(0)
+		return
+	}
+	replyZSetNodes(c, z.inRange(r, rev, offset, count), withScores)
+}
+
+// zremrangebyrankCommand is ZREMRANGEBYRANK key start stop, where the
+// indexes resolve like ZRANGE.
+func zremrangebyrankCommand(c *client) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	start, err1 := strconv.ParseInt(c.args[2], 10, 64)
+	stop, err2 := strconv.ParseInt(c.args[3], 10, 64)
+	if err1 != nil || err2 != nil {
+		c.replyInvalidIntError()
+		return
+	}
+	zremrangeGenericCommand(c, func(z *zset) []*zslNode {
+		first, last, ok := rangeIndexes(int(start), int(stop), z.len(), false)
+		if !ok {
+			return nil
+		}
+		nodes := make([]*zslNode, 0, last-first+1)
+		for x := z.byRank(first + 1); len(nodes) < cap(nodes); x = x.next(false) {
+			nodes = append(nodes, x)
+		}
+		return nodes
+	})
+}
+
+// zremrangebyscoreCommand is ZREMRANGEBYSCORE key min max.
+func zremrangebyscoreCommand(c *client) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	r, err := parseScoreRange(c.args[2], c.args[3])
+	if err != nil {
+		c.replyError("min or max is not a float")
+		return
+	}
+	zremrangeGenericCommand(c, func(z *zset) []*zslNode {
+		return z.inRange(r, false, 0, -1)
+	})
+}
+
+// zremrangebylexCommand is ZREMRANGEBYLEX key min max.
+func zremrangebylexCommand(c *client) {
+	if len(c.args) != 4 {
+		c.replyAritryError()
+		return
+	}
+	r, err := parseLexRange(c.args[2], c.args[3])
+	if err != nil {
+		c.replyError("min or max not valid string range item")
+		return
+	}
+	zremrangeGenericCommand(c, func(z *zset) []*zslNode {
+		return z.inRange(r, false, 0, -1)
+	})
+}
+
+// zremrangeGenericCommand removes the nodes that the nodes function returns
+// for the sorted set, and replies with the number removed. The key is
+// deleted with its last member.
+func zremrangeGenericCommand(c *client, nodes func(z *zset) []*zslNode) {
+	z, ok := c.db.getZSet(c.args[1], false)
+	if !ok {
+		c.replyTypeError()
+		return
+	}
+	if z == nil {
+		c.replyInt(0)
+		return
+	}
+	removed := nodes(z)
+	for _, x := range removed {
+		z.del(x.member)
+	}
+	if z.len() == 0 {
+		c.db.del(c.args[1])
+	}
+	c.dirty += len(removed)
+	c.replyInt(len(removed))
+}
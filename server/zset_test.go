@@ -0,0 +1,250 @@
+package server
+
+import (
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// TestZSetSkiplist compares the skiplist to a sorted slice after random
+// changes, including the ranks of the spans and the backward links.
+func TestZSetSkiplist(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	z := newZSet()
+	for i := 0; i < 5000; i++ {
+		member := strconv.Itoa(rng.Intn(300))
+		if rng.Intn(3) == 0 {
+			z.del(member)
+		} else {
+			z.set(member, float64(rng.Intn(50)))
+		}
+		if i%50 != 0 {
+			continue
+		}
+		var want []string
+		for member := range z.m {
+			want = append(want, member)
+		}
+		sort.Slice(want, func(i, j int) bool {
+			a, b := z.m[want[i]], z.m[want[j]]
+			return a < b || (a == b && want[i] < want[j])
+		})
+		got := z.members()
+		if len(got) != len(want) {
+			t.Fatalf("expected %d members, got %d", len(want), len(got))
+		}
+		for rank, member := range want {
+			if got[rank] != member {
+				t.Fatalf("expected %s at %d, got %s", member, rank, got[rank])
+			}
+			if x := z.byRank(rank + 1); x == nil || x.member != member {
+				t.Fatalf("expected %s at rank %d, got %v", member, rank+1, x)
+			}
+		}
+		var back []string
+		for x := z.tail; x != nil; x = x.backward {
+			back = append(back, x.member)
+		}
+		if len(back) != len(want) {
+			t.Fatalf("expected %d members backward, got %d", len(want), len(back))
+		}
+		for j, member := range back {
+			if want[len(want)-1-j] != member {
+				t.Fatalf("expected %s backward at %d, got %s", want[len(want)-1-j], j, member)
+			}
+		}
+		if z.byRank(len(want)+1) != nil {
+			t.Fatal("expected no node past the last rank")
+		}
+	}
+}
+
+func TestZSetAOF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sider-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	s, addr := testNewServer(t, aofPath)
+	stop := testServe(t, s, addr)
+	defer func() { stop() }()
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 300; i++ {
+		member := "m" + strconv.Itoa(rng.Intn(50))
+		switch rng.Intn(7) {
+		case 0:
+			s.Do("ZADD", "zset", "INCR", "0.25", member)
+		case 1:
+			s.Do("ZREM", "zset", member)
+		case 2:
+			s.Do("ZREMRANGEBYRANK", "zset", "0", "0")
+		case 3:
+			n := rng.Intn(20)
+			s.Do("ZREMRANGEBYSCORE", "zset", "("+strconv.Itoa(n), strconv.Itoa(n+1))
+		case 4:
+			s.Do("ZREMRANGEBYLEX", "zset", "-", "["+member)
+		default:
+			s.Do("ZADD", "zset", strconv.Itoa(rng.Intn(20)), member)
+		}
+	}
+	s.Do("ZADD", "zset", "inf", "top", "-inf", "bottom")
+	s.Do("ZADD", "gone", "1", "a")
+	s.Do("ZREM", "gone", "a")
+	digest, err := s.Do("DEBUG", "DIGEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zrange, _ := s.Do("ZRANGE", "zset", "0", "-1", "WITHSCORES")
+
+	// the keyspace is the same after a restart, before and after a rewrite
+	for _, rewrite := range []bool{false, true} {
+		if rewrite {
+			if _, err := s.Do("SAVE"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stop()
+		s, addr = testNewServer(t, aofPath)
+		stop = testServe(t, s, addr)
+		if v, _ := s.Do("DEBUG", "DIGEST"); v != digest {
+			t.Fatalf("expected digest %v, got %v", digest, v)
+		}
+		v, _ := s.Do("ZRANGE", "zset", "0", "-1", "WITHSCORES")
+		if len(v.([]interface{})) != len(zrange.([]interface{})) {
+			t.Fatalf("expected %v, got %v", zrange, v)
+		}
+		for i, member := range v.([]interface{}) {
+			if member != zrange.([]interface{})[i] {
+				t.Fatalf("expected %v, got %v", zrange, v)
+			}
+		}
+		if v, _ := s.Do("EXISTS", "gone"); v != 0 {
+			t.Fatalf("expected the emptied sorted set to be deleted, got %v", v)
+		}
+	}
+}
+
+func TestParseScoreRange(t *testing.T) {
+	inf := math.Inf(1)
+	tests := []struct {
+		min, max string
+		want     zscoreRange
+		ok       bool
+	}{
+		{"1", "2", zscoreRange{min: 1, max: 2}, true},
+		{"(1", "(2.5", zscoreRange{min: 1, max: 2.5, minex: true, maxex: true}, true},
+		{"-inf", "+inf", zscoreRange{min: -inf, max: inf}, true},
+		{"(-inf", "inf", zscoreRange{min: -inf, max: inf, minex: true}, true},
+		{"2", "1", zscoreRange{min: 2, max: 1}, true},
+		{"", "1", zscoreRange{}, false},
+		{"(", "1", zscoreRange{}, false},
+		{"1", "((2", zscoreRange{}, false},
+		{"[1", "2", zscoreRange{}, false},
+		{"nan", "2", zscoreRange{}, false},
+		{"1", "x", zscoreRange{}, false},
+	}
+	for _, tt := range tests {
+		r, err := parseScoreRange(tt.min, tt.max)
+		if (err == nil) != tt.ok || (tt.ok && r != tt.want) {
+			t.Fatalf("%q %q: expected %v %v, got %v %v", tt.min, tt.max, tt.want, tt.ok, r, err)
+		}
+	}
+}
+
+func TestParseLexRange(t *testing.T) {
+	tests := []struct {
+		min, max string
+		want     zlexRange
+		ok       bool
+	}{
+		{"[a", "[b", zlexRange{zlexBound{member: "a"}, zlexBound{member: "b"}}, true},
+		{"(a", "(b", zlexRange{zlexBound{member: "a", ex: true}, zlexBound{member: "b", ex: true}}, true},
+		{"-", "+", zlexRange{zlexBound{inf: -1}, zlexBound{inf: 1}}, true},
+		{"[", "(", zlexRange{zlexBound{}, zlexBound{ex: true}}, true},
+		{"+", "-", zlexRange{zlexBound{inf: 1}, zlexBound{inf: -1}}, true},
+		{"[-", "[+", zlexRange{zlexBound{member: "-"}, zlexBound{member: "+"}}, true},
+		{"a", "[b", zlexRange{}, false},
+		{"[a", "", zlexRange{}, false},
+		{"-a", "+", zlexRange{}, false},
+	}
+	for _, tt := range tests {
+		r, err := parseLexRange(tt.min, tt.max)
+		if (err == nil) != tt.ok || (tt.ok && r != tt.want) {
+			t.Fatalf("%q %q: expected %v %v, got %v %v", tt.min, tt.max, tt.want, tt.ok, r, err)
+		}
+	}
+}
+
+// TestZSetInRange compares the ranges by score and by member to a scan of
+// the members, in order and in reverse, with offsets and counts.
+func TestZSetInRange(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	scores, lex := newZSet(), newZSet()
+	for i := 0; i < 200; i++ {
+		scores.set(strconv.Itoa(i), float64(rng.Intn(40)))
+		lex.set(strconv.Itoa(rng.Intn(1000)), 0)
+	}
+	bound := func(ex bool) string {
+		if ex {
+			return "("
+		}
+		return "["
+	}
+	for i := 0; i < 1000; i++ {
+		z := scores
+		var r zslRange
+		if i%2 == 0 {
+			min, max := rng.Intn(45)-2, rng.Intn(45)-2
+			r = zscoreRange{float64(min), float64(max), rng.Intn(2) == 0, rng.Intn(2) == 0}
+		} else {
+			z = lex
+			lr, err := parseLexRange(bound(rng.Intn(2) == 0)+strconv.Itoa(rng.Intn(1000)),
+				bound(rng.Intn(2) == 0)+strconv.Itoa(rng.Intn(1000)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = lr
+		}
+		rev := rng.Intn(2) == 0
+		offset, count := rng.Intn(5), rng.Intn(30)-5
+		var want []string
+		z.ascend(func(member string, score float64) bool {
+			x := &zslNode{member: member, score: score}
+			if r.gteMin(x) && r.lteMax(x) {
+				want = append(want, member)
+			}
+			return true
+		})
+		if rev {
+			for i, j := 0, len(want)-1; i < j; i, j = i+1, j-1 {
+				want[i], want[j] = want[j], want[i]
+			}
+		}
+		if offset < len(want) {
+			want = want[offset:]
+		} else {
+			want = nil
+		}
+		if count >= 0 && count < len(want) {
+			want = want[:count]
+		}
+		nodes := z.inRange(r, rev, offset, count)
+		if len(nodes) != len(want) {
+			t.Fatalf("%v rev=%v offset=%d count=%d: expected %v, got %d nodes",
+				r, rev, offset, count, want, len(nodes))
+		}
+		for j, x := range nodes {
+			if x.member != want[j] {
+				t.Fatalf("%v rev=%v offset=%d count=%d: expected %s at %d, got %s",
+					r, rev, offset, count, want[j], j, x.member)
+			}
+		}
+	}
+}